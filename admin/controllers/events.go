@@ -0,0 +1,128 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/adampresley/mailslurper/admin/model"
+)
+
+// How long a client should wait before reconnecting to the
+// event stream, and how often a comment is sent to keep
+// idle connections open
+const (
+	EVENT_STREAM_RETRY_MILLISECONDS = 3000
+	EVENT_STREAM_KEEPALIVE_SECONDS  = 15
+)
+
+// Sent to a reconnecting client whose missed events are no longer
+// in the event log. The client should reload its mail items.
+const EVENT_STREAM_RESET = "reset"
+
+/*
+This function handles a web GET request for "/events". It streams
+mail events as Server-Sent Events: "mailReceived", "mailItemUpdated",
+"mailItemDeleted" and "mailsPurged". Each event carries its ID from
+the event log. A client reconnecting with a Last-Event-ID header, or
+a "lastEventId" parameter, is first sent every event it missed. If some
+of those have been trimmed from the log, or the log has been reset and
+the ID is newer than any event, a "reset" event is sent instead.
+*/
+func GetEventStream(writer http.ResponseWriter, request *http.Request) {
+	flusher, ok := writer.(http.Flusher)
+	if !ok {
+		http.Error(writer, "Event streams are not supported", 500)
+		return
+	}
+
+	lastEventId := 0
+	resuming := false
+
+	value := request.Header.Get("Last-Event-ID")
+	if len(value) <= 0 {
+		value = request.FormValue("lastEventId")
+	}
+
+	if len(value) > 0 {
+		var err error
+
+		lastEventId, err = strconv.Atoi(value)
+		if err != nil {
+			http.Error(writer, "Last event ID provided is invalid", 400)
+			return
+		}
+
+		resuming = true
+	}
+
+	/*
+	 * Start listening before reading the event log so an event
+	 * written in between is not missed.
+	 */
+	listener := Storage.AddEventListener()
+	defer Storage.RemoveEventListener(listener)
+
+	writer.Header().Set("Content-Type", "text/event-stream")
+	writer.Header().Set("Cache-Control", "no-cache")
+	writer.Header().Set("Connection", "keep-alive")
+	writer.WriteHeader(200)
+
+	fmt.Fprintf(writer, "retry: %d\n\n", EVENT_STREAM_RETRY_MILLISECONDS)
+
+	if resuming {
+		first, last := Storage.GetEventLogRange()
+
+		if lastEventId > last || lastEventId < first-1 {
+			fmt.Fprintf(writer, "id: %d\nevent: %s\ndata: {}\n\n", last, EVENT_STREAM_RESET)
+			lastEventId = last
+		} else {
+			for _, event := range Storage.GetEventsSince(lastEventId) {
+				writeEvent(writer, event)
+				lastEventId = event.Id
+			}
+		}
+	}
+
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(EVENT_STREAM_KEEPALIVE_SECONDS * time.Second)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case event, ok := <-listener:
+			/*
+			 * The listener is closed when we fall behind. Ending the
+			 * stream makes the client reconnect and catch up from the log.
+			 */
+			if !ok {
+				return
+			}
+
+			if event.Id <= lastEventId {
+				continue
+			}
+
+			writeEvent(writer, event)
+			lastEventId = event.Id
+			flusher.Flush()
+
+		case <-keepAlive.C:
+			fmt.Fprint(writer, ": keep-alive\n\n")
+			flusher.Flush()
+
+		case <-request.Context().Done():
+			return
+		}
+	}
+}
+
+func writeEvent(writer http.ResponseWriter, event model.JSONMailEvent) {
+	fmt.Fprintf(writer, "id: %d\nevent: %s\ndata: %s\n\n", event.Id, event.Event, event.Data)
+}
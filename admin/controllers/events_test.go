@@ -0,0 +1,202 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package controllers
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/adampresley/mailslurper/smtp"
+)
+
+/*
+Opens the event stream and returns a function that reads
+the next event as its "id:" and "event:" lines.
+*/
+func openEventStream(t *testing.T, server *httptest.Server, lastEventId string) (func() (string, string), func()) {
+	request, _ := http.NewRequest("GET", server.URL+"/events", nil)
+	if len(lastEventId) > 0 {
+		request.Header.Set("Last-Event-ID", lastEventId)
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("Unable to open the event stream: %s", err)
+	}
+
+	if response.StatusCode != 200 {
+		t.Fatalf("Expected 200, got %d", response.StatusCode)
+	}
+
+	reader := bufio.NewReader(response.Body)
+
+	next := func() (string, string) {
+		id, event := "", ""
+
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("Event stream ended: %s", err)
+			}
+
+			line = strings.TrimRight(line, "\n")
+
+			switch {
+			case strings.HasPrefix(line, "id: "):
+				id = strings.TrimPrefix(line, "id: ")
+
+			case strings.HasPrefix(line, "event: "):
+				event = strings.TrimPrefix(line, "event: ")
+
+			case len(line) == 0 && len(event) > 0:
+				return id, event
+			}
+		}
+	}
+
+	return next, func() { response.Body.Close() }
+}
+
+func TestGetEventStreamResumes(t *testing.T) {
+	useTestStorage(t)
+	defer Storage.Disconnect()
+
+	server := httptest.NewServer(http.HandlerFunc(GetEventStream))
+	defer server.Close()
+
+	storeTestMail("First", "Second", "Third")
+
+	next, closeStream := openEventStream(t, server, "1")
+	defer closeStream()
+
+	for _, expected := range []string{"2", "3"} {
+		if id, event := next(); id != expected || event != "mailReceived" {
+			t.Errorf("Expected missed event %s, got %s %s", expected, id, event)
+		}
+	}
+
+	go storeTestMail("Fourth")
+
+	if id, event := next(); id != "4" || event != "mailReceived" {
+		t.Errorf("Expected new event 4, got %s %s", id, event)
+	}
+}
+
+func TestGetEventStreamResetsOnGap(t *testing.T) {
+	tests := []struct {
+		name        string
+		lastEventId string
+	}{
+		{"trimmed from the log", "1"},
+		{"newer than the log", "50"},
+	}
+
+	for _, test := range tests {
+		useTestStorage(t)
+
+		server := httptest.NewServer(http.HandlerFunc(GetEventStream))
+
+		storeTestMail("First", "Second", "Third", "Fourth")
+
+		/*
+		 * Stands in for the oldest events being trimmed
+		 */
+		if _, err := Storage.Db.Exec("DELETE FROM mailevent WHERE id <= 2"); err != nil {
+			t.Fatalf("Unable to trim the event log: %s", err)
+		}
+
+		next, closeStream := openEventStream(t, server, test.lastEventId)
+
+		if id, event := next(); id != "4" || event != EVENT_STREAM_RESET {
+			t.Errorf("%s: expected a reset to event 4, got %s %s", test.name, id, event)
+		}
+
+		go storeTestMail("Fifth")
+
+		if id, event := next(); id != "5" || event != "mailReceived" {
+			t.Errorf("%s: expected new event 5 after the reset, got %s %s", test.name, id, event)
+		}
+
+		closeStream()
+		server.Close()
+		Storage.Disconnect()
+	}
+}
+
+func TestGetEventStreamResumesAtStartOfTrimmedLog(t *testing.T) {
+	useTestStorage(t)
+	defer Storage.Disconnect()
+
+	server := httptest.NewServer(http.HandlerFunc(GetEventStream))
+	defer server.Close()
+
+	storeTestMail("First", "Second", "Third")
+
+	if _, err := Storage.Db.Exec("DELETE FROM mailevent WHERE id <= 1"); err != nil {
+		t.Fatalf("Unable to trim the event log: %s", err)
+	}
+
+	next, closeStream := openEventStream(t, server, "1")
+	defer closeStream()
+
+	if id, event := next(); id != "2" || event != "mailReceived" {
+		t.Errorf("Expected missed event 2 without a reset, got %s %s", id, event)
+	}
+}
+
+func TestGetEventStreamWithoutLastEventId(t *testing.T) {
+	useTestStorage(t)
+	defer Storage.Disconnect()
+
+	server := httptest.NewServer(http.HandlerFunc(GetEventStream))
+	defer server.Close()
+
+	storeTestMail("Old")
+
+	next, closeStream := openEventStream(t, server, "")
+	defer closeStream()
+
+	go storeTestMail("New")
+
+	if id, _ := next(); id != "2" {
+		t.Errorf("Expected only new events to be sent, got event %s", id)
+	}
+}
+
+func TestGetEventStreamRejectsBadLastEventId(t *testing.T) {
+	useTestStorage(t)
+	defer Storage.Disconnect()
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/events", nil)
+	request.Header.Set("Last-Event-ID", "latest")
+
+	GetEventStream(recorder, request)
+
+	if recorder.Code != 400 {
+		t.Errorf("Expected 400, got %d", recorder.Code)
+	}
+}
+
+/*
+Writes a mail item for each subject and returns once they are stored.
+*/
+func storeTestMail(subjects ...string) {
+	dbWriteChannel := make(chan smtp.MailItemStruct, len(subjects))
+
+	for _, subject := range subjects {
+		dbWriteChannel <- smtp.MailItemStruct{
+			FromAddress: "<sender@example.com>",
+			ToAddresses: []string{"<user@example.com>"},
+			Subject:     subject,
+		}
+	}
+
+	close(dbWriteChannel)
+	Storage.StartWriteListener(dbWriteChannel)
+}
@@ -0,0 +1,68 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/adampresley/mailslurper/settings"
+	"github.com/adampresley/mailslurper/smtp"
+)
+
+// Fault rules applied by the SMTP server
+var Faults *smtp.FaultInjector
+
+/*
+This function handles a web GET request for "/faults". It returns
+a JSON-serialized array of the fault rules in effect.
+*/
+func GetFaultRuleCollection(writer http.ResponseWriter, request *http.Request) {
+	json, _ := json.Marshal(Faults.Rules())
+	settings.Config.WriteJson(writer, json)
+}
+
+/*
+This function handles a web PUT request for "/faults". The request body
+is a JSON array of fault rules which replaces the rules in effect. Rules
+set this way apply immediately and are not saved to config.json.
+*/
+func SetFaultRuleCollection(writer http.ResponseWriter, request *http.Request) {
+	rules := make([]smtp.FaultRule, 0)
+
+	err := json.NewDecoder(request.Body).Decode(&rules)
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("Fault rules provided are invalid: %s", err), 400)
+		return
+	}
+
+	err = Faults.SetRules(rules)
+	if err != nil {
+		http.Error(writer, err.Error(), 400)
+		return
+	}
+
+	json, _ := json.Marshal(Faults.Rules())
+	settings.Config.WriteJson(writer, json)
+}
+
+/*
+This function handles a web GET request for "/faults/injected". It
+returns a JSON-serialized array of the faults injected so far.
+*/
+func GetInjectedFaultCollection(writer http.ResponseWriter, request *http.Request) {
+	json, _ := json.Marshal(Faults.Injected())
+	settings.Config.WriteJson(writer, json)
+}
+
+/*
+This function handles a web DELETE request for "/faults/injected".
+It empties the log of injected faults.
+*/
+func DeleteInjectedFaultCollection(writer http.ResponseWriter, request *http.Request) {
+	Faults.ClearInjected()
+	settings.Config.WriteJson(writer, []byte("{\"success\": true}"))
+}
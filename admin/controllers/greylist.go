@@ -0,0 +1,44 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/adampresley/mailslurper/settings"
+	"github.com/adampresley/mailslurper/smtp"
+)
+
+// Greylist applied by the SMTP server. Nil when greylisting is off.
+var Greylist *smtp.Greylist
+
+/*
+This function handles a web GET request for "/greylist". It returns
+a JSON-serialized array of the (client IP, sender, recipient) triplets
+seen by the greylist, oldest first. The array is empty when greylisting
+is turned off.
+*/
+func GetGreylistTripletCollection(writer http.ResponseWriter, request *http.Request) {
+	triplets := make([]smtp.GreylistTriplet, 0)
+	if Greylist != nil {
+		triplets = Greylist.Triplets()
+	}
+
+	json, _ := json.Marshal(triplets)
+	settings.Config.WriteJson(writer, json)
+}
+
+/*
+This function handles a web DELETE request for "/greylist". It forgets
+every triplet so the next attempt for each is refused again.
+*/
+func DeleteGreylistTripletCollection(writer http.ResponseWriter, request *http.Request) {
+	if Greylist != nil {
+		Greylist.Reset()
+	}
+
+	settings.Config.WriteJson(writer, []byte("{\"success\": true}"))
+}
@@ -8,12 +8,12 @@ import (
 	"bytes"
 	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"strconv"
 	"time"
 
 	"github.com/adampresley/mailslurper/settings"
-	"github.com/adampresley/mailslurper/smtp"
 )
 
 /*
@@ -26,7 +26,7 @@ func DownloadAttachment(writer http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	attachment := smtp.Storage.GetAttachment(attachmentId)
+	attachment := Storage.GetAttachment(attachmentId)
 
 	data, err := base64.StdEncoding.DecodeString(attachment["content"])
 	if err != nil {
@@ -48,14 +48,26 @@ func Home(writer http.ResponseWriter, request *http.Request) {
 /*
 This function handles a web GET request for "/mails". It queries the storage
 engine for all mail items, sets the content type header to text/json, and
-returns a JSON-serialized array of mail data.
+returns a JSON-serialized array of mail data. The results can be filtered
+with the optional "q" (text search), "read", "starred" (true or false),
+"tag", "mailbox" and "by" parameters.
 */
 func GetMailCollection(writer http.ResponseWriter, request *http.Request) {
-	mailItems := smtp.Storage.GetMails()
+	search, err := parseMailSearch(request)
+	if err != nil {
+		http.Error(writer, err.Error(), 400)
+		return
+	}
+
+	mailItems := Storage.GetMails(search)
 	json, _ := json.Marshal(mailItems)
 	settings.Config.WriteJson(writer, json)
 }
 
+/*
+Returns a single mail item, including its body and attachment
+list, as JSON.
+*/
 func GetMailItem(writer http.ResponseWriter, request *http.Request) {
 	id, err := strconv.Atoi(request.FormValue("id"))
 	if err != nil {
@@ -63,7 +75,71 @@ func GetMailItem(writer http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	mailItem := smtp.Storage.GetMail(id)
+	mailItem := Storage.GetMail(id)
+	if mailItem.Id <= 0 {
+		http.Error(writer, "Mail item not found", 404)
+		return
+	}
+
 	json, _ := json.Marshal(mailItem)
 	settings.Config.WriteJson(writer, json)
 }
+
+/*
+Returns the raw source of a mail item, exactly as the SMTP
+client sent it apart from the Received header added on arrival.
+*/
+func GetMailItemRawSource(writer http.ResponseWriter, request *http.Request) {
+	id, err := strconv.Atoi(request.FormValue("id"))
+	if err != nil {
+		http.Error(writer, "ID provided is invalid", 500)
+		return
+	}
+
+	rawSource, found := Storage.GetMailRawSource(id)
+	if !found {
+		http.Error(writer, "Mail item not found", 404)
+		return
+	}
+
+	writer.Header().Add("Content-Type", "message/rfc822")
+	writer.Header().Add("Content-Length", strconv.Itoa(len(rawSource)))
+	writer.Write([]byte(rawSource))
+}
+
+/*
+Deletes a single mail item and its attachments.
+*/
+func DeleteMailItem(writer http.ResponseWriter, request *http.Request) {
+	id, err := strconv.Atoi(request.FormValue("id"))
+	if err != nil {
+		http.Error(writer, "ID provided is invalid", 500)
+		return
+	}
+
+	found, err := Storage.DeleteMail(id)
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("There was an error deleting the mail item: %s", err), 500)
+		return
+	}
+
+	if !found {
+		http.Error(writer, "Mail item not found", 404)
+		return
+	}
+
+	settings.Config.WriteJson(writer, []byte("{\"success\": true}"))
+}
+
+/*
+Deletes every mail item and attachment.
+*/
+func DeleteMailCollection(writer http.ResponseWriter, request *http.Request) {
+	err := Storage.PurgeMails()
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("There was an error deleting mail items: %s", err), 500)
+		return
+	}
+
+	settings.Config.WriteJson(writer, []byte("{\"success\": true}"))
+}
@@ -0,0 +1,50 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/adampresley/mailslurper/settings"
+	"github.com/adampresley/mailslurper/smtp"
+)
+
+// Latency rules applied by the SMTP server
+var Latency *smtp.LatencySimulator
+
+/*
+This function handles a web GET request for "/latency". It returns
+a JSON-serialized array of the latency rules in effect.
+*/
+func GetLatencyRuleCollection(writer http.ResponseWriter, request *http.Request) {
+	json, _ := json.Marshal(Latency.Rules())
+	settings.Config.WriteJson(writer, json)
+}
+
+/*
+This function handles a web PUT request for "/latency". The request body
+is a JSON array of latency rules which replaces the rules in effect. Rules
+set this way apply to new connections and are not saved to config.json.
+*/
+func SetLatencyRuleCollection(writer http.ResponseWriter, request *http.Request) {
+	rules := make([]smtp.LatencyRule, 0)
+
+	err := json.NewDecoder(request.Body).Decode(&rules)
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("Latency rules provided are invalid: %s", err), 400)
+		return
+	}
+
+	err = Latency.SetRules(rules)
+	if err != nil {
+		http.Error(writer, err.Error(), 400)
+		return
+	}
+
+	json, _ := json.Marshal(Latency.Rules())
+	settings.Config.WriteJson(writer, json)
+}
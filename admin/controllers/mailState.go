@@ -0,0 +1,169 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/adampresley/mailslurper/settings"
+	"github.com/adampresley/mailslurper/smtp"
+)
+
+/*
+Marks a mail item as read or unread. Expects an "id" and a "read"
+value of true or false. If "read" is omitted the item is marked read.
+*/
+func SetMailRead(writer http.ResponseWriter, request *http.Request) {
+	id, err := strconv.Atoi(request.FormValue("id"))
+	if err != nil {
+		http.Error(writer, "ID provided is invalid", 500)
+		return
+	}
+
+	isRead, err := parseBoolWithDefault(request.FormValue("read"), true)
+	if err != nil {
+		http.Error(writer, "Read value provided is invalid", 400)
+		return
+	}
+
+	found, err := Storage.SetMailRead(id, isRead)
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("There was an error updating the mail item: %s", err), 500)
+		return
+	}
+
+	if !found {
+		http.Error(writer, "Mail item not found", 404)
+		return
+	}
+
+	settings.Config.WriteJson(writer, []byte("{\"success\": true}"))
+}
+
+/*
+Stars or un-stars a mail item. Expects an "id" and a "starred" value
+of true or false. If "starred" is omitted the item is starred.
+*/
+func SetMailStarred(writer http.ResponseWriter, request *http.Request) {
+	id, err := strconv.Atoi(request.FormValue("id"))
+	if err != nil {
+		http.Error(writer, "ID provided is invalid", 500)
+		return
+	}
+
+	isStarred, err := parseBoolWithDefault(request.FormValue("starred"), true)
+	if err != nil {
+		http.Error(writer, "Starred value provided is invalid", 400)
+		return
+	}
+
+	found, err := Storage.SetMailStarred(id, isStarred)
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("There was an error updating the mail item: %s", err), 500)
+		return
+	}
+
+	if !found {
+		http.Error(writer, "Mail item not found", 404)
+		return
+	}
+
+	settings.Config.WriteJson(writer, []byte("{\"success\": true}"))
+}
+
+/*
+Replaces the tags on a mail item. Expects an "id" and a comma
+separated list of "tags". An empty list removes all tags.
+*/
+func SetMailTags(writer http.ResponseWriter, request *http.Request) {
+	id, err := strconv.Atoi(request.FormValue("id"))
+	if err != nil {
+		http.Error(writer, "ID provided is invalid", 500)
+		return
+	}
+
+	found, err := Storage.SetMailTags(id, strings.Split(request.FormValue("tags"), ","))
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("There was an error updating the mail item: %s", err), 500)
+		return
+	}
+
+	if !found {
+		http.Error(writer, "Mail item not found", 404)
+		return
+	}
+
+	settings.Config.WriteJson(writer, []byte("{\"success\": true}"))
+}
+
+/*
+Builds a set of mail search criteria from the "q", "read", "starred",
+"tag", "mailbox" and "by" request values.
+*/
+func parseMailSearch(request *http.Request) (smtp.MailSearch, error) {
+	var err error
+
+	search := smtp.MailSearch{
+		Tag:         request.FormValue("tag"),
+		Text:        request.FormValue("q"),
+		Mailbox:     request.FormValue("mailbox"),
+		MailboxKind: request.FormValue("by"),
+	}
+
+	if search.IsRead, err = parseOptionalBool(request.FormValue("read")); err != nil {
+		return search, fmt.Errorf("Read filter provided is invalid")
+	}
+
+	if search.IsStarred, err = parseOptionalBool(request.FormValue("starred")); err != nil {
+		return search, fmt.Errorf("Starred filter provided is invalid")
+	}
+
+	if len(search.MailboxKind) <= 0 {
+		search.MailboxKind = smtp.MAILBOX_BY_ADDRESS
+	}
+
+	if !smtp.IsValidMailboxKind(search.MailboxKind) {
+		return search, fmt.Errorf("Mailbox grouping provided is invalid")
+	}
+
+	return search, nil
+}
+
+/*
+Parses an optional true/false request value. A blank value
+returns nil, meaning "not specified".
+*/
+func parseOptionalBool(value string) (*bool, error) {
+	if len(strings.TrimSpace(value)) <= 0 {
+		return nil, nil
+	}
+
+	result, err := strconv.ParseBool(strings.TrimSpace(value))
+	if err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+/*
+Parses a true/false request value, returning defaultValue
+if the value is blank.
+*/
+func parseBoolWithDefault(value string, defaultValue bool) (bool, error) {
+	result, err := parseOptionalBool(value)
+	if err != nil {
+		return false, err
+	}
+
+	if result == nil {
+		return defaultValue, nil
+	}
+
+	return *result, nil
+}
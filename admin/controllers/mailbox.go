@@ -0,0 +1,58 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/adampresley/mailslurper/settings"
+	"github.com/adampresley/mailslurper/smtp"
+)
+
+/*
+This function handles a web GET request for "/mailboxes". It returns a
+JSON-serialized array of virtual mailboxes with total and unread counts.
+Mailboxes are keyed by recipient address unless the "by" parameter
+asks for "domain" or plus-address "tag" grouping.
+*/
+func GetMailboxCollection(writer http.ResponseWriter, request *http.Request) {
+	kind := request.FormValue("by")
+	if len(kind) <= 0 {
+		kind = smtp.MAILBOX_BY_ADDRESS
+	}
+
+	if !smtp.IsValidMailboxKind(kind) {
+		http.Error(writer, "Mailbox grouping provided is invalid", 400)
+		return
+	}
+
+	mailboxes := Storage.GetMailboxes(kind)
+	json, _ := json.Marshal(mailboxes)
+	settings.Config.WriteJson(writer, json)
+}
+
+/*
+This function handles a web GET request for "/mailbox". It returns the
+mail items sent to the mailbox named in the "name" parameter. It accepts
+the same "by", "read", "starred" and "tag" parameters as "/mails".
+*/
+func GetMailboxMailCollection(writer http.ResponseWriter, request *http.Request) {
+	search, err := parseMailSearch(request)
+	if err != nil {
+		http.Error(writer, err.Error(), 400)
+		return
+	}
+
+	search.Mailbox = request.FormValue("name")
+	if len(search.Mailbox) <= 0 {
+		http.Error(writer, "Mailbox name is required", 400)
+		return
+	}
+
+	mailItems := Storage.GetMails(search)
+	json, _ := json.Marshal(mailItems)
+	settings.Config.WriteJson(writer, json)
+}
@@ -0,0 +1,128 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adampresley/mailslurper/admin/model"
+	"github.com/adampresley/mailslurper/relay"
+	"github.com/adampresley/mailslurper/settings"
+	"github.com/adampresley/mailslurper/smtp"
+)
+
+// Upstream SMTP servers mail items can be released to. The
+// first one is used when a release does not name a relay.
+var Relays []relay.Upstream
+
+/*
+This function handles a web POST request for "/mail/release". It sends
+the raw source of the mail item named by "id" to an upstream SMTP server
+and records the outcome against the mail item. The optional "relay"
+parameter picks a configured relay by name, and "to" is a comma separated
+list of recipients to send to instead of the original ones.
+*/
+func ReleaseMailItem(writer http.ResponseWriter, request *http.Request) {
+	id, err := strconv.Atoi(request.FormValue("id"))
+	if err != nil {
+		http.Error(writer, "ID provided is invalid", 500)
+		return
+	}
+
+	upstream, ok := findRelay(request.FormValue("relay"))
+	if !ok {
+		http.Error(writer, "Relay provided is not configured", 400)
+		return
+	}
+
+	mailItem := Storage.GetMail(id)
+	if mailItem.Id <= 0 {
+		http.Error(writer, "Mail item not found", 404)
+		return
+	}
+
+	rawSource, _ := Storage.GetMailRawSource(id)
+
+	recipients := mailItem.ToAddresses
+	if to := parseRecipients(request.FormValue("to")); len(to) > 0 {
+		recipients = to
+	}
+
+	for index, recipient := range recipients {
+		recipients[index] = relay.EnvelopeAddress(recipient)
+	}
+
+	err = relay.Send(upstream, mailItem.FromAddress, recipients, rawSource)
+
+	mailRelay := model.JSONMailRelay{
+		MailItemId:  id,
+		RelayName:   upstream.Name,
+		Recipients:  recipients,
+		Success:     err == nil,
+		DateRelayed: time.Now().UTC().Format(smtp.DATE_RECEIVED_FORMAT),
+	}
+
+	if err != nil {
+		mailRelay.Error = err.Error()
+	}
+
+	if logErr := Storage.AddMailRelay(mailRelay); logErr != nil {
+		log.Println("Error recording mail relay: ", logErr)
+	}
+
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("There was an error relaying the mail item: %s", err), 500)
+		return
+	}
+
+	json, _ := json.Marshal(mailRelay)
+	settings.Config.WriteJson(writer, json)
+}
+
+/*
+This function handles a web GET request for "/mail/relays". It returns
+a JSON-serialized array of the times the mail item named by "id" has
+been relayed, newest first.
+*/
+func GetMailRelayCollection(writer http.ResponseWriter, request *http.Request) {
+	id, err := strconv.Atoi(request.FormValue("id"))
+	if err != nil {
+		http.Error(writer, "ID provided is invalid", 500)
+		return
+	}
+
+	mailRelays := Storage.GetMailRelays(id)
+	json, _ := json.Marshal(mailRelays)
+	settings.Config.WriteJson(writer, json)
+}
+
+func findRelay(name string) (relay.Upstream, bool) {
+	for _, upstream := range Relays {
+		if len(name) <= 0 || upstream.Name == name {
+			return upstream, true
+		}
+	}
+
+	return relay.Upstream{}, false
+}
+
+func parseRecipients(value string) []string {
+	result := make([]string, 0)
+
+	for _, recipient := range strings.Split(value, ",") {
+		recipient = strings.TrimSpace(recipient)
+		if len(recipient) > 0 {
+			result = append(result, recipient)
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,85 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/adampresley/mailslurper/settings"
+	"github.com/adampresley/mailslurper/smtp"
+)
+
+/*
+Controller for the SMTP transcripts page
+*/
+func Transcripts(writer http.ResponseWriter, request *http.Request) {
+	settings.Config.RenderView(writer, "transcripts")
+}
+
+/*
+This function handles a web GET request for "/sessions". It returns a
+JSON-serialized array of recorded SMTP sessions, newest first, without
+their transcripts. The optional "outcome" parameter ("accepted",
+"noMessage" or "error") only returns sessions that ended that way.
+*/
+func GetSmtpSessionCollection(writer http.ResponseWriter, request *http.Request) {
+	outcome := request.FormValue("outcome")
+
+	switch outcome {
+	case "", smtp.SESSION_OUTCOME_ACCEPTED, smtp.SESSION_OUTCOME_NO_MESSAGE, smtp.SESSION_OUTCOME_ERROR:
+	default:
+		http.Error(writer, "Outcome provided is invalid", 400)
+		return
+	}
+
+	sessions := Storage.GetSmtpSessions(outcome)
+	json, _ := json.Marshal(sessions)
+	settings.Config.WriteJson(writer, json)
+}
+
+/*
+This function handles a web GET request for "/session". It returns the
+SMTP session named by "id", including its transcript, as JSON.
+*/
+func GetSmtpSession(writer http.ResponseWriter, request *http.Request) {
+	id, err := strconv.Atoi(request.FormValue("id"))
+	if err != nil {
+		http.Error(writer, "ID provided is invalid", 500)
+		return
+	}
+
+	session := Storage.GetSmtpSession(id)
+	if session.Id <= 0 {
+		http.Error(writer, "SMTP session not found", 404)
+		return
+	}
+
+	json, _ := json.Marshal(session)
+	settings.Config.WriteJson(writer, json)
+}
+
+/*
+This function handles a web GET request for "/mail/transcript". It returns
+the SMTP session the mail item named by "id" was received in, including
+its transcript, as JSON.
+*/
+func GetMailItemSmtpSession(writer http.ResponseWriter, request *http.Request) {
+	id, err := strconv.Atoi(request.FormValue("id"))
+	if err != nil {
+		http.Error(writer, "ID provided is invalid", 500)
+		return
+	}
+
+	session := Storage.GetMailSmtpSession(id)
+	if session.Id <= 0 {
+		http.Error(writer, "SMTP session not found", 404)
+		return
+	}
+
+	json, _ := json.Marshal(session)
+	settings.Config.WriteJson(writer, json)
+}
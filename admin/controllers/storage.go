@@ -0,0 +1,13 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package controllers
+
+import (
+	"github.com/adampresley/mailslurper/smtp"
+)
+
+// The mail storage the administrator controllers read from and
+// write to. This is set up by main before serving requests.
+var Storage *smtp.MailStorage
@@ -0,0 +1,82 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adampresley/mailslurper/settings"
+	"github.com/adampresley/mailslurper/smtp"
+)
+
+// Number of seconds "/mail/wait" blocks when no timeout is provided
+const DEFAULT_WAIT_TIMEOUT_SECONDS = 30
+
+/*
+This function handles a web GET request for "/mail/wait". It blocks until a
+mail item matching the "to", "from", "subject" (a regular expression) and
+"after" (an RFC 3339 date/time) parameters is received, then returns it as
+JSON. If nothing matches within "timeout" seconds a 408 is returned.
+*/
+func WaitForMailItem(writer http.ResponseWriter, request *http.Request) {
+	var err error
+
+	criteria := smtp.MailCriteria{
+		To:   request.FormValue("to"),
+		From: request.FormValue("from"),
+	}
+
+	if len(request.FormValue("subject")) > 0 {
+		if criteria.Subject, err = regexp.Compile(request.FormValue("subject")); err != nil {
+			http.Error(writer, fmt.Sprintf("Subject pattern provided is invalid: %s", err), 400)
+			return
+		}
+	}
+
+	if len(request.FormValue("after")) > 0 {
+		if criteria.ReceivedAfter, err = parseRequestTime(request.FormValue("after")); err != nil {
+			http.Error(writer, "After date provided is invalid", 400)
+			return
+		}
+	}
+
+	timeout := DEFAULT_WAIT_TIMEOUT_SECONDS
+	if len(request.FormValue("timeout")) > 0 {
+		if timeout, err = strconv.Atoi(request.FormValue("timeout")); err != nil || timeout < 0 {
+			http.Error(writer, "Timeout provided is invalid", 400)
+			return
+		}
+	}
+
+	mailItem, found := Storage.WaitForMail(criteria, time.Duration(timeout)*time.Second, request.Context().Done())
+	if !found {
+		http.Error(writer, "Timed out waiting for a matching mail item", 408)
+		return
+	}
+
+	json, _ := json.Marshal(mailItem)
+	settings.Config.WriteJson(writer, json)
+}
+
+/*
+Parses a date/time request value. RFC 3339 is preferred, but the
+"YYYY-MM-DD HH:MM:SS" format used for mail dates is accepted as UTC.
+*/
+func parseRequestTime(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+
+	result, err := time.Parse(time.RFC3339Nano, value)
+	if err == nil {
+		return result, nil
+	}
+
+	return time.Parse("2006-01-02 15:04:05", value)
+}
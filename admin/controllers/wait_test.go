@@ -0,0 +1,85 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/adampresley/mailslurper/admin/model"
+	"github.com/adampresley/mailslurper/smtp"
+)
+
+func useTestStorage(t *testing.T) {
+	Storage = &smtp.MailStorage{Engine: smtp.ENGINE_SQLITE_MEMORY}
+
+	if err := Storage.Connect(); err != nil {
+		t.Fatalf("Unable to set up in-memory storage: %s", err)
+	}
+}
+
+func TestWaitForMailItemTimesOut(t *testing.T) {
+	useTestStorage(t)
+	defer Storage.Disconnect()
+
+	recorder := httptest.NewRecorder()
+	WaitForMailItem(recorder, httptest.NewRequest("GET", "/mail/wait?to=nobody@example.com&timeout=0", nil))
+
+	if recorder.Code != 408 {
+		t.Errorf("Expected 408, got %d", recorder.Code)
+	}
+}
+
+func TestWaitForMailItemRejectsBadValues(t *testing.T) {
+	useTestStorage(t)
+	defer Storage.Disconnect()
+
+	for _, query := range []string{"subject=(", "after=yesterday", "timeout=-1", "timeout=soon"} {
+		recorder := httptest.NewRecorder()
+		WaitForMailItem(recorder, httptest.NewRequest("GET", "/mail/wait?"+query, nil))
+
+		if recorder.Code != 400 {
+			t.Errorf("Expected 400 for %s, got %d", query, recorder.Code)
+		}
+	}
+}
+
+func TestWaitForMailItemReturnsNewMail(t *testing.T) {
+	useTestStorage(t)
+	defer Storage.Disconnect()
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+
+		dbWriteChannel := make(chan smtp.MailItemStruct, 1)
+		dbWriteChannel <- smtp.MailItemStruct{
+			FromAddress: "<sender@example.com>",
+			ToAddresses: []string{"<user@example.com>"},
+			Subject:     "Your code is 1234",
+		}
+		close(dbWriteChannel)
+
+		Storage.StartWriteListener(dbWriteChannel)
+	}()
+
+	recorder := httptest.NewRecorder()
+	WaitForMailItem(recorder, httptest.NewRequest("GET", "/mail/wait?to=user@example.com&subject=code&timeout=5", nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	mailItem := model.JSONMailItem{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &mailItem); err != nil {
+		t.Fatalf("Unable to decode mail item: %s", err)
+	}
+
+	if mailItem.Subject != "Your code is 1234" {
+		t.Errorf("Expected the matching mail item, got %+v", mailItem)
+	}
+}
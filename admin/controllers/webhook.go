@@ -0,0 +1,54 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/adampresley/mailslurper/settings"
+)
+
+/*
+This function handles a web GET request for "/webhooks". It returns
+a JSON-serialized array of the configured webhooks. Secrets are
+never returned.
+*/
+func GetWebhookCollection(writer http.ResponseWriter, request *http.Request) {
+	webhooks := make([]settings.WebhookConfiguration, 0, len(settings.Config.Webhooks))
+
+	for _, webhook := range settings.Config.Webhooks {
+		webhook.Secret = ""
+		webhooks = append(webhooks, webhook)
+	}
+
+	json, _ := json.Marshal(webhooks)
+	settings.Config.WriteJson(writer, json)
+}
+
+/*
+This function handles a web GET request for "/webhooks/deliveries". It
+returns the log of webhook delivery attempts, newest first. The optional
+"mailItemId" and "webhook" parameters narrow the log down to a single
+mail item or webhook name.
+*/
+func GetWebhookDeliveryCollection(writer http.ResponseWriter, request *http.Request) {
+	mailItemId := 0
+
+	if value := request.FormValue("mailItemId"); len(value) > 0 {
+		var err error
+
+		mailItemId, err = strconv.Atoi(value)
+		if err != nil {
+			http.Error(writer, "Mail item ID provided is invalid", 400)
+			return
+		}
+	}
+
+	deliveries := Storage.GetWebhookDeliveries(mailItemId, request.FormValue("webhook"))
+	json, _ := json.Marshal(deliveries)
+	settings.Config.WriteJson(writer, json)
+}
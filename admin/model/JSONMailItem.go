@@ -4,11 +4,27 @@
 
 package model
 
+import "encoding/json"
+
 type JSONAttachment struct {
 	Id       int    `json:"id"`
 	FileName string `json:"fileName"`
 }
 
+type JSONMailbox struct {
+	Name        string `json:"name"`
+	TotalCount  int    `json:"totalCount"`
+	UnreadCount int    `json:"unreadCount"`
+}
+
+type JSONMailEvent struct {
+	Id          int             `json:"id"`
+	Event       string          `json:"event"`
+	MailItemId  int             `json:"mailItemId"`
+	Data        json.RawMessage `json:"data"`
+	DateCreated string          `json:"dateCreated"`
+}
+
 type JSONMailItem struct {
 	Id              int              `json:"id"`
 	DateSent        string           `json:"dateSent"`
@@ -18,6 +34,68 @@ type JSONMailItem struct {
 	XMailer         string           `json:"xmailer"`
 	Body            string           `json:"body"`
 	ContentType     string           `json:"contentType"`
+	BodyType        string           `json:"bodyType"`
+	SMTPUTF8        bool             `json:"smtpUtf8"`
+	ClientIP        string           `json:"clientIP"`
+	ClientPort      int              `json:"clientPort"`
+	HeloName        string           `json:"heloName"`
+	AuthUser        string           `json:"authUser"`
+	TLS             bool             `json:"tls"`
+	TLSVersion      string           `json:"tlsVersion"`
+	TLSCipherSuite  string           `json:"tlsCipherSuite"`
 	AttachmentCount int              `json:"attachmentCount"`
 	Attachments     []JSONAttachment `json:"attachments"`
+	IsRead          bool             `json:"isRead"`
+	IsStarred       bool             `json:"isStarred"`
+	Tags            []string         `json:"tags"`
+	DateReceived    string           `json:"dateReceived"`
+	Relays          []JSONMailRelay  `json:"relays,omitempty"`
+}
+
+type JSONMailRelay struct {
+	Id          int      `json:"id"`
+	MailItemId  int      `json:"mailItemId"`
+	RelayName   string   `json:"relayName"`
+	RuleName    string   `json:"ruleName"`
+	Recipients  []string `json:"recipients"`
+	Success     bool     `json:"success"`
+	Error       string   `json:"error"`
+	DateRelayed string   `json:"dateRelayed"`
+}
+
+type JSONWebhookPayload struct {
+	JSONMailItem
+	Headers map[string][]string `json:"headers"`
+}
+
+type JSONWebhookDelivery struct {
+	Id            int    `json:"id"`
+	MailItemId    int    `json:"mailItemId"`
+	WebhookName   string `json:"webhookName"`
+	URL           string `json:"url"`
+	Attempt       int    `json:"attempt"`
+	StatusCode    int    `json:"statusCode"`
+	Success       bool   `json:"success"`
+	Error         string `json:"error"`
+	DateAttempted string `json:"dateAttempted"`
+}
+
+type JSONSmtpSession struct {
+	Id             int                  `json:"id"`
+	MailItemId     int                  `json:"mailItemId"`
+	ClientAddress  string               `json:"clientAddress"`
+	HeloName       string               `json:"heloName"`
+	TLS            bool                 `json:"tls"`
+	TLSVersion     string               `json:"tlsVersion"`
+	TLSCipherSuite string               `json:"tlsCipherSuite"`
+	Outcome        string               `json:"outcome"`
+	DateStarted    string               `json:"dateStarted"`
+	DateEnded      string               `json:"dateEnded"`
+	Transcript     []JSONTranscriptLine `json:"transcript,omitempty"`
+}
+
+type JSONTranscriptLine struct {
+	Direction string `json:"direction"`
+	Line      string `json:"line"`
+	Date      string `json:"date"`
 }
@@ -0,0 +1,453 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/adampresley/mailslurper/admin/model"
+	"github.com/adampresley/mailslurper/client"
+)
+
+// Exit codes returned by Run
+const (
+	EXIT_OK    int = 0
+	EXIT_ERROR int = 1
+	EXIT_USAGE int = 2
+)
+
+// Administrator address used when neither --server nor the
+// MAILSLURPER_URL environment variable is provided
+const DEFAULT_SERVER = "http://localhost:8080"
+
+/*
+A command registers its flags on the context's flag set in setup,
+then returns the function that runs it with the positional arguments.
+*/
+type command struct {
+	usage       string
+	description string
+	setup       func(context *commandContext) func(args []string) error
+}
+
+type commandContext struct {
+	client *client.Client
+	flags  *flag.FlagSet
+	json   bool
+	stdout io.Writer
+}
+
+var commands = map[string]command{
+	"list":        {"list [--q text] [--mailbox address] [--unread]", "List mail items", listCommand},
+	"show":        {"show <id>", "Show a mail item's headers and body", showCommand},
+	"raw":         {"raw <id>", "Print the raw source of a mail item", rawCommand},
+	"attachments": {"attachments <id> [--save dir]", "List, or save, a mail item's attachments", attachmentsCommand},
+	"wait":        {"wait [--to address] [--from address] [--subject regex] [--timeout 30s]", "Wait for a matching mail item and show it", waitCommand},
+	"release":     {"release <id> [--relay name] [--to address,...]", "Send a mail item on to a real SMTP server", releaseCommand},
+	"purge":       {"purge", "Delete all mail items", purgeCommand},
+}
+
+var commandOrder = []string{"list", "show", "raw", "attachments", "wait", "release", "purge"}
+
+/*
+Returns true if name is one of the command-line client commands,
+meaning the binary should act as a client instead of a server.
+*/
+func IsCommand(name string) bool {
+	_, ok := commands[name]
+	return ok || name == "help"
+}
+
+/*
+Runs a command-line client command against a running MailSlurper
+administrator. args starts with the command name, for example
+[]string{"show", "12", "--json"}. Flags may appear before or after
+positional arguments. The return value is a process exit code.
+*/
+func Run(args []string, stdout io.Writer, stderr io.Writer) int {
+	if len(args) <= 0 {
+		printUsage(stderr)
+		return EXIT_USAGE
+	}
+
+	if args[0] == "help" {
+		printUsage(stdout)
+		return EXIT_OK
+	}
+
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(stderr, "Unknown command %q\n\n", args[0])
+		printUsage(stderr)
+		return EXIT_USAGE
+	}
+
+	server := os.Getenv("MAILSLURPER_URL")
+	if len(server) <= 0 {
+		server = DEFAULT_SERVER
+	}
+
+	context := &commandContext{stdout: stdout}
+	context.flags = flag.NewFlagSet(args[0], flag.ContinueOnError)
+	context.flags.SetOutput(stderr)
+	context.flags.StringVar(&server, "server", server, "Address of the MailSlurper administrator")
+	context.flags.BoolVar(&context.json, "json", false, "Write JSON instead of a table")
+
+	context.flags.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: mailslurper %s [--server url] [--json]\n\n%s\n\n", cmd.usage, cmd.description)
+		context.flags.PrintDefaults()
+	}
+
+	run := cmd.setup(context)
+
+	positional, err := parseInterspersed(context.flags, args[1:])
+	if err != nil {
+		return EXIT_USAGE
+	}
+
+	context.client = client.New(server)
+
+	err = run(positional)
+	if err == errUsage {
+		context.flags.Usage()
+		return EXIT_USAGE
+	} else if err != nil {
+		fmt.Fprintln(stderr, err)
+		return EXIT_ERROR
+	}
+
+	return EXIT_OK
+}
+
+var errUsage = fmt.Errorf("usage")
+
+/*
+Parses flags that may appear anywhere in the argument list, returning
+the positional arguments left over.
+*/
+func parseInterspersed(flags *flag.FlagSet, args []string) ([]string, error) {
+	positional := make([]string, 0)
+
+	for {
+		err := flags.Parse(args)
+		if err != nil {
+			return nil, err
+		}
+
+		if flags.NArg() <= 0 {
+			return positional, nil
+		}
+
+		positional = append(positional, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+}
+
+func printUsage(writer io.Writer) {
+	fmt.Fprintln(writer, "Usage: mailslurper <command> [arguments] [--server url] [--json]")
+	fmt.Fprintln(writer, "")
+	fmt.Fprintln(writer, "Without a command MailSlurper starts the SMTP server and administrator.")
+	fmt.Fprintln(writer, "The commands below talk to a running administrator at --server, or")
+	fmt.Fprintf(writer, "MAILSLURPER_URL, defaulting to %s.\n\n", DEFAULT_SERVER)
+
+	tableWriter := tabwriter.NewWriter(writer, 0, 4, 2, ' ', 0)
+	for _, name := range commandOrder {
+		fmt.Fprintf(tableWriter, "  %s\t%s\n", commands[name].usage, commands[name].description)
+	}
+
+	tableWriter.Flush()
+}
+
+/*
+Parses the single mail item ID positional argument most commands take.
+*/
+func parseId(args []string) (int, error) {
+	if len(args) != 1 {
+		return 0, errUsage
+	}
+
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		return 0, fmt.Errorf("ID %q is invalid", args[0])
+	}
+
+	return id, nil
+}
+
+func writeJSON(writer io.Writer, value interface{}) error {
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+func writeMailItemTable(writer io.Writer, mailItems []model.JSONMailItem) {
+	tableWriter := tabwriter.NewWriter(writer, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tableWriter, "ID\tRECEIVED\tFROM\tTO\tSUBJECT\tATTACHMENTS")
+
+	for _, mailItem := range mailItems {
+		fmt.Fprintf(tableWriter, "%d\t%s\t%s\t%s\t%s\t%d\n",
+			mailItem.Id,
+			mailItem.DateReceived,
+			mailItem.FromAddress,
+			strings.Join(mailItem.ToAddresses, ", "),
+			mailItem.Subject,
+			mailItem.AttachmentCount,
+		)
+	}
+
+	tableWriter.Flush()
+}
+
+func writeMailItem(writer io.Writer, mailItem model.JSONMailItem) {
+	tableWriter := tabwriter.NewWriter(writer, 0, 4, 1, ' ', 0)
+
+	fmt.Fprintf(tableWriter, "ID:\t%d\n", mailItem.Id)
+	fmt.Fprintf(tableWriter, "Date Sent:\t%s\n", mailItem.DateSent)
+	fmt.Fprintf(tableWriter, "Received:\t%s\n", mailItem.DateReceived)
+	fmt.Fprintf(tableWriter, "From:\t%s\n", mailItem.FromAddress)
+	fmt.Fprintf(tableWriter, "To:\t%s\n", strings.Join(mailItem.ToAddresses, ", "))
+	fmt.Fprintf(tableWriter, "Subject:\t%s\n", mailItem.Subject)
+	fmt.Fprintf(tableWriter, "Content-Type:\t%s\n", mailItem.ContentType)
+
+	if len(mailItem.Tags) > 0 {
+		fmt.Fprintf(tableWriter, "Tags:\t%s\n", strings.Join(mailItem.Tags, ", "))
+	}
+
+	for _, attachment := range mailItem.Attachments {
+		fmt.Fprintf(tableWriter, "Attachment:\t%s (id %d)\n", attachment.FileName, attachment.Id)
+	}
+
+	tableWriter.Flush()
+	fmt.Fprintf(writer, "\n%s\n", mailItem.Body)
+}
+
+func listCommand(context *commandContext) func(args []string) error {
+	text := context.flags.String("q", "", "Only list mail items containing this text")
+	mailbox := context.flags.String("mailbox", "", "Only list mail items sent to this address")
+	unread := context.flags.Bool("unread", false, "Only list unread mail items")
+
+	return func(args []string) error {
+		if len(args) > 0 {
+			return errUsage
+		}
+
+		options := client.SearchOptions{Text: *text, Mailbox: *mailbox}
+
+		if *unread {
+			isRead := false
+			options.IsRead = &isRead
+		}
+
+		mailItems, err := context.client.Search(options)
+		if err != nil {
+			return err
+		}
+
+		if context.json {
+			return writeJSON(context.stdout, mailItems)
+		}
+
+		writeMailItemTable(context.stdout, mailItems)
+		return nil
+	}
+}
+
+func showCommand(context *commandContext) func(args []string) error {
+	return func(args []string) error {
+		id, err := parseId(args)
+		if err != nil {
+			return err
+		}
+
+		mailItem, err := context.client.Get(id)
+		if err != nil {
+			return err
+		}
+
+		if context.json {
+			return writeJSON(context.stdout, mailItem)
+		}
+
+		writeMailItem(context.stdout, mailItem)
+		return nil
+	}
+}
+
+func rawCommand(context *commandContext) func(args []string) error {
+	return func(args []string) error {
+		id, err := parseId(args)
+		if err != nil {
+			return err
+		}
+
+		rawSource, err := context.client.Raw(id)
+		if err != nil {
+			return err
+		}
+
+		if context.json {
+			return writeJSON(context.stdout, map[string]interface{}{"id": id, "rawSource": rawSource})
+		}
+
+		_, err = io.WriteString(context.stdout, rawSource)
+		return err
+	}
+}
+
+func attachmentsCommand(context *commandContext) func(args []string) error {
+	saveDirectory := context.flags.String("save", "", "Save the attachments into this directory")
+
+	return func(args []string) error {
+		id, err := parseId(args)
+		if err != nil {
+			return err
+		}
+
+		mailItem, err := context.client.Get(id)
+		if err != nil {
+			return err
+		}
+
+		savedTo := make(map[int]string)
+
+		if len(*saveDirectory) > 0 {
+			for _, attachment := range mailItem.Attachments {
+				contents, err := context.client.DownloadAttachment(attachment.Id)
+				if err != nil {
+					return err
+				}
+
+				fileName := filepath.Join(*saveDirectory, filepath.Base(attachment.FileName))
+				err = ioutil.WriteFile(fileName, contents, 0644)
+				if err != nil {
+					return err
+				}
+
+				savedTo[attachment.Id] = fileName
+			}
+		}
+
+		if context.json {
+			result := make([]map[string]interface{}, 0, len(mailItem.Attachments))
+
+			for _, attachment := range mailItem.Attachments {
+				item := map[string]interface{}{"id": attachment.Id, "fileName": attachment.FileName}
+				if path, ok := savedTo[attachment.Id]; ok {
+					item["savedTo"] = path
+				}
+
+				result = append(result, item)
+			}
+
+			return writeJSON(context.stdout, result)
+		}
+
+		tableWriter := tabwriter.NewWriter(context.stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tableWriter, "ID\tFILE NAME\tSAVED TO")
+
+		for _, attachment := range mailItem.Attachments {
+			fmt.Fprintf(tableWriter, "%d\t%s\t%s\n", attachment.Id, attachment.FileName, savedTo[attachment.Id])
+		}
+
+		tableWriter.Flush()
+		return nil
+	}
+}
+
+func waitCommand(context *commandContext) func(args []string) error {
+	to := context.flags.String("to", "", "Recipient address to wait for")
+	from := context.flags.String("from", "", "Sender address to wait for")
+	subject := context.flags.String("subject", "", "Regular expression the subject must match")
+	after := context.flags.String("after", "", "Only match mail received after this RFC 3339 date/time")
+	timeout := context.flags.Duration("timeout", 30*time.Second, "How long to wait")
+
+	return func(args []string) error {
+		if len(args) > 0 {
+			return errUsage
+		}
+
+		criteria := client.WaitCriteria{To: *to, From: *from, Subject: *subject}
+
+		if len(*after) > 0 {
+			receivedAfter, err := time.Parse(time.RFC3339Nano, *after)
+			if err != nil {
+				return fmt.Errorf("After date %q is invalid: %s", *after, err)
+			}
+
+			criteria.ReceivedAfter = receivedAfter
+		}
+
+		mailItem, err := context.client.WaitFor(criteria, *timeout)
+		if err != nil {
+			return err
+		}
+
+		if context.json {
+			return writeJSON(context.stdout, mailItem)
+		}
+
+		writeMailItem(context.stdout, mailItem)
+		return nil
+	}
+}
+
+func releaseCommand(context *commandContext) func(args []string) error {
+	relayName := context.flags.String("relay", "", "Name of the relay to use. Defaults to the first one configured")
+	to := context.flags.String("to", "", "Comma separated recipients to send to instead of the original ones")
+
+	return func(args []string) error {
+		id, err := parseId(args)
+		if err != nil {
+			return err
+		}
+
+		options := client.ReleaseOptions{Relay: *relayName}
+		if len(*to) > 0 {
+			options.To = strings.Split(*to, ",")
+		}
+
+		mailRelay, err := context.client.Release(id, options)
+		if err != nil {
+			return err
+		}
+
+		if context.json {
+			return writeJSON(context.stdout, mailRelay)
+		}
+
+		fmt.Fprintf(context.stdout, "Mail item %d relayed through %s to %s.\n", id, mailRelay.RelayName, strings.Join(mailRelay.Recipients, ", "))
+		return nil
+	}
+}
+
+func purgeCommand(context *commandContext) func(args []string) error {
+	return func(args []string) error {
+		if len(args) > 0 {
+			return errUsage
+		}
+
+		err := context.client.Purge()
+		if err != nil {
+			return err
+		}
+
+		if context.json {
+			return writeJSON(context.stdout, map[string]interface{}{"success": true})
+		}
+
+		fmt.Fprintln(context.stdout, "All mail items deleted.")
+		return nil
+	}
+}
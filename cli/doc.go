@@ -0,0 +1,10 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+/*
+Package cli implements the MailSlurper command-line client commands, such
+as "mailslurper list" and "mailslurper wait --to user@example.com", which
+talk to a running MailSlurper administrator over its HTTP API.
+*/
+package cli
@@ -0,0 +1,56 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package client
+
+import (
+	"time"
+
+	"github.com/adampresley/mailslurper/admin/model"
+)
+
+/*
+TestingT is the part of testing.TB used by the test helpers, so
+this package does not have to import "testing".
+*/
+type TestingT interface {
+	Helper()
+	Fatalf(format string, args ...interface{})
+}
+
+/*
+Waits for a mail item matching the criteria and returns it. The test
+fails immediately if no such mail arrives within the timeout.
+
+Example:
+
+	mailItem := mailslurper.ExpectMail(t, client.WaitCriteria{To: "user+signup@example.com"}, 10*time.Second)
+*/
+func (c *Client) ExpectMail(t TestingT, criteria WaitCriteria, timeout time.Duration) model.JSONMailItem {
+	t.Helper()
+
+	mailItem, err := c.WaitFor(criteria, timeout)
+	if err == ErrTimeout {
+		t.Fatalf("Expected a mail item matching %+v within %s, but none arrived", criteria, timeout)
+	} else if err != nil {
+		t.Fatalf("Error waiting for a mail item matching %+v: %s", criteria, err)
+	}
+
+	return mailItem
+}
+
+/*
+Waits for the duration provided and fails the test if a mail item
+matching the criteria arrives during that time.
+*/
+func (c *Client) ExpectNoMail(t TestingT, criteria WaitCriteria, wait time.Duration) {
+	t.Helper()
+
+	mailItem, err := c.WaitFor(criteria, wait)
+	if err == nil {
+		t.Fatalf("Expected no mail item matching %+v, but received mail item %d with subject %q", criteria, mailItem.Id, mailItem.Subject)
+	} else if err != ErrTimeout {
+		t.Fatalf("Error waiting for a mail item matching %+v: %s", criteria, err)
+	}
+}
@@ -0,0 +1,281 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adampresley/mailslurper/admin/model"
+)
+
+// Returned by WaitFor when no matching mail item arrives in time
+var ErrTimeout = errors.New("Timed out waiting for a matching mail item")
+
+/*
+APIError is returned when the MailSlurper administrator responds
+with a status code other than 200.
+*/
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("MailSlurper returned %d: %s", e.StatusCode, e.Message)
+}
+
+/*
+Client talks to the HTTP API of a running MailSlurper administrator.
+BaseURL is the address of the administrator, such as "http://localhost:8080".
+If HTTPClient is nil http.DefaultClient is used.
+*/
+type Client struct {
+	BaseURL    string
+	HTTPClient *http.Client
+}
+
+/*
+SearchOptions narrows down the mail items returned by Search. Fields
+left nil or empty are not sent. MailboxKind is one of "address",
+"domain" or "tag" and only applies when Mailbox is set.
+*/
+type SearchOptions struct {
+	Text        string
+	IsRead      *bool
+	IsStarred   *bool
+	Tag         string
+	Mailbox     string
+	MailboxKind string
+}
+
+/*
+WaitCriteria describes a mail item to wait for. Subject is a regular
+expression. Fields left empty match everything.
+*/
+type WaitCriteria struct {
+	To            string
+	From          string
+	Subject       string
+	ReceivedAfter time.Time
+}
+
+/*
+ReleaseOptions controls where Release sends a mail item. Relay names a
+configured relay and defaults to the first one. To replaces the original
+recipients when it is not empty.
+*/
+type ReleaseOptions struct {
+	Relay string
+	To    []string
+}
+
+/*
+Creates a new client for the MailSlurper administrator at baseURL.
+*/
+func New(baseURL string) *Client {
+	return &Client{BaseURL: strings.TrimRight(baseURL, "/")}
+}
+
+/*
+Returns all mail items. Bodies are not included; use Get for those.
+*/
+func (c *Client) List() ([]model.JSONMailItem, error) {
+	return c.Search(SearchOptions{})
+}
+
+/*
+Returns the mail items matching a set of search options. Bodies
+are not included; use Get for those.
+*/
+func (c *Client) Search(options SearchOptions) ([]model.JSONMailItem, error) {
+	values := url.Values{}
+
+	setIfNotEmpty(values, "q", options.Text)
+	setIfNotEmpty(values, "tag", options.Tag)
+	setIfNotEmpty(values, "mailbox", options.Mailbox)
+	setIfNotEmpty(values, "by", options.MailboxKind)
+
+	if options.IsRead != nil {
+		values.Set("read", strconv.FormatBool(*options.IsRead))
+	}
+
+	if options.IsStarred != nil {
+		values.Set("starred", strconv.FormatBool(*options.IsStarred))
+	}
+
+	result := make([]model.JSONMailItem, 0)
+	err := c.getJSON("/mails", values, &result)
+	return result, err
+}
+
+/*
+Returns a single mail item, including its body and attachment list.
+*/
+func (c *Client) Get(id int) (model.JSONMailItem, error) {
+	result := model.JSONMailItem{}
+	err := c.getJSON("/mail", idValues(id), &result)
+	return result, err
+}
+
+/*
+Blocks until a mail item matching the criteria has been received and
+returns it. If nothing matches within the timeout ErrTimeout is returned.
+*/
+func (c *Client) WaitFor(criteria WaitCriteria, timeout time.Duration) (model.JSONMailItem, error) {
+	values := url.Values{}
+
+	setIfNotEmpty(values, "to", criteria.To)
+	setIfNotEmpty(values, "from", criteria.From)
+	setIfNotEmpty(values, "subject", criteria.Subject)
+	values.Set("timeout", strconv.Itoa(int((timeout+time.Second-1)/time.Second)))
+
+	if !criteria.ReceivedAfter.IsZero() {
+		values.Set("after", criteria.ReceivedAfter.UTC().Format(time.RFC3339Nano))
+	}
+
+	result := model.JSONMailItem{}
+	err := c.getJSON("/mail/wait", values, &result)
+
+	if apiError, ok := err.(*APIError); ok && apiError.StatusCode == http.StatusRequestTimeout {
+		return result, ErrTimeout
+	}
+
+	return result, err
+}
+
+/*
+Deletes a mail item and its attachments.
+*/
+func (c *Client) Delete(id int) error {
+	response, err := c.do("DELETE", "/mail", idValues(id))
+	if err != nil {
+		return err
+	}
+
+	response.Body.Close()
+	return nil
+}
+
+/*
+Deletes every mail item and attachment.
+*/
+func (c *Client) Purge() error {
+	response, err := c.do("DELETE", "/mails", nil)
+	if err != nil {
+		return err
+	}
+
+	response.Body.Close()
+	return nil
+}
+
+/*
+Sends a captured mail item on to a real SMTP server configured on the
+MailSlurper administrator, returning the relay log entry.
+*/
+func (c *Client) Release(id int, options ReleaseOptions) (model.JSONMailRelay, error) {
+	result := model.JSONMailRelay{}
+	values := idValues(id)
+
+	setIfNotEmpty(values, "relay", options.Relay)
+	setIfNotEmpty(values, "to", strings.Join(options.To, ","))
+
+	response, err := c.do("POST", "/mail/release", values)
+	if err != nil {
+		return result, err
+	}
+
+	defer response.Body.Close()
+
+	err = json.NewDecoder(response.Body).Decode(&result)
+	return result, err
+}
+
+/*
+Downloads the contents of an attachment, decoded, by attachment ID.
+*/
+func (c *Client) DownloadAttachment(id int) ([]byte, error) {
+	response, err := c.do("GET", "/attachment", idValues(id))
+	if err != nil {
+		return nil, err
+	}
+
+	defer response.Body.Close()
+	return ioutil.ReadAll(response.Body)
+}
+
+/*
+Returns the raw source of a mail item exactly as it was sent.
+*/
+func (c *Client) Raw(id int) (string, error) {
+	response, err := c.do("GET", "/mail/raw", idValues(id))
+	if err != nil {
+		return "", err
+	}
+
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	return string(body), err
+}
+
+func (c *Client) do(method string, path string, values url.Values) (*http.Response, error) {
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	address := strings.TrimRight(c.BaseURL, "/") + path
+	if len(values) > 0 {
+		address += "?" + values.Encode()
+	}
+
+	request, err := http.NewRequest(method, address, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		defer response.Body.Close()
+
+		message, _ := ioutil.ReadAll(response.Body)
+		return nil, &APIError{StatusCode: response.StatusCode, Message: strings.TrimSpace(string(message))}
+	}
+
+	return response, nil
+}
+
+func (c *Client) getJSON(path string, values url.Values, result interface{}) error {
+	response, err := c.do("GET", path, values)
+	if err != nil {
+		return err
+	}
+
+	defer response.Body.Close()
+	return json.NewDecoder(response.Body).Decode(result)
+}
+
+func idValues(id int) url.Values {
+	return url.Values{"id": []string{strconv.Itoa(id)}}
+}
+
+func setIfNotEmpty(values url.Values, key string, value string) {
+	if len(value) > 0 {
+		values.Set(key, value)
+	}
+}
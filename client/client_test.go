@@ -0,0 +1,259 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package client_test
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adampresley/mailslurper/admin/controllers"
+	"github.com/adampresley/mailslurper/client"
+	"github.com/adampresley/mailslurper/smtp"
+	"github.com/gorilla/mux"
+)
+
+/*
+Starts the administrator API against an empty in-memory
+database and returns a client for it.
+*/
+func newTestClient(t *testing.T) (*client.Client, func()) {
+	controllers.Storage = &smtp.MailStorage{Engine: smtp.ENGINE_SQLITE_MEMORY}
+
+	if err := controllers.Storage.Connect(); err != nil {
+		t.Fatalf("Unable to set up in-memory storage: %s", err)
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/mail", controllers.GetMailItem).Methods("GET")
+	router.HandleFunc("/mail", controllers.DeleteMailItem).Methods("DELETE")
+	router.HandleFunc("/mail/raw", controllers.GetMailItemRawSource).Methods("GET")
+	router.HandleFunc("/mails", controllers.GetMailCollection).Methods("GET")
+	router.HandleFunc("/mail/wait", controllers.WaitForMailItem).Methods("GET")
+	router.HandleFunc("/attachment", controllers.DownloadAttachment).Methods("GET")
+
+	server := httptest.NewServer(router)
+
+	return client.New(server.URL + "/"), func() {
+		server.Close()
+		controllers.Storage.Disconnect()
+	}
+}
+
+/*
+Writes a mail item to storage and waits until the
+administrator API can see it.
+*/
+func storeMail(t *testing.T, c *client.Client, mailItem smtp.MailItemStruct) {
+	before, _ := c.List()
+
+	dbWriteChannel := make(chan smtp.MailItemStruct, 1)
+	dbWriteChannel <- mailItem
+	close(dbWriteChannel)
+	go controllers.Storage.StartWriteListener(dbWriteChannel)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mailItems, err := c.List()
+		if err == nil && len(mailItems) > len(before) {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for mail item %q to be stored", mailItem.Subject)
+		}
+
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func newMailItem(to string, subject string) smtp.MailItemStruct {
+	return smtp.MailItemStruct{
+		DateSent:     "2014-01-02 03:04:05",
+		DateReceived: time.Now().UTC().Format(smtp.DATE_RECEIVED_FORMAT),
+		FromAddress:  "<sender@example.com>",
+		ToAddresses:  []string{to},
+		Subject:      subject,
+		Body:         "Body of " + subject,
+		RawSource:    "Subject: " + subject + "\r\n\r\nBody of " + subject,
+	}
+}
+
+/*
+Records test failures instead of ending the test, so the
+assertion helpers can be checked.
+*/
+type fakeT struct {
+	failure string
+}
+
+func (f *fakeT) Helper() {}
+
+func (f *fakeT) Fatalf(format string, args ...interface{}) {
+	f.failure = fmt.Sprintf(format, args...)
+}
+
+func TestListSearchAndGet(t *testing.T) {
+	c, done := newTestClient(t)
+	defer done()
+
+	storeMail(t, c, newMailItem("<bob+signup@example.com>", "Welcome"))
+	storeMail(t, c, newMailItem("<alice@other.com>", "Invoice 12"))
+
+	mailItems, err := c.List()
+	if err != nil || len(mailItems) != 2 {
+		t.Fatalf("Expected 2 mail items, got %d: %v", len(mailItems), err)
+	}
+
+	found, err := c.Search(client.SearchOptions{Text: "invoice"})
+	if err != nil || len(found) != 1 || found[0].Subject != "Invoice 12" {
+		t.Errorf("Expected the text search to find Invoice 12, got %+v: %v", found, err)
+	}
+
+	found, err = c.Search(client.SearchOptions{Mailbox: "signup", MailboxKind: "tag"})
+	if err != nil || len(found) != 1 || found[0].Subject != "Welcome" {
+		t.Errorf("Expected the signup mailbox to hold Welcome, got %+v: %v", found, err)
+	}
+
+	mailItem, err := c.Get(found[0].Id)
+	if err != nil || mailItem.Body != "Body of Welcome" {
+		t.Errorf("Expected Get to return the body, got %+v: %v", mailItem, err)
+	}
+}
+
+func TestGetKeepsPercentSigns(t *testing.T) {
+	c, done := newTestClient(t)
+	defer done()
+
+	storeMail(t, c, newMailItem("<user@example.com>", "100% off, 50%s and %d"))
+	mailItems, _ := c.List()
+
+	mailItem, err := c.Get(mailItems[0].Id)
+	if err != nil || mailItem.Subject != "100% off, 50%s and %d" {
+		t.Errorf("Expected the subject to come back unchanged, got %q: %v", mailItem.Subject, err)
+	}
+}
+
+func TestGetMissingMailItem(t *testing.T) {
+	c, done := newTestClient(t)
+	defer done()
+
+	_, err := c.Get(42)
+
+	apiError, ok := err.(*client.APIError)
+	if !ok || apiError.StatusCode != 404 {
+		t.Errorf("Expected a 404 APIError, got %v", err)
+	}
+}
+
+func TestRawAndDelete(t *testing.T) {
+	c, done := newTestClient(t)
+	defer done()
+
+	storeMail(t, c, newMailItem("<user@example.com>", "Raw"))
+	mailItems, _ := c.List()
+	id := mailItems[0].Id
+
+	raw, err := c.Raw(id)
+	if err != nil || raw != "Subject: Raw\r\n\r\nBody of Raw" {
+		t.Errorf("Expected the raw source, got %q: %v", raw, err)
+	}
+
+	if err := c.Delete(id); err != nil {
+		t.Fatalf("Delete failed: %s", err)
+	}
+
+	if mailItems, _ := c.List(); len(mailItems) != 0 {
+		t.Errorf("Expected no mail items after deleting, got %d", len(mailItems))
+	}
+
+	err = c.Delete(id)
+
+	apiError, ok := err.(*client.APIError)
+	if !ok || apiError.StatusCode != 404 {
+		t.Errorf("Expected deleting a missing mail item to give a 404 APIError, got %v", err)
+	}
+}
+
+func TestDownloadAttachment(t *testing.T) {
+	c, done := newTestClient(t)
+	defer done()
+
+	mailItem := newMailItem("<user@example.com>", "Attached")
+	mailItem.Attachments = []*smtp.Attachment{
+		{Headers: &smtp.AttachmentHeader{FileName: "hello.txt", ContentType: "text/plain"}, Contents: "SGVsbG8sIHdvcmxk"},
+	}
+
+	storeMail(t, c, mailItem)
+	mailItems, _ := c.List()
+
+	stored, err := c.Get(mailItems[0].Id)
+	if err != nil || len(stored.Attachments) != 1 {
+		t.Fatalf("Expected one attachment, got %+v: %v", stored.Attachments, err)
+	}
+
+	content, err := c.DownloadAttachment(stored.Attachments[0].Id)
+	if err != nil || string(content) != "Hello, world" {
+		t.Errorf("Expected the decoded attachment, got %q: %v", content, err)
+	}
+}
+
+func TestWaitFor(t *testing.T) {
+	c, done := newTestClient(t)
+	defer done()
+
+	start := time.Now().Add(-time.Second)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+
+		dbWriteChannel := make(chan smtp.MailItemStruct, 1)
+		dbWriteChannel <- newMailItem("<user@example.com>", "Your code is 1234")
+		close(dbWriteChannel)
+		controllers.Storage.StartWriteListener(dbWriteChannel)
+	}()
+
+	mailItem, err := c.WaitFor(client.WaitCriteria{To: "user@example.com", Subject: "code", ReceivedAfter: start}, 5*time.Second)
+	if err != nil || mailItem.Subject != "Your code is 1234" {
+		t.Errorf("Expected the new mail item, got %+v: %v", mailItem, err)
+	}
+
+	_, err = c.WaitFor(client.WaitCriteria{To: "nobody@example.com"}, 0)
+	if err != client.ErrTimeout {
+		t.Errorf("Expected ErrTimeout, got %v", err)
+	}
+}
+
+func TestExpectMailAndExpectNoMail(t *testing.T) {
+	c, done := newTestClient(t)
+	defer done()
+
+	storeMail(t, c, newMailItem("<user@example.com>", "Welcome"))
+
+	passing := &fakeT{}
+	if mailItem := c.ExpectMail(passing, client.WaitCriteria{To: "user@example.com"}, time.Second); mailItem.Subject != "Welcome" || passing.failure != "" {
+		t.Errorf("Expected ExpectMail to return Welcome without failing, got %+v and %q", mailItem, passing.failure)
+	}
+
+	failing := &fakeT{}
+	c.ExpectMail(failing, client.WaitCriteria{To: "nobody@example.com"}, 0)
+	if !strings.Contains(failing.failure, "none arrived") {
+		t.Errorf("Expected ExpectMail to fail when no mail arrives, got %q", failing.failure)
+	}
+
+	passing = &fakeT{}
+	c.ExpectNoMail(passing, client.WaitCriteria{To: "nobody@example.com"}, 0)
+	if passing.failure != "" {
+		t.Errorf("Expected ExpectNoMail to pass, got %q", passing.failure)
+	}
+
+	failing = &fakeT{}
+	c.ExpectNoMail(failing, client.WaitCriteria{To: "user@example.com"}, 0)
+	if !strings.Contains(failing.failure, "Welcome") {
+		t.Errorf("Expected ExpectNoMail to fail naming the mail item, got %q", failing.failure)
+	}
+}
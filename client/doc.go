@@ -0,0 +1,18 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+/*
+Package client provides a Go client for the MailSlurper administrator
+HTTP API, along with helpers for asserting on received mail from tests.
+
+Example:
+
+	mailslurper := client.New("http://localhost:8080")
+
+	mailItem := mailslurper.ExpectMail(t, client.WaitCriteria{
+		To:      "user+signup@example.com",
+		Subject: "^Welcome",
+	}, 10*time.Second)
+*/
+package client
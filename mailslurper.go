@@ -5,29 +5,52 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"runtime"
 //	"runtime/pprof"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/adampresley/mailslurper/admin/controllers"
+	"github.com/adampresley/mailslurper/cli"
 	"github.com/adampresley/mailslurper/profiling"
+	"github.com/adampresley/mailslurper/relay"
 	"github.com/adampresley/mailslurper/settings"
 	"github.com/adampresley/mailslurper/smtp"
+	"github.com/adampresley/mailslurper/webhook"
 	"github.com/gorilla/mux"
 )
 
 var cpuprofile = flag.String("cpuprofile", "", "Write CPU profile to disk")
 var memprofile = flag.String("memprofile", "", "Write memory profile to disk")
 
+/*
+How long SMTP sessions and HTTP requests in progress are given
+to finish when shutting down
+*/
+const SHUTDOWN_TIMEOUT = 10 * time.Second
+
 func main() {
 	var err error
 
+	/*
+	 * If the first argument is a client command, such as "list" or
+	 * "wait", talk to a running instance instead of starting one.
+	 */
+	if len(os.Args) > 1 && cli.IsCommand(os.Args[1]) {
+		os.Exit(cli.Run(os.Args[1:], os.Stdout, os.Stderr))
+	}
+
 	profiling.Initialize()
 	flag.Parse()
 	runtime.GOMAXPROCS(runtime.NumCPU())
@@ -48,15 +71,31 @@ func main() {
 */
 
 	/*
-	 * Prepare SIGINT handler (CTRL+C)
+	 * Prepare SIGINT (CTRL+C) and SIGTERM handler. The first signal
+	 * starts shutting down, a second one exits right away.
 	 */
 	profiling.Timer.Step("Initializing SIGINT channel")
 
+	shutdown := make(chan bool)
+	var shutdownOnce sync.Once
+
+	requestShutdown := func() {
+		shutdownOnce.Do(func() { close(shutdown) })
+	}
+
 	done := make(chan os.Signal, 1)
-	signal.Notify(done, os.Interrupt)
+	signal.Notify(done, os.Interrupt, syscall.SIGTERM)
 
 	go func() {
 		for _ = range done {
+			select {
+			case <-shutdown:
+				log.Println("Exiting without finishing shutdown")
+				os.Exit(1)
+
+			default:
+			}
+
 /*
 			if *cpuprofile != "" {
 				pprof.StopCPUProfile();
@@ -77,7 +116,7 @@ func main() {
 			}
 */
 
-			os.Exit(0)
+			requestShutdown()
 		}
 	}()
 
@@ -88,6 +127,10 @@ func main() {
 		WWWPort:     8080,
 		SmtpAddress: "127.0.0.1",
 		SmtpPort:    8000,
+
+		MaxMessageSize: 26214400,
+		Chunking:       true,
+		SmtpMode:       smtp.SMTP_MODE_LENIENT,
 	}
 
 	settings.Config.LoadHeader("header")
@@ -104,25 +147,175 @@ func main() {
 	staticPath := filepath.Join(settings.Config.WWWAbs, "resources")
 
 	/*
-	 * Setup global database connection handle
+	 * Setup the database connection handle and websocket hub
 	 */
 	profiling.Timer.Step("Setup database storage and write-listener")
 
-	setupGlobalDatabaseConnection()
-	defer smtp.Storage.Disconnect()
+	storage := setupDatabaseConnection()
+	defer log.Println("Shutdown complete")
+	defer storage.Disconnect()
+
+	/*
+	 * Deferred calls run in reverse, so shutting down stops the SMTP
+	 * server and writes its queued mail items first, then closes the
+	 * websockets, the HTTP server and finally the database.
+	 */
+	requestContext, cancelRequests := context.WithCancel(context.Background())
+	httpServer := &http.Server{
+		BaseContext: func(net.Listener) context.Context { return requestContext },
+	}
+
+	defer func() {
+		cancelRequests()
+
+		shutdownContext, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+		defer cancel()
+
+		if err := httpServer.Shutdown(shutdownContext); err != nil {
+			log.Println("Closing HTTP requests still in progress: ", err)
+			httpServer.Close()
+		}
+	}()
+
+	websocketHub := smtp.NewWebsocketHub(storage.GetServerStatus)
+	defer websocketHub.Close()
+
+	storage.Websockets = websocketHub
+	controllers.Storage = storage
+
+	/*
+	 * Setup outbound webhooks for newly received mail
+	 */
+	profiling.Timer.Step("Setup webhooks")
+	webhookDispatcher, err := webhook.NewDispatcher(storage, settings.Config.Webhooks)
+	if err != nil {
+		log.Println("Error in webhook configuration: ", err)
+		return
+	}
+
+	webhookDispatcher.Start()
+	defer webhookDispatcher.Stop()
+
+	/*
+	 * Setup upstream SMTP servers for releasing mail
+	 */
+	relays, err := setupRelays()
+	if err != nil {
+		log.Println("Error in relay configuration: ", err)
+		return
+	}
+
+	controllers.Relays = relays
+
+	relayRules, err := setupRelayRules(relays)
+	if err != nil {
+		log.Println("Error in relay rule configuration: ", err)
+		return
+	}
+
+	/*
+	 * Setup fault injection. The injector always exists so
+	 * rules can be added through the administrator later.
+	 */
+	faultRules := make([]smtp.FaultRule, 0, len(settings.Config.Faults))
+	for _, configuration := range settings.Config.Faults {
+		faultRules = append(faultRules, smtp.FaultRule(configuration))
+	}
+
+	faults, err := smtp.NewFaultInjector(faultRules)
+	if err != nil {
+		log.Println("Error in fault configuration: ", err)
+		return
+	}
+
+	controllers.Faults = faults
+
+	/*
+	 * Setup latency and connection drop simulation
+	 */
+	latencyRules := make([]smtp.LatencyRule, 0, len(settings.Config.Latency))
+	for _, configuration := range settings.Config.Latency {
+		latencyRules = append(latencyRules, smtp.LatencyRule(configuration))
+	}
+
+	latency, err := smtp.NewLatencySimulator(latencyRules)
+	if err != nil {
+		log.Println("Error in latency configuration: ", err)
+		return
+	}
+
+	controllers.Latency = latency
+
+	/*
+	 * Setup greylisting, if turned on
+	 */
+	var greylist *smtp.Greylist
+	if settings.Config.Greylisting.Enabled {
+		greylist = smtp.NewGreylist(
+			time.Duration(settings.Config.Greylisting.DelaySeconds*float64(time.Second)),
+			time.Duration(settings.Config.Greylisting.ExpirySeconds*float64(time.Second)),
+		)
+	}
+
+	controllers.Greylist = greylist
+
+	/*
+	 * Setup per-client rate limits, if any are set
+	 */
+	var rateLimiter *smtp.RateLimiter
+	if settings.Config.Limits.ConnectionsPerMinute > 0 || settings.Config.Limits.MessagesPerMinute > 0 {
+		rateLimiter = smtp.NewRateLimiter(settings.Config.Limits.ConnectionsPerMinute, settings.Config.Limits.MessagesPerMinute)
+	}
+
+	if settings.Config.SmtpMode != smtp.SMTP_MODE_LENIENT && settings.Config.SmtpMode != smtp.SMTP_MODE_STRICT {
+		log.Printf("Error in configuration: smtpMode must be %q or %q\n", smtp.SMTP_MODE_LENIENT, smtp.SMTP_MODE_STRICT)
+		return
+	}
+
+	verifier, err := smtp.NewAddressVerifier(settings.Config.Vrfy.Mode, settings.Config.Vrfy.KnownRecipients)
+	if err != nil {
+		log.Println("Error in VRFY configuration: ", err)
+		return
+	}
+
+	listeners, err := setupListeners()
+	if err != nil {
+		log.Println("Error in listener configuration: ", err)
+		return
+	}
 
 	/*
-	 * Setup the SMTP listener
+	 * Setup the SMTP listeners
 	 */
 	profiling.Timer.Step("Setup SMTP server")
-	smtpServer := smtp.Server{Address: fmt.Sprintf("%s:%d", settings.Config.SmtpAddress, int(settings.Config.SmtpPort))}
-	defer smtpServer.Close()
+	smtpServer := smtp.Server{
+		Listeners:  listeners,
+		Storage:    storage,
+		RelayRules: relayRules,
+		Faults:     faults,
+		Latency:    latency,
+		Greylist:   greylist,
+
+		MaxMessageSize: int(settings.Config.MaxMessageSize),
+		MaxRecipients:  int(settings.Config.MaxRecipients),
+		Chunking:       settings.Config.Chunking,
+		Strict:         settings.Config.SmtpMode == smtp.SMTP_MODE_STRICT,
+		Verifier:       verifier,
+		MaxConnections: settings.Config.Limits.MaxConnections,
+		RateLimiter:    rateLimiter,
+	}
+	defer smtpServer.Shutdown(SHUTDOWN_TIMEOUT)
 
 	/*
 	 * Start up the SMTP server and serve requests
 	 * out of a goroutine.
 	 */
-	smtpServer.Connect()
+	err = smtpServer.Connect()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
 	go smtpServer.ProcessRequests()
 
 	/*
@@ -136,8 +329,41 @@ func main() {
 
 	// Mail items
 	requestRouter.HandleFunc("/mail", controllers.GetMailItem).Methods("GET")
+	requestRouter.HandleFunc("/mail", controllers.DeleteMailItem).Methods("DELETE")
+	requestRouter.HandleFunc("/mail/raw", controllers.GetMailItemRawSource).Methods("GET")
 	requestRouter.HandleFunc("/mails", controllers.GetMailCollection).Methods("GET")
+	requestRouter.HandleFunc("/mails", controllers.DeleteMailCollection).Methods("DELETE")
+	requestRouter.HandleFunc("/mail/wait", controllers.WaitForMailItem).Methods("GET")
 	requestRouter.HandleFunc("/attachment", controllers.DownloadAttachment).Methods("GET")
+	requestRouter.HandleFunc("/mail/read", controllers.SetMailRead).Methods("PUT")
+	requestRouter.HandleFunc("/mail/starred", controllers.SetMailStarred).Methods("PUT")
+	requestRouter.HandleFunc("/mail/tags", controllers.SetMailTags).Methods("PUT")
+	requestRouter.HandleFunc("/mail/release", controllers.ReleaseMailItem).Methods("POST")
+	requestRouter.HandleFunc("/mail/relays", controllers.GetMailRelayCollection).Methods("GET")
+	requestRouter.HandleFunc("/mail/transcript", controllers.GetMailItemSmtpSession).Methods("GET")
+
+	// Mailboxes
+	requestRouter.HandleFunc("/mailboxes", controllers.GetMailboxCollection).Methods("GET")
+	requestRouter.HandleFunc("/mailbox", controllers.GetMailboxMailCollection).Methods("GET")
+
+	// Fault injection
+	requestRouter.HandleFunc("/faults", controllers.GetFaultRuleCollection).Methods("GET")
+	requestRouter.HandleFunc("/faults", controllers.SetFaultRuleCollection).Methods("PUT")
+	requestRouter.HandleFunc("/faults/injected", controllers.GetInjectedFaultCollection).Methods("GET")
+	requestRouter.HandleFunc("/faults/injected", controllers.DeleteInjectedFaultCollection).Methods("DELETE")
+	requestRouter.HandleFunc("/latency", controllers.GetLatencyRuleCollection).Methods("GET")
+	requestRouter.HandleFunc("/latency", controllers.SetLatencyRuleCollection).Methods("PUT")
+	requestRouter.HandleFunc("/greylist", controllers.GetGreylistTripletCollection).Methods("GET")
+	requestRouter.HandleFunc("/greylist", controllers.DeleteGreylistTripletCollection).Methods("DELETE")
+
+	// SMTP sessions
+	requestRouter.HandleFunc("/transcripts", controllers.Transcripts).Methods("GET")
+	requestRouter.HandleFunc("/sessions", controllers.GetSmtpSessionCollection).Methods("GET")
+	requestRouter.HandleFunc("/session", controllers.GetSmtpSession).Methods("GET")
+
+	// Webhooks
+	requestRouter.HandleFunc("/webhooks", controllers.GetWebhookCollection).Methods("GET")
+	requestRouter.HandleFunc("/webhooks/deliveries", controllers.GetWebhookDeliveryCollection).Methods("GET")
 
 	// Configuration
 	requestRouter.HandleFunc("/configuration", controllers.Config).Methods("GET")
@@ -145,17 +371,38 @@ func main() {
 	requestRouter.HandleFunc("/config", controllers.SaveConfig).Methods("PUT")
 
 	// Web-sockets
-	requestRouter.HandleFunc("/ws", smtp.WebsocketHandler)
+	requestRouter.HandleFunc("/ws", websocketHub.Handler)
+
+	// Server-Sent Events
+	requestRouter.HandleFunc("/events", controllers.GetEventStream).Methods("GET")
 
 	// Static requests
 	requestRouter.PathPrefix("/resources/").Handler(http.StripPrefix("/resources/", http.FileServer(http.Dir(staticPath))))
 
 	profiling.Timer.Step("Serving requests")
 	log.Printf("MailSlurper administrator started on %s (%s)\n\n", settings.Config.GetFullListenAddress(), settings.Config.WWW)
-	http.ListenAndServe(settings.Config.GetFullListenAddress(), requestRouter)
+
+	httpServer.Addr = settings.Config.GetFullListenAddress()
+	httpServer.Handler = requestRouter
+
+	go func() {
+		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Println("Error serving the administrator: ", err)
+			requestShutdown()
+		}
+	}()
+
+	/*
+	 * Wait for a signal, then let the deferred calls shut everything down
+	 */
+	<-shutdown
 }
 
-func setupGlobalDatabaseConnection() {
+/*
+Creates the mail storage for the database engine configured in
+settings and connects to it.
+*/
+func setupDatabaseConnection() *smtp.MailStorage {
 	var engine int
 	var host string
 	var port string
@@ -167,6 +414,9 @@ func setupGlobalDatabaseConnection() {
 	case "sqlite":
 		engine = smtp.ENGINE_SQLITE
 
+	case "memory":
+		engine = smtp.ENGINE_SQLITE_MEMORY
+
 	case "mysql":
 		engine = smtp.ENGINE_MYSQL
 		host = settings.Config.DBHost
@@ -184,7 +434,7 @@ func setupGlobalDatabaseConnection() {
 		password = settings.Config.DBPassword
 	}
 
-	smtp.Storage = smtp.MailStorage{
+	storage := &smtp.MailStorage{
 		Engine:   engine,
 		Host:     host,
 		Port:     port,
@@ -193,9 +443,137 @@ func setupGlobalDatabaseConnection() {
 		Password: password,
 	}
 
-	err := smtp.Storage.Connect()
+	err := storage.Connect()
 
 	if err != nil {
 		log.Panic("Unable to connect to database: ", err)
 	}
+
+	return storage
+}
+
+/*
+Converts the listeners in settings into listeners for the SMTP server,
+loading their TLS certificates. Without any listeners configured the
+SMTP server listens on smtpAddress and smtpPort.
+*/
+func setupListeners() ([]*smtp.Listener, error) {
+	configurations := settings.Config.Listeners
+	if len(configurations) <= 0 {
+		configurations = []settings.ListenerConfiguration{
+			{Name: "smtp", Address: settings.Config.SmtpAddress, Port: settings.Config.SmtpPort},
+		}
+	}
+
+	result := make([]*smtp.Listener, 0, len(configurations))
+
+	for index, configuration := range configurations {
+		listener := &smtp.Listener{
+			Name:       configuration.Name,
+			Network:    configuration.Network,
+			Address:    configuration.Address,
+			TLSMode:    configuration.TLS,
+			Extensions: configuration.Extensions,
+		}
+
+		if len(listener.Network) <= 0 {
+			listener.Network = "tcp"
+		}
+
+		if len(listener.Name) <= 0 {
+			listener.Name = fmt.Sprintf("listener %d", index+1)
+		}
+
+		if listener.Network != "unix" {
+			listener.Address = net.JoinHostPort(configuration.Address, fmt.Sprintf("%d", int(configuration.Port)))
+		}
+
+		if len(configuration.CertFile) > 0 || len(configuration.KeyFile) > 0 {
+			certificate, err := tls.LoadX509KeyPair(configuration.CertFile, configuration.KeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("Listener %s cannot load its TLS certificate: %s", listener.Name, err)
+			}
+
+			listener.TLSConfig = &tls.Config{Certificates: []tls.Certificate{certificate}}
+		}
+
+		result = append(result, listener)
+	}
+
+	return result, nil
+}
+
+/*
+Converts the relays in settings into upstream servers mail can
+be released to. Each relay needs a host; names default to it.
+*/
+func setupRelays() ([]relay.Upstream, error) {
+	result := make([]relay.Upstream, 0, len(settings.Config.Relays))
+
+	for index, configuration := range settings.Config.Relays {
+		if len(configuration.Host) <= 0 {
+			return nil, fmt.Errorf("Relay %d (%s) does not have a host", index+1, configuration.Name)
+		}
+
+		upstream := relay.Upstream{
+			Name:               configuration.Name,
+			Host:               configuration.Host,
+			Port:               int(configuration.Port),
+			UserName:           configuration.UserName,
+			Password:           configuration.Password,
+			StartTLS:           configuration.StartTLS,
+			InsecureSkipVerify: configuration.InsecureSkipVerify,
+		}
+
+		if len(upstream.Name) <= 0 {
+			upstream.Name = upstream.Host
+		}
+
+		if upstream.Port <= 0 {
+			upstream.Port = 25
+		}
+
+		result = append(result, upstream)
+	}
+
+	return result, nil
+}
+
+/*
+Converts the relay rules in settings into rules for the SMTP server,
+looking up each rule's relay by name.
+*/
+func setupRelayRules(relays []relay.Upstream) ([]smtp.RelayRule, error) {
+	result := make([]smtp.RelayRule, 0, len(settings.Config.RelayRules))
+
+	for index, configuration := range settings.Config.RelayRules {
+		rule := smtp.RelayRule{
+			Name:      configuration.Name,
+			To:        configuration.To,
+			From:      configuration.From,
+			RewriteTo: configuration.RewriteTo,
+		}
+
+		if len(rule.Name) <= 0 {
+			rule.Name = fmt.Sprintf("rule %d", index+1)
+		}
+
+		found := false
+
+		for _, upstream := range relays {
+			if upstream.Name == configuration.Relay {
+				rule.Upstream = upstream
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return nil, fmt.Errorf("Relay rule %s uses relay %q, which is not configured", rule.Name, configuration.Relay)
+		}
+
+		result = append(result, rule)
+	}
+
+	return result, nil
 }
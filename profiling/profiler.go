@@ -2,7 +2,9 @@ package profiling
 
 import "github.com/spf13/nitro"
 
-var Timer *nitro.B
+// Initialized up front so packages that record steps can be used
+// without main calling Initialize first, such as from tests.
+var Timer *nitro.B = nitro.Initialize()
 
 func Initialize() {
 	Timer = nitro.Initialize()
@@ -0,0 +1,15 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+/*
+Package relay sends captured mail on to a real SMTP server, so a message
+can be checked in an actual inbox.
+
+Example:
+
+	upstream := relay.Upstream{Name: "office", Host: "smtp.example.com", Port: 587, StartTLS: true}
+
+	err := relay.Send(upstream, "<app@example.com>", []string{"me@example.com"}, rawSource)
+*/
+package relay
@@ -0,0 +1,147 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package relay
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long to wait when connecting to an upstream server, and how
+// long the whole conversation with it may take once connected
+const (
+	DIAL_TIMEOUT_SECONDS = 30
+	SEND_TIMEOUT_SECONDS = 60
+)
+
+/*
+Upstream describes a real SMTP server that captured mail can be relayed to.
+If UserName is set the relay authenticates with AUTH PLAIN, which requires
+StartTLS unless the server is on localhost. InsecureSkipVerify turns off
+certificate checks for servers with self-signed certificates.
+*/
+type Upstream struct {
+	Name               string
+	Host               string
+	Port               int
+	UserName           string
+	Password           string
+	StartTLS           bool
+	InsecureSkipVerify bool
+}
+
+/*
+Returns the host and port of the upstream server.
+*/
+func (upstream Upstream) Address() string {
+	return net.JoinHostPort(upstream.Host, strconv.Itoa(upstream.Port))
+}
+
+/*
+Sends a message to an upstream server. The message is the raw source of
+a mail item, exactly as it was captured. from and to are the envelope
+sender and recipients and may include angle brackets. The conversation
+fails if it takes longer than SEND_TIMEOUT_SECONDS.
+*/
+func Send(upstream Upstream, from string, to []string, message string) error {
+	if len(to) <= 0 {
+		return fmt.Errorf("No recipients to relay to")
+	}
+
+	connection, err := net.DialTimeout("tcp", upstream.Address(), DIAL_TIMEOUT_SECONDS*time.Second)
+	if err != nil {
+		return err
+	}
+
+	/*
+	 * An upstream server that stops responding must not hold up
+	 * the caller forever
+	 */
+	connection.SetDeadline(time.Now().Add(SEND_TIMEOUT_SECONDS * time.Second))
+
+	client, err := smtp.NewClient(connection, upstream.Host)
+	if err != nil {
+		connection.Close()
+		return err
+	}
+
+	defer client.Close()
+
+	if upstream.StartTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("%s does not support STARTTLS", upstream.Address())
+		}
+
+		err = client.StartTLS(&tls.Config{ServerName: upstream.Host, InsecureSkipVerify: upstream.InsecureSkipVerify})
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(upstream.UserName) > 0 {
+		err = client.Auth(smtp.PlainAuth("", upstream.UserName, upstream.Password, upstream.Host))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = client.Mail(EnvelopeAddress(from))
+	if err != nil {
+		return err
+	}
+
+	for _, recipient := range to {
+		err = client.Rcpt(EnvelopeAddress(recipient))
+		if err != nil {
+			return err
+		}
+	}
+
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+
+	/*
+	 * Captured raw sources stop short of the CRLF before the
+	 * terminating dot, so put it back.
+	 */
+	if !strings.HasSuffix(message, "\r\n") {
+		message += "\r\n"
+	}
+
+	_, err = writer.Write([]byte(message))
+	if err != nil {
+		writer.Close()
+		return err
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
+
+/*
+Strips a stored address such as "Bob <bob@example.com>" or
+"<bob@example.com>" down to the bare address used in MAIL FROM
+and RCPT TO.
+*/
+func EnvelopeAddress(address string) string {
+	parsed, err := mail.ParseAddress(address)
+	if err == nil {
+		return parsed.Address
+	}
+
+	return strings.Trim(strings.TrimSpace(address), "<>")
+}
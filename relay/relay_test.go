@@ -0,0 +1,101 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package relay_test
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adampresley/mailslurper/relay"
+	"github.com/adampresley/mailslurper/smtptest"
+)
+
+func upstreamFor(t *testing.T, server *smtptest.Server) relay.Upstream {
+	host, port, err := net.SplitHostPort(server.Address)
+	if err != nil {
+		t.Fatalf("Unable to split address %s: %s", server.Address, err)
+	}
+
+	portNumber, _ := strconv.Atoi(port)
+	return relay.Upstream{Name: "stand-in", Host: host, Port: portNumber}
+}
+
+func TestSend(t *testing.T) {
+	server := smtptest.NewServer()
+	defer server.Close()
+
+	message := "From: sender@example.com\r\nSubject: Released\r\n\r\nFirst line\r\n.Line starting with a dot\r\nLast line"
+
+	err := relay.Send(upstreamFor(t, server), "Sender <sender@example.com>", []string{"<one@example.com>", "two@example.com"}, message)
+	if err != nil {
+		t.Fatalf("Send failed: %s", err)
+	}
+
+	mailItem, ok := server.WaitForMail(5 * time.Second)
+	if !ok {
+		t.Fatal("The upstream server did not receive the message")
+	}
+
+	if mailItem.FromAddress != "<sender@example.com>" {
+		t.Errorf("Expected envelope sender <sender@example.com>, got %q", mailItem.FromAddress)
+	}
+
+	if strings.Join(mailItem.ToAddresses, ",") != "<one@example.com>,<two@example.com>" {
+		t.Errorf("Expected both recipients, got %v", mailItem.ToAddresses)
+	}
+
+	if mailItem.Subject != "Released" {
+		t.Errorf("Expected subject Released, got %q", mailItem.Subject)
+	}
+
+	if !strings.HasSuffix(mailItem.RawSource, "\r\n\r\nFirst line\r\n.Line starting with a dot\r\nLast line") {
+		t.Errorf("Expected the message to arrive unchanged, got %q", mailItem.RawSource)
+	}
+}
+
+func TestSendWithoutRecipients(t *testing.T) {
+	server := smtptest.NewServer()
+	defer server.Close()
+
+	if err := relay.Send(upstreamFor(t, server), "sender@example.com", nil, "Subject: Nobody\r\n\r\nHello"); err == nil {
+		t.Error("Expected an error when there are no recipients")
+	}
+}
+
+func TestSendRequiresStartTLS(t *testing.T) {
+	server := smtptest.NewServer()
+	defer server.Close()
+
+	upstream := upstreamFor(t, server)
+	upstream.StartTLS = true
+
+	err := relay.Send(upstream, "sender@example.com", []string{"user@example.com"}, "Subject: Secure\r\n\r\nHello")
+	if err == nil || !strings.Contains(err.Error(), "STARTTLS") {
+		t.Errorf("Expected an error as the server does not offer STARTTLS, got %v", err)
+	}
+
+	if received := server.Received(); len(received) != 0 {
+		t.Errorf("Expected nothing to be sent, got %d mail items", len(received))
+	}
+}
+
+func TestEnvelopeAddress(t *testing.T) {
+	tests := map[string]string{
+		"bob@example.com":                  "bob@example.com",
+		"<bob@example.com>":                "bob@example.com",
+		"Bob Smith <bob@example.com>":      "bob@example.com",
+		" <bob@example.com> ":              "bob@example.com",
+		"\"Smith, Bob\" <bob@example.com>": "bob@example.com",
+	}
+
+	for address, expected := range tests {
+		if result := relay.EnvelopeAddress(address); result != expected {
+			t.Errorf("EnvelopeAddress(%q) = %q, expected %q", address, result, expected)
+		}
+	}
+}
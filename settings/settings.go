@@ -18,7 +18,7 @@ var flagWWW = flag.String("www", "", "Path to the web administrator directory.")
 var flagWWWPort = flag.Int("wwwport", 0, "Port number to bind to for WWW administrator.")
 var flagSmtpAddress = flag.String("smtpaddress", "", "Address to bind the SMTP server to.")
 var flagSmtpPort = flag.Int("smtpport", 0, "Port number to bind to for SMTP server.")
-var flagDBEngine = flag.String("dbengine", "", "Database engine for storage: sqlite, mysql, mssql")
+var flagDBEngine = flag.String("dbengine", "", "Database engine for storage: sqlite, memory, mysql, mssql")
 var flagDBHost = flag.String("dbhost", "", "Host name of database server (does not apply to sqlite)")
 var flagDBPort = flag.String("dbport", "", "Port number database server runs on (does not apply to sqlite)")
 var flagDBDatabase = flag.String("dbdatabase", "", "Name of database for storage (does not apply to sqlite)")
@@ -39,6 +39,166 @@ type Configuration struct {
 	DBDatabase  string  `json:"dbDatabase"`
 	DBUserName  string  `json:"dbUserName"`
 	DBPassword  string  `json:"dbPassword"`
+
+	MaxMessageSize float64 `json:"maxMessageSize"`
+	MaxRecipients  float64 `json:"maxRecipients"`
+	Chunking       bool    `json:"chunking"`
+	SmtpMode       string  `json:"smtpMode"`
+
+	Listeners []ListenerConfiguration `json:"listeners"`
+
+	Vrfy VrfyConfiguration `json:"vrfy"`
+
+	Webhooks []WebhookConfiguration `json:"webhooks"`
+	Relays   []RelayConfiguration   `json:"relays"`
+
+	RelayRules []RelayRuleConfiguration   `json:"relayRules"`
+	Faults     []FaultRuleConfiguration   `json:"faults"`
+	Latency    []LatencyRuleConfiguration `json:"latency"`
+
+	Greylisting GreylistConfiguration `json:"greylisting"`
+	Limits      LimitsConfiguration   `json:"limits"`
+}
+
+/*
+Describes an address the SMTP server listens on. Network is "tcp",
+"tcp4", "tcp6" or "unix". For TCP, Address is the host or IP to bind
+to and Port the port; for "unix", Address is the socket file path. TLS
+is "none", "starttls" or "implicit", and the last two need CertFile and
+KeyFile. Extensions limits the extensions advertised in reply to EHLO;
+leave it out to offer them all.
+*/
+type ListenerConfiguration struct {
+	Name       string   `json:"name"`
+	Network    string   `json:"network,omitempty"`
+	Address    string   `json:"address"`
+	Port       float64  `json:"port,omitempty"`
+	TLS        string   `json:"tls,omitempty"`
+	CertFile   string   `json:"certFile,omitempty"`
+	KeyFile    string   `json:"keyFile,omitempty"`
+	Extensions []string `json:"extensions,omitempty"`
+}
+
+/*
+Describes a URL that is sent a JSON POST each time a mail item is
+received. To and From are optional address wildcard patterns, such
+as "*@example.com", and Subject is an optional regular expression. If
+Secret is set each request is signed with an HMAC-SHA256 of the body.
+Failed deliveries are tried up to MaxAttempts times, waiting
+RetryDelaySeconds before the first retry and doubling after that.
+*/
+type WebhookConfiguration struct {
+	Name              string  `json:"name"`
+	URL               string  `json:"url"`
+	Secret            string  `json:"secret,omitempty"`
+	To                string  `json:"to,omitempty"`
+	From              string  `json:"from,omitempty"`
+	Subject           string  `json:"subject,omitempty"`
+	MaxAttempts       int     `json:"maxAttempts,omitempty"`
+	RetryDelaySeconds float64 `json:"retryDelaySeconds,omitempty"`
+}
+
+/*
+Describes a real SMTP server that captured mail items can be released
+to. UserName and Password are only needed if the server requires AUTH.
+Set StartTLS to upgrade the connection before authenticating.
+*/
+type RelayConfiguration struct {
+	Name               string  `json:"name"`
+	Host               string  `json:"host"`
+	Port               float64 `json:"port"`
+	UserName           string  `json:"userName,omitempty"`
+	Password           string  `json:"password,omitempty"`
+	StartTLS           bool    `json:"startTLS,omitempty"`
+	InsecureSkipVerify bool    `json:"insecureSkipVerify,omitempty"`
+}
+
+/*
+Forwards newly received mail through one of the configured relays.
+To and From are optional address wildcard patterns; only recipients
+matching To are forwarded. RewriteTo optionally replaces each forwarded
+recipient and may use {local} and {domain} from the original address.
+*/
+type RelayRuleConfiguration struct {
+	Name      string `json:"name"`
+	To        string `json:"to,omitempty"`
+	From      string `json:"from,omitempty"`
+	Relay     string `json:"relay"`
+	RewriteTo string `json:"rewriteTo,omitempty"`
+}
+
+/*
+Makes an SMTP command fail with a chosen reply code. Stage is one of
+"connect", "helo", "mail", "rcpt", "data" or "message". To and From are
+optional address wildcard patterns. Probability, from 0 to 1, is the
+chance a matching command fails, where 0 means always. EveryNth only
+fails every Nth matching command.
+*/
+type FaultRuleConfiguration struct {
+	Name        string  `json:"name"`
+	Stage       string  `json:"stage"`
+	To          string  `json:"to,omitempty"`
+	From        string  `json:"from,omitempty"`
+	Probability float64 `json:"probability,omitempty"`
+	EveryNth    int     `json:"everyNth,omitempty"`
+	Code        int     `json:"code"`
+	Message     string  `json:"message,omitempty"`
+}
+
+/*
+Slows down or drops SMTP sessions. To and From are optional address
+wildcard patterns; leave both out for a global rule. Delays are in
+milliseconds and hold back the greeting, each RCPT TO reply and the
+reply after the DATA terminator. The drop percentages, from 0 to 100,
+are the chance the connection is closed while the message is being
+sent or once it has arrived.
+*/
+type LatencyRuleConfiguration struct {
+	Name                      string  `json:"name"`
+	To                        string  `json:"to,omitempty"`
+	From                      string  `json:"from,omitempty"`
+	GreetingDelayMilliseconds int     `json:"greetingDelayMilliseconds,omitempty"`
+	RcptDelayMilliseconds     int     `json:"rcptDelayMilliseconds,omitempty"`
+	MessageDelayMilliseconds  int     `json:"messageDelayMilliseconds,omitempty"`
+	DropDuringDataPercent     float64 `json:"dropDuringDataPercent,omitempty"`
+	DropAfterMessagePercent   float64 `json:"dropAfterMessagePercent,omitempty"`
+}
+
+/*
+Turns on greylisting. The first attempt to send from a client IP and
+sender to a recipient is refused with a 451, and retries are accepted
+once DelaySeconds have passed. Triplets are forgotten ExpirySeconds
+after they were first seen, or last seen once passed. Zero uses the
+default of four hours.
+*/
+type GreylistConfiguration struct {
+	Enabled       bool    `json:"enabled"`
+	DelaySeconds  float64 `json:"delaySeconds"`
+	ExpirySeconds float64 `json:"expirySeconds,omitempty"`
+}
+
+/*
+Protects the SMTP server from clients that connect or send too much.
+MaxConnections is the most connections handled at once. The per-minute
+limits are counted for each client IP. Connections over a limit are
+refused with a 421, and MAIL FROM with a 450 once a client has sent
+MessagesPerMinute messages. Zero means no limit.
+*/
+type LimitsConfiguration struct {
+	MaxConnections       int `json:"maxConnections"`
+	ConnectionsPerMinute int `json:"connectionsPerMinute"`
+	MessagesPerMinute    int `json:"messagesPerMinute"`
+}
+
+/*
+Sets how the VRFY and EXPN commands are answered. Mode is "always",
+which replies 252 without saying whether an address exists, "known",
+which checks addresses against the KnownRecipients wildcard patterns,
+or "disabled".
+*/
+type VrfyConfiguration struct {
+	Mode            string   `json:"mode"`
+	KnownRecipients []string `json:"knownRecipients,omitempty"`
 }
 
 var Config Configuration
@@ -144,7 +304,7 @@ Renders a view to the HTTP response stream
 */
 func (c *Configuration) RenderView(writer http.ResponseWriter, fileName string) {
 	body := fmt.Sprintf("%s%s%s", c.Header, c.loadView(fileName), c.Footer)
-	fmt.Fprintf(writer, body)
+	writer.Write([]byte(body))
 }
 
 /*
@@ -163,6 +323,19 @@ func (c *Configuration) SaveSettings(configFile string) error {
 	config["dbDatabase"] = c.DBDatabase
 	config["dbUserName"] = c.DBUserName
 	config["dbPassword"] = c.DBPassword
+	config["maxMessageSize"] = c.MaxMessageSize
+	config["maxRecipients"] = c.MaxRecipients
+	config["chunking"] = c.Chunking
+	config["smtpMode"] = c.SmtpMode
+	config["listeners"] = c.Listeners
+	config["vrfy"] = c.Vrfy
+	config["webhooks"] = c.Webhooks
+	config["relays"] = c.Relays
+	config["relayRules"] = c.RelayRules
+	config["faults"] = c.Faults
+	config["latency"] = c.Latency
+	config["greylisting"] = c.Greylisting
+	config["limits"] = c.Limits
 
 	json, err := json.Marshal(config)
 	if err != nil {
@@ -182,11 +355,9 @@ Takes a byte array of JSON serialized data and writes it to
 the HTTP response stream.
 */
 func (c *Configuration) WriteJson(writer http.ResponseWriter, jsonData []byte) {
-	content := string(jsonData)
-
 	writer.Header().Add("Content-Type", "application/json")
-	writer.Header().Add("Content-Length", strconv.Itoa(len(content)))
-	fmt.Fprintf(writer, string(jsonData))
+	writer.Header().Add("Content-Length", strconv.Itoa(len(jsonData)))
+	writer.Write(jsonData)
 }
 
 func (c *Configuration) loadView(viewFileName string) string {
@@ -0,0 +1,128 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package smtp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Values of the BODY parameter on MAIL FROM (RFC 6152 and RFC 3030)
+const (
+	BODY_7BIT       = "7BIT"
+	BODY_8BITMIME   = "8BITMIME"
+	BODY_BINARYMIME = "BINARYMIME"
+)
+
+/*
+Returns what follows the colon in a command such as "MAIL FROM:<a@b.com>".
+Spaces around the colon are allowed. False is returned if the command is
+not followed by a colon.
+*/
+func commandArgument(line string, command string) (string, bool) {
+	index := strings.Index(strings.ToLower(line), command)
+	if index < 0 {
+		return "", false
+	}
+
+	rest := strings.TrimSpace(line[index+len(command):])
+	if !strings.HasPrefix(rest, ":") {
+		return "", false
+	}
+
+	return strings.TrimSpace(rest[1:]), true
+}
+
+/*
+Splits the argument of a MAIL FROM or RCPT TO command into the
+address and its ESMTP parameters, such as "SIZE=1024". Parameter
+names are returned upper case. The address keeps any angle brackets.
+*/
+func splitPathAndParameters(argument string) (string, map[string]string) {
+	argument = strings.TrimSpace(argument)
+	parameters := make(map[string]string)
+
+	path, rest := argument, ""
+	if strings.HasPrefix(argument, "<") {
+		if end := strings.Index(argument, ">"); end > -1 {
+			path, rest = argument[:end+1], argument[end+1:]
+		}
+	} else if end := strings.IndexAny(argument, " \t"); end > -1 {
+		path, rest = argument[:end], argument[end:]
+	}
+
+	for _, parameter := range strings.Fields(rest) {
+		name, value := parameter, ""
+		if index := strings.Index(parameter, "="); index > -1 {
+			name, value = parameter[:index], parameter[index+1:]
+		}
+
+		parameters[strings.ToUpper(name)] = value
+	}
+
+	return path, parameters
+}
+
+/*
+Checks the parameters given to MAIL FROM. SIZE, BODY and SMTPUTF8 are
+understood. BODY=BINARYMIME is only allowed when chunking is on, as such
+messages can only be sent with BDAT. An empty string is returned if they
+are all valid, otherwise the reply to refuse the command with. The SIZE
+limit itself is checked by the parser.
+*/
+func checkMailParameters(parameters map[string]string, chunking bool) string {
+	for name, value := range parameters {
+		switch name {
+		case "SIZE":
+			if size, err := strconv.Atoi(value); err != nil || size < 0 {
+				return "501 5.5.4 Invalid SIZE parameter"
+			}
+
+		case "BODY":
+			switch strings.ToUpper(value) {
+			case BODY_7BIT, BODY_8BITMIME:
+			case BODY_BINARYMIME:
+				if !chunking {
+					return "501 5.5.4 BODY=BINARYMIME requires CHUNKING"
+				}
+
+			default:
+				return fmt.Sprintf("501 5.5.4 BODY=%s not supported", value)
+			}
+
+		case "SMTPUTF8":
+			if len(value) > 0 {
+				return "501 5.5.4 SMTPUTF8 does not take a value"
+			}
+
+		default:
+			return fmt.Sprintf("555 5.5.4 MAIL FROM parameter %s not supported", name)
+		}
+	}
+
+	return ""
+}
+
+/*
+Checks an address can be used in the current transaction. Addresses
+with characters outside ASCII, such as 用户@例子.测试, are only allowed
+when the client has asked for SMTPUTF8 (RFC 6531). An empty string is
+returned if the address is fine, otherwise the reply to refuse it with.
+*/
+func checkAddressEncoding(address string, smtpUTF8 bool) string {
+	if !utf8.ValidString(address) {
+		return "553 5.6.7 Address is not valid UTF-8"
+	}
+
+	for _, character := range address {
+		if character >= utf8.RuneSelf && !smtpUTF8 {
+			return "553 5.6.7 Non-ASCII addresses require SMTPUTF8"
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,170 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package smtp
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCommandArgument(t *testing.T) {
+	tests := []struct {
+		line     string
+		expected string
+		ok       bool
+	}{
+		{"MAIL FROM:<bob@example.com>", "<bob@example.com>", true},
+		{"mail from : <bob@example.com> SIZE=10", "<bob@example.com> SIZE=10", true},
+		{"MAIL FROM:<>", "<>", true},
+		{"MAIL FROM <bob@example.com>", "", false},
+		{"RCPT TO:<bob@example.com>", "", false},
+	}
+
+	for _, test := range tests {
+		result, ok := commandArgument(test.line, "mail from")
+		if result != test.expected || ok != test.ok {
+			t.Errorf("commandArgument(%q) = %q, %v, expected %q, %v", test.line, result, ok, test.expected, test.ok)
+		}
+	}
+}
+
+func TestSplitPathAndParameters(t *testing.T) {
+	tests := []struct {
+		argument   string
+		path       string
+		parameters map[string]string
+	}{
+		{"<bob@example.com>", "<bob@example.com>", map[string]string{}},
+		{"  <bob@example.com>  ", "<bob@example.com>", map[string]string{}},
+		{"<bob@example.com> SIZE=1024", "<bob@example.com>", map[string]string{"SIZE": "1024"}},
+		{"<bob@example.com> body=8bitmime smtputf8", "<bob@example.com>", map[string]string{"BODY": "8bitmime", "SMTPUTF8": ""}},
+		{"<\"bob smith\"@example.com> SIZE=1", "<\"bob smith\"@example.com>", map[string]string{"SIZE": "1"}},
+		{"bob@example.com SIZE=1", "bob@example.com", map[string]string{"SIZE": "1"}},
+		{"<>", "<>", map[string]string{}},
+	}
+
+	for _, test := range tests {
+		path, parameters := splitPathAndParameters(test.argument)
+		if path != test.path || !reflect.DeepEqual(parameters, test.parameters) {
+			t.Errorf("splitPathAndParameters(%q) = %q, %v, expected %q, %v", test.argument, path, parameters, test.path, test.parameters)
+		}
+	}
+}
+
+func TestCheckMailParameters(t *testing.T) {
+	tests := []struct {
+		parameters map[string]string
+		chunking   bool
+		expected   string
+	}{
+		{map[string]string{}, false, ""},
+		{map[string]string{"SIZE": "1024"}, false, ""},
+		{map[string]string{"SIZE": "-1"}, false, "501"},
+		{map[string]string{"SIZE": "big"}, false, "501"},
+		{map[string]string{"BODY": "8BITMIME"}, false, ""},
+		{map[string]string{"BODY": "7bit"}, false, ""},
+		{map[string]string{"BODY": "BINARYMIME"}, false, "501"},
+		{map[string]string{"BODY": "BINARYMIME"}, true, ""},
+		{map[string]string{"SMTPUTF8": ""}, false, ""},
+		{map[string]string{"SMTPUTF8": "yes"}, false, "501"},
+		{map[string]string{"RET": "HDRS"}, false, "555"},
+	}
+
+	for _, test := range tests {
+		if result := checkMailParameters(test.parameters, test.chunking); !strings.HasPrefix(result, test.expected) || (len(test.expected) == 0 && len(result) > 0) {
+			t.Errorf("checkMailParameters(%v) = %q, expected a %q reply", test.parameters, result, test.expected)
+		}
+	}
+}
+
+func TestCheckAddressEncoding(t *testing.T) {
+	tests := []struct {
+		address  string
+		smtpUTF8 bool
+		expected string
+	}{
+		{"<bob@example.com>", false, ""},
+		{"<bob@example.com>", true, ""},
+		{"<用户@例子.测试>", false, "553"},
+		{"<用户@例子.测试>", true, ""},
+		{"<bob@ex\xffample.com>", true, "553"},
+	}
+
+	for _, test := range tests {
+		if result := checkAddressEncoding(test.address, test.smtpUTF8); !strings.HasPrefix(result, test.expected) || (len(test.expected) == 0 && len(result) > 0) {
+			t.Errorf("checkAddressEncoding(%q, %v) = %q, expected a %q reply", test.address, test.smtpUTF8, result, test.expected)
+		}
+	}
+}
+
+func TestParserRunMailParameters(t *testing.T) {
+	tests := []struct {
+		name     string
+		script   []sessionStep
+		bodyType string
+		smtpUTF8 bool
+	}{
+		{
+			name: "8BITMIME",
+			script: []sessionStep{
+				{"MAIL FROM:<sender@example.com> BODY=8BITMIME", "250"},
+				{"RCPT TO:<bob@example.com>", "250"},
+			},
+			bodyType: BODY_8BITMIME,
+		},
+		{
+			name: "7BIT",
+			script: []sessionStep{
+				{"MAIL FROM:<sender@example.com> BODY=7bit", "250"},
+			},
+			bodyType: BODY_7BIT,
+		},
+		{
+			name: "SMTPUTF8",
+			script: []sessionStep{
+				{"MAIL FROM:<发件人@例子.测试> SMTPUTF8", "250"},
+				{"RCPT TO:<用户@例子.测试>", "250"},
+			},
+			smtpUTF8: true,
+		},
+		{
+			name: "non-ASCII without SMTPUTF8",
+			script: []sessionStep{
+				{"MAIL FROM:<发件人@例子.测试>", "553"},
+				{"MAIL FROM:<sender@example.com>", "250"},
+				{"RCPT TO:<用户@例子.测试>", "553"},
+			},
+		},
+		{
+			name: "unknown parameters",
+			script: []sessionStep{
+				{"MAIL FROM:<sender@example.com> RET=HDRS", "555"},
+				{"MAIL FROM:<sender@example.com>", "250"},
+				{"RCPT TO:<bob@example.com> NOTIFY=NEVER", "555"},
+			},
+		},
+		{
+			name: "missing colon",
+			script: []sessionStep{
+				{"MAIL FROM <sender@example.com>", "501"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		parser := &Parser{}
+		session := startTestSession(t, parser)
+
+		session.run([]sessionStep{{"", "220"}, {"EHLO localhost", "250"}})
+		session.run(test.script)
+		session.run([]sessionStep{{"QUIT", "221"}})
+		session.close()
+
+		if parser.MailItem.BodyType != test.bodyType || parser.MailItem.SMTPUTF8 != test.smtpUTF8 {
+			t.Errorf("%s: expected body type %q and SMTPUTF8 %v, got %q and %v", test.name, test.bodyType, test.smtpUTF8, parser.MailItem.BodyType, parser.MailItem.SMTPUTF8)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package smtp
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Modes the parser can check commands in. Lenient mode accepts the
+// sloppy commands many clients send, such as addresses without angle
+// brackets or MAIL FROM before HELO. Strict mode holds clients to RFC
+// 5321 and refuses anything else with a 5xx reply, so protocol bugs in
+// a mailer show up in testing.
+const (
+	SMTP_MODE_LENIENT = "lenient"
+	SMTP_MODE_STRICT  = "strict"
+)
+
+// Longest command line allowed in strict mode, including the CRLF
+const MAX_COMMAND_LINE_LEN = 512
+
+var strictCommandSyntax = map[int]*regexp.Regexp{
+	HELO:     regexp.MustCompile(`(?i)^(HELO|EHLO) [^ ]+$`),
+	MAIL:     regexp.MustCompile(`(?i)^MAIL FROM:<([^<> ]+@[^<> @]+)?>( [^ ]+)*$`),
+	RCPT:     regexp.MustCompile(`(?i)^RCPT TO:<([^<> ]+@[^<> @]+|postmaster)>( [^ ]+)*$`),
+	DATA:     regexp.MustCompile(`(?i)^DATA$`),
+	BDAT:     regexp.MustCompile(`(?i)^BDAT [0-9]+( LAST)?$`),
+	RSET:     regexp.MustCompile(`(?i)^RSET$`),
+	QUIT:     regexp.MustCompile(`(?i)^QUIT$`),
+	NOOP:     regexp.MustCompile(`(?i)^NOOP( .*)?$`),
+	VRFY:     regexp.MustCompile(`(?i)^VRFY .+$`),
+	EXPN:     regexp.MustCompile(`(?i)^EXPN .+$`),
+	HELP:     regexp.MustCompile(`(?i)^HELP( [^ ]+)?$`),
+	STARTTLS: regexp.MustCompile(`(?i)^STARTTLS$`),
+	AUTH:     regexp.MustCompile(`(?i)^AUTH [A-Z0-9_-]+( ([A-Za-z0-9+/]+=*|=))?$`),
+}
+
+var strictCommandUsage = map[int]string{
+	HELO:     "HELO hostname",
+	MAIL:     "MAIL FROM:<address>",
+	RCPT:     "RCPT TO:<address>",
+	DATA:     "DATA",
+	BDAT:     "BDAT <size> [LAST]",
+	RSET:     "RSET",
+	QUIT:     "QUIT",
+	NOOP:     "NOOP",
+	VRFY:     "VRFY <address>",
+	EXPN:     "EXPN <list>",
+	HELP:     "HELP [command]",
+	STARTTLS: "STARTTLS",
+	AUTH:     "AUTH mechanism [initial-response]",
+}
+
+/*
+Checks the syntax of a command line. Both modes refuse commands that
+are not recognized. Strict mode also requires lines to end with CRLF,
+be no longer than MAX_COMMAND_LINE_LEN, and match the grammar of RFC
+5321. An empty string is returned if the line is fine, otherwise the
+reply to refuse it with.
+*/
+func checkCommandSyntax(command int, line string, strict bool) string {
+	if command < 0 {
+		return "500 5.5.2 Unrecognized command"
+	}
+
+	if !strict {
+		return ""
+	}
+
+	if !strings.HasSuffix(line, "\r\n") {
+		return "500 5.5.2 Syntax error, commands must end with CRLF"
+	}
+
+	if len(line) > MAX_COMMAND_LINE_LEN {
+		return "500 5.5.2 Line too long"
+	}
+
+	if pattern, ok := strictCommandSyntax[command]; ok && !pattern.MatchString(strings.TrimSuffix(line, "\r\n")) {
+		return "501 5.5.4 Syntax: " + strictCommandUsage[command]
+	}
+
+	return ""
+}
+
+/*
+Checks a command is allowed at this point in the session. Strict mode
+requires HELO or EHLO before MAIL FROM, MAIL FROM before RCPT TO, a
+recipient before DATA, only one MAIL FROM per transaction, and EHLO
+before AUTH, which is not allowed during a transaction. Lenient
+mode allows any order. BDAT is not checked here, as its chunk has to be
+read before it can be refused. An empty string is returned if the
+command is allowed, otherwise the reply to refuse it with.
+*/
+func (parser *Parser) checkCommandSequence(command int) string {
+	if !parser.Strict {
+		return ""
+	}
+
+	switch command {
+	case MAIL:
+		if !parser.greeted {
+			return "503 5.5.1 Send HELO or EHLO first"
+		}
+
+		if parser.inTransaction {
+			return "503 5.5.1 Sender already given"
+		}
+
+	case RCPT:
+		if !parser.inTransaction {
+			return "503 5.5.1 Need MAIL FROM before RCPT TO"
+		}
+
+	case DATA:
+		if !parser.inTransaction || len(parser.MailItem.ToAddresses) <= 0 {
+			return "503 5.5.1 Need RCPT TO first"
+		}
+
+	case AUTH:
+		if !parser.greeted || !parser.extended {
+			return "503 5.5.1 Send EHLO first"
+		}
+
+		if parser.inTransaction {
+			return "503 5.5.1 AUTH not allowed during a mail transaction"
+		}
+	}
+
+	return ""
+}
+
+/*
+Splits the first command line off data read from the client, keeping
+the rest pending so pipelined commands are handled one at a time. In
+strict mode a line is only complete once its line feed has arrived; in
+lenient mode whatever has arrived is taken as the line.
+*/
+func (parser *Parser) nextCommandLine(raw string) (string, bool) {
+	index := strings.Index(raw, "\n")
+	if index < 0 {
+		if parser.Strict || len(raw) <= 0 {
+			parser.pending = raw
+			return "", false
+		}
+
+		return raw, true
+	}
+
+	parser.pending = raw[index+1:]
+	return raw[:index+1], true
+}
@@ -0,0 +1,238 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package smtp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseCommand(t *testing.T) {
+	tests := map[string]int{
+		"HELO localhost\r\n":                HELO,
+		"ehlo localhost\r\n":                HELO,
+		"MAIL FROM:<bob@example.com>\r\n":   MAIL,
+		"RCPT TO:<bob@example.com>\r\n":     RCPT,
+		"DATA\r\n":                          DATA,
+		"BDAT 5 LAST\r\nHello":              BDAT,
+		"  quit  \r\n":                      QUIT,
+		"DATABASE\r\n":                      -1,
+		"X-MAIL FROM:<bob@example.com>\r\n": -1,
+		"\r\n":                              -1,
+	}
+
+	parser := &Parser{}
+
+	for line, expected := range tests {
+		if result := parser.ParseCommand(line); result != expected {
+			t.Errorf("ParseCommand(%q) = %d, expected %d", line, result, expected)
+		}
+	}
+}
+
+func TestCheckCommandSyntax(t *testing.T) {
+	tests := []struct {
+		command int
+		line    string
+		strict  string
+		lenient string
+	}{
+		{-1, "FOO\r\n", "500", "500"},
+		{HELO, "HELO localhost\r\n", "", ""},
+		{HELO, "HELO localhost\n", "500", ""},
+		{HELO, "HELO\r\n", "501", ""},
+		{MAIL, "MAIL FROM:<bob@example.com>\r\n", "", ""},
+		{MAIL, "MAIL FROM:<>\r\n", "", ""},
+		{MAIL, "MAIL FROM:<bob@example.com> SIZE=10\r\n", "", ""},
+		{MAIL, "MAIL FROM:bob@example.com\r\n", "501", ""},
+		{MAIL, "MAIL FROM: <bob@example.com>\r\n", "501", ""},
+		{RCPT, "RCPT TO:<bob@example.com>\r\n", "", ""},
+		{RCPT, "RCPT TO:<postmaster>\r\n", "", ""},
+		{RCPT, "RCPT TO:<bob>\r\n", "501", ""},
+		{DATA, "DATA\r\n", "", ""},
+		{DATA, "DATA now\r\n", "501", ""},
+		{BDAT, "BDAT 10 LAST\r\n", "", ""},
+		{QUIT, "QUIT\r\n", "", ""},
+		{MAIL, "MAIL FROM:<" + strings.Repeat("a", MAX_COMMAND_LINE_LEN) + "@example.com>\r\n", "500", ""},
+	}
+
+	for _, test := range tests {
+		if result := checkCommandSyntax(test.command, test.line, true); !strings.HasPrefix(result, test.strict) || (len(test.strict) == 0 && len(result) > 0) {
+			t.Errorf("Strict checkCommandSyntax(%q) = %q, expected a %q reply", test.line, result, test.strict)
+		}
+
+		if result := checkCommandSyntax(test.command, test.line, false); !strings.HasPrefix(result, test.lenient) || (len(test.lenient) == 0 && len(result) > 0) {
+			t.Errorf("Lenient checkCommandSyntax(%q) = %q, expected a %q reply", test.line, result, test.lenient)
+		}
+	}
+}
+
+func TestNextCommandLine(t *testing.T) {
+	tests := []struct {
+		strict   bool
+		raw      string
+		line     string
+		complete bool
+		pending  string
+	}{
+		{true, "HELO a\r\nMAIL FROM:<b@c.d>\r\n", "HELO a\r\n", true, "MAIL FROM:<b@c.d>\r\n"},
+		{true, "HELO a", "", false, "HELO a"},
+		{false, "HELO a", "HELO a", true, ""},
+		{false, "", "", false, ""},
+	}
+
+	for _, test := range tests {
+		parser := &Parser{Strict: test.strict}
+
+		line, complete := parser.nextCommandLine(test.raw)
+		if line != test.line || complete != test.complete || parser.pending != test.pending {
+			t.Errorf("nextCommandLine(%q) in strict %v = %q, %v with %q pending, expected %q, %v with %q pending", test.raw, test.strict, line, complete, parser.pending, test.line, test.complete, test.pending)
+		}
+	}
+}
+
+func TestParserRunCommandSequence(t *testing.T) {
+	tests := []struct {
+		name    string
+		send    []string
+		strict  []string
+		lenient []string
+	}{
+		{
+			name:    "MAIL FROM before HELO",
+			send:    []string{"MAIL FROM:<sender@example.com>"},
+			strict:  []string{"503"},
+			lenient: []string{"250"},
+		},
+		{
+			name:    "RCPT TO before MAIL FROM",
+			send:    []string{"HELO localhost", "RCPT TO:<bob@example.com>"},
+			strict:  []string{"250", "503"},
+			lenient: []string{"250", "250"},
+		},
+		{
+			name:    "DATA without recipients",
+			send:    []string{"HELO localhost", "MAIL FROM:<sender@example.com>", "DATA"},
+			strict:  []string{"250", "250", "503"},
+			lenient: []string{"250", "250", "354"},
+		},
+		{
+			name:    "second MAIL FROM in a transaction",
+			send:    []string{"HELO localhost", "MAIL FROM:<sender@example.com>", "MAIL FROM:<other@example.com>"},
+			strict:  []string{"250", "250", "503"},
+			lenient: []string{"250", "250", "250"},
+		},
+		{
+			name:    "MAIL FROM after RSET",
+			send:    []string{"HELO localhost", "MAIL FROM:<sender@example.com>", "RSET", "MAIL FROM:<other@example.com>"},
+			strict:  []string{"250", "250", "250", "250"},
+			lenient: []string{"250", "250", "250", "250"},
+		},
+		{
+			name:    "bare address",
+			send:    []string{"HELO localhost", "MAIL FROM:sender@example.com"},
+			strict:  []string{"250", "501"},
+			lenient: []string{"250", "250"},
+		},
+		{
+			name:    "unknown command",
+			send:    []string{"HELO localhost", "TURN"},
+			strict:  []string{"250", "500"},
+			lenient: []string{"250", "500"},
+		},
+	}
+
+	for _, test := range tests {
+		for _, strict := range []bool{true, false} {
+			expected := test.lenient
+			if strict {
+				expected = test.strict
+			}
+
+			parser := &Parser{Strict: strict}
+			session := startTestSession(t, parser)
+			session.expect("220")
+
+			for index, line := range test.send {
+				session.send(line)
+
+				if reply := session.expect(""); !strings.HasPrefix(reply, expected[index]) {
+					t.Errorf("%s in strict %v: expected %q to get %s, got %q", test.name, strict, line, expected[index], reply)
+				}
+			}
+
+			/*
+			 * A lenient DATA is waiting for content
+			 */
+			if strings.HasSuffix(test.send[len(test.send)-1], "DATA") && !strict {
+				session.send("Subject: Hello\r\n\r\nHello\r\n.")
+				session.expect("250")
+			}
+
+			session.run([]sessionStep{{"QUIT", "221"}})
+			session.close()
+		}
+	}
+}
+
+func TestParserRunMailAfterData(t *testing.T) {
+	for _, strict := range []bool{true, false} {
+		parser := &Parser{Strict: strict}
+		session := startTestSession(t, parser)
+
+		session.run([]sessionStep{
+			{"", "220"},
+			{"EHLO localhost", "250"},
+			{"MAIL FROM:<sender@example.com>", "250"},
+			{"RCPT TO:<bob@example.com>", "250"},
+			{"DATA", "354"},
+			{"Subject: First\r\n\r\nHello\r\n.", "250"},
+			{"MAIL FROM:<second@example.com>", "250"},
+			{"RCPT TO:<alice@example.com>", "250"},
+			{"DATA", "354"},
+			{"Subject: Second\r\n\r\nHello again\r\n.", "250"},
+			{"QUIT", "221"},
+		})
+
+		session.close()
+
+		if len(parser.Messages) != 2 {
+			t.Fatalf("Strict %v: expected both messages to be accepted, got %d", strict, len(parser.Messages))
+		}
+
+		first, second := parser.Messages[0], parser.Messages[1]
+
+		if first.FromAddress != "<sender@example.com>" || strings.Join(first.ToAddresses, ",") != "<bob@example.com>" || first.Subject != "First" {
+			t.Errorf("Strict %v: expected the first message to keep its envelope, got %q to %v with subject %q", strict, first.FromAddress, first.ToAddresses, first.Subject)
+		}
+
+		if second.FromAddress != "<second@example.com>" || strings.Join(second.ToAddresses, ",") != "<alice@example.com>" || second.Subject != "Second" {
+			t.Errorf("Strict %v: expected the second message to have its own envelope, got %q to %v with subject %q", strict, second.FromAddress, second.ToAddresses, second.Subject)
+		}
+	}
+}
+
+func TestParserRunPipelining(t *testing.T) {
+	parser := &Parser{Strict: true}
+	session := startTestSession(t, parser)
+
+	session.run([]sessionStep{{"", "220"}, {"EHLO localhost", "250"}})
+	session.sendRaw("MAIL FROM:<sender@example.com>\r\nRCPT TO:<one@example.com>\r\nRCPT TO:<two@example.com>\r\nDATA\r\n")
+
+	for _, code := range []string{"250", "250", "250", "354"} {
+		session.expect(code)
+	}
+
+	session.run([]sessionStep{
+		{"Subject: Pipelined\r\n\r\nHello\r\n.", "250"},
+		{"QUIT", "221"},
+	})
+
+	session.close()
+
+	if len(parser.Messages) != 1 || strings.Join(parser.Messages[0].ToAddresses, ",") != "<one@example.com>,<two@example.com>" {
+		t.Errorf("Expected the pipelined message to be accepted for both recipients, got %+v", parser.Messages)
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package smtp
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/adampresley/mailslurper/admin/model"
+	"github.com/adampresley/mailslurper/profiling"
+)
+
+// Types of events written to the event log
+const (
+	EVENT_MAIL_RECEIVED = "mailReceived"
+	EVENT_MAIL_UPDATED  = "mailItemUpdated"
+	EVENT_MAIL_DELETED  = "mailItemDeleted"
+	EVENT_MAILS_PURGED  = "mailsPurged"
+)
+
+// Number of events kept in the event log. Older events are
+// removed as new ones are written.
+const EVENT_LOG_MAX_LEN = 1000
+
+// Number of events an event listener can have queued
+// before it is considered too slow and closed
+const EVENT_LISTENER_BUFFER_LEN = 100
+
+/*
+Registers a new listener for the event log. The returned channel receives
+every event recorded from now on until the listener is removed with
+RemoveEventListener. If the listener falls too far behind the channel is
+closed; the listener can catch up from the log with GetEventsSince.
+*/
+func (ms *MailStorage) AddEventListener() chan model.JSONMailEvent {
+	listener := make(chan model.JSONMailEvent, EVENT_LISTENER_BUFFER_LEN)
+
+	ms.listenersLock.Lock()
+	defer ms.listenersLock.Unlock()
+
+	if ms.eventListeners == nil {
+		ms.eventListeners = make(map[chan model.JSONMailEvent]bool)
+	}
+
+	ms.eventListeners[listener] = true
+	return listener
+}
+
+/*
+Stops sending events to a listener created with AddEventListener.
+*/
+func (ms *MailStorage) RemoveEventListener(listener chan model.JSONMailEvent) {
+	ms.listenersLock.Lock()
+	delete(ms.eventListeners, listener)
+	ms.listenersLock.Unlock()
+}
+
+/*
+Retrieves the events recorded after the provided event ID, oldest first.
+Only the most recent EVENT_LOG_MAX_LEN events are kept.
+*/
+func (ms *MailStorage) GetEventsSince(lastEventId int) []model.JSONMailEvent {
+	profiling.Timer.Step("Retrieving events")
+
+	rows, err := ms.Db.Query("SELECT id, eventType, mailItemId, data, dateCreated FROM mailevent WHERE id > ? ORDER BY id", lastEventId)
+	if err != nil {
+		log.Panic("Error running query to get events: ", err)
+	}
+
+	defer rows.Close()
+
+	result := make([]model.JSONMailEvent, 0)
+
+	for rows.Next() {
+		var data string
+		event := model.JSONMailEvent{}
+
+		rows.Scan(&event.Id, &event.Event, &event.MailItemId, &data, &event.DateCreated)
+		event.Data = json.RawMessage(data)
+
+		result = append(result, event)
+	}
+
+	return result
+}
+
+/*
+Returns the IDs of the oldest and newest events in the event log, or
+zeros if it is empty.
+*/
+func (ms *MailStorage) GetEventLogRange() (int, int) {
+	profiling.Timer.Step("Retrieving event log range")
+
+	var first, last int
+
+	err := ms.Db.QueryRow("SELECT COALESCE(MIN(id), 0), COALESCE(MAX(id), 0) FROM mailevent").Scan(&first, &last)
+	if err != nil {
+		log.Panic("Error running query to get the event log range: ", err)
+	}
+
+	return first, last
+}
+
+/*
+Writes an event to the event log and sends it to all event listeners and
+to the websockets subscribed to the mail item's addresses. Pass no
+addresses for events every websocket should see. Errors are logged rather
+than returned as the change the event describes has already been committed.
+*/
+func (ms *MailStorage) publishEvent(eventType string, mailItemId int, data interface{}, toAddresses []string, fromAddress string) {
+	profiling.Timer.Step("Writing event")
+
+	/*
+	 * Events must reach listeners in the same order they are
+	 * numbered in the log.
+	 */
+	ms.eventsLock.Lock()
+	defer ms.eventsLock.Unlock()
+
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		log.Println("Error encoding event: ", err)
+		return
+	}
+
+	event := model.JSONMailEvent{
+		Event:       eventType,
+		MailItemId:  mailItemId,
+		Data:        json.RawMessage(encoded),
+		DateCreated: time.Now().UTC().Format(DATE_RECEIVED_FORMAT),
+	}
+
+	result, err := ms.Db.Exec("INSERT INTO mailevent (eventType, mailItemId, data, dateCreated) VALUES (?, ?, ?, ?)", event.Event, event.MailItemId, string(encoded), event.DateCreated)
+	if err != nil {
+		log.Println("Error recording event: ", err)
+		return
+	}
+
+	eventId, _ := result.LastInsertId()
+	event.Id = int(eventId)
+
+	if event.Id > EVENT_LOG_MAX_LEN {
+		_, err = ms.Db.Exec("DELETE FROM mailevent WHERE id <= ?", event.Id-EVENT_LOG_MAX_LEN)
+		if err != nil {
+			log.Println("Error trimming event log: ", err)
+		}
+	}
+
+	if ms.Websockets != nil {
+		websocketEvent := WebsocketEvent{
+			Version: WEBSOCKET_PROTOCOL_VERSION,
+			Type:    eventType,
+			Id:      event.Id,
+			Data:    data,
+		}
+
+		if len(toAddresses) > 0 || len(fromAddress) > 0 {
+			ms.Websockets.BroadcastMailEvent(websocketEvent, toAddresses, fromAddress)
+		} else {
+			ms.Websockets.BroadcastEvent(websocketEvent)
+		}
+	}
+
+	ms.listenersLock.Lock()
+	defer ms.listenersLock.Unlock()
+
+	for listener := range ms.eventListeners {
+		select {
+		case listener <- event:
+		default:
+			delete(ms.eventListeners, listener)
+			close(listener)
+		}
+	}
+}
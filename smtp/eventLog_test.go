@@ -0,0 +1,91 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package smtp
+
+import (
+	"testing"
+)
+
+func TestGetEventsSince(t *testing.T) {
+	storage := newTestStorage(t)
+	defer storage.Disconnect()
+
+	writeTestMail(t, storage, testMailItem("<user@example.com>", "Hello"))
+	id := storage.GetMails(MailSearch{})[0].Id
+
+	storage.SetMailRead(id, true)
+	storage.DeleteMail(id)
+
+	if found, err := storage.DeleteMail(id); found || err != nil {
+		t.Errorf("Deleting a missing mail item = %v, %v, expected false, nil", found, err)
+	}
+
+	events := storage.GetEventsSince(0)
+	expected := []string{EVENT_MAIL_RECEIVED, EVENT_MAIL_UPDATED, EVENT_MAIL_DELETED}
+
+	if len(events) != len(expected) {
+		t.Fatalf("Expected %d events, got %d", len(expected), len(events))
+	}
+
+	for index, event := range events {
+		if event.Event != expected[index] || event.MailItemId != id {
+			t.Errorf("Expected event %d to be %s for mail item %d, got %s for %d", index, expected[index], id, event.Event, event.MailItemId)
+		}
+	}
+
+	since := storage.GetEventsSince(events[0].Id)
+	if len(since) != 2 || since[0].Id != events[1].Id {
+		t.Errorf("Expected the 2 events after %d, got %+v", events[0].Id, since)
+	}
+}
+
+func TestEventLogIsTrimmed(t *testing.T) {
+	storage := newTestStorage(t)
+	defer storage.Disconnect()
+
+	for index := 0; index < EVENT_LOG_MAX_LEN+5; index++ {
+		storage.publishEvent(EVENT_MAILS_PURGED, 0, map[string]interface{}{}, nil, "")
+	}
+
+	events := storage.GetEventsSince(0)
+	if len(events) != EVENT_LOG_MAX_LEN {
+		t.Fatalf("Expected %d events to be kept, got %d", EVENT_LOG_MAX_LEN, len(events))
+	}
+
+	if events[0].Id != 6 {
+		t.Errorf("Expected the oldest kept event to be 6, got %d", events[0].Id)
+	}
+
+	if first, last := storage.GetEventLogRange(); first != 6 || last != EVENT_LOG_MAX_LEN+5 {
+		t.Errorf("Expected the event log to range from 6 to %d, got %d to %d", EVENT_LOG_MAX_LEN+5, first, last)
+	}
+}
+
+func TestEventListeners(t *testing.T) {
+	storage := newTestStorage(t)
+	defer storage.Disconnect()
+
+	listener := storage.AddEventListener()
+	storage.publishEvent(EVENT_MAILS_PURGED, 0, map[string]interface{}{}, nil, "")
+
+	if event := <-listener; event.Event != EVENT_MAILS_PURGED || event.Id != 1 {
+		t.Errorf("Expected event 1 to be %s, got %+v", EVENT_MAILS_PURGED, event)
+	}
+
+	for index := 0; index <= EVENT_LISTENER_BUFFER_LEN; index++ {
+		storage.publishEvent(EVENT_MAILS_PURGED, 0, map[string]interface{}{}, nil, "")
+	}
+
+	count := 0
+	for range listener {
+		count++
+	}
+
+	if count != EVENT_LISTENER_BUFFER_LEN {
+		t.Errorf("Expected a slow listener to be closed after %d events, got %d", EVENT_LISTENER_BUFFER_LEN, count)
+	}
+
+	storage.RemoveEventListener(listener)
+}
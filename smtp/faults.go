@@ -0,0 +1,231 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package smtp
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// SMTP stages a fault can be injected at. "message" is the reply
+// to the end of the DATA content, after the message has been read.
+const (
+	FAULT_STAGE_CONNECT = "connect"
+	FAULT_STAGE_HELO    = "helo"
+	FAULT_STAGE_MAIL    = "mail"
+	FAULT_STAGE_RCPT    = "rcpt"
+	FAULT_STAGE_DATA    = "data"
+	FAULT_STAGE_MESSAGE = "message"
+)
+
+// Number of injected faults kept for inspection
+const FAULT_LOG_MAX_LEN = 1000
+
+// Replies used when a fault rule does not provide its own message
+var defaultFaultMessages = map[int]string{
+	421: "Service not available, closing transmission channel",
+	450: "Mailbox unavailable",
+	451: "Local error in processing",
+	452: "Too many recipients",
+	550: "Mailbox unavailable",
+	551: "User not local",
+	552: "Exceeded storage allocation",
+	553: "Mailbox name not allowed",
+	554: "Transaction failed",
+}
+
+/*
+FaultRule makes an SMTP command fail with a chosen reply code. Stage is
+one of the FAULT_STAGE_* constants. To and From are address wildcard
+patterns; empty patterns match everything. A rule with a To pattern
+only applies at stages where recipients are known: "rcpt", "data" and
+"message".
+
+Probability is the chance, from 0 to 1, that a matching command fails.
+Zero means it always fails. EveryNth makes only every Nth matching
+command fail, so 3 fails the third, sixth, and so on. A 421 reply
+closes the connection, as a real server would.
+*/
+type FaultRule struct {
+	Name        string  `json:"name"`
+	Stage       string  `json:"stage"`
+	To          string  `json:"to,omitempty"`
+	From        string  `json:"from,omitempty"`
+	Probability float64 `json:"probability,omitempty"`
+	EveryNth    int     `json:"everyNth,omitempty"`
+	Code        int     `json:"code"`
+	Message     string  `json:"message,omitempty"`
+}
+
+/*
+InjectedFault records a reply sent because of a fault rule.
+*/
+type InjectedFault struct {
+	Rule          string   `json:"rule"`
+	Stage         string   `json:"stage"`
+	Code          int      `json:"code"`
+	Message       string   `json:"message"`
+	ClientAddress string   `json:"clientAddress"`
+	From          string   `json:"from"`
+	To            []string `json:"to"`
+	DateInjected  string   `json:"dateInjected"`
+}
+
+/*
+FaultInjector holds the fault rules for an SMTP server and a log of the
+faults it has injected. It is safe to use from many sessions at once.
+Create one with NewFaultInjector.
+*/
+type FaultInjector struct {
+	lock     sync.Mutex
+	rules    []FaultRule
+	matches  []int
+	injected []InjectedFault
+}
+
+/*
+Creates a fault injector with a set of rules. An error is returned
+if any rule is invalid.
+*/
+func NewFaultInjector(rules []FaultRule) (*FaultInjector, error) {
+	result := &FaultInjector{injected: make([]InjectedFault, 0)}
+
+	err := result.SetRules(rules)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+/*
+Replaces the fault rules. Counts used by EveryNth start over.
+*/
+func (fi *FaultInjector) SetRules(rules []FaultRule) error {
+	for index, rule := range rules {
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("Fault rule %d (%s) is invalid: %s", index+1, rule.Name, err)
+		}
+	}
+
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+
+	fi.rules = append(make([]FaultRule, 0, len(rules)), rules...)
+	fi.matches = make([]int, len(rules))
+	return nil
+}
+
+/*
+Returns a copy of the current fault rules.
+*/
+func (fi *FaultInjector) Rules() []FaultRule {
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+
+	return append(make([]FaultRule, 0, len(fi.rules)), fi.rules...)
+}
+
+/*
+Returns the faults injected so far, oldest first. Only the most
+recent FAULT_LOG_MAX_LEN are kept.
+*/
+func (fi *FaultInjector) Injected() []InjectedFault {
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+
+	return append(make([]InjectedFault, 0, len(fi.injected)), fi.injected...)
+}
+
+/*
+Empties the log of injected faults.
+*/
+func (fi *FaultInjector) ClearInjected() {
+	fi.lock.Lock()
+	fi.injected = make([]InjectedFault, 0)
+	fi.lock.Unlock()
+}
+
+/*
+Checks the rules for a command at an SMTP stage. If one fires, the fault
+is logged and returned along with true. Rules are checked in order and
+the first to fire wins.
+*/
+func (fi *FaultInjector) Check(stage string, clientAddress string, from string, to []string) (InjectedFault, bool) {
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+
+	for index, rule := range fi.rules {
+		if rule.Stage != stage || !MatchAddressPattern(rule.From, from) || !MatchAnyAddressPattern(rule.To, to) {
+			continue
+		}
+
+		fi.matches[index]++
+
+		if rule.EveryNth > 1 && fi.matches[index]%rule.EveryNth != 0 {
+			continue
+		}
+
+		if rule.Probability > 0 && rand.Float64() >= rule.Probability {
+			continue
+		}
+
+		fault := InjectedFault{
+			Rule:          rule.Name,
+			Stage:         stage,
+			Code:          rule.Code,
+			Message:       rule.reply(),
+			ClientAddress: clientAddress,
+			From:          from,
+			To:            append(make([]string, 0, len(to)), to...),
+			DateInjected:  time.Now().UTC().Format(DATE_RECEIVED_FORMAT),
+		}
+
+		fi.injected = append(fi.injected, fault)
+		if len(fi.injected) > FAULT_LOG_MAX_LEN {
+			fi.injected = fi.injected[len(fi.injected)-FAULT_LOG_MAX_LEN:]
+		}
+
+		return fault, true
+	}
+
+	return InjectedFault{}, false
+}
+
+func (rule FaultRule) validate() error {
+	switch rule.Stage {
+	case FAULT_STAGE_CONNECT, FAULT_STAGE_HELO, FAULT_STAGE_MAIL, FAULT_STAGE_RCPT, FAULT_STAGE_DATA, FAULT_STAGE_MESSAGE:
+	default:
+		return fmt.Errorf("stage %q is not one of connect, helo, mail, rcpt, data or message", rule.Stage)
+	}
+
+	if rule.Code < 400 || rule.Code > 599 {
+		return fmt.Errorf("code %d is not a 4xx or 5xx reply", rule.Code)
+	}
+
+	if rule.Probability < 0 || rule.Probability > 1 {
+		return fmt.Errorf("probability must be between 0 and 1")
+	}
+
+	if rule.EveryNth < 0 {
+		return fmt.Errorf("everyNth cannot be negative")
+	}
+
+	return nil
+}
+
+func (rule FaultRule) reply() string {
+	if len(rule.Message) > 0 {
+		return rule.Message
+	}
+
+	if message, ok := defaultFaultMessages[rule.Code]; ok {
+		return message
+	}
+
+	return "Requested action not taken"
+}
@@ -0,0 +1,159 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package smtp
+
+import (
+	"testing"
+)
+
+func TestParserRunInjectsFaults(t *testing.T) {
+	tests := []struct {
+		name     string
+		rule     FaultRule
+		script   []sessionStep
+		state    int
+		accepted bool
+	}{
+		{
+			name: "connect",
+			rule: FaultRule{Stage: FAULT_STAGE_CONNECT, Code: 421},
+			script: []sessionStep{
+				{"", "421 Service not available"},
+			},
+			state: STATE_ERROR,
+		},
+		{
+			name: "helo",
+			rule: FaultRule{Stage: FAULT_STAGE_HELO, Code: 550, Message: "Go away"},
+			script: []sessionStep{
+				{"", "220"},
+				{"HELO localhost", "550 Go away"},
+				{"QUIT", "221"},
+			},
+			state: STATE_QUIT,
+		},
+		{
+			name: "mail",
+			rule: FaultRule{Stage: FAULT_STAGE_MAIL, From: "*@spammer.test", Code: 553},
+			script: []sessionStep{
+				{"", "220"},
+				{"HELO localhost", "250"},
+				{"MAIL FROM:<bob@spammer.test>", "553 Mailbox name not allowed"},
+				{"MAIL FROM:<bob@example.com>", "250"},
+				{"QUIT", "221"},
+			},
+			state: STATE_QUIT,
+		},
+		{
+			name: "rcpt",
+			rule: FaultRule{Stage: FAULT_STAGE_RCPT, To: "*@full.test", Code: 452},
+			script: []sessionStep{
+				{"", "220"},
+				{"HELO localhost", "250"},
+				{"MAIL FROM:<sender@example.com>", "250"},
+				{"RCPT TO:<bob@full.test>", "452 Too many recipients"},
+				{"RCPT TO:<bob@example.com>", "250"},
+				{"DATA", "354"},
+				{"Subject: Hello\r\n\r\nHello\r\n.", "250"},
+				{"QUIT", "221"},
+			},
+			state:    STATE_QUIT,
+			accepted: true,
+		},
+		{
+			name: "rcpt closing the connection",
+			rule: FaultRule{Stage: FAULT_STAGE_RCPT, Code: 421},
+			script: []sessionStep{
+				{"", "220"},
+				{"HELO localhost", "250"},
+				{"MAIL FROM:<sender@example.com>", "250"},
+				{"RCPT TO:<bob@example.com>", "421"},
+				{"", "221"},
+			},
+			state: STATE_ERROR,
+		},
+		{
+			name: "data",
+			rule: FaultRule{Stage: FAULT_STAGE_DATA, Code: 451},
+			script: []sessionStep{
+				{"", "220"},
+				{"HELO localhost", "250"},
+				{"MAIL FROM:<sender@example.com>", "250"},
+				{"RCPT TO:<bob@example.com>", "250"},
+				{"DATA", "451 Local error in processing"},
+				{"QUIT", "221"},
+			},
+			state: STATE_QUIT,
+		},
+		{
+			name: "message",
+			rule: FaultRule{Stage: FAULT_STAGE_MESSAGE, Code: 554},
+			script: []sessionStep{
+				{"", "220"},
+				{"HELO localhost", "250"},
+				{"MAIL FROM:<sender@example.com>", "250"},
+				{"RCPT TO:<bob@example.com>", "250"},
+				{"DATA", "354"},
+				{"Subject: Hello\r\n\r\nHello\r\n.", "554 Transaction failed"},
+				{"QUIT", "221"},
+			},
+			state: STATE_QUIT,
+		},
+	}
+
+	for _, test := range tests {
+		faults, err := NewFaultInjector([]FaultRule{test.rule})
+		if err != nil {
+			t.Fatalf("%s: unable to create fault injector: %s", test.name, err)
+		}
+
+		parser := &Parser{Faults: faults}
+		session := startTestSession(t, parser)
+
+		session.run(test.script)
+		session.close()
+
+		if parser.State != test.state || (len(parser.Messages) > 0) != test.accepted {
+			t.Errorf("%s: expected state %d and accepted %v, got %d and %d messages", test.name, test.state, test.accepted, parser.State, len(parser.Messages))
+		}
+
+		injected := faults.Injected()
+		if len(injected) != 1 || injected[0].Stage != test.rule.Stage || injected[0].Code != test.rule.Code {
+			t.Errorf("%s: expected one %d fault at the %s stage to be logged, got %+v", test.name, test.rule.Code, test.rule.Stage, injected)
+		}
+	}
+}
+
+func TestFaultInjectorEveryNth(t *testing.T) {
+	faults, _ := NewFaultInjector([]FaultRule{{Stage: FAULT_STAGE_RCPT, EveryNth: 3, Code: 450}})
+
+	for count := 1; count <= 6; count++ {
+		_, fired := faults.Check(FAULT_STAGE_RCPT, "127.0.0.1:1234", "", []string{"<bob@example.com>"})
+
+		if fired != (count%3 == 0) {
+			t.Errorf("Command %d: expected fired to be %v", count, count%3 == 0)
+		}
+	}
+
+	if _, fired := faults.Check(FAULT_STAGE_MAIL, "127.0.0.1:1234", "", nil); fired {
+		t.Error("Expected the rule not to fire at another stage")
+	}
+}
+
+func TestFaultInjectorRejectsInvalidRules(t *testing.T) {
+	tests := map[string]FaultRule{
+		"unknown stage":        {Stage: "quit", Code: 421},
+		"success code":         {Stage: FAULT_STAGE_RCPT, Code: 250},
+		"probability above 1":  {Stage: FAULT_STAGE_RCPT, Code: 450, Probability: 1.5},
+		"negative probability": {Stage: FAULT_STAGE_RCPT, Code: 450, Probability: -0.5},
+		"negative everyNth":    {Stage: FAULT_STAGE_RCPT, Code: 450, EveryNth: -1},
+	}
+
+	for name, rule := range tests {
+		if _, err := NewFaultInjector([]FaultRule{rule}); err == nil {
+			t.Errorf("Expected an error for a rule with %s", name)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package smtp
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// How long triplets are remembered when no expiry is given
+	DEFAULT_GREYLIST_EXPIRY = 4 * time.Hour
+
+	// How often expired triplets are looked for
+	GREYLIST_SWEEP_INTERVAL = time.Minute
+)
+
+/*
+GreylistTriplet is a client IP, sender and recipient seen by the
+greylist. Passed is set once a retry has been accepted, after which
+mail for the triplet is no longer held back.
+*/
+type GreylistTriplet struct {
+	ClientIP  string `json:"clientIP"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Attempts  int    `json:"attempts"`
+	Passed    bool   `json:"passed"`
+	FirstSeen string `json:"firstSeen"`
+	LastSeen  string `json:"lastSeen"`
+
+	firstSeen time.Time
+	lastSeen  time.Time
+}
+
+/*
+Greylist simulates greylisting. The first time a (client IP, sender,
+recipient) triplet is seen its RCPT TO is refused with a temporary
+error, as are retries until Delay has passed. After that the triplet
+is accepted. Triplets are forgotten once Expiry has passed since they
+were first seen, or for triplets that have passed, since they were
+last seen. It is safe to use from many sessions at once. Create one
+with NewGreylist.
+*/
+type Greylist struct {
+	Delay  time.Duration
+	Expiry time.Duration
+
+	lock      sync.Mutex
+	triplets  map[string]*GreylistTriplet
+	order     []*GreylistTriplet
+	lastSweep time.Time
+}
+
+/*
+Creates an empty greylist which accepts retries after a delay and
+forgets triplets after expiry. An expiry of zero uses
+DEFAULT_GREYLIST_EXPIRY.
+*/
+func NewGreylist(delay time.Duration, expiry time.Duration) *Greylist {
+	if expiry <= 0 {
+		expiry = DEFAULT_GREYLIST_EXPIRY
+	}
+
+	return &Greylist{
+		Delay:     delay,
+		Expiry:    expiry,
+		triplets:  make(map[string]*GreylistTriplet),
+		order:     make([]*GreylistTriplet, 0),
+		lastSweep: time.Now().UTC(),
+	}
+}
+
+/*
+Records an attempt to send from a client to a recipient and returns
+true if it should be accepted.
+*/
+func (gl *Greylist) Check(clientAddress string, from string, to string) bool {
+	clientIP := clientAddress
+	if host, _, err := net.SplitHostPort(clientAddress); err == nil {
+		clientIP = host
+	}
+
+	from, to = NormalizeAddress(from), NormalizeAddress(to)
+	key := tripletKey(clientIP, from, to)
+	now := time.Now().UTC()
+
+	gl.lock.Lock()
+	defer gl.lock.Unlock()
+
+	gl.sweep(now)
+
+	triplet, ok := gl.triplets[key]
+	if ok && gl.expired(triplet, now) {
+		gl.remove(triplet)
+		ok = false
+	}
+
+	if !ok {
+		triplet = &GreylistTriplet{
+			ClientIP:  clientIP,
+			From:      from,
+			To:        to,
+			FirstSeen: now.Format(DATE_RECEIVED_FORMAT),
+			firstSeen: now,
+		}
+
+		gl.triplets[key] = triplet
+		gl.order = append(gl.order, triplet)
+	}
+
+	triplet.Attempts++
+	triplet.LastSeen = now.Format(DATE_RECEIVED_FORMAT)
+	triplet.lastSeen = now
+
+	if ok && now.Sub(triplet.firstSeen) >= gl.Delay {
+		triplet.Passed = true
+	}
+
+	return triplet.Passed
+}
+
+/*
+Returns a copy of the triplets seen so far, oldest first.
+*/
+func (gl *Greylist) Triplets() []GreylistTriplet {
+	gl.lock.Lock()
+	defer gl.lock.Unlock()
+
+	gl.sweep(time.Now().UTC())
+
+	result := make([]GreylistTriplet, 0, len(gl.order))
+	for _, triplet := range gl.order {
+		result = append(result, *triplet)
+	}
+
+	return result
+}
+
+/*
+Forgets every triplet, so the next attempt for each is refused again.
+*/
+func (gl *Greylist) Reset() {
+	gl.lock.Lock()
+	gl.triplets = make(map[string]*GreylistTriplet)
+	gl.order = make([]*GreylistTriplet, 0)
+	gl.lock.Unlock()
+}
+
+/*
+Forgets expired triplets, so the greylist does not grow forever.
+*/
+func (gl *Greylist) sweep(now time.Time) {
+	if now.Sub(gl.lastSweep) < GREYLIST_SWEEP_INTERVAL {
+		return
+	}
+
+	order := make([]*GreylistTriplet, 0, len(gl.order))
+	for _, triplet := range gl.order {
+		if gl.expired(triplet, now) {
+			delete(gl.triplets, tripletKey(triplet.ClientIP, triplet.From, triplet.To))
+			continue
+		}
+
+		order = append(order, triplet)
+	}
+
+	gl.order = order
+	gl.lastSweep = now
+}
+
+func (gl *Greylist) expired(triplet *GreylistTriplet, now time.Time) bool {
+	if triplet.Passed {
+		return now.Sub(triplet.lastSeen) >= gl.Expiry
+	}
+
+	return now.Sub(triplet.firstSeen) >= gl.Expiry
+}
+
+func (gl *Greylist) remove(triplet *GreylistTriplet) {
+	delete(gl.triplets, tripletKey(triplet.ClientIP, triplet.From, triplet.To))
+
+	for index, candidate := range gl.order {
+		if candidate == triplet {
+			gl.order = append(gl.order[:index], gl.order[index+1:]...)
+			return
+		}
+	}
+}
+
+func tripletKey(clientIP string, from string, to string) string {
+	return clientIP + "\x00" + from + "\x00" + to
+}
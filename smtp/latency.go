@@ -0,0 +1,191 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package smtp
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Points in an SMTP session where latency is simulated. "greeting" is
+// the 220 welcome, "rcpt" the reply to each RCPT TO, "data" the time
+// the message content is being sent, and "message" the reply to the
+// end of the DATA content.
+const (
+	LATENCY_STAGE_GREETING = "greeting"
+	LATENCY_STAGE_RCPT     = "rcpt"
+	LATENCY_STAGE_DATA     = "data"
+	LATENCY_STAGE_MESSAGE  = "message"
+)
+
+/*
+LatencyRule slows down or drops SMTP sessions so client timeouts and
+retries can be tested. To and From are address wildcard patterns; a rule
+with neither applies globally. Rules with patterns never apply to the
+greeting, as no addresses are known yet.
+
+The delays hold back the greeting, the reply to each RCPT TO, and the
+reply after the DATA terminator. DropDuringDataPercent is the chance,
+from 0 to 100, that the connection is closed while the message content
+is being sent. DropAfterMessagePercent is the chance it is closed once
+the content has arrived, instead of replying. Dropped messages are not
+stored.
+
+For each setting the first matching rule that sets it is used, so list
+rules with patterns before a global one.
+*/
+type LatencyRule struct {
+	Name                      string  `json:"name"`
+	To                        string  `json:"to,omitempty"`
+	From                      string  `json:"from,omitempty"`
+	GreetingDelayMilliseconds int     `json:"greetingDelayMilliseconds,omitempty"`
+	RcptDelayMilliseconds     int     `json:"rcptDelayMilliseconds,omitempty"`
+	MessageDelayMilliseconds  int     `json:"messageDelayMilliseconds,omitempty"`
+	DropDuringDataPercent     float64 `json:"dropDuringDataPercent,omitempty"`
+	DropAfterMessagePercent   float64 `json:"dropAfterMessagePercent,omitempty"`
+}
+
+/*
+LatencySimulator holds the latency rules for an SMTP server. It is
+safe to use from many sessions at once. Create one with
+NewLatencySimulator.
+*/
+type LatencySimulator struct {
+	lock  sync.Mutex
+	rules []LatencyRule
+}
+
+/*
+Creates a latency simulator with a set of rules. An error is returned
+if any rule is invalid.
+*/
+func NewLatencySimulator(rules []LatencyRule) (*LatencySimulator, error) {
+	result := &LatencySimulator{}
+
+	err := result.SetRules(rules)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+/*
+Replaces the latency rules.
+*/
+func (ls *LatencySimulator) SetRules(rules []LatencyRule) error {
+	for index, rule := range rules {
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("Latency rule %d (%s) is invalid: %s", index+1, rule.Name, err)
+		}
+	}
+
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+
+	ls.rules = append(make([]LatencyRule, 0, len(rules)), rules...)
+	return nil
+}
+
+/*
+Returns a copy of the current latency rules.
+*/
+func (ls *LatencySimulator) Rules() []LatencyRule {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+
+	return append(make([]LatencyRule, 0, len(ls.rules)), ls.rules...)
+}
+
+/*
+Returns how long to hold back the reply at a stage of the session.
+Only the "greeting", "rcpt" and "message" stages have delays.
+*/
+func (ls *LatencySimulator) Delay(stage string, from string, to []string) time.Duration {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+
+	for _, rule := range ls.rules {
+		milliseconds := rule.delay(stage)
+		if milliseconds > 0 && rule.matches(stage, from, to) {
+			return time.Duration(milliseconds) * time.Millisecond
+		}
+	}
+
+	return 0
+}
+
+/*
+Returns true if the connection should be dropped at a stage of the
+session. Only the "data" and "message" stages drop connections.
+*/
+func (ls *LatencySimulator) Drop(stage string, from string, to []string) bool {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+
+	for _, rule := range ls.rules {
+		percent := rule.dropPercent(stage)
+		if percent > 0 && rule.matches(stage, from, to) {
+			return rand.Float64()*100 < percent
+		}
+	}
+
+	return false
+}
+
+func (rule LatencyRule) matches(stage string, from string, to []string) bool {
+	if stage == LATENCY_STAGE_GREETING {
+		return len(rule.To) <= 0 && len(rule.From) <= 0
+	}
+
+	return MatchAddressPattern(rule.From, from) && MatchAnyAddressPattern(rule.To, to)
+}
+
+func (rule LatencyRule) delay(stage string) int {
+	switch stage {
+	case LATENCY_STAGE_GREETING:
+		return rule.GreetingDelayMilliseconds
+
+	case LATENCY_STAGE_RCPT:
+		return rule.RcptDelayMilliseconds
+
+	case LATENCY_STAGE_MESSAGE:
+		return rule.MessageDelayMilliseconds
+
+	default:
+		return 0
+	}
+}
+
+func (rule LatencyRule) dropPercent(stage string) float64 {
+	switch stage {
+	case LATENCY_STAGE_DATA:
+		return rule.DropDuringDataPercent
+
+	case LATENCY_STAGE_MESSAGE:
+		return rule.DropAfterMessagePercent
+
+	default:
+		return 0
+	}
+}
+
+func (rule LatencyRule) validate() error {
+	if rule.GreetingDelayMilliseconds < 0 || rule.RcptDelayMilliseconds < 0 || rule.MessageDelayMilliseconds < 0 {
+		return fmt.Errorf("delays cannot be negative")
+	}
+
+	if rule.DropDuringDataPercent < 0 || rule.DropDuringDataPercent > 100 {
+		return fmt.Errorf("dropDuringDataPercent must be between 0 and 100")
+	}
+
+	if rule.DropAfterMessagePercent < 0 || rule.DropAfterMessagePercent > 100 {
+		return fmt.Errorf("dropAfterMessagePercent must be between 0 and 100")
+	}
+
+	return nil
+}
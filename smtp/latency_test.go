@@ -0,0 +1,137 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package smtp
+
+import (
+	"testing"
+	"time"
+)
+
+/*
+Runs a step of a session and returns how long the reply took.
+*/
+func timeStep(session *testSession, step sessionStep) time.Duration {
+	start := time.Now()
+	session.run([]sessionStep{step})
+	return time.Since(start)
+}
+
+func TestParserRunDelaysReplies(t *testing.T) {
+	latency, err := NewLatencySimulator([]LatencyRule{
+		{Name: "slow mailbox", To: "*@slow.test", RcptDelayMilliseconds: 200},
+		{Name: "global", GreetingDelayMilliseconds: 100, MessageDelayMilliseconds: 150},
+	})
+
+	if err != nil {
+		t.Fatalf("Unable to create latency simulator: %s", err)
+	}
+
+	parser := &Parser{Latency: latency}
+	session := startTestSession(t, parser)
+
+	tests := []struct {
+		step    sessionStep
+		minimum time.Duration
+		maximum time.Duration
+	}{
+		{sessionStep{"", "220"}, 100 * time.Millisecond, time.Second},
+		{sessionStep{"HELO localhost", "250"}, 0, 100 * time.Millisecond},
+		{sessionStep{"MAIL FROM:<sender@example.com>", "250"}, 0, 100 * time.Millisecond},
+		{sessionStep{"RCPT TO:<bob@slow.test>", "250"}, 200 * time.Millisecond, time.Second},
+		{sessionStep{"RCPT TO:<bob@example.com>", "250"}, 0, 100 * time.Millisecond},
+		{sessionStep{"DATA", "354"}, 0, 100 * time.Millisecond},
+		{sessionStep{"Subject: Hello\r\n\r\nHello\r\n.", "250"}, 150 * time.Millisecond, time.Second},
+		{sessionStep{"QUIT", "221"}, 0, 100 * time.Millisecond},
+	}
+
+	for _, test := range tests {
+		if elapsed := timeStep(session, test.step); elapsed < test.minimum || elapsed > test.maximum {
+			t.Errorf("Expected the reply to %q to take between %s and %s, took %s", test.step.send, test.minimum, test.maximum, elapsed)
+		}
+	}
+
+	session.close()
+
+	if len(parser.Messages) != 1 || parser.simulatedDelay != 450*time.Millisecond {
+		t.Errorf("Expected the message to be accepted after 450ms of simulated delay, got %d messages and %s", len(parser.Messages), parser.simulatedDelay)
+	}
+}
+
+func TestParserRunDropsConnections(t *testing.T) {
+	tests := map[string]LatencyRule{
+		"during data":   {DropDuringDataPercent: 100},
+		"after message": {DropAfterMessagePercent: 100},
+	}
+
+	for name, rule := range tests {
+		latency, _ := NewLatencySimulator([]LatencyRule{rule})
+		parser := &Parser{Latency: latency}
+		session := startTestSession(t, parser)
+
+		session.run([]sessionStep{
+			{"", "220"},
+			{"HELO localhost", "250"},
+			{"MAIL FROM:<sender@example.com>", "250"},
+			{"RCPT TO:<bob@example.com>", "250"},
+			{"DATA", "354"},
+		})
+
+		session.send("Subject: Hello\r\n\r\nHello\r\n.")
+		session.expectClosed()
+		session.close()
+
+		if parser.State != STATE_ERROR || len(parser.Messages) > 0 {
+			t.Errorf("%s: expected the session to end in error without a message, got state %d and %d messages", name, parser.State, len(parser.Messages))
+		}
+	}
+}
+
+func TestLatencySimulatorRules(t *testing.T) {
+	latency, _ := NewLatencySimulator([]LatencyRule{
+		{Name: "tenant a", To: "*@tenant-a.test", RcptDelayMilliseconds: 300, GreetingDelayMilliseconds: 900},
+		{Name: "from app", From: "app@example.com", DropAfterMessagePercent: 100},
+		{Name: "global", RcptDelayMilliseconds: 10, GreetingDelayMilliseconds: 20},
+	})
+
+	delays := []struct {
+		stage    string
+		from     string
+		to       []string
+		expected time.Duration
+	}{
+		{LATENCY_STAGE_GREETING, "", nil, 20 * time.Millisecond},
+		{LATENCY_STAGE_RCPT, "<sender@example.com>", []string{"<bob@tenant-a.test>"}, 300 * time.Millisecond},
+		{LATENCY_STAGE_RCPT, "<sender@example.com>", []string{"<bob@tenant-b.test>"}, 10 * time.Millisecond},
+		{LATENCY_STAGE_MESSAGE, "<sender@example.com>", []string{"<bob@tenant-a.test>"}, 0},
+	}
+
+	for _, test := range delays {
+		if result := latency.Delay(test.stage, test.from, test.to); result != test.expected {
+			t.Errorf("Delay(%s, %q, %v) = %s, expected %s", test.stage, test.from, test.to, result, test.expected)
+		}
+	}
+
+	if !latency.Drop(LATENCY_STAGE_MESSAGE, "<app@example.com>", nil) {
+		t.Error("Expected mail from app@example.com to be dropped after the message")
+	}
+
+	if latency.Drop(LATENCY_STAGE_MESSAGE, "<other@example.com>", nil) || latency.Drop(LATENCY_STAGE_DATA, "<app@example.com>", nil) {
+		t.Error("Expected only mail from app@example.com to be dropped, and only after the message")
+	}
+}
+
+func TestLatencySimulatorRejectsInvalidRules(t *testing.T) {
+	tests := map[string]LatencyRule{
+		"negative delay":         {RcptDelayMilliseconds: -1},
+		"drop during data above": {DropDuringDataPercent: 101},
+		"negative drop after":    {DropAfterMessagePercent: -1},
+	}
+
+	for name, rule := range tests {
+		if _, err := NewLatencySimulator([]LatencyRule{rule}); err == nil {
+			t.Errorf("Expected an error for a rule with %s", name)
+		}
+	}
+}
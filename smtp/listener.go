@@ -0,0 +1,198 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package smtp
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// How a listener uses TLS. "none" is plain SMTP, like port 25.
+// "starttls" offers the STARTTLS command to upgrade the connection,
+// like port 587. "implicit" starts TLS as soon as a client connects,
+// like port 465.
+const (
+	TLS_MODE_NONE     = "none"
+	TLS_MODE_STARTTLS = "starttls"
+	TLS_MODE_IMPLICIT = "implicit"
+)
+
+// SMTP service extensions a listener can choose to advertise.
+// STARTTLS is not listed as it is set by the TLS mode.
+var SupportedExtensions = []string{"SIZE", "PIPELINING", "8BITMIME", "SMTPUTF8", "CHUNKING", "BINARYMIME", "AUTH"}
+
+/*
+Listener is one address the SMTP server accepts connections on.
+Network is "tcp", "tcp4", "tcp6" or "unix". Address is host:port for
+TCP networks, with IPv6 hosts in brackets, and a socket file path for
+"unix". TLSConfig must be set for the "starttls" and "implicit" TLS
+modes. Extensions limits the extensions advertised in reply to EHLO to
+some of SupportedExtensions; when nil all of them are offered. CHUNKING
+or AUTH not being offered also refuses BDAT or AUTH.
+*/
+type Listener struct {
+	Name       string
+	Network    string
+	Address    string
+	TLSMode    string
+	TLSConfig  *tls.Config
+	Extensions []string
+
+	handle net.Listener
+}
+
+/*
+Returns the address the listener is bound to, which tells the port
+picked when listening on port 0. It is nil until the server connects.
+*/
+func (l *Listener) Addr() net.Addr {
+	if l.handle == nil {
+		return nil
+	}
+
+	return l.handle.Addr()
+}
+
+/*
+Returns the listener's name, or its address if it has none.
+*/
+func (l *Listener) String() string {
+	if len(l.Name) > 0 {
+		return l.Name
+	}
+
+	return l.Network + " " + l.Address
+}
+
+func (l *Listener) validate() error {
+	switch l.Network {
+	case "tcp", "tcp4", "tcp6", "unix":
+	default:
+		return fmt.Errorf("SMTP listener %s: network %q is not one of tcp, tcp4, tcp6 or unix", l, l.Network)
+	}
+
+	switch l.TLSMode {
+	case "", TLS_MODE_NONE:
+	case TLS_MODE_STARTTLS, TLS_MODE_IMPLICIT:
+		if l.TLSConfig == nil {
+			return fmt.Errorf("SMTP listener %s: TLS mode %q needs a certificate", l, l.TLSMode)
+		}
+
+	default:
+		return fmt.Errorf("SMTP listener %s: TLS mode %q is not one of none, starttls or implicit", l, l.TLSMode)
+	}
+
+	for _, extension := range l.Extensions {
+		if !containsFold(SupportedExtensions, extension) {
+			return fmt.Errorf("SMTP listener %s: extension %q is not one of %s", l, extension, strings.Join(SupportedExtensions, ", "))
+		}
+	}
+
+	return nil
+}
+
+/*
+Binds the listener. Errors say which listener failed and, for the
+common causes, what to do about it.
+*/
+func (l *Listener) listen() error {
+	if l.Network == "unix" {
+		removeStaleSocket(l.Address)
+	}
+
+	handle, err := net.Listen(l.Network, l.Address)
+	if err != nil {
+		return l.bindError(err)
+	}
+
+	if l.TLSMode == TLS_MODE_IMPLICIT {
+		handle = tls.NewListener(handle, l.TLSConfig)
+	}
+
+	l.handle = handle
+	return nil
+}
+
+func (l *Listener) bindError(err error) error {
+	hint := ""
+
+	switch {
+	case errors.Is(err, syscall.EADDRINUSE):
+		hint = "something else is already listening there"
+
+	case errors.Is(err, syscall.EACCES) && l.Network == "unix":
+		hint = "permission denied creating the socket file"
+
+	case errors.Is(err, syscall.EACCES):
+		hint = "permission denied; ports below 1024 need root or CAP_NET_BIND_SERVICE"
+
+	case errors.Is(err, syscall.EADDRNOTAVAIL):
+		hint = "the address does not belong to this machine"
+
+	case errors.Is(err, syscall.EAFNOSUPPORT):
+		hint = "this machine does not support that address family"
+	}
+
+	if len(hint) > 0 {
+		return fmt.Errorf("Cannot listen for SMTP on %s (%s %s): %s: %s", l, l.Network, l.Address, hint, err)
+	}
+
+	return fmt.Errorf("Cannot listen for SMTP on %s (%s %s): %s", l, l.Network, l.Address, err)
+}
+
+/*
+Returns true if an extension is advertised on this listener.
+*/
+func (l *Listener) offers(extension string) bool {
+	return l.Extensions == nil || containsFold(l.Extensions, extension)
+}
+
+/*
+Returns the TLS configuration used for STARTTLS, which is nil
+unless the listener is in "starttls" mode.
+*/
+func (l *Listener) startTLSConfig() *tls.Config {
+	if l.TLSMode != TLS_MODE_STARTTLS {
+		return nil
+	}
+
+	return l.TLSConfig
+}
+
+/*
+Removes a socket file left behind by a server that did not shut down
+cleanly. Nothing is removed if the path is not a socket or something
+is still accepting connections on it.
+*/
+func removeStaleSocket(path string) {
+	info, err := os.Stat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		return
+	}
+
+	connection, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		connection.Close()
+		return
+	}
+
+	os.Remove(path)
+}
+
+func containsFold(list []string, value string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, value) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,234 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package smtp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	netsmtp "net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+Returns a TLS configuration with a self-signed certificate for localhost.
+*/
+func testTLSConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Unable to generate key: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	certificate, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Unable to create certificate: %s", err)
+	}
+
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{certificate}, PrivateKey: key}}}
+}
+
+func TestListenerValidate(t *testing.T) {
+	tlsConfig := &tls.Config{}
+
+	tests := []struct {
+		listener Listener
+		valid    bool
+	}{
+		{Listener{Network: "tcp", Address: "127.0.0.1:0"}, true},
+		{Listener{Network: "unix", Address: "/tmp/smtp.sock", TLSMode: TLS_MODE_NONE}, true},
+		{Listener{Network: "tcp", TLSMode: TLS_MODE_STARTTLS, TLSConfig: tlsConfig}, true},
+		{Listener{Network: "tcp", Extensions: []string{"size", "AUTH"}}, true},
+		{Listener{Network: "udp"}, false},
+		{Listener{Network: "tcp", TLSMode: TLS_MODE_IMPLICIT}, false},
+		{Listener{Network: "tcp", TLSMode: "always", TLSConfig: tlsConfig}, false},
+		{Listener{Network: "tcp", Extensions: []string{"STARTTLS"}}, false},
+	}
+
+	for _, test := range tests {
+		if err := test.listener.validate(); (err == nil) != test.valid {
+			t.Errorf("Expected %+v valid to be %v, got %v", test.listener, test.valid, err)
+		}
+	}
+}
+
+func TestListenerBindError(t *testing.T) {
+	first := &Listener{Name: "first", Network: "tcp", Address: "127.0.0.1:0"}
+	if err := first.listen(); err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+
+	defer first.handle.Close()
+
+	second := &Listener{Name: "second", Network: "tcp", Address: first.Addr().String()}
+	err := second.listen()
+
+	if err == nil || !strings.Contains(err.Error(), "second") || !strings.Contains(err.Error(), "already listening") {
+		t.Errorf("Expected an error naming the listener and saying the address is in use, got %v", err)
+	}
+}
+
+func TestListenerRemovesStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "smtp.sock")
+
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+
+	/*
+	 * Leave the socket file behind as a crashed server would
+	 */
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener := &Listener{Network: "unix", Address: path}
+	if err = listener.listen(); err != nil {
+		t.Fatalf("Expected the stale socket file to be replaced, got %s", err)
+	}
+
+	listener.handle.Close()
+
+	regular := filepath.Join(t.TempDir(), "regular")
+	os.WriteFile(regular, []byte("keep me"), 0600)
+	removeStaleSocket(regular)
+
+	if _, err = os.Stat(regular); err != nil {
+		t.Errorf("Expected a file that is not a socket to be kept, got %s", err)
+	}
+}
+
+/*
+Sends a message through a client, upgrading the connection with STARTTLS
+first when startTLS is true.
+*/
+func sendTestMail(t *testing.T, connection net.Conn, subject string, startTLS bool) {
+	client, err := netsmtp.NewClient(connection, "localhost")
+	if err != nil {
+		t.Fatalf("%s: unable to start SMTP session: %s", subject, err)
+	}
+
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok != startTLS {
+		t.Errorf("%s: expected STARTTLS offered to be %v", subject, startTLS)
+	}
+
+	if startTLS {
+		if err = client.StartTLS(&tls.Config{ServerName: "localhost", InsecureSkipVerify: true}); err != nil {
+			t.Fatalf("%s: STARTTLS failed: %s", subject, err)
+		}
+	}
+
+	if err = client.Mail("sender@example.com"); err != nil {
+		t.Fatalf("%s: MAIL FROM failed: %s", subject, err)
+	}
+
+	if err = client.Rcpt("bob@example.com"); err != nil {
+		t.Fatalf("%s: RCPT TO failed: %s", subject, err)
+	}
+
+	writer, err := client.Data()
+	if err != nil {
+		t.Fatalf("%s: DATA failed: %s", subject, err)
+	}
+
+	writer.Write([]byte("Subject: " + subject + "\r\n\r\nHello\r\n"))
+
+	if err = writer.Close(); err != nil {
+		t.Fatalf("%s: message refused: %s", subject, err)
+	}
+
+	client.Quit()
+}
+
+func TestServerListeners(t *testing.T) {
+	storage := newTestStorage(t)
+	defer storage.Disconnect()
+
+	tlsConfig := testTLSConfig(t)
+	socket := filepath.Join(t.TempDir(), "smtp.sock")
+
+	server := &Server{
+		Storage: storage,
+		Listeners: []*Listener{
+			{Name: "plain", Network: "tcp", Address: "127.0.0.1:0"},
+			{Name: "socket", Network: "unix", Address: socket},
+			{Name: "implicit", Network: "tcp", Address: "127.0.0.1:0", TLSMode: TLS_MODE_IMPLICIT, TLSConfig: tlsConfig},
+			{Name: "starttls", Network: "tcp", Address: "127.0.0.1:0", TLSMode: TLS_MODE_STARTTLS, TLSConfig: tlsConfig},
+		},
+	}
+
+	if err := server.Connect(); err != nil {
+		t.Fatalf("Unable to connect: %s", err)
+	}
+
+	received := storage.AddMailReceivedListener()
+	defer storage.RemoveMailReceivedListener(received)
+
+	go server.ProcessRequests()
+
+	tests := []struct {
+		listener *Listener
+		dial     func(address string) (net.Conn, error)
+		startTLS bool
+		tls      bool
+	}{
+		{server.Listeners[0], func(address string) (net.Conn, error) { return net.Dial("tcp", address) }, false, false},
+		{server.Listeners[1], func(address string) (net.Conn, error) { return net.Dial("unix", socket) }, false, false},
+		{server.Listeners[2], func(address string) (net.Conn, error) {
+			return tls.Dial("tcp", address, &tls.Config{ServerName: "localhost", InsecureSkipVerify: true})
+		}, false, true},
+		{server.Listeners[3], func(address string) (net.Conn, error) { return net.Dial("tcp", address) }, true, true},
+	}
+
+	for _, test := range tests {
+		connection, err := test.dial(test.listener.Addr().String())
+		if err != nil {
+			t.Fatalf("%s: unable to connect: %s", test.listener, err)
+		}
+
+		sendTestMail(t, connection, test.listener.Name, test.startTLS)
+
+		select {
+		case mailItem := <-received:
+			if mailItem.Subject != test.listener.Name {
+				t.Errorf("Expected the mail item sent to %s, got %q", test.listener, mailItem.Subject)
+			}
+
+			if mailItem.TLS != test.tls || (test.tls && len(mailItem.TLSVersion) == 0) {
+				t.Errorf("%s: expected TLS to be %v, got %v %q", test.listener, test.tls, mailItem.TLS, mailItem.TLSVersion)
+			}
+
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%s: timed out waiting for the mail item", test.listener)
+		}
+	}
+
+	server.Close()
+
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Errorf("Expected the socket file to be removed on close, got %v", err)
+	}
+}
@@ -4,20 +4,51 @@
 
 package smtp
 
+import "github.com/adampresley/mailslurper/admin/model"
+
 /*
 MailItemStruct is a struct describing a parsed mail item. This is
 populated after an incoming client connection has finished
 sending mail data to this server.
 */
 type MailItemStruct struct {
-	Id          int           `json:"id"`
-	DateSent    string        `json:"dateSent"`
-	FromAddress string        `json:"fromAddress"`
-	ToAddresses []string      `json:"toAddresses"`
-	Subject     string        `json:"subject"`
-	XMailer     string        `json:"xmailer"`
-	Body        string        `json:"body"`
-	ContentType string        `json:"contentType"`
-	Boundary    string        `json:"boundary"`
-	Attachments []*Attachment `json:"attachments"`
+	Id           int           `json:"id"`
+	DateSent     string        `json:"dateSent"`
+	FromAddress  string        `json:"fromAddress"`
+	ToAddresses  []string      `json:"toAddresses"`
+	Subject      string        `json:"subject"`
+	XMailer      string        `json:"xmailer"`
+	Body         string        `json:"body"`
+	ContentType  string        `json:"contentType"`
+	Boundary     string        `json:"boundary"`
+	Attachments  []*Attachment `json:"attachments"`
+	DateReceived string        `json:"dateReceived"`
+	RawSource    string        `json:"rawSource"`
+
+	// BODY declared on MAIL FROM, such as "8BITMIME", and whether
+	// the client asked for SMTPUTF8. BodyType is empty if not declared.
+	BodyType string `json:"bodyType"`
+	SMTPUTF8 bool   `json:"smtpUtf8"`
+
+	// Client the mail item was received from: its address, the name
+	// it gave in HELO or EHLO, the user it authenticated as with AUTH,
+	// and the TLS state of the connection. AuthUser is empty for
+	// clients that did not authenticate.
+	ClientIP       string `json:"clientIP"`
+	ClientPort     int    `json:"clientPort"`
+	HeloName       string `json:"heloName"`
+	AuthUser       string `json:"authUser"`
+	TLS            bool   `json:"tls"`
+	TLSVersion     string `json:"tlsVersion"`
+	TLSCipherSuite string `json:"tlsCipherSuite"`
+
+	// Outcome of the relay rules applied when the mail item was received
+	Relays []model.JSONMailRelay `json:"relays"`
+
+	// SMTP session the mail item was received in
+	Session *model.JSONSmtpSession `json:"-"`
 }
+
+// Format used to record the date and time a mail item was received.
+// Dates are always stored in UTC so they sort as plain strings.
+const DATE_RECEIVED_FORMAT = "2006-01-02T15:04:05.000000Z07:00"
@@ -0,0 +1,85 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package smtp
+
+import (
+	"log"
+	"strings"
+
+	"github.com/adampresley/mailslurper/admin/model"
+	"github.com/adampresley/mailslurper/profiling"
+)
+
+/*
+Records an attempt to relay a mail item to an upstream SMTP server,
+either released by hand or forwarded by a relay rule.
+*/
+func (ms *MailStorage) AddMailRelay(mailRelay model.JSONMailRelay) error {
+	profiling.Timer.Step("Writing mail relay")
+
+	_, err := ms.Db.Exec(
+		"INSERT INTO mailrelay (mailItemId, relayName, ruleName, recipients, success, errorMessage, dateRelayed) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		mailRelay.MailItemId,
+		mailRelay.RelayName,
+		mailRelay.RuleName,
+		strings.Join(mailRelay.Recipients, "; "),
+		mailRelay.Success,
+		mailRelay.Error,
+		mailRelay.DateRelayed,
+	)
+
+	return err
+}
+
+/*
+Retrieves the relay log for a mail item, newest first.
+*/
+func (ms *MailStorage) GetMailRelays(mailItemId int) []model.JSONMailRelay {
+	profiling.Timer.Step("Getting mail relays")
+
+	rows, err := ms.Db.Query(`
+		SELECT
+			  id
+			, mailItemId
+			, relayName
+			, ruleName
+			, recipients
+			, success
+			, errorMessage
+			, dateRelayed
+		FROM mailrelay
+		WHERE mailItemId=?
+		ORDER BY id DESC
+	`, mailItemId)
+
+	if err != nil {
+		log.Panic("Error running query to get mail relays: ", err)
+	}
+
+	defer rows.Close()
+
+	result := make([]model.JSONMailRelay, 0)
+
+	for rows.Next() {
+		var recipients string
+		mailRelay := model.JSONMailRelay{}
+
+		rows.Scan(
+			&mailRelay.Id,
+			&mailRelay.MailItemId,
+			&mailRelay.RelayName,
+			&mailRelay.RuleName,
+			&recipients,
+			&mailRelay.Success,
+			&mailRelay.Error,
+			&mailRelay.DateRelayed,
+		)
+
+		mailRelay.Recipients = strings.Split(recipients, "; ")
+		result = append(result, mailRelay)
+	}
+
+	return result
+}
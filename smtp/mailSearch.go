@@ -0,0 +1,114 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package smtp
+
+import (
+	"strings"
+
+	"github.com/adampresley/mailslurper/admin/model"
+)
+
+/*
+MailSearch describes criteria used to narrow down the mail items
+returned from storage. Fields left nil or empty are not used
+to filter results. Text matches any part of the subject, body,
+sender or recipients. Mailbox limits results to mail sent to a
+virtual mailbox, grouped by MailboxKind (one of the MAILBOX_BY_
+constants, defaulting to MAILBOX_BY_ADDRESS).
+*/
+type MailSearch struct {
+	IsRead      *bool
+	IsStarred   *bool
+	Tag         string
+	Text        string
+	Mailbox     string
+	MailboxKind string
+}
+
+/*
+Builds the WHERE clause, and the matching list of query parameters,
+for this set of search criteria. If there are no criteria an empty
+string is returned.
+*/
+func (search MailSearch) whereClause() (string, []interface{}) {
+	conditions := make([]string, 0)
+	parameters := make([]interface{}, 0)
+
+	if search.IsRead != nil {
+		conditions = append(conditions, "mailitem.isRead=?")
+		parameters = append(parameters, *search.IsRead)
+	}
+
+	if search.IsStarred != nil {
+		conditions = append(conditions, "mailitem.isStarred=?")
+		parameters = append(parameters, *search.IsStarred)
+	}
+
+	if len(strings.TrimSpace(search.Tag)) > 0 {
+		conditions = append(conditions, "mailitem.id IN (SELECT mailitemtag.mailItemId FROM mailitemtag WHERE mailitemtag.tag=?)")
+		parameters = append(parameters, strings.TrimSpace(search.Tag))
+	}
+
+	if len(strings.TrimSpace(search.Text)) > 0 {
+		text := "%" + strings.TrimSpace(search.Text) + "%"
+
+		conditions = append(conditions, "(mailitem.subject LIKE ? OR mailitem.body LIKE ? OR mailitem.fromAddress LIKE ? OR mailitem.toAddressList LIKE ?)")
+		parameters = append(parameters, text, text, text, text)
+	}
+
+	if len(conditions) <= 0 {
+		return "", parameters
+	}
+
+	return "WHERE " + strings.Join(conditions, " AND "), parameters
+}
+
+/*
+Returns only the mail items which were sent to the mailbox
+specified in this search. If no mailbox is specified the
+mail items are returned as-is.
+*/
+func (search MailSearch) filterByMailbox(mailItems []model.JSONMailItem) []model.JSONMailItem {
+	mailbox := strings.ToLower(strings.TrimSpace(search.Mailbox))
+	if len(mailbox) <= 0 {
+		return mailItems
+	}
+
+	result := make([]model.JSONMailItem, 0, len(mailItems))
+
+	for _, mailItem := range mailItems {
+		for _, name := range mailboxNames(mailItem.ToAddresses, search.MailboxKind) {
+			if name == mailbox {
+				result = append(result, mailItem)
+				break
+			}
+		}
+	}
+
+	return result
+}
+
+/*
+Takes a list of free-form tags and returns a cleaned up copy. Blank
+tags are dropped, surrounding whitespace is trimmed, and duplicates
+are removed while keeping the original order.
+*/
+func normalizeTags(tags []string) []string {
+	result := make([]string, 0, len(tags))
+	seen := make(map[string]bool)
+
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+
+		if len(tag) <= 0 || seen[tag] {
+			continue
+		}
+
+		seen[tag] = true
+		result = append(result, tag)
+	}
+
+	return result
+}
@@ -0,0 +1,93 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package smtp
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/adampresley/mailslurper/admin/model"
+)
+
+func TestMailSearchWhereClause(t *testing.T) {
+	yes, no := true, false
+
+	tests := []struct {
+		search     MailSearch
+		where      string
+		parameters []interface{}
+	}{
+		{MailSearch{}, "", []interface{}{}},
+		{MailSearch{IsRead: &yes}, "WHERE mailitem.isRead=?", []interface{}{true}},
+		{MailSearch{IsRead: &no, IsStarred: &yes}, "WHERE mailitem.isRead=? AND mailitem.isStarred=?", []interface{}{false, true}},
+		{MailSearch{Tag: "  "}, "", []interface{}{}},
+		{
+			MailSearch{Tag: " invoice "},
+			"WHERE mailitem.id IN (SELECT mailitemtag.mailItemId FROM mailitemtag WHERE mailitemtag.tag=?)",
+			[]interface{}{"invoice"},
+		},
+	}
+
+	for _, test := range tests {
+		where, parameters := test.search.whereClause()
+
+		if where != test.where {
+			t.Errorf("Expected %q, got %q", test.where, where)
+		}
+
+		if !reflect.DeepEqual(parameters, test.parameters) {
+			t.Errorf("Expected parameters %v for %q, got %v", test.parameters, test.where, parameters)
+		}
+	}
+}
+
+func TestMailSearchFilterByMailbox(t *testing.T) {
+	mailItems := []model.JSONMailItem{
+		{Id: 1, ToAddresses: []string{"<bob+signup@example.com>"}},
+		{Id: 2, ToAddresses: []string{"<alice@example.com>", "<bob@other.com>"}},
+		{Id: 3, ToAddresses: []string{"<Bob+Signup@Other.com>"}},
+	}
+
+	tests := []struct {
+		search   MailSearch
+		expected []int
+	}{
+		{MailSearch{}, []int{1, 2, 3}},
+		{MailSearch{Mailbox: "bob@other.com"}, []int{2}},
+		{MailSearch{Mailbox: " ALICE@example.com ", MailboxKind: MAILBOX_BY_ADDRESS}, []int{2}},
+		{MailSearch{Mailbox: "other.com", MailboxKind: MAILBOX_BY_DOMAIN}, []int{2, 3}},
+		{MailSearch{Mailbox: "signup", MailboxKind: MAILBOX_BY_TAG}, []int{1, 3}},
+		{MailSearch{Mailbox: "nobody", MailboxKind: MAILBOX_BY_TAG}, []int{}},
+	}
+
+	for _, test := range tests {
+		ids := make([]int, 0)
+		for _, mailItem := range test.search.filterByMailbox(mailItems) {
+			ids = append(ids, mailItem.Id)
+		}
+
+		if !reflect.DeepEqual(ids, test.expected) {
+			t.Errorf("Mailbox %q by %q: expected %v, got %v", test.search.Mailbox, test.search.MailboxKind, test.expected, ids)
+		}
+	}
+}
+
+func TestNormalizeTags(t *testing.T) {
+	tests := []struct {
+		tags     []string
+		expected []string
+	}{
+		{[]string{}, []string{}},
+		{[]string{""}, []string{}},
+		{[]string{" a ", "b", "a", "  ", "c"}, []string{"a", "b", "c"}},
+		{[]string{"Invoice", "invoice"}, []string{"Invoice", "invoice"}},
+	}
+
+	for _, test := range tests {
+		if result := normalizeTags(test.tags); !reflect.DeepEqual(result, test.expected) {
+			t.Errorf("normalizeTags(%q) = %q, expected %q", test.tags, result, test.expected)
+		}
+	}
+}
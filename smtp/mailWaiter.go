@@ -0,0 +1,107 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package smtp
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/adampresley/mailslurper/admin/model"
+	"github.com/adampresley/mailslurper/profiling"
+)
+
+/*
+MailCriteria describes a mail item someone is waiting for. To and From
+are compared against normalized addresses, Subject is a regular expression,
+and ReceivedAfter only matches mail received after the given time. Empty
+criteria match everything.
+*/
+type MailCriteria struct {
+	To            string
+	From          string
+	Subject       *regexp.Regexp
+	ReceivedAfter time.Time
+}
+
+/*
+Returns true if a mail item with the provided recipients, sender, subject
+and receive date satisfies these criteria.
+*/
+func (criteria MailCriteria) Matches(toAddresses []string, fromAddress string, subject string, dateReceived string) bool {
+	if len(strings.TrimSpace(criteria.To)) > 0 {
+		found := false
+		to := NormalizeAddress(criteria.To)
+
+		for _, address := range toAddresses {
+			if NormalizeAddress(address) == to {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	if len(strings.TrimSpace(criteria.From)) > 0 && NormalizeAddress(fromAddress) != NormalizeAddress(criteria.From) {
+		return false
+	}
+
+	if criteria.Subject != nil && !criteria.Subject.MatchString(subject) {
+		return false
+	}
+
+	if !criteria.ReceivedAfter.IsZero() {
+		received, err := time.Parse(DATE_RECEIVED_FORMAT, dateReceived)
+		if err != nil || !received.After(criteria.ReceivedAfter) {
+			return false
+		}
+	}
+
+	return true
+}
+
+/*
+Blocks until a mail item matching the criteria is in storage, the timeout
+elapses, or the cancel channel is closed. Mail already in storage is checked
+first, then new mail is watched for as it is written. When a match is found
+the full mail item and true are returned. Otherwise false is returned.
+*/
+func (ms *MailStorage) WaitForMail(criteria MailCriteria, timeout time.Duration, cancel <-chan struct{}) (model.JSONMailItem, bool) {
+	profiling.Timer.Step("Waiting for mail item")
+
+	/*
+	 * Start listening before looking at storage so a mail item
+	 * written in between is not missed.
+	 */
+	listener := ms.AddMailReceivedListener()
+	defer ms.RemoveMailReceivedListener(listener)
+
+	for _, mailItem := range ms.GetMails(MailSearch{}) {
+		if criteria.Matches(mailItem.ToAddresses, mailItem.FromAddress, mailItem.Subject, mailItem.DateReceived) {
+			return ms.GetMail(mailItem.Id), true
+		}
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case mailItem := <-listener:
+			if criteria.Matches(mailItem.ToAddresses, mailItem.FromAddress, mailItem.Subject, mailItem.DateReceived) {
+				return ms.GetMail(mailItem.Id), true
+			}
+
+		case <-timer.C:
+			return model.JSONMailItem{}, false
+
+		case <-cancel:
+			return model.JSONMailItem{}, false
+		}
+	}
+}
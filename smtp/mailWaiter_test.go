@@ -0,0 +1,96 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package smtp
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestMailCriteriaMatches(t *testing.T) {
+	received := "2014-06-01T12:00:00.000000Z"
+	to := []string{"<one@example.com>", "Two <two@example.com>"}
+
+	tests := []struct {
+		name     string
+		criteria MailCriteria
+		expected bool
+	}{
+		{"empty", MailCriteria{}, true},
+		{"second recipient", MailCriteria{To: "TWO@example.com"}, true},
+		{"other recipient", MailCriteria{To: "three@example.com"}, false},
+		{"sender", MailCriteria{From: "<sender@example.com>"}, true},
+		{"other sender", MailCriteria{From: "someone@example.com"}, false},
+		{"subject", MailCriteria{Subject: regexp.MustCompile("^Your code is [0-9]+$")}, true},
+		{"other subject", MailCriteria{Subject: regexp.MustCompile("^Welcome")}, false},
+		{"received after", MailCriteria{ReceivedAfter: time.Date(2014, 6, 1, 11, 59, 59, 0, time.UTC)}, true},
+		{"received before", MailCriteria{ReceivedAfter: time.Date(2014, 6, 1, 12, 0, 0, 0, time.UTC)}, false},
+		{"all", MailCriteria{To: "one@example.com", From: "sender@example.com", Subject: regexp.MustCompile("code")}, true},
+	}
+
+	for _, test := range tests {
+		if result := test.criteria.Matches(to, "Sender <sender@example.com>", "Your code is 1234", received); result != test.expected {
+			t.Errorf("%s: expected %t, got %t", test.name, test.expected, result)
+		}
+	}
+
+	if (MailCriteria{ReceivedAfter: time.Now()}).Matches(to, "", "", "") {
+		t.Error("Expected a mail item without a receive date not to match a ReceivedAfter criteria")
+	}
+}
+
+func TestWaitForMailFindsStoredMail(t *testing.T) {
+	storage := newTestStorage(t)
+	defer storage.Disconnect()
+
+	writeTestMail(t, storage, testMailItem("<one@example.com>", "Stored"))
+
+	mailItem, ok := storage.WaitForMail(MailCriteria{To: "one@example.com"}, time.Second, nil)
+	if !ok || mailItem.Subject != "Stored" || mailItem.Body != "Hello" {
+		t.Errorf("Expected the stored mail item with its body, got %t and %+v", ok, mailItem)
+	}
+}
+
+func TestWaitForMailWaitsForNewMail(t *testing.T) {
+	storage := newTestStorage(t)
+	defer storage.Disconnect()
+
+	writeTestMail(t, storage, testMailItem("<one@example.com>", "Not this one"))
+
+	dbWriteChannel := make(chan MailItemStruct, 1)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		dbWriteChannel <- testMailItem("<two@example.com>", "This one")
+		storage.StartWriteListener(dbWriteChannel)
+	}()
+
+	mailItem, ok := storage.WaitForMail(MailCriteria{To: "two@example.com"}, 5*time.Second, nil)
+	if !ok || mailItem.Subject != "This one" {
+		t.Errorf("Expected the new mail item, got %t and %+v", ok, mailItem)
+	}
+}
+
+func TestWaitForMailTimesOutAndCancels(t *testing.T) {
+	storage := newTestStorage(t)
+	defer storage.Disconnect()
+
+	if _, ok := storage.WaitForMail(MailCriteria{To: "nobody@example.com"}, 20*time.Millisecond, nil); ok {
+		t.Error("Expected no mail item before the timeout")
+	}
+
+	cancel := make(chan struct{})
+	close(cancel)
+
+	start := time.Now()
+	if _, ok := storage.WaitForMail(MailCriteria{To: "nobody@example.com"}, time.Minute, cancel); ok {
+		t.Error("Expected no mail item once cancelled")
+	}
+
+	if time.Since(start) > 5*time.Second {
+		t.Error("Expected cancelling to stop the wait straight away")
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package smtp
+
+import (
+	"net/mail"
+	"path"
+	"strings"
+)
+
+// Constants for the ways recipient addresses can be grouped into
+// virtual mailboxes. MAILBOX_BY_ADDRESS uses the full address,
+// MAILBOX_BY_DOMAIN uses everything after the @, and MAILBOX_BY_TAG
+// uses the plus-address tag (the "test123" in user+test123@domain.com).
+const (
+	MAILBOX_BY_ADDRESS string = "address"
+	MAILBOX_BY_DOMAIN  string = "domain"
+	MAILBOX_BY_TAG     string = "tag"
+)
+
+/*
+Returns true if the provided value is one of the MAILBOX_BY_ constants.
+*/
+func IsValidMailboxKind(kind string) bool {
+	return kind == MAILBOX_BY_ADDRESS || kind == MAILBOX_BY_DOMAIN || kind == MAILBOX_BY_TAG
+}
+
+/*
+Takes an address as sent by a client, such as "<Bob@Example.com>" or
+"Bob Smith <bob@example.com>", and returns the bare, lowercase address.
+*/
+func NormalizeAddress(address string) string {
+	address = strings.TrimSpace(address)
+
+	parsed, err := mail.ParseAddress(address)
+	if err == nil {
+		return strings.ToLower(parsed.Address)
+	}
+
+	return strings.ToLower(strings.Trim(address, "<> "))
+}
+
+/*
+Returns the name of the mailbox an address belongs to when mailboxes
+are grouped by the specified kind. An empty string is returned when the
+address does not belong to a mailbox of that kind, for example an
+address without a plus-address tag when grouping by tag.
+*/
+func MailboxName(address string, kind string) string {
+	address = NormalizeAddress(address)
+
+	atPos := strings.LastIndex(address, "@")
+	localPart := address
+	domain := ""
+
+	if atPos > -1 {
+		localPart = address[:atPos]
+		domain = address[atPos+1:]
+	}
+
+	switch kind {
+	case MAILBOX_BY_DOMAIN:
+		return domain
+
+	case MAILBOX_BY_TAG:
+		plusPos := strings.Index(localPart, "+")
+		if plusPos < 0 {
+			return ""
+		}
+
+		return localPart[plusPos+1:]
+
+	default:
+		return address
+	}
+}
+
+/*
+Returns the distinct mailbox names a list of recipient addresses
+belongs to when grouped by the specified kind.
+*/
+func mailboxNames(addresses []string, kind string) []string {
+	result := make([]string, 0, len(addresses))
+	seen := make(map[string]bool)
+
+	for _, address := range addresses {
+		name := MailboxName(address, kind)
+
+		if len(name) <= 0 || seen[name] {
+			continue
+		}
+
+		seen[name] = true
+		result = append(result, name)
+	}
+
+	return result
+}
+
+/*
+Returns true if an address matches a wildcard pattern such as
+"*@tenant-a.test" or "qa+*@example.com". Matching ignores case
+and angle brackets. An empty pattern matches every address.
+*/
+func MatchAddressPattern(pattern string, address string) bool {
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	if len(pattern) <= 0 {
+		return true
+	}
+
+	matched, err := path.Match(pattern, NormalizeAddress(address))
+	return err == nil && matched
+}
+
+/*
+Returns true if any address in a list matches a wildcard pattern.
+An empty pattern matches every list, even an empty one.
+*/
+func MatchAnyAddressPattern(pattern string, addresses []string) bool {
+	if len(strings.TrimSpace(pattern)) <= 0 {
+		return true
+	}
+
+	for _, address := range addresses {
+		if MatchAddressPattern(pattern, address) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,125 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package smtp
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeAddress(t *testing.T) {
+	tests := map[string]string{
+		"bob@example.com":             "bob@example.com",
+		"<Bob@Example.com>":           "bob@example.com",
+		"Bob Smith <bob@example.com>": "bob@example.com",
+		"  <bob@example.com>  ":       "bob@example.com",
+		"not an address":              "not an address",
+	}
+
+	for address, expected := range tests {
+		if result := NormalizeAddress(address); result != expected {
+			t.Errorf("NormalizeAddress(%q) = %q, expected %q", address, result, expected)
+		}
+	}
+}
+
+func TestMailboxName(t *testing.T) {
+	tests := []struct {
+		address  string
+		kind     string
+		expected string
+	}{
+		{"<Bob+Test123@Example.com>", MAILBOX_BY_ADDRESS, "bob+test123@example.com"},
+		{"<Bob+Test123@Example.com>", MAILBOX_BY_DOMAIN, "example.com"},
+		{"<Bob+Test123@Example.com>", MAILBOX_BY_TAG, "test123"},
+		{"<bob@example.com>", MAILBOX_BY_TAG, ""},
+		{"<bob+@example.com>", MAILBOX_BY_TAG, ""},
+		{"<a+b+c@example.com>", MAILBOX_BY_TAG, "b+c"},
+		{"postmaster", MAILBOX_BY_DOMAIN, ""},
+		{"<bob@example.com>", "", "bob@example.com"},
+	}
+
+	for _, test := range tests {
+		if result := MailboxName(test.address, test.kind); result != test.expected {
+			t.Errorf("MailboxName(%q, %q) = %q, expected %q", test.address, test.kind, result, test.expected)
+		}
+	}
+}
+
+func TestMailboxNames(t *testing.T) {
+	addresses := []string{"<a+x@one.com>", "<b@one.com>", "<c+y@two.com>", "<d+x@two.com>"}
+
+	tests := map[string][]string{
+		MAILBOX_BY_ADDRESS: {"a+x@one.com", "b@one.com", "c+y@two.com", "d+x@two.com"},
+		MAILBOX_BY_DOMAIN:  {"one.com", "two.com"},
+		MAILBOX_BY_TAG:     {"x", "y"},
+	}
+
+	for kind, expected := range tests {
+		if result := mailboxNames(addresses, kind); !reflect.DeepEqual(result, expected) {
+			t.Errorf("mailboxNames by %s = %v, expected %v", kind, result, expected)
+		}
+	}
+}
+
+func TestIsValidMailboxKind(t *testing.T) {
+	for _, kind := range []string{MAILBOX_BY_ADDRESS, MAILBOX_BY_DOMAIN, MAILBOX_BY_TAG} {
+		if !IsValidMailboxKind(kind) {
+			t.Errorf("Expected %q to be a valid mailbox kind", kind)
+		}
+	}
+
+	for _, kind := range []string{"", "Domain", "user"} {
+		if IsValidMailboxKind(kind) {
+			t.Errorf("Expected %q not to be a valid mailbox kind", kind)
+		}
+	}
+}
+
+func TestMatchAddressPattern(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		address  string
+		expected bool
+	}{
+		{"", "<anyone@example.com>", true},
+		{"  ", "<anyone@example.com>", true},
+		{"*@tenant-a.test", "<bob@tenant-a.test>", true},
+		{"*@tenant-a.test", "<bob@tenant-b.test>", false},
+		{"*@Tenant-A.test", "Bob <BOB@tenant-a.TEST>", true},
+		{"qa+*@example.com", "<qa+build12@example.com>", true},
+		{"qa+*@example.com", "<qa@example.com>", false},
+		{"bob@example.com", "bob@example.com", true},
+		{"bob@example.com", "bob@example.com.au", false},
+		{"[", "<bob@example.com>", false},
+	}
+
+	for _, test := range tests {
+		if result := MatchAddressPattern(test.pattern, test.address); result != test.expected {
+			t.Errorf("MatchAddressPattern(%q, %q) = %v, expected %v", test.pattern, test.address, result, test.expected)
+		}
+	}
+}
+
+func TestMatchAnyAddressPattern(t *testing.T) {
+	addresses := []string{"<bob@one.test>", "<alice@two.test>"}
+
+	tests := []struct {
+		pattern   string
+		addresses []string
+		expected  bool
+	}{
+		{"", nil, true},
+		{"*@two.test", addresses, true},
+		{"*@three.test", addresses, false},
+		{"*@one.test", nil, false},
+	}
+
+	for _, test := range tests {
+		if result := MatchAnyAddressPattern(test.pattern, test.addresses); result != test.expected {
+			t.Errorf("MatchAnyAddressPattern(%q, %v) = %v, expected %v", test.pattern, test.addresses, result, test.expected)
+		}
+	}
+}
@@ -26,6 +26,28 @@ func ConnectMSSQL(host string, port string, database string, userName string, pa
 	return db, nil
 }
 
+/*
+Columns to add to tables created by an earlier version of MailSlurper,
+which the OBJECT_ID checks leave as they were. Each has a default so
+rows already stored are given a value.
+*/
+var msSQLAddedColumns = []addedColumn{
+	{"mailitem", "isRead", "BIT NOT NULL DEFAULT 0"},
+	{"mailitem", "isStarred", "BIT NOT NULL DEFAULT 0"},
+	{"mailitem", "dateReceived", "VARCHAR(32) NOT NULL DEFAULT ''"},
+	{"mailitem", "rawSource", "TEXT NOT NULL DEFAULT ''"},
+	{"mailrelay", "ruleName", "VARCHAR(100) NOT NULL DEFAULT ''"},
+	{"mailitem", "bodyType", "VARCHAR(20) NOT NULL DEFAULT ''"},
+	{"mailitem", "smtpUtf8", "BIT NOT NULL DEFAULT 0"},
+	{"mailitem", "clientIP", "VARCHAR(45) NOT NULL DEFAULT ''"},
+	{"mailitem", "clientPort", "INT NOT NULL DEFAULT 0"},
+	{"mailitem", "heloName", "VARCHAR(255) NOT NULL DEFAULT ''"},
+	{"mailitem", "authUser", "VARCHAR(255) NOT NULL DEFAULT ''"},
+	{"mailitem", "tls", "BIT NOT NULL DEFAULT 0"},
+	{"mailitem", "tlsVersion", "VARCHAR(20) NOT NULL DEFAULT ''"},
+	{"mailitem", "tlsCipherSuite", "VARCHAR(100) NOT NULL DEFAULT ''"},
+}
+
 func CreateMSSQLDatabase(db *sql.DB) error {
 	log.Println("Creating tables...")
 
@@ -42,7 +64,20 @@ func CreateMSSQLDatabase(db *sql.DB) error {
 				xmailer VARCHAR(50),
 				body TEXT,
 				contentType VARCHAR(50),
-				boundary VARCHAR(50)
+				boundary VARCHAR(50),
+				dateReceived VARCHAR(32) NOT NULL DEFAULT '',
+				rawSource TEXT NOT NULL DEFAULT '',
+				bodyType VARCHAR(20) NOT NULL DEFAULT '',
+				smtpUtf8 BIT NOT NULL DEFAULT 0,
+				clientIP VARCHAR(45) NOT NULL DEFAULT '',
+				clientPort INT NOT NULL DEFAULT 0,
+				heloName VARCHAR(255) NOT NULL DEFAULT '',
+				authUser VARCHAR(255) NOT NULL DEFAULT '',
+				tls BIT NOT NULL DEFAULT 0,
+				tlsVersion VARCHAR(20) NOT NULL DEFAULT '',
+				tlsCipherSuite VARCHAR(100) NOT NULL DEFAULT '',
+				isRead BIT NOT NULL DEFAULT 0,
+				isStarred BIT NOT NULL DEFAULT 0
 			);
 		END
 	`
@@ -69,6 +104,118 @@ func CreateMSSQLDatabase(db *sql.DB) error {
 		return err
 	}
 
+	sql = `
+		IF OBJECT_ID('mailitemtag', 'U') IS NULL BEGIN
+			CREATE TABLE mailitemtag (
+				id INT NOT NULL PRIMARY KEY IDENTITY(1,1),
+				mailItemId INT,
+				tag VARCHAR(100)
+			);
+		END
+	`
+
+	_, err = db.Exec(sql)
+	if err != nil {
+		return err
+	}
+
+	sql = `
+		IF OBJECT_ID('webhookdelivery', 'U') IS NULL BEGIN
+			CREATE TABLE webhookdelivery (
+				id INT NOT NULL PRIMARY KEY IDENTITY(1,1),
+				mailItemId INT,
+				webhookName VARCHAR(100),
+				url VARCHAR(512),
+				attempt INT,
+				statusCode INT,
+				success BIT NOT NULL DEFAULT 0,
+				errorMessage TEXT,
+				dateAttempted VARCHAR(32)
+			);
+		END
+	`
+
+	_, err = db.Exec(sql)
+	if err != nil {
+		return err
+	}
+
+	sql = `
+		IF OBJECT_ID('mailevent', 'U') IS NULL BEGIN
+			CREATE TABLE mailevent (
+				id INT NOT NULL PRIMARY KEY IDENTITY(1,1),
+				eventType VARCHAR(50),
+				mailItemId INT,
+				data TEXT,
+				dateCreated VARCHAR(32)
+			);
+		END
+	`
+
+	_, err = db.Exec(sql)
+	if err != nil {
+		return err
+	}
+
+	sql = `
+		IF OBJECT_ID('mailrelay', 'U') IS NULL BEGIN
+			CREATE TABLE mailrelay (
+				id INT NOT NULL PRIMARY KEY IDENTITY(1,1),
+				mailItemId INT,
+				relayName VARCHAR(100),
+				ruleName VARCHAR(100) NOT NULL DEFAULT '',
+				recipients TEXT,
+				success BIT NOT NULL DEFAULT 0,
+				errorMessage TEXT,
+				dateRelayed VARCHAR(32)
+			);
+		END
+	`
+
+	_, err = db.Exec(sql)
+	if err != nil {
+		return err
+	}
+
+	sql = `
+		IF OBJECT_ID('smtpsession', 'U') IS NULL BEGIN
+			CREATE TABLE smtpsession (
+				id INT NOT NULL PRIMARY KEY IDENTITY(1,1),
+				mailItemId INT NOT NULL DEFAULT 0,
+				clientAddress VARCHAR(100),
+				heloName VARCHAR(255),
+				tls BIT NOT NULL DEFAULT 0,
+				tlsVersion VARCHAR(20),
+				tlsCipherSuite VARCHAR(100),
+				outcome VARCHAR(20),
+				dateStarted VARCHAR(32),
+				dateEnded VARCHAR(32),
+				transcript TEXT
+			);
+		END
+	`
+
+	_, err = db.Exec(sql)
+	if err != nil {
+		return err
+	}
+
+	for _, column := range msSQLAddedColumns {
+		sql = fmt.Sprintf(
+			"IF COL_LENGTH('%s', '%s') IS NULL BEGIN ALTER TABLE %s ADD %s %s; END",
+			column.table,
+			column.name,
+			column.table,
+			column.name,
+			column.definition,
+		)
+
+		_, err = db.Exec(sql)
+		if err != nil {
+			return err
+		}
+	}
+
 	log.Println("Created tables successfully.")
 	return nil
 }
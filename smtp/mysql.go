@@ -20,7 +20,7 @@ func ConnectMySQL(host string, port string, database string, userName string, pa
 	 */
 	log.Println("Connecting to MySQL database")
 
-	db, err := sql.Open("mysql", fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?autocommit=true", userName, password, host, port, database))
+	db, err := sql.Open("mysql", fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?autocommit=true&clientFoundRows=true", userName, password, host, port, database))
 	if err != nil {
 		return nil, err
 	}
@@ -38,6 +38,30 @@ func ConnectMySQL(host string, port string, database string, userName string, pa
 	return db, nil
 }
 
+/*
+Columns added to tables after they were first created. Tables made by
+an earlier version of MailSlurper are missing them, as CREATE TABLE IF
+NOT EXISTS leaves existing tables alone, so they are added on startup.
+Each is NOT NULL with a default, so rows already stored are given a
+value; TEXT columns cannot have a default and are given an empty string.
+*/
+var mySQLAddedColumns = []addedColumn{
+	{"mailitem", "isRead", "TINYINT(1) NOT NULL DEFAULT 0"},
+	{"mailitem", "isStarred", "TINYINT(1) NOT NULL DEFAULT 0"},
+	{"mailitem", "dateReceived", "VARCHAR(32) NOT NULL DEFAULT ''"},
+	{"mailitem", "rawSource", "LONGTEXT NOT NULL"},
+	{"mailrelay", "ruleName", "VARCHAR(100) NOT NULL DEFAULT ''"},
+	{"mailitem", "bodyType", "VARCHAR(20) NOT NULL DEFAULT ''"},
+	{"mailitem", "smtpUtf8", "TINYINT(1) NOT NULL DEFAULT 0"},
+	{"mailitem", "clientIP", "VARCHAR(45) NOT NULL DEFAULT ''"},
+	{"mailitem", "clientPort", "INT NOT NULL DEFAULT 0"},
+	{"mailitem", "heloName", "VARCHAR(255) NOT NULL DEFAULT ''"},
+	{"mailitem", "authUser", "VARCHAR(255) NOT NULL DEFAULT ''"},
+	{"mailitem", "tls", "TINYINT(1) NOT NULL DEFAULT 0"},
+	{"mailitem", "tlsVersion", "VARCHAR(20) NOT NULL DEFAULT ''"},
+	{"mailitem", "tlsCipherSuite", "VARCHAR(100) NOT NULL DEFAULT ''"},
+}
+
 func CreateMySQLDatabase(db *sql.DB) error {
 	log.Println("Creating tables...")
 
@@ -53,7 +77,20 @@ func CreateMySQLDatabase(db *sql.DB) error {
 			xmailer VARCHAR(50),
 			body TEXT,
 			contentType VARCHAR(50),
-			boundary VARCHAR(50)
+			boundary VARCHAR(50),
+			dateReceived VARCHAR(32) NOT NULL DEFAULT '',
+			rawSource LONGTEXT NOT NULL,
+			bodyType VARCHAR(20) NOT NULL DEFAULT '',
+			smtpUtf8 TINYINT(1) NOT NULL DEFAULT 0,
+			clientIP VARCHAR(45) NOT NULL DEFAULT '',
+			clientPort INT NOT NULL DEFAULT 0,
+			heloName VARCHAR(255) NOT NULL DEFAULT '',
+			authUser VARCHAR(255) NOT NULL DEFAULT '',
+			tls TINYINT(1) NOT NULL DEFAULT 0,
+			tlsVersion VARCHAR(20) NOT NULL DEFAULT '',
+			tlsCipherSuite VARCHAR(100) NOT NULL DEFAULT '',
+			isRead TINYINT(1) NOT NULL DEFAULT 0,
+			isStarred TINYINT(1) NOT NULL DEFAULT 0
 		);
 	`
 
@@ -77,6 +114,117 @@ func CreateMySQLDatabase(db *sql.DB) error {
 		return err
 	}
 
+	sql = `
+		CREATE TABLE IF NOT EXISTS mailitemtag (
+			id INT NOT NULL PRIMARY KEY AUTO_INCREMENT,
+			mailItemId INT,
+			tag VARCHAR(100)
+		);
+	`
+
+	_, err = db.Exec(sql)
+	if err != nil {
+		return err
+	}
+
+	sql = `
+		CREATE TABLE IF NOT EXISTS webhookdelivery (
+			id INT NOT NULL PRIMARY KEY AUTO_INCREMENT,
+			mailItemId INT,
+			webhookName VARCHAR(100),
+			url VARCHAR(512),
+			attempt INT,
+			statusCode INT,
+			success TINYINT(1) NOT NULL DEFAULT 0,
+			errorMessage TEXT,
+			dateAttempted VARCHAR(32)
+		);
+	`
+
+	_, err = db.Exec(sql)
+	if err != nil {
+		return err
+	}
+
+	sql = `
+		CREATE TABLE IF NOT EXISTS mailevent (
+			id INT NOT NULL PRIMARY KEY AUTO_INCREMENT,
+			eventType VARCHAR(50),
+			mailItemId INT,
+			data LONGTEXT,
+			dateCreated VARCHAR(32)
+		);
+	`
+
+	_, err = db.Exec(sql)
+	if err != nil {
+		return err
+	}
+
+	sql = `
+		CREATE TABLE IF NOT EXISTS mailrelay (
+			id INT NOT NULL PRIMARY KEY AUTO_INCREMENT,
+			mailItemId INT,
+			relayName VARCHAR(100),
+			ruleName VARCHAR(100) NOT NULL DEFAULT '',
+			recipients TEXT,
+			success TINYINT(1) NOT NULL DEFAULT 0,
+			errorMessage TEXT,
+			dateRelayed VARCHAR(32)
+		);
+	`
+
+	_, err = db.Exec(sql)
+	if err != nil {
+		return err
+	}
+
+	sql = `
+		CREATE TABLE IF NOT EXISTS smtpsession (
+			id INT NOT NULL PRIMARY KEY AUTO_INCREMENT,
+			mailItemId INT NOT NULL DEFAULT 0,
+			clientAddress VARCHAR(100),
+			heloName VARCHAR(255),
+			tls TINYINT(1) NOT NULL DEFAULT 0,
+			tlsVersion VARCHAR(20),
+			tlsCipherSuite VARCHAR(100),
+			outcome VARCHAR(20),
+			dateStarted VARCHAR(32),
+			dateEnded VARCHAR(32),
+			transcript LONGTEXT
+		);
+	`
+
+	_, err = db.Exec(sql)
+	if err != nil {
+		return err
+	}
+
+	for _, column := range mySQLAddedColumns {
+		var count int
+
+		err = db.QueryRow(
+			"SELECT COUNT(*) FROM information_schema.COLUMNS WHERE TABLE_SCHEMA=DATABASE() AND TABLE_NAME=? AND COLUMN_NAME=?",
+			column.table,
+			column.name,
+		).Scan(&count)
+
+		if err != nil {
+			return err
+		}
+
+		if count > 0 {
+			continue
+		}
+
+		log.Printf("Adding column %s to table %s\n", column.name, column.table)
+
+		_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD %s %s", column.table, column.name, column.definition))
+		if err != nil {
+			return err
+		}
+	}
+
 	log.Println("Created tables successfully.")
 	return nil
 }
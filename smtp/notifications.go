@@ -0,0 +1,78 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package smtp
+
+import "log"
+
+// Number of new mail notifications a listener can have queued
+// before further notifications to it are dropped
+const MAIL_LISTENER_BUFFER_LEN = 100
+
+/*
+Registers a new listener for mail items that have been written to this
+storage. The returned channel receives every new mail item until the
+listener is removed with RemoveMailReceivedListener.
+*/
+func (ms *MailStorage) AddMailReceivedListener() chan MailItemStruct {
+	return ms.addMailReceivedListener(false)
+}
+
+/*
+Registers a new listener like AddMailReceivedListener, except that no
+notification is ever dropped: storing new mail items waits until the
+listener has room. The listener must be read from promptly until it is
+removed with RemoveMailReceivedListener.
+*/
+func (ms *MailStorage) AddBlockingMailReceivedListener() chan MailItemStruct {
+	return ms.addMailReceivedListener(true)
+}
+
+func (ms *MailStorage) addMailReceivedListener(blocking bool) chan MailItemStruct {
+	listener := make(chan MailItemStruct, MAIL_LISTENER_BUFFER_LEN)
+
+	ms.listenersLock.Lock()
+	defer ms.listenersLock.Unlock()
+
+	if ms.listeners == nil {
+		ms.listeners = make(map[chan MailItemStruct]bool)
+	}
+
+	ms.listeners[listener] = blocking
+	return listener
+}
+
+/*
+Stops sending new mail items to a listener created with
+AddMailReceivedListener.
+*/
+func (ms *MailStorage) RemoveMailReceivedListener(listener chan MailItemStruct) {
+	ms.listenersLock.Lock()
+	delete(ms.listeners, listener)
+	ms.listenersLock.Unlock()
+}
+
+/*
+Called once a new mail item has been committed to storage. This sends
+the mail item to all registered listeners. Listeners that are not keeping
+up have the notification dropped, and logged, rather than holding up the
+storage write listener, unless they were added as blocking listeners.
+*/
+func (ms *MailStorage) notifyMailReceived(mailItem MailItemStruct) {
+	ms.listenersLock.Lock()
+	defer ms.listenersLock.Unlock()
+
+	for listener, blocking := range ms.listeners {
+		if blocking {
+			listener <- mailItem
+			continue
+		}
+
+		select {
+		case listener <- mailItem:
+		default:
+			log.Printf("A mail received listener is not keeping up, so it was not told about mail item %d\n", mailItem.Id)
+		}
+	}
+}
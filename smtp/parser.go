@@ -6,8 +6,12 @@ package smtp
 
 import (
 	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
 	"log"
 	"net"
+	"strconv"
 	"strings"
 	"time"
 
@@ -17,12 +21,19 @@ import (
 // Constants representing the commands that an SMTP client will
 // send during the course of communicating with our server.
 const (
-	DATA int = iota
-	RCPT int = iota
-	MAIL int = iota
-	HELO int = iota
-	RSET int = iota
-	QUIT int = iota
+	DATA     int = iota
+	RCPT     int = iota
+	MAIL     int = iota
+	HELO     int = iota
+	RSET     int = iota
+	QUIT     int = iota
+	BDAT     int = iota
+	NOOP     int = iota
+	VRFY     int = iota
+	EXPN     int = iota
+	HELP     int = iota
+	STARTTLS int = iota
+	AUTH     int = iota
 )
 
 // Constants for the various states the parser can be in. The parser
@@ -42,11 +53,14 @@ const (
 // CONN_TIMEOUT_MILLISECONDS is how many milliseconds to wait before
 // attempting to read from the socket again. COMMAND_TIMEOUT_SETTINGS
 // is how long to hold the socket open without recieving commands
-// before closing with an error.
+// before closing with an error. MAX_CHUNK_LEN is the most bytes read
+// from the socket in one go, so message content is checked against
+// the size limit as it streams in.
 const (
 	RECEIVE_BUFFER_LEN        = 1024
 	CONN_TIMEOUT_MILLISECONDS = 5
 	COMMAND_TIMEOUT_SECONDS   = 5
+	MAX_CHUNK_LEN             = 65536
 )
 
 // This is a command map of SMTP command strings to their int
@@ -62,6 +76,13 @@ var Commands = map[string]int{
 	"rset":      RSET,
 	"quit":      QUIT,
 	"data":      DATA,
+	"bdat":      BDAT,
+	"noop":      NOOP,
+	"vrfy":      VRFY,
+	"expn":      EXPN,
+	"help":      HELP,
+	"starttls":  STARTTLS,
+	"auth":      AUTH,
 }
 
 // SMTP parser. The parser type keeps the current state of a parsing session,
@@ -71,6 +92,80 @@ type Parser struct {
 	State      int
 	Connection net.Conn
 	MailItem   MailItemStruct
+
+	// Fault rules to apply to this session. May be nil.
+	Faults *FaultInjector
+
+	// Latency rules to apply to this session. May be nil.
+	Latency *LatencySimulator
+
+	// Greylist recipients are checked against. May be nil.
+	Greylist *Greylist
+
+	// Largest message in bytes and most recipients per message
+	// accepted. Zero means no limit.
+	MaxMessageSize int
+	MaxRecipients  int
+
+	// Whether BDAT (RFC 3030 CHUNKING) is offered
+	Chunking bool
+
+	// Whether commands are checked in strict mode. See SMTP_MODE_STRICT.
+	Strict bool
+
+	// Answers VRFY and EXPN. When nil they are always answered with 252.
+	Verifier *AddressVerifier
+
+	// Per-client message rate limit. May be nil.
+	RateLimiter *RateLimiter
+
+	// Records the commands and responses of this session. May be nil.
+	Transcript *Transcript
+
+	// Extensions advertised in reply to EHLO. When nil all are offered.
+	Extensions []string
+
+	// Certificate used to upgrade the connection with STARTTLS. STARTTLS
+	// is only offered when this is set.
+	TLSConfig *tls.Config
+
+	// Name of this server, given in the Received header added to
+	// accepted messages
+	HostName string
+
+	// Whether HELO or EHLO has been given, and whether a mail
+	// transaction has been started with MAIL FROM
+	greeted       bool
+	inTransaction bool
+
+	// Name the client gave in HELO or EHLO, and whether it used EHLO
+	heloName string
+	extended bool
+
+	// User the client authenticated as with AUTH
+	authUser string
+
+	// Messages accepted after DATA or BDAT, in the order they were
+	// received. Only accepted messages are stored.
+	Messages []MailItemStruct
+
+	// Data read from the connection but not yet processed, such as
+	// commands pipelined after a BDAT chunk
+	pending string
+
+	// Set once the client has closed the connection, so the session
+	// can end instead of waiting for the command timeout
+	disconnected bool
+
+	// Message content collected from BDAT chunks so far
+	chunks         bytes.Buffer
+	chunksTooLarge bool
+
+	// Delay to hold back the next response for, and the total
+	// simulated delay so far, which does not count toward the
+	// command timeout.
+	responseDelay  time.Duration
+	simulatedDelay time.Duration
 }
 
 /*
@@ -82,9 +177,6 @@ func (parser *Parser) CommandRouter(command int, input string) bool {
 	var result bool
 	var response string
 
-	var headers *MailHeader
-	var body *MailBody
-
 	switch command {
 	case HELO:
 		result, response = parser.Process_HELO(strings.TrimSpace(input))
@@ -94,8 +186,9 @@ func (parser *Parser) CommandRouter(command int, input string) bool {
 		result, response = parser.Process_MAIL(strings.TrimSpace(input))
 		if result == false {
 			log.Println("An error occurred processing the MAIL FROM command: ", response)
-		} else {
+		} else if len(response) > 0 {
 			parser.MailItem.FromAddress = response
+			parser.inTransaction = true
 			log.Println("Mail from: ", parser.MailItem.FromAddress)
 		}
 
@@ -105,29 +198,53 @@ func (parser *Parser) CommandRouter(command int, input string) bool {
 		result, response = parser.Process_RCPT(strings.TrimSpace(input))
 		if result == false {
 			log.Println("An error occurred process the RCPT TO command: ", response)
-		} else {
+		} else if len(response) > 0 {
 			parser.MailItem.ToAddresses = append(parser.MailItem.ToAddresses, response)
 		}
 
 		return result
 
-	case DATA:
-		result, response, headers, body = parser.Process_DATA(strings.TrimSpace(input))
+	case DATA, BDAT:
+		if command == DATA {
+			result, response, _, _ = parser.Process_DATA(strings.TrimSpace(input))
+		} else {
+			result, response, _, _ = parser.Process_BDAT(input)
+		}
+
 		if result == false {
 			log.Println("An error occurred while reading the DATA chunk: ", response)
-		} else {
-			if len(strings.TrimSpace(body.HTMLBody)) <= 0 {
-				parser.MailItem.Body = body.TextBody
-			} else {
-				parser.MailItem.Body = body.HTMLBody
-			}
+		}
+
+		return result
+
+	case RSET:
+		result, response = parser.Process_RSET(strings.TrimSpace(input))
+		return result
 
-			parser.MailItem.Subject = headers.Subject
-			parser.MailItem.DateSent = headers.Date
-			parser.MailItem.XMailer = headers.XMailer
-			parser.MailItem.ContentType = headers.ContentType
-			parser.MailItem.Boundary = headers.Boundary
-			parser.MailItem.Attachments = body.Attachments
+	case NOOP:
+		result, response = parser.Process_NOOP(strings.TrimSpace(input))
+		return result
+
+	case VRFY, EXPN:
+		result, response = parser.Process_VRFY(command, strings.TrimSpace(input))
+		return result
+
+	case HELP:
+		result, response = parser.Process_HELP(strings.TrimSpace(input))
+		return result
+
+	case STARTTLS:
+		result, response = parser.Process_STARTTLS(strings.TrimSpace(input))
+		if result == false {
+			log.Println("An error occurred processing the STARTTLS command: ", response)
+		}
+
+		return result
+
+	case AUTH:
+		result, response = parser.Process_AUTH(strings.TrimSpace(input))
+		if result == false {
+			log.Println("An error occurred processing the AUTH command: ", response)
 		}
 
 		return result
@@ -139,13 +256,21 @@ func (parser *Parser) CommandRouter(command int, input string) bool {
 
 /*
 Takes a string and returns the integer command representation. For example
-if the string contains "DATA" then the value 1 (the constant DATA) will be returned.
+if the string starts with "DATA" then the value 0 (the constant DATA) will be returned.
+Only the first line is looked at, as a BDAT command may be followed by its data.
+-1 is returned if the command is not recognized.
 */
 func (parser *Parser) ParseCommand(line string) int {
 	result := -1
 
+	if index := strings.Index(line, "\n"); index > -1 {
+		line = line[:index]
+	}
+
+	line = strings.ToLower(strings.TrimSpace(line))
+
 	for key, value := range Commands {
-		if strings.Index(strings.ToLower(line), key) > -1 {
+		if line == key || strings.HasPrefix(line, key+" ") || strings.HasPrefix(line, key+":") {
 			result = value
 			break
 		}
@@ -157,7 +282,8 @@ func (parser *Parser) ParseCommand(line string) int {
 /*
 Function to process the HELO and EHLO SMTP commands. This command
 responds to clients with a 250 greeting code and returns success
-or false and an error message (if any).
+or false and an error message (if any). The reply to EHLO also lists
+the extensions supported.
 */
 func (parser *Parser) Process_HELO(line string) (bool, string) {
 	lowercaseLine := strings.ToLower(line)
@@ -167,12 +293,40 @@ func (parser *Parser) Process_HELO(line string) (bool, string) {
 		return false, "Invalid command"
 	}
 
-	split := strings.Split(line, " ")
+	split := strings.Fields(line)
 	if len(split) < 2 {
-		return false, "HELO command format is invalid"
+		parser.SendResponse("501 5.5.4 Syntax: HELO hostname")
+		return true, ""
+	}
+
+	if parser.injectFault(FAULT_STAGE_HELO, parser.MailItem.FromAddress, nil) {
+		return true, ""
 	}
 
-	result, _ := parser.SendResponse("250 Hello. How very nice to meet you!")
+	lines := []string{"Hello. How very nice to meet you!"}
+	if strings.HasPrefix(lowercaseLine, "ehlo") {
+		lines = append(lines, parser.extensions()...)
+	}
+
+	for index := range lines {
+		separator := "-"
+		if index == len(lines)-1 {
+			separator = " "
+		}
+
+		lines[index] = "250" + separator + lines[index]
+	}
+
+	parser.resetTransaction()
+	parser.greeted = true
+	parser.heloName = split[1]
+	parser.extended = strings.HasPrefix(lowercaseLine, "ehlo")
+
+	if parser.Transcript != nil {
+		parser.Transcript.HeloName = split[1]
+	}
+
+	result, _ := parser.SendResponse(strings.Join(lines, "\r\n"))
 	if result != true {
 		return false, "Error writing to connection stream in response to HELO"
 	}
@@ -191,19 +345,58 @@ func (parser *Parser) Process_MAIL(line string) (bool, string) {
 		return false, "Invalid command"
 	}
 
-	split := strings.Split(line, ":")
-	if len(split) < 2 {
-		return false, "MAIL FROM command format is invalid"
+	argument, ok := commandArgument(line, "mail from")
+	if !ok {
+		parser.SendResponse("501 5.5.4 Syntax: MAIL FROM:<address>")
+		return true, ""
 	}
 
-	from := strings.Join(split[1:], "")
+	from, parameters := splitPathAndParameters(argument)
+
+	if parser.RateLimiter != nil && !parser.RateLimiter.AllowMessage(parser.Connection.RemoteAddr().String()) {
+		log.Println("Message rate limit reached for ", parser.Connection.RemoteAddr())
+		parser.SendResponse("450 4.7.1 Too many messages from your address, try again later")
+		return true, ""
+	}
+
+	if parser.injectFault(FAULT_STAGE_MAIL, from, nil) {
+		return true, ""
+	}
+
+	if reply := checkMailParameters(parameters, parser.Chunking); len(reply) > 0 {
+		parser.SendResponse(reply)
+		return true, ""
+	}
+
+	_, smtpUTF8 := parameters["SMTPUTF8"]
+	if reply := checkAddressEncoding(from, smtpUTF8); len(reply) > 0 {
+		parser.SendResponse(reply)
+		return true, ""
+	}
+
+	if size, ok := parameters["SIZE"]; ok {
+		declaredSize, _ := strconv.Atoi(size)
+		if parser.MaxMessageSize > 0 && declaredSize > parser.MaxMessageSize {
+			log.Printf("Declared message size %d exceeds the limit of %d\n", declaredSize, parser.MaxMessageSize)
+			parser.SendResponse("552 5.3.4 Message size exceeds fixed maximum message size")
+			return true, ""
+		}
+	}
+
+	/*
+	 * Each transaction starts a new message, so nothing is carried
+	 * over from one that was refused or abandoned
+	 */
+	parser.resetTransaction()
+	parser.MailItem.BodyType = strings.ToUpper(parameters["BODY"])
+	parser.MailItem.SMTPUTF8 = smtpUTF8
 
 	result, _ := parser.SendOkResponse()
 	if result != true {
 		return false, "Error writing to connection stream in response to MAIL FROM"
 	}
 
-	return true, strings.TrimSpace(from)
+	return true, from
 }
 
 /*
@@ -218,19 +411,341 @@ func (parser *Parser) Process_RCPT(line string) (bool, string) {
 		return false, "Invalid command"
 	}
 
-	split := strings.Split(line, ":")
-	if len(split) < 2 {
-		return false, "RCPT TO command format is invalid"
+	argument, ok := commandArgument(line, "rcpt to")
+	if !ok {
+		parser.SendResponse("501 5.5.4 Syntax: RCPT TO:<address>")
+		return true, ""
+	}
+
+	to, parameters := splitPathAndParameters(argument)
+
+	if len(parameters) > 0 {
+		parser.SendResponse("555 5.5.4 RCPT TO parameters not supported")
+		return true, ""
+	}
+
+	if reply := checkAddressEncoding(to, parser.MailItem.SMTPUTF8); len(reply) > 0 {
+		parser.SendResponse(reply)
+		return true, ""
 	}
 
-	to := strings.Join(split[1:], "")
+	parser.delayNextResponse(LATENCY_STAGE_RCPT, []string{to})
+
+	if parser.injectFault(FAULT_STAGE_RCPT, parser.MailItem.FromAddress, []string{to}) {
+		return true, ""
+	}
+
+	if parser.MaxRecipients > 0 && len(parser.MailItem.ToAddresses) >= parser.MaxRecipients {
+		log.Println("Too many recipients, refusing: ", to)
+		parser.SendResponse("452 4.5.3 Too many recipients")
+		return true, ""
+	}
+
+	if parser.Greylist != nil && !parser.Greylist.Check(parser.Connection.RemoteAddr().String(), parser.MailItem.FromAddress, to) {
+		log.Println("Greylisted recipient: ", to)
+		parser.SendResponse("451 4.7.1 Greylisted, please try again later")
+		return true, ""
+	}
 
 	result, _ := parser.SendOkResponse()
 	if result != true {
 		return false, "Error writing to connection stream in response to RCPT TO"
 	}
 
-	return true, strings.TrimSpace(to)
+	return true, to
+}
+
+/*
+Function to process the RSET command (constant RSET). This abandons
+the current transaction so a client can start over, for example after
+one of its commands was refused, and responds with 250 Ok. Messages
+that have already been accepted are kept.
+*/
+func (parser *Parser) Process_RSET(line string) (bool, string) {
+	parser.resetTransaction()
+
+	result, _ := parser.SendOkResponse()
+	if result != true {
+		return false, "Error writing to connection stream in response to RSET"
+	}
+
+	return true, ""
+}
+
+/*
+Function to process the NOOP command (constant NOOP). This does nothing
+but respond with 250 Ok, and is often used by clients and monitoring to
+check the connection is still alive.
+*/
+func (parser *Parser) Process_NOOP(line string) (bool, string) {
+	result, _ := parser.SendOkResponse()
+	if result != true {
+		return false, "Error writing to connection stream in response to NOOP"
+	}
+
+	return true, ""
+}
+
+/*
+Function to process the VRFY and EXPN commands (constants VRFY and EXPN).
+VRFY asks whether an address exists and EXPN asks for the members of a
+mailing list. How they are answered depends on the parser's Verifier.
+*/
+func (parser *Parser) Process_VRFY(command int, line string) (bool, string) {
+	split := strings.SplitN(line, " ", 2)
+	if len(split) < 2 || len(strings.TrimSpace(split[1])) <= 0 {
+		parser.SendResponse(fmt.Sprintf("501 5.5.4 Syntax: %s <address>", strings.ToUpper(split[0])))
+		return true, ""
+	}
+
+	verifier := parser.Verifier
+	if verifier == nil {
+		verifier = &AddressVerifier{Mode: VRFY_MODE_ALWAYS}
+	}
+
+	reply := verifier.Verify(split[1])
+	if command == EXPN {
+		reply = verifier.Expand(split[1])
+	}
+
+	result, _ := parser.SendResponse(reply)
+	if result != true {
+		return false, "Error writing to connection stream in response to VRFY"
+	}
+
+	return true, ""
+}
+
+/*
+Function to process the HELP command (constant HELP). This responds with
+a 214 reply listing the commands the server understands.
+*/
+func (parser *Parser) Process_HELP(line string) (bool, string) {
+	commands := "HELO EHLO MAIL RCPT DATA RSET NOOP VRFY EXPN HELP QUIT"
+	if parser.Chunking {
+		commands = "HELO EHLO MAIL RCPT DATA BDAT RSET NOOP VRFY EXPN HELP QUIT"
+	}
+
+	if parser.authAvailable() {
+		commands += " AUTH"
+	}
+
+	if parser.startTLSAvailable() {
+		commands += " STARTTLS"
+	}
+
+	response := []string{
+		"214-2.0.0 This is MailSlurper, a mail server for testing.",
+		"214-2.0.0 Commands:",
+		"214-2.0.0   " + commands,
+		"214 2.0.0 End of HELP info",
+	}
+
+	result, _ := parser.SendResponse(strings.Join(response, "\r\n"))
+	if result != true {
+		return false, "Error writing to connection stream in response to HELP"
+	}
+
+	return true, ""
+}
+
+/*
+Function to process the STARTTLS command (constant STARTTLS) from RFC 3207.
+After a 220 reply the TLS handshake is done on the connection, which then
+replaces it. The session starts over, so the client must send EHLO again.
+Commands pipelined after STARTTLS are thrown away, as they were sent before
+the connection was secure. A failed handshake ends the session.
+*/
+func (parser *Parser) Process_STARTTLS(line string) (bool, string) {
+	if len(strings.Fields(line)) > 1 {
+		parser.SendResponse("501 5.5.4 Syntax: STARTTLS")
+		return true, ""
+	}
+
+	if _, ok := parser.Connection.(*tls.Conn); ok {
+		parser.SendResponse("503 5.5.1 TLS already active")
+		return true, ""
+	}
+
+	if !parser.startTLSAvailable() {
+		parser.SendResponse("502 5.5.1 STARTTLS is not available")
+		return true, ""
+	}
+
+	result, _ := parser.SendResponse("220 2.0.0 Ready to start TLS")
+	if result != true {
+		return false, "Error writing to connection stream in response to STARTTLS"
+	}
+
+	parser.pending = ""
+
+	tlsConnection := tls.Server(parser.Connection, parser.TLSConfig)
+	tlsConnection.SetDeadline(time.Now().Add(time.Second * COMMAND_TIMEOUT_SECONDS))
+
+	err := tlsConnection.Handshake()
+	if err != nil {
+		parser.record(TRANSCRIPT_NOTE, fmt.Sprintf("[TLS handshake failed: %s]", err))
+		return false, fmt.Sprintf("TLS handshake failed: %s", err)
+	}
+
+	tlsConnection.SetDeadline(time.Time{})
+	parser.Connection = tlsConnection
+
+	_, version, cipherSuite := connectionTLSState(tlsConnection)
+	parser.record(TRANSCRIPT_NOTE, fmt.Sprintf("[TLS started: %s %s]", version, cipherSuite))
+
+	parser.resetTransaction()
+	parser.greeted = false
+	parser.heloName = ""
+	parser.extended = false
+	parser.authUser = ""
+
+	return true, ""
+}
+
+/*
+Function to process the AUTH command (constant AUTH) from RFC 4954. The
+PLAIN and LOGIN mechanisms are supported, with or without an initial
+response. As this is a server for testing any user name and password
+is accepted; the user name is recorded on the mail items sent after.
+A client that answers a challenge with "*" cancels the exchange.
+*/
+func (parser *Parser) Process_AUTH(line string) (bool, string) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || len(fields) > 3 {
+		parser.SendResponse("501 5.5.4 Syntax: AUTH mechanism [initial-response]")
+		return true, ""
+	}
+
+	if !parser.authAvailable() {
+		parser.SendResponse("502 5.5.1 AUTH is not available")
+		return true, ""
+	}
+
+	if len(parser.authUser) > 0 {
+		parser.SendResponse("503 5.5.1 Already authenticated")
+		return true, ""
+	}
+
+	initialResponse, hasInitialResponse := "", len(fields) == 3
+	if hasInitialResponse {
+		initialResponse = fields[2]
+	}
+
+	var userName string
+	var ok bool
+
+	switch strings.ToUpper(fields[1]) {
+	case "PLAIN":
+		credentials := initialResponse
+		if !hasInitialResponse {
+			if credentials, ok = parser.authChallenge(""); !ok {
+				return parser.endAuth(credentials)
+			}
+		}
+
+		/*
+		 * The credentials are "authorization\0user\0password"
+		 */
+		decoded, valid := decodeAuthResponse(credentials)
+		parts := strings.Split(decoded, "\x00")
+		if !valid || len(parts) != 3 {
+			parser.SendResponse("501 5.5.2 Cannot decode AUTH PLAIN credentials")
+			return true, ""
+		}
+
+		userName = parts[1]
+
+	case "LOGIN":
+		encodedUser := initialResponse
+		if !hasInitialResponse {
+			if encodedUser, ok = parser.authChallenge("Username:"); !ok {
+				return parser.endAuth(encodedUser)
+			}
+		}
+
+		if encodedPassword, ok := parser.authChallenge("Password:"); !ok {
+			return parser.endAuth(encodedPassword)
+		}
+
+		decoded, valid := decodeAuthResponse(encodedUser)
+		if !valid {
+			parser.SendResponse("501 5.5.2 Cannot decode AUTH LOGIN user name")
+			return true, ""
+		}
+
+		userName = decoded
+
+	default:
+		parser.SendResponse("504 5.5.4 Unrecognized authentication type")
+		return true, ""
+	}
+
+	if len(userName) <= 0 {
+		parser.SendResponse("535 5.7.8 Authentication credentials invalid")
+		return true, ""
+	}
+
+	parser.authUser = userName
+	parser.record(TRANSCRIPT_NOTE, fmt.Sprintf("[Authenticated as %s]", userName))
+
+	result, _ := parser.SendResponse("235 2.7.0 Authentication successful")
+	if result != true {
+		return false, "Error writing to connection stream in response to AUTH"
+	}
+
+	return true, ""
+}
+
+/*
+Sends an AUTH challenge and reads the client's answer. The challenge is
+base64 encoded as RFC 4954 requires. False is returned if the client
+cancels with "*", in which case the answer is "*", or does not answer
+at all, in which case the answer is empty.
+*/
+func (parser *Parser) authChallenge(challenge string) (string, bool) {
+	result, _ := parser.SendResponse("334 " + base64.StdEncoding.EncodeToString([]byte(challenge)))
+	if result != true {
+		return "", false
+	}
+
+	answer, ok := parser.readLine()
+	if !ok {
+		return "", false
+	}
+
+	parser.record(TRANSCRIPT_CLIENT, "[credentials]")
+
+	answer = strings.TrimSpace(answer)
+	return answer, answer != "*"
+}
+
+/*
+Ends an AUTH exchange that the client cancelled or walked away from.
+*/
+func (parser *Parser) endAuth(answer string) (bool, string) {
+	if answer == "*" {
+		parser.SendResponse("501 5.0.0 Authentication cancelled")
+		return true, ""
+	}
+
+	return false, "No answer to AUTH challenge"
+}
+
+/*
+Decodes a base64 AUTH response. A single "=" stands for an empty response.
+*/
+func decodeAuthResponse(response string) (string, bool) {
+	if response == "=" {
+		return "", true
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(response)
+	if err != nil {
+		return "", false
+	}
+
+	return string(decoded), true
 }
 
 /*
@@ -253,9 +768,15 @@ This function will return the following items.
 	2. Error or success message
 	3. Headers
 	4. Body breakdown
+
+The unparsed DATA content is also kept on the parser's mail item as RawSource,
+with the dots the client added to the start of lines removed (RFC 5321 section
+4.5.2). If the content grows past MaxMessageSize the rest is read and thrown
+away, and the client is told the message is too large.
 */
 func (parser *Parser) Process_DATA(line string) (bool, string, *MailHeader, *MailBody) {
 	var dataBuffer bytes.Buffer
+	var tooLarge bool
 
 	profiling.Timer.Step("Parsing mail body")
 
@@ -264,22 +785,213 @@ func (parser *Parser) Process_DATA(line string) (bool, string, *MailHeader, *Mai
 		return false, "Invalid command", nil, nil
 	}
 
+	if parser.MailItem.BodyType == BODY_BINARYMIME {
+		parser.SendResponse("503 5.5.1 BINARYMIME messages must be sent with BDAT")
+		return true, "BINARYMIME requires BDAT", nil, nil
+	}
+
+	if parser.chunks.Len() > 0 || parser.chunksTooLarge {
+		parser.SendResponse("503 5.5.1 DATA cannot be mixed with BDAT in one message")
+		return true, "DATA during BDAT", nil, nil
+	}
+
+	if parser.injectFault(FAULT_STAGE_DATA, parser.MailItem.FromAddress, parser.MailItem.ToAddresses) {
+		parser.resetTransaction()
+		return true, "Rejected by fault rule", nil, nil
+	}
+
 	parser.SendResponse("354 End data with <CR><LF>.<CR><LF>")
 	parser.State = STATE_HEADER
 
+	dropDuringData := parser.Latency != nil && parser.Latency.Drop(LATENCY_STAGE_DATA, parser.MailItem.FromAddress, parser.MailItem.ToAddresses)
+	lastRead := time.Now()
+
 	for {
 		dataResponse := parser.ReadChunk()
 
+		if parser.disconnected && !strings.Contains(dataResponse, "\r\n.\r\n") {
+			parser.record(TRANSCRIPT_NOTE, "[Client disconnected]")
+			return false, "Client disconnected during DATA", nil, nil
+		}
+
+		/*
+		 * A client that stops sending message content would otherwise
+		 * hold the session open forever
+		 */
+		if len(dataResponse) <= 0 {
+			if time.Since(lastRead) > time.Second*COMMAND_TIMEOUT_SECONDS {
+				parser.resetTransaction()
+				parser.record(TRANSCRIPT_NOTE, "[Timed out waiting for message content]")
+				parser.SendResponse("421 4.4.2 Timed out waiting for message content, closing connection")
+				parser.State = STATE_ERROR
+				return true, "Timed out during DATA", nil, nil
+			}
+
+			continue
+		}
+
+		lastRead = time.Now()
+
+		if dropDuringData && len(dataResponse) > 0 {
+			parser.dropConnection(LATENCY_STAGE_DATA)
+			return true, "Connection dropped", nil, nil
+		}
+
 		terminatorPos := strings.Index(dataResponse, "\r\n.\r\n")
-		if terminatorPos <= -1 {
-			dataBuffer.WriteString(dataResponse)
+		if terminatorPos > -1 {
+			parser.pending = dataResponse[terminatorPos+5:]
+			dataResponse = dataResponse[0:terminatorPos]
 		} else {
-			dataBuffer.WriteString(dataResponse[0:terminatorPos])
+			/*
+			 * The terminator may be split across reads, so the start
+			 * of one is held back until the next read
+			 */
+			partial := partialTerminatorLen(dataResponse)
+			parser.pending = dataResponse[len(dataResponse)-partial:]
+			dataResponse = dataResponse[:len(dataResponse)-partial]
+		}
+
+		if !tooLarge {
+			if parser.MaxMessageSize > 0 && dataBuffer.Len()+len(dataResponse) > parser.MaxMessageSize {
+				tooLarge = true
+				dataBuffer.Reset()
+			} else {
+				dataBuffer.WriteString(dataResponse)
+			}
+		}
+
+		if terminatorPos > -1 {
 			break
 		}
 	}
 
-	entireMailContents := dataBuffer.String()
+	if tooLarge {
+		parser.resetTransaction()
+		parser.record(TRANSCRIPT_NOTE, "[Message content discarded, too large]")
+		log.Printf("Message exceeds the size limit of %d bytes and will not be accepted\n", parser.MaxMessageSize)
+		parser.SendResponse("552 5.3.4 Message size exceeds fixed maximum message size")
+		return true, "Message too large", nil, nil
+	}
+
+	parser.record(TRANSCRIPT_CLIENT, fmt.Sprintf("[%d bytes of message content]", dataBuffer.Len()))
+	parser.record(TRANSCRIPT_CLIENT, ".")
+	return parser.finishMessage(removeDotStuffing(dataBuffer.String()))
+}
+
+/*
+Function to process the BDAT command (constant BDAT) from RFC 3030 CHUNKING.
+The command is "BDAT <size>" or "BDAT <size> LAST" and is followed by exactly
+that many bytes of message content, which may be anything, including binary
+data and lines with a single dot. Each chunk is added to the message and
+acknowledged; once the LAST chunk arrives the message is parsed as it would
+be after DATA. The return values are the same as Process_DATA, with headers
+and body only given for the LAST chunk.
+*/
+func (parser *Parser) Process_BDAT(input string) (bool, string, *MailHeader, *MailBody) {
+	line, rest := input, ""
+	if index := strings.Index(input, "\r\n"); index > -1 {
+		line, rest = input[:index], input[index+2:]
+	}
+
+	parser.pending = rest + parser.pending
+
+	fields := strings.Fields(line)
+	if len(fields) < 2 || len(fields) > 3 || (len(fields) == 3 && strings.ToUpper(fields[2]) != "LAST") {
+		parser.SendResponse("501 5.5.4 Syntax: BDAT <size> [LAST]")
+		return true, "", nil, nil
+	}
+
+	size, err := strconv.Atoi(fields[1])
+	if err != nil || size < 0 {
+		parser.SendResponse("501 5.5.4 Syntax: BDAT <size> [LAST]")
+		return true, "", nil, nil
+	}
+
+	if !parser.Chunking {
+		if _, ok := parser.readBytes(size, true); !ok {
+			return false, "Timed out reading BDAT chunk", nil, nil
+		}
+
+		parser.SendResponse("502 5.5.1 BDAT is not enabled")
+		return true, "", nil, nil
+	}
+
+	last := len(fields) == 3
+	firstChunk := parser.chunks.Len() <= 0 && !parser.chunksTooLarge
+
+	if firstChunk {
+		profiling.Timer.Step("Parsing mail body")
+
+		if parser.Latency != nil && parser.Latency.Drop(LATENCY_STAGE_DATA, parser.MailItem.FromAddress, parser.MailItem.ToAddresses) {
+			parser.dropConnection(LATENCY_STAGE_DATA)
+			return true, "Connection dropped", nil, nil
+		}
+	}
+
+	/*
+	 * The chunk has to be read, even if it is going to be refused,
+	 * so its content is not taken for commands.
+	 */
+	if parser.MaxMessageSize > 0 && parser.chunks.Len()+size > parser.MaxMessageSize {
+		parser.chunksTooLarge = true
+		parser.chunks.Reset()
+	}
+
+	chunk, ok := parser.readBytes(size, parser.chunksTooLarge)
+	if !ok {
+		return false, "Timed out reading BDAT chunk", nil, nil
+	}
+
+	parser.record(TRANSCRIPT_CLIENT, fmt.Sprintf("[%d bytes of chunk content]", size))
+
+	if len(parser.MailItem.ToAddresses) <= 0 {
+		parser.resetChunks()
+		parser.SendResponse("503 5.5.1 No valid recipients")
+		return true, "", nil, nil
+	}
+
+	if firstChunk && parser.injectFault(FAULT_STAGE_DATA, parser.MailItem.FromAddress, parser.MailItem.ToAddresses) {
+		parser.resetTransaction()
+		return true, "Rejected by fault rule", nil, nil
+	}
+
+	parser.State = STATE_HEADER
+	parser.chunks.WriteString(chunk)
+
+	if !last {
+		if parser.chunksTooLarge {
+			parser.SendResponse("552 5.3.4 Message size exceeds fixed maximum message size")
+		} else {
+			parser.SendResponse(fmt.Sprintf("250 2.0.0 %d octets received", size))
+		}
+
+		return true, "", nil, nil
+	}
+
+	entireMailContents, tooLarge := parser.chunks.String(), parser.chunksTooLarge
+	parser.resetChunks()
+
+	if tooLarge {
+		parser.resetTransaction()
+		log.Printf("Message exceeds the size limit of %d bytes and will not be accepted\n", parser.MaxMessageSize)
+		parser.SendResponse("552 5.3.4 Message size exceeds fixed maximum message size")
+		return true, "Message too large", nil, nil
+	}
+
+	return parser.finishMessage(entireMailContents)
+}
+
+/*
+Parses the complete content of a message sent with DATA or BDAT and
+replies to the client. The message is accepted unless a latency or
+fault rule says otherwise. An accepted message is added to Messages,
+with a Received header and the details of the client, and the next
+transaction starts with a new mail item.
+*/
+func (parser *Parser) finishMessage(entireMailContents string) (bool, string, *MailHeader, *MailBody) {
+	parser.MailItem.RawSource = entireMailContents
+	parser.MailItem.HeloName = parser.heloName
+	parser.MailItem.AuthUser = parser.authUser
 
 	/*
 	 * Parse the header content
@@ -295,30 +1007,183 @@ func (parser *Parser) Process_DATA(line string) (bool, string, *MailHeader, *Mai
 	body := &MailBody{}
 	body.Parse(entireMailContents, header.Boundary)
 
+	if parser.Latency != nil && parser.Latency.Drop(LATENCY_STAGE_MESSAGE, parser.MailItem.FromAddress, parser.MailItem.ToAddresses) {
+		parser.dropConnection(LATENCY_STAGE_MESSAGE)
+		return true, "Connection dropped", header, body
+	}
+
+	parser.delayNextResponse(LATENCY_STAGE_MESSAGE, parser.MailItem.ToAddresses)
+
+	if parser.injectFault(FAULT_STAGE_MESSAGE, parser.MailItem.FromAddress, parser.MailItem.ToAddresses) {
+		parser.resetTransaction()
+		return true, "Rejected by fault rule", header, body
+	}
+
+	if len(strings.TrimSpace(body.HTMLBody)) <= 0 {
+		parser.MailItem.Body = body.TextBody
+	} else {
+		parser.MailItem.Body = body.HTMLBody
+	}
+
+	parser.MailItem.Subject = header.Subject
+	parser.MailItem.DateSent = header.Date
+	parser.MailItem.XMailer = header.XMailer
+	parser.MailItem.ContentType = header.ContentType
+	parser.MailItem.Boundary = header.Boundary
+	parser.MailItem.Attachments = body.Attachments
+
+	received := time.Now().UTC()
+
+	recordClient(&parser.MailItem, parser.Connection)
+	parser.MailItem.RawSource = receivedHeader(parser.MailItem, parser.extended, parser.HostName, received) + parser.MailItem.RawSource
+	parser.MailItem.DateReceived = received.Format(DATE_RECEIVED_FORMAT)
+
+	parser.Messages = append(parser.Messages, parser.MailItem)
+	parser.resetTransaction()
+
+	if parser.RateLimiter != nil {
+		parser.RateLimiter.AddMessage(parser.Connection.RemoteAddr().String())
+	}
+
 	parser.SendOkResponse()
 	return true, "Success", header, body
 }
 
+/*
+Reads exactly count bytes from the client, starting with any pending data.
+Anything read past them is kept pending for the next read. If discard is
+true the bytes are thrown away as they arrive and an empty string is
+returned. False is returned if the client stops sending for longer than
+COMMAND_TIMEOUT_SECONDS.
+*/
+func (parser *Parser) readBytes(count int, discard bool) (string, bool) {
+	var result bytes.Buffer
+
+	remaining := count
+	lastRead := time.Now()
+
+	for remaining > 0 {
+		chunk := parser.ReadChunk()
+		if len(chunk) <= 0 {
+			if parser.disconnected || time.Since(lastRead) > time.Second*COMMAND_TIMEOUT_SECONDS {
+				return "", false
+			}
+
+			continue
+		}
+
+		lastRead = time.Now()
+
+		if len(chunk) > remaining {
+			parser.pending = chunk[remaining:]
+			chunk = chunk[:remaining]
+		}
+
+		remaining -= len(chunk)
+
+		if !discard {
+			result.WriteString(chunk)
+		}
+	}
+
+	return result.String(), true
+}
+
+/*
+Abandons the current mail transaction, as RSET, HELO and EHLO do, and
+starts a new mail item. Messages that have already been accepted are kept.
+*/
+func (parser *Parser) resetTransaction() {
+	parser.MailItem = MailItemStruct{ToAddresses: make([]string, 0, 20)}
+	parser.inTransaction = false
+	parser.resetChunks()
+}
+
+/*
+Reads one line from the client, such as the answer to an AUTH challenge,
+without its line ending. False is returned if the client disconnects or
+sends nothing for COMMAND_TIMEOUT_SECONDS.
+*/
+func (parser *Parser) readLine() (string, bool) {
+	startTime := time.Now()
+
+	for {
+		line, complete := parser.nextCommandLine(parser.ReadChunk())
+		if complete {
+			return strings.TrimRight(line, "\r\n"), true
+		}
+
+		if parser.disconnected || time.Since(startTime) > time.Second*COMMAND_TIMEOUT_SECONDS {
+			return "", false
+		}
+	}
+}
+
+/*
+Throws away any message content collected from BDAT chunks.
+*/
+func (parser *Parser) resetChunks() {
+	parser.chunks.Reset()
+	parser.chunksTooLarge = false
+}
+
+/*
+Removes the extra dot a client adds to the start of each line that
+begins with a dot when sending message content with DATA.
+*/
+func removeDotStuffing(content string) string {
+	if strings.HasPrefix(content, ".") {
+		content = content[1:]
+	}
+
+	return strings.Replace(content, "\r\n.", "\r\n", -1)
+}
+
+/*
+Returns how many bytes at the end of some message content could be the
+start of the "\r\n.\r\n" terminator.
+*/
+func partialTerminatorLen(content string) int {
+	for length := 4; length > 0; length-- {
+		if strings.HasSuffix(content, "\r\n.\r\n"[:length]) {
+			return length
+		}
+	}
+
+	return 0
+}
+
 /*
 This function reads the raw data from the socket connection to our client. This will
 read on the socket until there is nothing left to read and an error is generated.
 This method blocks the socket for the number of milliseconds defined in CONN_TIMEOUT_MILLISECONDS.
 It then records what has been read in that time, then blocks again until there is nothing left on
-the socket to read. The final value is stored and returned as a string.
+the socket to read, or MAX_CHUNK_LEN bytes have been read. The final value is stored and returned
+as a string. Any pending data left over from a BDAT chunk is returned first.
 */
 func (parser *Parser) ReadChunk() string {
 	var raw bytes.Buffer
 	var bytesRead int
+	var err error
+
+	raw.WriteString(parser.pending)
+	parser.pending = ""
 
+	totalRead := 0
 	bytesRead = 1
 
-	for bytesRead > 0 {
+	for bytesRead > 0 && totalRead < MAX_CHUNK_LEN {
 		parser.Connection.SetReadDeadline(time.Now().Add(time.Millisecond * CONN_TIMEOUT_MILLISECONDS))
 
 		buffer := make([]byte, RECEIVE_BUFFER_LEN)
-		bytesRead, err := parser.Connection.Read(buffer)
+		bytesRead, err = parser.Connection.Read(buffer)
+		totalRead += bytesRead
 
 		if err != nil {
+			if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+				parser.disconnected = true
+			}
+
 			break
 		}
 
@@ -344,7 +1209,19 @@ func (parser *Parser) Run() {
 	var command int
 	var commandRouterResult bool
 
-	parser.SendResponse("220 Welcome to MailSlurper!")
+	parser.delayNextResponse(LATENCY_STAGE_GREETING, nil)
+
+	if parser.injectFault(FAULT_STAGE_CONNECT, "", nil) {
+		parser.State = STATE_ERROR
+		return
+	}
+
+	if result, response := parser.SendResponse("220 Welcome to MailSlurper!"); result != true {
+		log.Println("Error sending greeting: ", response)
+		parser.State = STATE_ERROR
+		return
+	}
+
 	log.Println("Reading data from client connection...")
 
 	/*
@@ -361,21 +1238,41 @@ func (parser *Parser) Run() {
 
 	for parser.State != STATE_QUIT && parser.State != STATE_ERROR {
 		raw = parser.ReadChunk()
-		command = parser.ParseCommand(raw)
+		line, complete := parser.nextCommandLine(raw)
 
-		if command == QUIT {
-			parser.State = STATE_QUIT
-			log.Println("Closing connection.")
-		} else {
-			commandRouterResult = parser.CommandRouter(command, raw)
+		if !complete && parser.disconnected {
+			parser.record(TRANSCRIPT_NOTE, "[Client disconnected]")
+			parser.State = STATE_ERROR
+			break
+		}
 
-			if commandRouterResult != true {
-				parser.State = STATE_ERROR
-				log.Println("Error occured executing command ", command)
+		if complete {
+			command = parser.ParseCommand(line)
+			parser.record(TRANSCRIPT_CLIENT, hideCredentials(command, strings.TrimRight(line, "\r\n")))
+
+			reply := checkCommandSyntax(command, line, parser.Strict)
+			if len(reply) <= 0 {
+				reply = parser.checkCommandSequence(command)
+			}
+
+			if len(reply) > 0 {
+				log.Println("Refused command: ", strings.TrimSpace(line))
+				parser.SendResponse(reply)
+			} else if command == QUIT {
+				parser.State = STATE_QUIT
+				log.Println("Closing connection.")
+			} else {
+				commandRouterResult = parser.CommandRouter(command, line)
+
+				if commandRouterResult != true {
+					parser.State = STATE_ERROR
+					log.Println("Error occured executing command ", command)
+				}
 			}
 		}
 
-		if int(time.Since(startTime).Seconds()) > COMMAND_TIMEOUT_SECONDS {
+		if int((time.Since(startTime) - parser.simulatedDelay).Seconds()) > COMMAND_TIMEOUT_SECONDS {
+			parser.record(TRANSCRIPT_NOTE, "[Session timed out]")
 			parser.State = STATE_ERROR
 		}
 	}
@@ -403,14 +1300,123 @@ func (parser *Parser) SendOkResponse() (bool, string) {
 	return result, response
 }
 
+/*
+Checks the fault rules for a stage of the session. If a rule fires its
+reply is sent to the client and true is returned; the caller should then
+skip its normal reply. A 421 reply also ends the session.
+*/
+func (parser *Parser) injectFault(stage string, from string, to []string) bool {
+	if parser.Faults == nil {
+		return false
+	}
+
+	fault, ok := parser.Faults.Check(stage, parser.Connection.RemoteAddr().String(), from, to)
+	if !ok {
+		return false
+	}
+
+	log.Printf("Fault rule %s injected %d at %s stage\n", fault.Rule, fault.Code, stage)
+	parser.SendResponse(fmt.Sprintf("%d %s", fault.Code, fault.Message))
+
+	if fault.Code == 421 {
+		parser.State = STATE_ERROR
+	}
+
+	return true
+}
+
+/*
+Returns the SMTP service extensions listed in the reply to EHLO.
+*/
+func (parser *Parser) extensions() []string {
+	size := "SIZE"
+	if parser.MaxMessageSize > 0 {
+		size = fmt.Sprintf("SIZE %d", parser.MaxMessageSize)
+	}
+
+	offered := []string{size, "PIPELINING", "8BITMIME", "SMTPUTF8"}
+	if parser.Chunking {
+		offered = append(offered, "CHUNKING", "BINARYMIME")
+	}
+
+	offered = append(offered, "AUTH PLAIN LOGIN")
+
+	result := make([]string, 0, len(offered)+1)
+	for _, extension := range offered {
+		if parser.Extensions == nil || containsFold(parser.Extensions, strings.Fields(extension)[0]) {
+			result = append(result, extension)
+		}
+	}
+
+	if parser.startTLSAvailable() {
+		result = append(result, "STARTTLS")
+	}
+
+	return result
+}
+
+/*
+Returns true if the listener offers AUTH.
+*/
+func (parser *Parser) authAvailable() bool {
+	return parser.Extensions == nil || containsFold(parser.Extensions, "AUTH")
+}
+
+/*
+Returns true if the connection can still be upgraded with STARTTLS.
+*/
+func (parser *Parser) startTLSAvailable() bool {
+	_, secure := parser.Connection.(*tls.Conn)
+	return parser.TLSConfig != nil && !secure
+}
+
+/*
+Looks up the simulated latency for a stage of the session. The next
+response sent is held back by that long.
+*/
+func (parser *Parser) delayNextResponse(stage string, to []string) {
+	if parser.Latency == nil {
+		return
+	}
+
+	parser.responseDelay = parser.Latency.Delay(stage, parser.MailItem.FromAddress, to)
+}
+
+/*
+Closes the client connection without a reply, as a server that has
+crashed or lost its network would. TCP connections are reset rather
+than shut down cleanly. The session ends and nothing is stored.
+*/
+func (parser *Parser) dropConnection(stage string) {
+	log.Printf("Latency rule dropped the connection at %s stage\n", stage)
+	parser.record(TRANSCRIPT_NOTE, fmt.Sprintf("[Connection dropped by latency rule at %s stage]", stage))
+
+	if tcpConnection, ok := parser.Connection.(*net.TCPConn); ok {
+		tcpConnection.SetLinger(0)
+	}
+
+	parser.Connection.Close()
+	parser.State = STATE_ERROR
+}
+
 /*
 Function to send a response to a client connection. It returns true/false for success and a string
-with any response.
+with any response. If latency is being simulated the response is held back first.
 */
 func (parser *Parser) SendResponse(resp string) (bool, string) {
 	result := true
 	response := ""
 
+	if parser.responseDelay > 0 {
+		time.Sleep(parser.responseDelay)
+		parser.simulatedDelay += parser.responseDelay
+		parser.responseDelay = 0
+	}
+
+	for _, line := range strings.Split(resp, "\r\n") {
+		parser.record(TRANSCRIPT_SERVER, line)
+	}
+
 	_, err := parser.Connection.Write([]byte(string(resp + "\r\n")))
 	if err != nil {
 		result = false
@@ -419,3 +1425,12 @@ func (parser *Parser) SendResponse(resp string) (bool, string) {
 
 	return result, response
 }
+
+/*
+Adds a line to the session transcript, if one is being kept.
+*/
+func (parser *Parser) record(direction string, line string) {
+	if parser.Transcript != nil {
+		parser.Transcript.Add(direction, line)
+	}
+}
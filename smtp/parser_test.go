@@ -0,0 +1,672 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package smtp
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+A step in a scripted SMTP session. The line is sent, unless it is
+empty, and then a reply starting with the expected code is read.
+*/
+type sessionStep struct {
+	send   string
+	expect string
+}
+
+/*
+Runs a parser on one end of an in-memory connection
+and talks to it from the other.
+*/
+type testSession struct {
+	t      *testing.T
+	parser *Parser
+	client net.Conn
+	reader *bufio.Reader
+	done   chan bool
+}
+
+func startTestSession(t *testing.T, parser *Parser) *testSession {
+	server, client := net.Pipe()
+
+	parser.State = STATE_START
+	parser.Connection = server
+
+	session := &testSession{
+		t:      t,
+		parser: parser,
+		client: client,
+		reader: bufio.NewReader(client),
+		done:   make(chan bool),
+	}
+
+	go func() {
+		parser.Run()
+		server.Close()
+		close(session.done)
+	}()
+
+	return session
+}
+
+/*
+Sends a line to the parser, ending it with CRLF.
+*/
+func (session *testSession) send(line string) {
+	session.sendRaw(line + "\r\n")
+}
+
+/*
+Sends data to the parser as it is.
+*/
+func (session *testSession) sendRaw(data string) {
+	session.client.SetWriteDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := session.client.Write([]byte(data)); err != nil {
+		session.t.Fatalf("Unable to send %q: %s", data, err)
+	}
+}
+
+/*
+Reads a reply, including every line of a multi-line reply, and
+fails the test unless it starts with the expected code.
+*/
+func (session *testSession) expect(code string) string {
+	session.client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply := ""
+
+	for {
+		line, err := session.reader.ReadString('\n')
+		if err != nil {
+			session.t.Fatalf("Expected a %s reply, got %q and %s", code, reply+line, err)
+		}
+
+		reply += line
+
+		if len(line) < 4 || line[3] != '-' {
+			break
+		}
+	}
+
+	if !strings.HasPrefix(reply, code) {
+		session.t.Fatalf("Expected a %s reply, got %q", code, reply)
+	}
+
+	return reply
+}
+
+/*
+Fails the test unless the parser closes the connection
+without sending anything more.
+*/
+func (session *testSession) expectClosed() {
+	session.client.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	if line, err := session.reader.ReadString('\n'); err != io.EOF {
+		session.t.Fatalf("Expected the connection to be closed, got %q and %v", line, err)
+	}
+}
+
+/*
+Runs each step of a script in turn.
+*/
+func (session *testSession) run(script []sessionStep) {
+	for _, step := range script {
+		if len(step.send) > 0 {
+			session.send(step.send)
+		}
+
+		session.expect(step.expect)
+	}
+}
+
+/*
+Closes the client end of the connection and waits for the parser to finish.
+*/
+func (session *testSession) close() {
+	session.client.Close()
+
+	select {
+	case <-session.done:
+	case <-time.After(10 * time.Second):
+		session.t.Fatal("The parser did not finish")
+	}
+}
+
+func TestParserRunAcceptsMail(t *testing.T) {
+	parser := &Parser{}
+	session := startTestSession(t, parser)
+
+	session.run([]sessionStep{
+		{"", "220"},
+		{"HELO localhost", "250"},
+		{"MAIL FROM:<sender@example.com>", "250"},
+		{"RCPT TO:<one@example.com>", "250"},
+		{"RCPT TO:<two@example.com>", "250"},
+		{"DATA", "354"},
+		{"Subject: Hello\r\n\r\nHello there\r\n.", "250"},
+		{"QUIT", "221"},
+	})
+
+	session.close()
+
+	if parser.State != STATE_QUIT || len(parser.Messages) != 1 {
+		t.Fatalf("Expected the session to quit with a message accepted, got state %d and %d messages", parser.State, len(parser.Messages))
+	}
+
+	message := parser.Messages[0]
+
+	if message.FromAddress != "<sender@example.com>" || strings.Join(message.ToAddresses, ",") != "<one@example.com>,<two@example.com>" {
+		t.Errorf("Expected the envelope to be recorded, got %q to %v", message.FromAddress, message.ToAddresses)
+	}
+
+	if message.Subject != "Hello" || !strings.HasPrefix(message.RawSource, "Received: from localhost") || !strings.HasSuffix(message.RawSource, "\r\nSubject: Hello\r\n\r\nHello there") {
+		t.Errorf("Expected the message to be recorded with a Received header, got subject %q and %q", message.Subject, message.RawSource)
+	}
+}
+
+func TestParserRunRset(t *testing.T) {
+	parser := &Parser{}
+	session := startTestSession(t, parser)
+
+	session.run([]sessionStep{
+		{"", "220"},
+		{"HELO localhost", "250"},
+		{"MAIL FROM:<first@example.com>", "250"},
+		{"RCPT TO:<one@example.com>", "250"},
+		{"RSET", "250"},
+		{"MAIL FROM:<second@example.com>", "250"},
+		{"RCPT TO:<two@example.com>", "250"},
+		{"QUIT", "221"},
+	})
+
+	session.close()
+
+	if len(parser.Messages) > 0 {
+		t.Error("Expected no message to be accepted without DATA")
+	}
+
+	if parser.MailItem.FromAddress != "<second@example.com>" || strings.Join(parser.MailItem.ToAddresses, ",") != "<two@example.com>" {
+		t.Errorf("Expected RSET to discard the first envelope, got %q to %v", parser.MailItem.FromAddress, parser.MailItem.ToAddresses)
+	}
+}
+
+func TestParserRunSizeParameter(t *testing.T) {
+	parser := &Parser{MaxMessageSize: 100}
+	session := startTestSession(t, parser)
+
+	session.expect("220")
+	session.send("EHLO localhost")
+
+	if reply := session.expect("250"); !strings.Contains(reply, "250-SIZE 100\r\n") {
+		t.Errorf("Expected EHLO to offer SIZE 100, got %q", reply)
+	}
+
+	session.run([]sessionStep{
+		{"MAIL FROM:<sender@example.com> SIZE=101", "552"},
+		{"MAIL FROM:<sender@example.com> SIZE=large", "501"},
+		{"MAIL FROM:<sender@example.com> SIZE=100", "250"},
+		{"QUIT", "221"},
+	})
+
+	session.close()
+
+	if parser.MailItem.FromAddress != "<sender@example.com>" {
+		t.Errorf("Expected the accepted sender to be recorded, got %q", parser.MailItem.FromAddress)
+	}
+}
+
+func TestParserRunMessageTooLarge(t *testing.T) {
+	parser := &Parser{MaxMessageSize: 100}
+	session := startTestSession(t, parser)
+
+	session.run([]sessionStep{
+		{"", "220"},
+		{"HELO localhost", "250"},
+		{"MAIL FROM:<sender@example.com>", "250"},
+		{"RCPT TO:<bob@example.com>", "250"},
+		{"DATA", "354"},
+		{"Subject: Large\r\n\r\n" + strings.Repeat("Too much content\r\n", 20) + ".", "552"},
+		{"QUIT", "221"},
+	})
+
+	session.close()
+
+	if len(parser.Messages) > 0 || len(parser.MailItem.RawSource) > 0 {
+		t.Errorf("Expected the message to be refused and discarded, got %d bytes", len(parser.MailItem.RawSource))
+	}
+}
+
+func TestParserRunMaxRecipients(t *testing.T) {
+	parser := &Parser{MaxRecipients: 2}
+	session := startTestSession(t, parser)
+
+	session.run([]sessionStep{
+		{"", "220"},
+		{"HELO localhost", "250"},
+		{"MAIL FROM:<sender@example.com>", "250"},
+		{"RCPT TO:<one@example.com>", "250"},
+		{"RCPT TO:<two@example.com>", "250"},
+		{"RCPT TO:<three@example.com>", "452"},
+		{"DATA", "354"},
+		{"Subject: Hello\r\n\r\nHello\r\n.", "250"},
+		{"QUIT", "221"},
+	})
+
+	session.close()
+
+	if len(parser.Messages) != 1 || strings.Join(parser.Messages[0].ToAddresses, ",") != "<one@example.com>,<two@example.com>" {
+		t.Errorf("Expected only the first two recipients, got %+v", parser.Messages)
+	}
+}
+
+func TestParserRunBdat(t *testing.T) {
+	parser := &Parser{Chunking: true}
+	session := startTestSession(t, parser)
+
+	session.expect("220")
+	session.send("EHLO localhost")
+
+	if reply := session.expect("250"); !strings.Contains(reply, "250-CHUNKING\r\n") {
+		t.Errorf("Expected EHLO to offer CHUNKING, got %q", reply)
+	}
+
+	first := "Subject: Chunks\r\n\r\n"
+	second := "Line one\r\n.\r\nLine after a dot\r\n"
+
+	session.run([]sessionStep{
+		{"MAIL FROM:<sender@example.com> BODY=BINARYMIME", "250"},
+		{"RCPT TO:<bob@example.com>", "250"},
+	})
+
+	session.sendRaw(fmt.Sprintf("BDAT %d\r\n%s", len(first), first))
+	if reply := session.expect("250"); !strings.Contains(reply, fmt.Sprintf("%d octets", len(first))) {
+		t.Errorf("Expected the chunk size to be acknowledged, got %q", reply)
+	}
+
+	session.sendRaw(fmt.Sprintf("BDAT %d LAST\r\n%sQUIT\r\n", len(second), second))
+	session.expect("250")
+	session.expect("221")
+	session.close()
+
+	if len(parser.Messages) != 1 {
+		t.Fatalf("Expected one message to be accepted, got %d", len(parser.Messages))
+	}
+
+	if message := parser.Messages[0]; !strings.HasSuffix(message.RawSource, "\r\n"+first+second) || message.Subject != "Chunks" {
+		t.Errorf("Expected the chunks to make up the message, got subject %q and %q", message.Subject, message.RawSource)
+	}
+}
+
+func TestParserRunBdatRefused(t *testing.T) {
+	tests := []struct {
+		name     string
+		parser   *Parser
+		script   []sessionStep
+		accepted bool
+	}{
+		{
+			name:   "chunking not offered",
+			parser: &Parser{},
+			script: []sessionStep{
+				{"BDAT 0 LAST\r\n", "502"},
+				{"MAIL FROM:<sender@example.com> BODY=BINARYMIME\r\n", "501"},
+			},
+		},
+		{
+			name:   "bad size",
+			parser: &Parser{Chunking: true},
+			script: []sessionStep{
+				{"BDAT five\r\n", "501"},
+				{"BDAT 5 FIRST\r\n", "501"},
+			},
+		},
+		{
+			name:   "DATA for a BINARYMIME message",
+			parser: &Parser{Chunking: true},
+			script: []sessionStep{
+				{"RSET\r\n", "250"},
+				{"MAIL FROM:<sender@example.com> BODY=BINARYMIME\r\n", "250"},
+				{"RCPT TO:<bob@example.com>\r\n", "250"},
+				{"DATA\r\n", "503"},
+			},
+		},
+		{
+			name:   "DATA after a chunk",
+			parser: &Parser{Chunking: true},
+			script: []sessionStep{
+				{"BDAT 19\r\nSubject: Chunks\r\n\r\n", "250"},
+				{"DATA\r\n", "503"},
+				{"BDAT 7 LAST\r\nHello\r\n", "250"},
+			},
+			accepted: true,
+		},
+		{
+			name:   "chunks over the size limit",
+			parser: &Parser{Chunking: true, MaxMessageSize: 10},
+			script: []sessionStep{
+				{"BDAT 8\r\nSubject:", "250"},
+				{"BDAT 8\r\n Large\r\n", "552"},
+				{"BDAT 2 LAST\r\n\r\n", "552"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		session := startTestSession(t, test.parser)
+
+		session.run([]sessionStep{
+			{"", "220"},
+			{"EHLO localhost", "250"},
+			{"MAIL FROM:<sender@example.com>", "250"},
+			{"RCPT TO:<bob@example.com>", "250"},
+		})
+
+		for _, step := range test.script {
+			session.sendRaw(step.send)
+			session.expect(step.expect)
+		}
+
+		session.run([]sessionStep{{"QUIT", "221"}})
+		session.close()
+
+		if (len(test.parser.Messages) > 0) != test.accepted {
+			t.Errorf("%s: expected accepted to be %v", test.name, test.accepted)
+		}
+	}
+}
+
+func TestParserRunAuth(t *testing.T) {
+	plain := base64.StdEncoding.EncodeToString([]byte("\x00plain-user\x00secret"))
+	login := base64.StdEncoding.EncodeToString([]byte("login-user"))
+	password := base64.StdEncoding.EncodeToString([]byte("secret"))
+
+	tests := []struct {
+		name     string
+		script   []sessionStep
+		authUser string
+	}{
+		{
+			name: "PLAIN with an initial response",
+			script: []sessionStep{
+				{"AUTH PLAIN " + plain, "235"},
+			},
+			authUser: "plain-user",
+		},
+		{
+			name: "PLAIN after a challenge",
+			script: []sessionStep{
+				{"AUTH PLAIN", "334 "},
+				{plain, "235"},
+			},
+			authUser: "plain-user",
+		},
+		{
+			name: "LOGIN",
+			script: []sessionStep{
+				{"AUTH LOGIN", "334 VXNlcm5hbWU6"},
+				{login, "334 UGFzc3dvcmQ6"},
+				{password, "235"},
+			},
+			authUser: "login-user",
+		},
+		{
+			name: "LOGIN with an initial response",
+			script: []sessionStep{
+				{"AUTH LOGIN " + login, "334 UGFzc3dvcmQ6"},
+				{password, "235"},
+				{"AUTH PLAIN " + plain, "503"},
+			},
+			authUser: "login-user",
+		},
+		{
+			name: "bad base64",
+			script: []sessionStep{
+				{"AUTH PLAIN", "334 "},
+				{"not base64!", "501"},
+				{"AUTH LOGIN", "334"},
+				{"%%%", "334"},
+				{password, "501"},
+			},
+		},
+		{
+			name: "cancelled",
+			script: []sessionStep{
+				{"AUTH LOGIN", "334"},
+				{"*", "501"},
+			},
+		},
+		{
+			name: "unknown mechanism",
+			script: []sessionStep{
+				{"AUTH CRAM-MD5", "504"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		parser := &Parser{}
+		session := startTestSession(t, parser)
+
+		session.expect("220")
+		session.send("EHLO localhost")
+
+		if reply := session.expect("250"); !strings.Contains(reply, "250 AUTH PLAIN LOGIN\r\n") {
+			t.Errorf("%s: expected EHLO to offer AUTH, got %q", test.name, reply)
+		}
+
+		session.run(test.script)
+		session.run([]sessionStep{
+			{"MAIL FROM:<sender@example.com>", "250"},
+			{"RCPT TO:<bob@example.com>", "250"},
+			{"DATA", "354"},
+			{"Subject: Hello\r\n\r\nHello\r\n.", "250"},
+			{"QUIT", "221"},
+		})
+
+		session.close()
+
+		if len(parser.Messages) != 1 || parser.Messages[0].AuthUser != test.authUser {
+			t.Errorf("%s: expected the mail item to record user %q, got %+v", test.name, test.authUser, parser.Messages)
+		}
+	}
+}
+
+func TestParserRunAuthSequence(t *testing.T) {
+	plain := base64.StdEncoding.EncodeToString([]byte("\x00user\x00secret"))
+
+	parser := &Parser{Strict: true}
+	session := startTestSession(t, parser)
+
+	session.run([]sessionStep{
+		{"", "220"},
+		{"AUTH PLAIN " + plain, "503"},
+		{"HELO localhost", "250"},
+		{"AUTH PLAIN " + plain, "503"},
+		{"EHLO localhost", "250"},
+		{"MAIL FROM:<sender@example.com>", "250"},
+		{"AUTH PLAIN " + plain, "503"},
+		{"RSET", "250"},
+		{"AUTH PLAIN not-base64!", "501"},
+		{"AUTH PLAIN " + plain, "235"},
+		{"QUIT", "221"},
+	})
+
+	session.close()
+}
+
+func TestParserRunAuthNotOffered(t *testing.T) {
+	plain := base64.StdEncoding.EncodeToString([]byte("\x00user\x00secret"))
+
+	parser := &Parser{Extensions: []string{"SIZE", "PIPELINING"}}
+	session := startTestSession(t, parser)
+
+	session.expect("220")
+	session.send("EHLO localhost")
+
+	if reply := session.expect("250"); strings.Contains(reply, "AUTH") {
+		t.Errorf("Expected EHLO not to offer AUTH, got %q", reply)
+	}
+
+	session.send("HELP")
+	if reply := session.expect("214"); strings.Contains(reply, "AUTH") {
+		t.Errorf("Expected HELP not to list AUTH, got %q", reply)
+	}
+
+	session.run([]sessionStep{
+		{"AUTH PLAIN " + plain, "502"},
+		{"QUIT", "221"},
+	})
+
+	session.close()
+}
+
+func TestParserRunSplitTerminator(t *testing.T) {
+	parser := &Parser{}
+	session := startTestSession(t, parser)
+
+	session.run([]sessionStep{
+		{"", "220"},
+		{"HELO localhost", "250"},
+		{"MAIL FROM:<sender@example.com>", "250"},
+		{"RCPT TO:<bob@example.com>", "250"},
+		{"DATA", "354"},
+	})
+
+	/*
+	 * Each part is read on its own, splitting the terminator
+	 */
+	for _, part := range []string{"Subject: Split\r\n\r\nHello\r", "\n.", "\r\n"} {
+		session.sendRaw(part)
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	session.expect("250")
+	session.run([]sessionStep{{"QUIT", "221"}})
+	session.close()
+
+	if len(parser.Messages) != 1 || !strings.HasSuffix(parser.Messages[0].RawSource, "\r\nSubject: Split\r\n\r\nHello") {
+		t.Errorf("Expected the message to end at the split terminator, got %+v", parser.Messages)
+	}
+}
+
+func TestPartialTerminatorLen(t *testing.T) {
+	tests := map[string]int{
+		"Hello":          0,
+		"Hello\r":        1,
+		"Hello\r\n":      2,
+		"Hello\r\n.":     3,
+		"Hello\r\n.\r":   4,
+		"Hello\r\n..":    0,
+		"Hello\r\n.Hi\r": 1,
+	}
+
+	for content, expected := range tests {
+		if result := partialTerminatorLen(content); result != expected {
+			t.Errorf("partialTerminatorLen(%q) = %d, expected %d", content, result, expected)
+		}
+	}
+}
+
+func TestParserRunRefusedMessageClearsTransaction(t *testing.T) {
+	parser := &Parser{Strict: true, MaxMessageSize: 100}
+	session := startTestSession(t, parser)
+
+	session.run([]sessionStep{
+		{"", "220"},
+		{"HELO localhost", "250"},
+		{"MAIL FROM:<sender@example.com>", "250"},
+		{"RCPT TO:<bob@example.com>", "250"},
+		{"DATA", "354"},
+	})
+
+	/*
+	 * Larger than a single read, so it is refused while streaming
+	 */
+	session.sendRaw("Subject: Large\r\n\r\n" + strings.Repeat("Too much content\r\n", MAX_CHUNK_LEN/10) + ".\r\n")
+
+	session.run([]sessionStep{
+		{"", "552"},
+		{"RCPT TO:<bob@example.com>", "503"},
+		{"MAIL FROM:<sender@example.com>", "250"},
+		{"QUIT", "221"},
+	})
+
+	session.close()
+
+	if len(parser.Messages) > 0 || len(parser.MailItem.ToAddresses) > 0 {
+		t.Errorf("Expected the refused message to be cleared, got %d messages and recipients %v", len(parser.Messages), parser.MailItem.ToAddresses)
+	}
+}
+
+func TestParserRunDataTimeout(t *testing.T) {
+	parser := &Parser{}
+	session := startTestSession(t, parser)
+
+	session.run([]sessionStep{
+		{"", "220"},
+		{"HELO localhost", "250"},
+		{"MAIL FROM:<sender@example.com>", "250"},
+		{"RCPT TO:<bob@example.com>", "250"},
+		{"DATA", "354"},
+	})
+
+	/*
+	 * The client stops sending part way through the message
+	 */
+	session.sendRaw("Subject: Stalled\r\n\r\nHello")
+	time.Sleep(time.Second * COMMAND_TIMEOUT_SECONDS)
+
+	session.expect("421")
+	session.close()
+
+	if parser.State != STATE_ERROR || len(parser.Messages) > 0 {
+		t.Errorf("Expected the session to end in error without a message, got state %d and %d messages", parser.State, len(parser.Messages))
+	}
+}
+
+func TestRemoveDotStuffing(t *testing.T) {
+	tests := map[string]string{
+		"Hello\r\nThere":               "Hello\r\nThere",
+		"..Starts with a dot\r\nHello": ".Starts with a dot\r\nHello",
+		"Hello\r\n..\r\n...Dots":       "Hello\r\n.\r\n..Dots",
+		"Hello.\r\nThere":              "Hello.\r\nThere",
+	}
+
+	for content, expected := range tests {
+		if result := removeDotStuffing(content); result != expected {
+			t.Errorf("removeDotStuffing(%q) = %q, expected %q", content, result, expected)
+		}
+	}
+}
+
+func TestParserRunRemovesDotStuffing(t *testing.T) {
+	parser := &Parser{}
+	session := startTestSession(t, parser)
+
+	session.run([]sessionStep{
+		{"", "220"},
+		{"HELO localhost", "250"},
+		{"MAIL FROM:<sender@example.com>", "250"},
+		{"RCPT TO:<bob@example.com>", "250"},
+		{"DATA", "354"},
+		{"Subject: Dots\r\n\r\n..Line starting with a dot\r\n.", "250"},
+		{"QUIT", "221"},
+	})
+
+	session.close()
+
+	if len(parser.Messages) != 1 || !strings.HasSuffix(parser.Messages[0].RawSource, "\r\n\r\n.Line starting with a dot") {
+		t.Errorf("Expected the added dot to be removed, got %+v", parser.Messages)
+	}
+}
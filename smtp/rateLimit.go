@@ -0,0 +1,144 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package smtp
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Window the per-client rate limits are counted over
+const RATE_LIMIT_WINDOW = time.Minute
+
+/*
+RateLimiter limits how often each client IP may connect and send
+messages, counted over a sliding RATE_LIMIT_WINDOW. A limit of zero
+means no limit. It is safe to use from many sessions at once. Create
+one with NewRateLimiter.
+*/
+type RateLimiter struct {
+	ConnectionsPerMinute int
+	MessagesPerMinute    int
+
+	lock        sync.Mutex
+	connections map[string][]time.Time
+	messages    map[string][]time.Time
+	lastSweep   time.Time
+}
+
+/*
+Creates a rate limiter with no connections or messages counted yet.
+*/
+func NewRateLimiter(connectionsPerMinute int, messagesPerMinute int) *RateLimiter {
+	return &RateLimiter{
+		ConnectionsPerMinute: connectionsPerMinute,
+		MessagesPerMinute:    messagesPerMinute,
+		connections:          make(map[string][]time.Time),
+		messages:             make(map[string][]time.Time),
+		lastSweep:            time.Now(),
+	}
+}
+
+/*
+Records a connection from a client and returns true if it is within
+the connection rate limit. Refused connections are not counted.
+*/
+func (rl *RateLimiter) AllowConnection(clientAddress string) bool {
+	if rl.ConnectionsPerMinute <= 0 {
+		return true
+	}
+
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	now := time.Now()
+	rl.sweep(now)
+
+	key := clientHost(clientAddress)
+	rl.connections[key] = recent(rl.connections[key], now)
+
+	if len(rl.connections[key]) >= rl.ConnectionsPerMinute {
+		return false
+	}
+
+	rl.connections[key] = append(rl.connections[key], now)
+	return true
+}
+
+/*
+Returns true if a client may send another message without going over
+the message rate limit. Messages are counted with AddMessage once they
+have been accepted.
+*/
+func (rl *RateLimiter) AllowMessage(clientAddress string) bool {
+	if rl.MessagesPerMinute <= 0 {
+		return true
+	}
+
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	now := time.Now()
+	rl.sweep(now)
+
+	key := clientHost(clientAddress)
+	rl.messages[key] = recent(rl.messages[key], now)
+
+	return len(rl.messages[key]) < rl.MessagesPerMinute
+}
+
+/*
+Counts a message accepted from a client toward its message rate limit.
+*/
+func (rl *RateLimiter) AddMessage(clientAddress string) {
+	if rl.MessagesPerMinute <= 0 {
+		return
+	}
+
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	now := time.Now()
+	key := clientHost(clientAddress)
+	rl.messages[key] = append(recent(rl.messages[key], now), now)
+}
+
+/*
+Forgets clients that have not been seen for a whole window, so the
+counts do not grow forever.
+*/
+func (rl *RateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.lastSweep) < RATE_LIMIT_WINDOW {
+		return
+	}
+
+	for _, counts := range []map[string][]time.Time{rl.connections, rl.messages} {
+		for key, times := range counts {
+			if len(recent(times, now)) <= 0 {
+				delete(counts, key)
+			}
+		}
+	}
+
+	rl.lastSweep = now
+}
+
+func recent(times []time.Time, now time.Time) []time.Time {
+	index := 0
+	for index < len(times) && now.Sub(times[index]) >= RATE_LIMIT_WINDOW {
+		index++
+	}
+
+	return times[index:]
+}
+
+func clientHost(clientAddress string) string {
+	if host, _, err := net.SplitHostPort(clientAddress); err == nil {
+		return host
+	}
+
+	return clientAddress
+}
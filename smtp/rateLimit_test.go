@@ -0,0 +1,83 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package smtp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterConnections(t *testing.T) {
+	limiter := NewRateLimiter(2, 0)
+
+	for index, expected := range []bool{true, true, false, false} {
+		if result := limiter.AllowConnection("10.0.0.1:1234"); result != expected {
+			t.Errorf("Connection %d: expected allowed to be %v", index+1, expected)
+		}
+	}
+
+	if !limiter.AllowConnection("10.0.0.2:1234") {
+		t.Error("Expected another client to have its own limit")
+	}
+
+	/*
+	 * Connections older than the window no longer count
+	 */
+	limiter.connections["10.0.0.1"] = []time.Time{time.Now().Add(-RATE_LIMIT_WINDOW), time.Now()}
+
+	if !limiter.AllowConnection("10.0.0.1:5678") {
+		t.Error("Expected a connection to be allowed once an earlier one has left the window")
+	}
+}
+
+func TestRateLimiterMessages(t *testing.T) {
+	limiter := NewRateLimiter(0, 2)
+
+	for index := 0; index < 2; index++ {
+		if !limiter.AllowMessage("10.0.0.1:1234") {
+			t.Fatalf("Message %d: expected to be allowed", index+1)
+		}
+
+		limiter.AddMessage("10.0.0.1:1234")
+	}
+
+	if limiter.AllowMessage("10.0.0.1:5678") {
+		t.Error("Expected a third message from the same IP to be refused")
+	}
+
+	if !limiter.AllowConnection("10.0.0.1:5678") {
+		t.Error("Expected connections to be unlimited")
+	}
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+	limiter := NewRateLimiter(5, 5)
+	limiter.AllowConnection("10.0.0.1:1234")
+	limiter.AddMessage("10.0.0.1:1234")
+
+	limiter.sweep(time.Now().Add(2 * RATE_LIMIT_WINDOW))
+
+	if len(limiter.connections) != 0 || len(limiter.messages) != 0 {
+		t.Errorf("Expected idle clients to be forgotten, got %v and %v", limiter.connections, limiter.messages)
+	}
+}
+
+func TestParserRunMessageRateLimit(t *testing.T) {
+	parser := &Parser{RateLimiter: NewRateLimiter(0, 1)}
+	session := startTestSession(t, parser)
+
+	session.run([]sessionStep{
+		{"", "220"},
+		{"HELO localhost", "250"},
+		{"MAIL FROM:<sender@example.com>", "250"},
+		{"RCPT TO:<bob@example.com>", "250"},
+		{"DATA", "354"},
+		{"Subject: First\r\n\r\nHello\r\n.", "250"},
+		{"MAIL FROM:<sender@example.com>", "450"},
+		{"QUIT", "221"},
+	})
+
+	session.close()
+}
@@ -0,0 +1,76 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package smtp
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Records where a mail item came from: the client's address and the TLS
+state of the connection. Clients connected over a Unix socket have no
+address.
+*/
+func recordClient(mailItem *MailItemStruct, connection net.Conn) {
+	if host, port, err := net.SplitHostPort(connection.RemoteAddr().String()); err == nil {
+		mailItem.ClientIP = host
+		mailItem.ClientPort, _ = strconv.Atoi(port)
+	}
+
+	mailItem.TLS, mailItem.TLSVersion, mailItem.TLSCipherSuite = connectionTLSState(connection)
+}
+
+/*
+Builds the Received header (RFC 5321 section 4.4) the server adds to
+the top of a mail item it accepts. The protocol is named as in RFC
+3848, so "ESMTPSA" means EHLO was used over TLS by an authenticated
+client.
+*/
+func receivedHeader(mailItem MailItemStruct, extended bool, hostName string, received time.Time) string {
+	protocol := "SMTP"
+	if extended {
+		protocol = "ESMTP"
+
+		if mailItem.TLS {
+			protocol += "S"
+		}
+
+		if len(mailItem.AuthUser) > 0 {
+			protocol += "A"
+		}
+	}
+
+	client := "local socket"
+	if strings.Contains(mailItem.ClientIP, ":") {
+		client = fmt.Sprintf("[IPv6:%s]:%d", mailItem.ClientIP, mailItem.ClientPort)
+	} else if len(mailItem.ClientIP) > 0 {
+		client = fmt.Sprintf("[%s]:%d", mailItem.ClientIP, mailItem.ClientPort)
+	}
+
+	helo := mailItem.HeloName
+	if len(helo) <= 0 {
+		helo = "unknown"
+	}
+
+	result := fmt.Sprintf("Received: from %s (%s)\r\n\tby %s (MailSlurper) with %s", helo, client, hostName, protocol)
+
+	if mailItem.TLS {
+		result += fmt.Sprintf("\r\n\t(version=%s cipher=%s)", mailItem.TLSVersion, mailItem.TLSCipherSuite)
+	}
+
+	if len(mailItem.AuthUser) > 0 {
+		result += fmt.Sprintf("\r\n\t(authenticated as %s)", mailItem.AuthUser)
+	}
+
+	if len(mailItem.ToAddresses) == 1 {
+		result += fmt.Sprintf("\r\n\tfor <%s>", strings.Trim(mailItem.ToAddresses[0], "<> "))
+	}
+
+	return result + "; " + received.Format(time.RFC1123Z) + "\r\n"
+}
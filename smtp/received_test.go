@@ -0,0 +1,37 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package smtp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReceivedHeader(t *testing.T) {
+	received := time.Date(2026, 10, 19, 12, 15, 18, 0, time.UTC)
+
+	tests := []struct {
+		mailItem MailItemStruct
+		extended bool
+		expected string
+	}{
+		{
+			MailItemStruct{ClientIP: "10.0.0.12", ClientPort: 51234, HeloName: "app01.internal", ToAddresses: []string{"<bob@example.com>"}},
+			false,
+			"Received: from app01.internal ([10.0.0.12]:51234)\r\n\tby mailhost (MailSlurper) with SMTP\r\n\tfor <bob@example.com>; Mon, 19 Oct 2026 12:15:18 +0000\r\n",
+		},
+		{
+			MailItemStruct{ClientIP: "::1", ClientPort: 25, AuthUser: "app", TLS: true, TLSVersion: "TLS 1.3", TLSCipherSuite: "TLS_AES_128_GCM_SHA256"},
+			true,
+			"Received: from unknown ([IPv6:::1]:25)\r\n\tby mailhost (MailSlurper) with ESMTPSA\r\n\t(version=TLS 1.3 cipher=TLS_AES_128_GCM_SHA256)\r\n\t(authenticated as app); Mon, 19 Oct 2026 12:15:18 +0000\r\n",
+		},
+	}
+
+	for _, test := range tests {
+		if result := receivedHeader(test.mailItem, test.extended, "mailhost", received); result != test.expected {
+			t.Errorf("Expected %q, got %q", test.expected, result)
+		}
+	}
+}
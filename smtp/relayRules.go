@@ -0,0 +1,114 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package smtp
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/adampresley/mailslurper/admin/model"
+	"github.com/adampresley/mailslurper/relay"
+)
+
+/*
+RelayRule forwards newly received mail to a real SMTP server. To and
+From are address wildcard patterns such as "*@ourcompany.com". Only the
+recipients matching To are forwarded; empty patterns match everything.
+
+RewriteTo, when set, replaces each forwarded recipient. It may use
+"{local}" and "{domain}" for the parts of the original address, as in
+"qa+{local}@ourcompany.com".
+*/
+type RelayRule struct {
+	Name      string
+	To        string
+	From      string
+	RewriteTo string
+	Upstream  relay.Upstream
+}
+
+/*
+Returns the recipients of a mail item this rule forwards to, after
+rewriting. An empty result means the rule does not apply.
+*/
+func (rule RelayRule) Recipients(mailItem MailItemStruct) []string {
+	result := make([]string, 0)
+
+	if !MatchAddressPattern(rule.From, mailItem.FromAddress) {
+		return result
+	}
+
+	for _, address := range mailItem.ToAddresses {
+		if MatchAddressPattern(rule.To, address) {
+			result = append(result, rule.rewrite(relay.EnvelopeAddress(address)))
+		}
+	}
+
+	return result
+}
+
+func (rule RelayRule) rewrite(address string) string {
+	if len(rule.RewriteTo) <= 0 {
+		return address
+	}
+
+	local, domain := address, ""
+	if index := strings.LastIndex(address, "@"); index > -1 {
+		local, domain = address[:index], address[index+1:]
+	}
+
+	return strings.NewReplacer("{local}", local, "{domain}", domain).Replace(rule.RewriteTo)
+}
+
+/*
+Returns true if any of the relay rules forwards the mail item.
+*/
+func relayRulesApply(rules []RelayRule, mailItem MailItemStruct) bool {
+	for _, rule := range rules {
+		if len(rule.Recipients(mailItem)) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+Runs a mail item through each relay rule in turn. Every rule that
+applies forwards the message, and the outcome of each is returned
+so it can be stored with the mail item.
+*/
+func applyRelayRules(rules []RelayRule, mailItem MailItemStruct) []model.JSONMailRelay {
+	result := make([]model.JSONMailRelay, 0)
+
+	for _, rule := range rules {
+		recipients := rule.Recipients(mailItem)
+		if len(recipients) <= 0 {
+			continue
+		}
+
+		err := relay.Send(rule.Upstream, mailItem.FromAddress, recipients, mailItem.RawSource)
+
+		mailRelay := model.JSONMailRelay{
+			RelayName:   rule.Upstream.Name,
+			RuleName:    rule.Name,
+			Recipients:  recipients,
+			Success:     err == nil,
+			DateRelayed: time.Now().UTC().Format(DATE_RECEIVED_FORMAT),
+		}
+
+		if err != nil {
+			mailRelay.Error = err.Error()
+			log.Printf("Relay rule %s could not forward mail to %s: %s\n", rule.Name, strings.Join(recipients, ", "), err)
+		} else {
+			log.Printf("Relay rule %s forwarded mail to %s\n", rule.Name, strings.Join(recipients, ", "))
+		}
+
+		result = append(result, mailRelay)
+	}
+
+	return result
+}
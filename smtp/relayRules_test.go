@@ -0,0 +1,114 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package smtp
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adampresley/mailslurper/relay"
+)
+
+func TestRelayRuleRecipients(t *testing.T) {
+	mailItem := MailItemStruct{
+		FromAddress: "<app@example.com>",
+		ToAddresses: []string{"<bob@ourcompany.com>", "<alice@customer.test>"},
+	}
+
+	tests := []struct {
+		rule     RelayRule
+		expected string
+	}{
+		{RelayRule{}, "bob@ourcompany.com,alice@customer.test"},
+		{RelayRule{To: "*@ourcompany.com"}, "bob@ourcompany.com"},
+		{RelayRule{To: "*@ourcompany.com", RewriteTo: "qa+{local}@{domain}"}, "qa+bob@ourcompany.com"},
+		{RelayRule{From: "other@example.com"}, ""},
+		{RelayRule{To: "*@elsewhere.test"}, ""},
+	}
+
+	for _, test := range tests {
+		if result := strings.Join(test.rule.Recipients(mailItem), ","); result != test.expected {
+			t.Errorf("%+v: expected recipients %q, got %q", test.rule, test.expected, result)
+		}
+
+		if applies := relayRulesApply([]RelayRule{test.rule}, mailItem); applies != (len(test.expected) > 0) {
+			t.Errorf("%+v: expected applies to be %v", test.rule, len(test.expected) > 0)
+		}
+	}
+}
+
+func TestServerRelaysOutsideTheSession(t *testing.T) {
+	/*
+	 * An upstream server that accepts connections and never replies
+	 */
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+
+	stalled := make(chan net.Conn, 1)
+
+	go func() {
+		if connection, err := upstream.Accept(); err == nil {
+			stalled <- connection
+		}
+	}()
+
+	port := upstream.Addr().(*net.TCPAddr).Port
+
+	server := &Server{RelayRules: []RelayRule{{Name: "stalled", Upstream: relay.Upstream{Name: "stalled", Host: "127.0.0.1", Port: port}}}}
+	address := startTestServer(t, server)
+
+	defer server.Storage.Disconnect()
+	defer upstream.Close()
+
+	received := server.Storage.AddMailReceivedListener()
+
+	connection, reply := dialTestServer(t, address)
+	if !strings.HasPrefix(reply, "220") {
+		t.Fatalf("Expected a greeting, got %q", reply)
+	}
+
+	session := &testSession{t: t, client: connection, reader: bufio.NewReader(connection)}
+	session.run([]sessionStep{
+		{"HELO localhost", "250"},
+		{"MAIL FROM:<sender@example.com>", "250"},
+		{"RCPT TO:<bob@example.com>", "250"},
+		{"DATA", "354"},
+		{"Subject: Relayed\r\n\r\nHello\r\n.", "250"},
+		{"QUIT", "221"},
+	})
+
+	connection.Close()
+
+	select {
+	case <-received:
+		t.Fatal("Expected the mail item to wait for the relay")
+
+	case upstreamConnection := <-stalled:
+		/*
+		 * Let the relay fail now the session is over
+		 */
+		upstreamConnection.Close()
+
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the relay to connect")
+	}
+
+	select {
+	case mailItem := <-received:
+		if len(mailItem.Relays) != 1 || mailItem.Relays[0].Success {
+			t.Errorf("Expected a failed relay to be recorded, got %+v", mailItem.Relays)
+		}
+
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the mail item")
+	}
+
+	server.Close()
+}
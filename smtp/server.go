@@ -5,55 +5,164 @@
 package smtp
 
 import (
-	"fmt"
 	"log"
 	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/adampresley/mailslurper/profiling"
 )
 
-// Represents an SMTP server with an address and connection handle.
+// Shortest and longest delays before accepting connections is retried
+// after an error
+const (
+	ACCEPT_RETRY_MIN_DELAY = 5 * time.Millisecond
+	ACCEPT_RETRY_MAX_DELAY = time.Second
+)
+
+// Represents an SMTP server with the addresses it listens on.
+// Parsed mail items are run through RelayRules, then written to Storage.
 type Server struct {
-	Address          string
-	ConnectionHandle net.Listener
+	// Addresses to accept connections on. When empty a single plain
+	// TCP listener on Address is used.
+	Listeners []*Listener
+	Address   string
+
+	Storage    *MailStorage
+	RelayRules []RelayRule
+
+	// Fault rules applied to every session. May be nil.
+	Faults *FaultInjector
+
+	// Latency rules applied to every session. May be nil.
+	Latency *LatencySimulator
+
+	// Greylist applied to every session. May be nil.
+	Greylist *Greylist
+
+	// Largest message in bytes and most recipients per message
+	// accepted. Zero means no limit.
+	MaxMessageSize int
+	MaxRecipients  int
+
+	// Whether BDAT (RFC 3030 CHUNKING) is offered
+	Chunking bool
+
+	// Whether commands are checked in strict mode. See SMTP_MODE_STRICT.
+	Strict bool
+
+	// Answers VRFY and EXPN. May be nil.
+	Verifier *AddressVerifier
+
+	// Most client connections handled at once. Zero means no limit.
+	MaxConnections int
+
+	// Per-client connection and message rate limits. May be nil.
+	RateLimiter *RateLimiter
+
+	closing  int32
+	active   int32
+	sessions sync.WaitGroup
+	relaying sync.WaitGroup
+	done     chan bool
+
+	connectionsLock sync.Mutex
+	connections     map[net.Conn]bool
 }
 
 /*
-Establishes a listening connection to a socket on an address. This will
-set the connection handle on our Server struct.
+Binds every listener. If any of them cannot be bound the ones already
+bound are closed and an error naming the failed listener is returned.
 */
-func (s *Server) Connect() {
-	handle, err := net.Listen("tcp", s.Address)
-	if err != nil {
-		panic(fmt.Sprintf("Error while setting up SMTP listener"))
+func (s *Server) Connect() error {
+	if len(s.Listeners) <= 0 {
+		s.Listeners = []*Listener{{Name: "smtp", Network: "tcp", Address: s.Address}}
+	}
+
+	for index, listener := range s.Listeners {
+		err := listener.validate()
+		if err == nil {
+			err = listener.listen()
+		}
+
+		if err != nil {
+			for _, bound := range s.Listeners[:index] {
+				bound.handle.Close()
+			}
+
+			return err
+		}
+
+		log.Printf("SMTP listener %s setup at %s\n", listener, listener.Addr())
 	}
 
-	s.ConnectionHandle = handle
-	log.Println("SMTP listener setup at ", s.Address)
+	s.done = make(chan bool)
+	return nil
 }
 
 /*
-Closes a socket connection in an Server object. Most likely used in a defer call.
+Closes the server's listeners. Most likely used in a defer call.
+If ProcessRequests is running this waits for it to finish the sessions in progress
+and write their mail items to storage before returning.
 
 Example:
 	smtp := Server.Server { Address: "127.0.0.1:8000" }
 	defer smtp.Close()
 */
 func (s *Server) Close() {
-	s.ConnectionHandle.Close()
+	s.Shutdown(0)
+}
+
+/*
+Closes the server's listeners like Close, but only gives the sessions in
+progress until timeout to finish. The connections of sessions still running
+after that are closed. Either way every mail item already accepted is
+written to storage before this returns. A timeout of zero waits for the
+sessions however long they take.
+*/
+func (s *Server) Shutdown(timeout time.Duration) {
+	if !atomic.CompareAndSwapInt32(&s.closing, 0, 1) {
+		return
+	}
+
+	for _, listener := range s.Listeners {
+		if listener.handle != nil {
+			listener.handle.Close()
+		}
+	}
+
+	if s.done == nil {
+		return
+	}
+
+	if timeout <= 0 {
+		<-s.done
+		return
+	}
+
+	select {
+	case <-s.done:
+
+	case <-time.After(timeout):
+		log.Println("Closing SMTP sessions still in progress after", timeout)
+		s.closeConnections()
+		<-s.done
+	}
 }
 
 /*
 This function starts the process of handling SMTP client connections.
 The first order of business is to setup a channel for writing
-parsed mails, in the form of MailItemStruct variables, to our
-SQLite database. A goroutine is setup to listen on that
+parsed mails, in the form of MailItemStruct variables, to the
+server's Storage. A goroutine is setup to listen on that
 channel and handles storage.
 
-Meanwhile this method will loop forever and wait for client connections (blocking).
-When a connection is recieved a goroutine is started to create a new MailItemStruct
-and parser and the parser process is started. If the parsing is successful
-the MailItemStruct is added to the database writing channel.
+Meanwhile this method waits for client connections on every listener (blocking)
+until Close is called. When a connection is recieved a goroutine is started to
+create a new MailItemStruct and parser and the parser process is started. If the
+parsing is successful the MailItemStruct is added to the database writing channel.
 */
 func (s *Server) ProcessRequests() {
 	/*
@@ -61,41 +170,261 @@ func (s *Server) ProcessRequests() {
 	 * data storage. Start listening for write requests.
 	 */
 	dbWriteChannel := make(chan MailItemStruct, 100)
-	go Storage.StartWriteListener(dbWriteChannel)
+	writerDone := make(chan bool)
+
+	go func() {
+		s.Storage.StartWriteListener(dbWriteChannel)
+		close(writerDone)
+	}()
+
+	defer close(s.done)
+
+	/*
+	 * Name this server gives itself in Received headers
+	 */
+	hostName, err := os.Hostname()
+	if err != nil {
+		hostName = "localhost"
+	}
+
+	/*
+	 * Now start accepting connections for SMTP on every listener
+	 */
+	var accepting sync.WaitGroup
+
+	for _, listener := range s.Listeners {
+		accepting.Add(1)
+
+		go func(listener *Listener) {
+			defer accepting.Done()
+			s.acceptConnections(listener, hostName, dbWriteChannel)
+		}(listener)
+	}
 
 	/*
-	 * Now start accepting connections for SMTP
+	 * We've been closed. Let sessions in progress finish and their
+	 * mail items be relayed, then wait for them to be written.
 	 */
+	accepting.Wait()
+	s.sessions.Wait()
+	s.relaying.Wait()
+	close(dbWriteChannel)
+	<-writerDone
+
+	log.Println("SMTP listeners closed")
+}
+
+/*
+Accepts connections on one listener until the server is closed,
+handling each in its own goroutine. Connections over the connection
+limits are refused with a 421 reply. If accepting fails, such as when
+the process runs out of file descriptors, it is retried after a delay
+that doubles up to a second.
+*/
+func (s *Server) acceptConnections(listener *Listener, hostName string, dbWriter chan MailItemStruct) {
+	var retryDelay time.Duration
+
 	for {
-		connection, err := s.ConnectionHandle.Accept()
+		connection, err := listener.handle.Accept()
 		if err != nil {
-			log.Panicf("Error while accepting SMTP requests: %s", err)
+			if atomic.LoadInt32(&s.closing) == 1 {
+				return
+			}
+
+			retryDelay = retryDelay * 2
+			if retryDelay <= 0 {
+				retryDelay = ACCEPT_RETRY_MIN_DELAY
+			}
+
+			if retryDelay > ACCEPT_RETRY_MAX_DELAY {
+				retryDelay = ACCEPT_RETRY_MAX_DELAY
+			}
+
+			log.Printf("Error while accepting SMTP requests on %s, retrying in %s: %s\n", listener, retryDelay, err)
+			time.Sleep(retryDelay)
+			continue
 		}
 
-		go func(c net.Conn, dbWriter chan MailItemStruct) {
+		retryDelay = 0
+		s.sessions.Add(1)
+
+		if reply := s.admit(connection); len(reply) > 0 {
+			go func(c net.Conn) {
+				defer s.sessions.Done()
+				refuseConnection(c, reply)
+			}(connection)
+
+			continue
+		}
+
+		s.trackConnection(connection, true)
+
+		go func(c net.Conn) {
+			defer s.sessions.Done()
+			defer atomic.AddInt32(&s.active, -1)
+			defer s.trackConnection(c, false)
 			defer c.Close()
 
-			/*
-			 * Create a package that starts processing SMTP commands
-			 * unil it is time to close the connection
-			 */
-			mailItem := MailItemStruct{}
+			s.handleSession(listener, c, hostName, dbWriter)
+		}(connection)
+	}
+}
 
-			parser := Parser{
-				State:      STATE_START,
-				Connection: c,
-				MailItem:   mailItem,
-			}
+/*
+Checks a new connection against the connection limits. An empty string
+is returned if it may go ahead, and it is then counted as active until
+its session ends. Otherwise the reply to refuse it with is returned.
+*/
+func (s *Server) admit(connection net.Conn) string {
+	if s.RateLimiter != nil && !s.RateLimiter.AllowConnection(connection.RemoteAddr().String()) {
+		log.Println("Connection rate limit reached for ", connection.RemoteAddr())
+		return "421 4.7.0 Too many connections from your address, try again later"
+	}
+
+	if atomic.AddInt32(&s.active, 1) > int32(s.MaxConnections) && s.MaxConnections > 0 {
+		atomic.AddInt32(&s.active, -1)
+		log.Printf("Refusing connection from %s, already handling %d\n", connection.RemoteAddr(), s.MaxConnections)
+		return "421 4.7.0 Too many connections, try again later"
+	}
 
-			profiling.Timer.Step("Parse mail item")
-			parser.Run()
+	return ""
+}
 
-			if parser.State == STATE_QUIT {
-				log.Println("Writing mail item to database and websocket...")
-				dbWriter <- parser.MailItem
-			} else {
-				log.Println("An error occurred during mail transmission and data will not be written.")
-			}
-		}(connection, dbWriteChannel)
+/*
+Adds a connection to, or removes it from, the set of connections
+with a session in progress.
+*/
+func (s *Server) trackConnection(connection net.Conn, active bool) {
+	s.connectionsLock.Lock()
+	defer s.connectionsLock.Unlock()
+
+	if s.connections == nil {
+		s.connections = make(map[net.Conn]bool)
+	}
+
+	if active {
+		s.connections[connection] = true
+	} else {
+		delete(s.connections, connection)
+	}
+}
+
+/*
+Closes the connection of every session in progress, which makes
+the sessions end.
+*/
+func (s *Server) closeConnections() {
+	s.connectionsLock.Lock()
+	defer s.connectionsLock.Unlock()
+
+	for connection := range s.connections {
+		connection.Close()
+	}
+}
+
+/*
+Sends a refusal to a connection that will not be served and closes it.
+The client is only given a few seconds to take the reply.
+*/
+func refuseConnection(connection net.Conn, reply string) {
+	connection.SetDeadline(time.Now().Add(time.Second * COMMAND_TIMEOUT_SECONDS))
+	connection.Write([]byte(reply + "\r\n"))
+	connection.Close()
+}
+
+/*
+Runs an SMTP session on a client connection. Mail items accepted during
+the session are added to the database writing channel; if there are none
+only the session transcript is stored.
+*/
+func (s *Server) handleSession(listener *Listener, c net.Conn, hostName string, dbWriter chan MailItemStruct) {
+	/*
+	 * Create a package that starts processing SMTP commands
+	 * unil it is time to close the connection
+	 */
+	mailItem := MailItemStruct{}
+	transcript := NewTranscript(c)
+
+	parser := Parser{
+		State:      STATE_START,
+		Connection: c,
+		MailItem:   mailItem,
+		Faults:     s.Faults,
+		Latency:    s.Latency,
+		Greylist:   s.Greylist,
+
+		MaxMessageSize: s.MaxMessageSize,
+		MaxRecipients:  s.MaxRecipients,
+		Chunking:       s.Chunking && listener.offers("CHUNKING"),
+		Strict:         s.Strict,
+		Verifier:       s.Verifier,
+		RateLimiter:    s.RateLimiter,
+		Transcript:     transcript,
+		Extensions:     listener.Extensions,
+		TLSConfig:      listener.startTLSConfig(),
+		HostName:       hostName,
+	}
+
+	profiling.Timer.Step("Parse mail item")
+	parser.Run()
+
+	/*
+	 * The connection may have been upgraded with STARTTLS
+	 */
+	c = parser.Connection
+
+	/*
+	 * Messages are kept once they have been accepted, even if the
+	 * client goes away before QUIT, as it has been told so. Each
+	 * is stored with its own copy of the session transcript.
+	 */
+	if len(parser.Messages) > 0 {
+		session := transcript.Session(c, SESSION_OUTCOME_ACCEPTED)
+
+		for _, mailItem := range parser.Messages {
+			mailSession := session
+			mailItem.Session = &mailSession
+
+			s.deliver(mailItem, dbWriter)
+		}
+
+		return
+	}
+
+	outcome := SESSION_OUTCOME_ERROR
+	if parser.State == STATE_QUIT {
+		outcome = SESSION_OUTCOME_NO_MESSAGE
+		log.Println("No message was accepted during the session and nothing will be written.")
+	} else {
+		log.Println("An error occurred during mail transmission and data will not be written.")
+	}
+
+	if err := s.Storage.AddSmtpSession(transcript.Session(c, outcome)); err != nil {
+		log.Println("Error writing SMTP session: ", err)
+	}
+}
+
+/*
+Adds an accepted mail item to the database writing channel. A mail item
+that relay rules forward is relayed first in a goroutine of its own, so a
+slow upstream server neither holds up the session nor counts against
+MaxConnections.
+*/
+func (s *Server) deliver(mailItem MailItemStruct, dbWriter chan MailItemStruct) {
+	if !relayRulesApply(s.RelayRules, mailItem) {
+		log.Println("Writing mail item to database and websocket...")
+		dbWriter <- mailItem
+		return
 	}
+
+	s.relaying.Add(1)
+
+	go func() {
+		defer s.relaying.Done()
+
+		mailItem.Relays = applyRelayRules(s.RelayRules, mailItem)
+
+		log.Println("Writing mail item to database and websocket...")
+		dbWriter <- mailItem
+	}()
 }
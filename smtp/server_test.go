@@ -0,0 +1,162 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package smtp
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/*
+Starts a server on a random loopback port and returns it with its address.
+*/
+func startTestServer(t *testing.T, server *Server) string {
+	server.Address = "127.0.0.1:0"
+	server.Storage = newTestStorage(t)
+
+	if err := server.Connect(); err != nil {
+		t.Fatalf("Unable to connect: %s", err)
+	}
+
+	go server.ProcessRequests()
+	return server.Listeners[0].Addr().String()
+}
+
+/*
+Connects to a server and returns the connection and its first reply.
+*/
+func dialTestServer(t *testing.T, address string) (net.Conn, string) {
+	connection, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("Unable to connect: %s", err)
+	}
+
+	connection.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	reply, err := bufio.NewReader(connection).ReadString('\n')
+	if err != nil {
+		t.Fatalf("Unable to read the greeting: %s", err)
+	}
+
+	return connection, reply
+}
+
+func TestServerMaxConnections(t *testing.T) {
+	server := &Server{MaxConnections: 1}
+	address := startTestServer(t, server)
+
+	defer server.Storage.Disconnect()
+	defer server.Close()
+
+	first, reply := dialTestServer(t, address)
+	if !strings.HasPrefix(reply, "220") {
+		t.Fatalf("Expected the first connection to be greeted, got %q", reply)
+	}
+
+	second, reply := dialTestServer(t, address)
+	second.Close()
+
+	if !strings.HasPrefix(reply, "421 4.7.0 Too many connections") {
+		t.Errorf("Expected a connection over the limit to be refused with 421, got %q", reply)
+	}
+
+	first.Write([]byte("QUIT\r\n"))
+	first.Close()
+
+	/*
+	 * Once the first session has ended there is room again
+	 */
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&server.active) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	third, reply := dialTestServer(t, address)
+	third.Write([]byte("QUIT\r\n"))
+	third.Close()
+
+	if !strings.HasPrefix(reply, "220") {
+		t.Errorf("Expected a connection to be greeted after the first session ended, got %q", reply)
+	}
+}
+
+func TestServerConnectionRateLimit(t *testing.T) {
+	server := &Server{RateLimiter: NewRateLimiter(1, 0)}
+	address := startTestServer(t, server)
+
+	defer server.Storage.Disconnect()
+	defer server.Close()
+
+	first, reply := dialTestServer(t, address)
+	first.Write([]byte("QUIT\r\n"))
+	first.Close()
+
+	if !strings.HasPrefix(reply, "220") {
+		t.Fatalf("Expected the first connection to be greeted, got %q", reply)
+	}
+
+	second, reply := dialTestServer(t, address)
+	second.Close()
+
+	if !strings.HasPrefix(reply, "421 4.7.0 Too many connections from your address") {
+		t.Errorf("Expected a connection over the rate limit to be refused with 421, got %q", reply)
+	}
+}
+
+/*
+A listener whose Accept always fails, recording when it was called.
+The server is closed after a number of calls.
+*/
+type failingListener struct {
+	net.Listener
+	server *Server
+	calls  []time.Time
+	limit  int
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	l.calls = append(l.calls, time.Now())
+
+	if len(l.calls) >= l.limit {
+		atomic.StoreInt32(&l.server.closing, 1)
+	}
+
+	return nil, errors.New("too many open files")
+}
+
+func TestServerAcceptRetryBackoff(t *testing.T) {
+	server := &Server{}
+	failing := &failingListener{server: server, limit: 10}
+
+	done := make(chan bool)
+
+	go func() {
+		server.acceptConnections(&Listener{Name: "failing", handle: failing}, "localhost", nil)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Expected accepting to stop once the server is closed")
+	}
+
+	expected := ACCEPT_RETRY_MIN_DELAY
+
+	for index := 1; index < len(failing.calls); index++ {
+		if delay := failing.calls[index].Sub(failing.calls[index-1]); delay < expected {
+			t.Errorf("Retry %d: expected a delay of at least %s, got %s", index, expected, delay)
+		}
+
+		if expected *= 2; expected > ACCEPT_RETRY_MAX_DELAY {
+			expected = ACCEPT_RETRY_MAX_DELAY
+		}
+	}
+}
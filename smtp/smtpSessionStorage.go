@@ -0,0 +1,185 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package smtp
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+
+	"github.com/adampresley/mailslurper/admin/model"
+	"github.com/adampresley/mailslurper/profiling"
+)
+
+type sqlExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+/*
+Records an SMTP session that did not produce a mail item. Sessions
+that did are written along with their mail item. Sessions without a
+mail item are only kept until SESSION_LOG_MAX_LEN more sessions have
+been recorded.
+*/
+func (ms *MailStorage) AddSmtpSession(session model.JSONSmtpSession) error {
+	profiling.Timer.Step("Writing SMTP session")
+
+	id, err := insertSmtpSession(ms.Db, session)
+	if err != nil {
+		return err
+	}
+
+	if id > SESSION_LOG_MAX_LEN {
+		_, err = ms.Db.Exec("DELETE FROM smtpsession WHERE mailItemId=0 AND id <= ?", id-SESSION_LOG_MAX_LEN)
+	}
+
+	return err
+}
+
+func insertSmtpSession(db sqlExecer, session model.JSONSmtpSession) (int, error) {
+	transcript, _ := json.Marshal(session.Transcript)
+
+	result, err := db.Exec(
+		"INSERT INTO smtpsession (mailItemId, clientAddress, heloName, tls, tlsVersion, tlsCipherSuite, outcome, dateStarted, dateEnded, transcript) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		session.MailItemId,
+		session.ClientAddress,
+		session.HeloName,
+		session.TLS,
+		session.TLSVersion,
+		session.TLSCipherSuite,
+		session.Outcome,
+		session.DateStarted,
+		session.DateEnded,
+		string(transcript),
+	)
+
+	if err != nil {
+		return 0, err
+	}
+
+	id, _ := result.LastInsertId()
+	return int(id), nil
+}
+
+/*
+Retrieves recorded SMTP sessions, newest first, without their transcripts.
+If outcome is not empty only sessions that ended that way are returned.
+*/
+func (ms *MailStorage) GetSmtpSessions(outcome string) []model.JSONSmtpSession {
+	profiling.Timer.Step("Getting SMTP sessions")
+
+	rows, err := ms.Db.Query(`
+		SELECT
+			  id
+			, mailItemId
+			, clientAddress
+			, heloName
+			, tls
+			, tlsVersion
+			, tlsCipherSuite
+			, outcome
+			, dateStarted
+			, dateEnded
+		FROM smtpsession
+		WHERE outcome=? OR ?=''
+		ORDER BY id DESC
+	`, outcome, outcome)
+
+	if err != nil {
+		log.Panic("Error running query to get SMTP sessions: ", err)
+	}
+
+	defer rows.Close()
+
+	result := make([]model.JSONSmtpSession, 0)
+
+	for rows.Next() {
+		session := model.JSONSmtpSession{}
+
+		rows.Scan(
+			&session.Id,
+			&session.MailItemId,
+			&session.ClientAddress,
+			&session.HeloName,
+			&session.TLS,
+			&session.TLSVersion,
+			&session.TLSCipherSuite,
+			&session.Outcome,
+			&session.DateStarted,
+			&session.DateEnded,
+		)
+
+		result = append(result, session)
+	}
+
+	return result
+}
+
+/*
+Retrieves a single SMTP session and its transcript. The session
+has an Id of 0 if it was not found.
+*/
+func (ms *MailStorage) GetSmtpSession(id int) model.JSONSmtpSession {
+	return ms.getSmtpSession("id", id)
+}
+
+/*
+Retrieves the SMTP session a mail item was received in, along with
+its transcript. The session has an Id of 0 if it was not found.
+*/
+func (ms *MailStorage) GetMailSmtpSession(mailItemId int) model.JSONSmtpSession {
+	return ms.getSmtpSession("mailItemId", mailItemId)
+}
+
+func (ms *MailStorage) getSmtpSession(column string, value int) model.JSONSmtpSession {
+	profiling.Timer.Step("Getting SMTP session")
+
+	rows, err := ms.Db.Query(`
+		SELECT
+			  id
+			, mailItemId
+			, clientAddress
+			, heloName
+			, tls
+			, tlsVersion
+			, tlsCipherSuite
+			, outcome
+			, dateStarted
+			, dateEnded
+			, transcript
+		FROM smtpsession
+		WHERE `+column+`=?
+	`, value)
+
+	if err != nil {
+		log.Panic("Error running query to get SMTP session: ", err)
+	}
+
+	defer rows.Close()
+
+	result := model.JSONSmtpSession{}
+
+	for rows.Next() {
+		var transcript string
+
+		rows.Scan(
+			&result.Id,
+			&result.MailItemId,
+			&result.ClientAddress,
+			&result.HeloName,
+			&result.TLS,
+			&result.TLSVersion,
+			&result.TLSCipherSuite,
+			&result.Outcome,
+			&result.DateStarted,
+			&result.DateEnded,
+			&transcript,
+		)
+
+		json.Unmarshal([]byte(transcript), &result.Transcript)
+	}
+
+	return result
+}
@@ -0,0 +1,116 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package smtp
+
+import (
+	"testing"
+
+	"github.com/adampresley/mailslurper/admin/model"
+)
+
+func testSmtpSession(outcome string) model.JSONSmtpSession {
+	return model.JSONSmtpSession{
+		ClientAddress: "127.0.0.1:1234",
+		HeloName:      "client.example.com",
+		Outcome:       outcome,
+		DateStarted:   "2014-01-02 03:04:05",
+		DateEnded:     "2014-01-02 03:04:06",
+		Transcript: []model.JSONTranscriptLine{
+			{Direction: TRANSCRIPT_SERVER, Line: "220 Welcome"},
+			{Direction: TRANSCRIPT_CLIENT, Line: "QUIT"},
+		},
+	}
+}
+
+func TestAddSmtpSession(t *testing.T) {
+	storage := newTestStorage(t)
+	defer storage.Disconnect()
+
+	storage.AddSmtpSession(testSmtpSession(SESSION_OUTCOME_NO_MESSAGE))
+	storage.AddSmtpSession(testSmtpSession(SESSION_OUTCOME_ERROR))
+
+	sessions := storage.GetSmtpSessions("")
+	if len(sessions) != 2 || sessions[0].Id != 2 || sessions[0].Outcome != SESSION_OUTCOME_ERROR {
+		t.Fatalf("Expected 2 sessions, newest first, got %+v", sessions)
+	}
+
+	if len(sessions[0].Transcript) != 0 {
+		t.Errorf("Expected sessions to be listed without their transcripts, got %+v", sessions[0].Transcript)
+	}
+
+	if errors := storage.GetSmtpSessions(SESSION_OUTCOME_ERROR); len(errors) != 1 || errors[0].Id != 2 {
+		t.Errorf("Expected only the session that ended in an error, got %+v", errors)
+	}
+
+	session := storage.GetSmtpSession(1)
+	if session.HeloName != "client.example.com" || len(session.Transcript) != 2 || session.Transcript[1].Line != "QUIT" {
+		t.Errorf("Expected session 1 with its transcript, got %+v", session)
+	}
+
+	if missing := storage.GetSmtpSession(99); missing.Id != 0 {
+		t.Errorf("Expected a missing session to have an Id of 0, got %d", missing.Id)
+	}
+}
+
+func TestSmtpSessionLogIsTrimmed(t *testing.T) {
+	storage := newTestStorage(t)
+	defer storage.Disconnect()
+
+	for index := 0; index < SESSION_LOG_MAX_LEN+5; index++ {
+		storage.AddSmtpSession(testSmtpSession(SESSION_OUTCOME_NO_MESSAGE))
+	}
+
+	sessions := storage.GetSmtpSessions("")
+	if len(sessions) != SESSION_LOG_MAX_LEN {
+		t.Fatalf("Expected %d sessions to be kept, got %d", SESSION_LOG_MAX_LEN, len(sessions))
+	}
+
+	if oldest := sessions[len(sessions)-1].Id; oldest != 6 {
+		t.Errorf("Expected the oldest kept session to be 6, got %d", oldest)
+	}
+}
+
+func TestMailSmtpSession(t *testing.T) {
+	storage := newTestStorage(t)
+	defer storage.Disconnect()
+
+	session := testSmtpSession(SESSION_OUTCOME_ACCEPTED)
+	mailItem := testMailItem("<bob@example.com>", "Hello")
+	mailItem.Session = &session
+
+	writeTestMail(t, storage, mailItem)
+	storage.AddSmtpSession(testSmtpSession(SESSION_OUTCOME_NO_MESSAGE))
+
+	id := storage.GetMails(MailSearch{})[0].Id
+
+	result := storage.GetMailSmtpSession(id)
+	if result.MailItemId != id || result.Outcome != SESSION_OUTCOME_ACCEPTED || len(result.Transcript) != 2 {
+		t.Errorf("Expected the session mail item %d was received in, got %+v", id, result)
+	}
+
+	storage.PurgeMails()
+
+	if sessions := storage.GetSmtpSessions(""); len(sessions) != 1 || sessions[0].MailItemId != 0 {
+		t.Errorf("Expected purging to keep only the session without a mail item, got %+v", sessions)
+	}
+}
+
+func TestDeleteMailDeletesSmtpSession(t *testing.T) {
+	storage := newTestStorage(t)
+	defer storage.Disconnect()
+
+	session := testSmtpSession(SESSION_OUTCOME_ACCEPTED)
+	mailItem := testMailItem("<bob@example.com>", "Hello")
+	mailItem.Session = &session
+
+	writeTestMail(t, storage, mailItem)
+	id := storage.GetMails(MailSearch{})[0].Id
+
+	storage.DeleteMail(id)
+
+	if result := storage.GetMailSmtpSession(id); result.Id != 0 {
+		t.Errorf("Expected the session to be deleted with its mail item, got %+v", result)
+	}
+}
@@ -28,6 +28,23 @@ func ConnectSqlite() (*sql.DB, error) {
 	return db, nil
 }
 
+/*
+Opens a private, in-memory SQLite database. The connection pool is
+limited to a single connection as each new connection to ":memory:"
+would otherwise get its own empty database.
+*/
+func ConnectSqliteMemory() (*sql.DB, error) {
+	log.Println("Connecting to in-memory SQLITE3 database")
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		return nil, err
+	}
+
+	db.SetMaxOpenConns(1)
+	return db, nil
+}
+
 func CreateSqlliteDatabase(db *sql.DB) error {
 	log.Println("Creating tables...")
 
@@ -43,7 +60,20 @@ func CreateSqlliteDatabase(db *sql.DB) error {
 			xmailer TEXT,
 			body TEXT,
 			contentType TEXT,
-			boundary TEXT
+			boundary TEXT,
+			dateReceived TEXT,
+			rawSource TEXT,
+			bodyType TEXT,
+			smtpUtf8 INTEGER NOT NULL DEFAULT 0,
+			clientIP TEXT,
+			clientPort INTEGER NOT NULL DEFAULT 0,
+			heloName TEXT,
+			authUser TEXT,
+			tls INTEGER NOT NULL DEFAULT 0,
+			tlsVersion TEXT,
+			tlsCipherSuite TEXT,
+			isRead INTEGER NOT NULL DEFAULT 0,
+			isStarred INTEGER NOT NULL DEFAULT 0
 		);
 	`
 
@@ -67,6 +97,92 @@ func CreateSqlliteDatabase(db *sql.DB) error {
 		return err
 	}
 
+	sql = `
+		CREATE TABLE mailitemtag (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			mailItemId INTEGER,
+			tag TEXT
+		);
+	`
+
+	_, err = db.Exec(sql)
+	if err != nil {
+		return err
+	}
+
+	sql = `
+		CREATE TABLE webhookdelivery (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			mailItemId INTEGER,
+			webhookName TEXT,
+			url TEXT,
+			attempt INTEGER,
+			statusCode INTEGER,
+			success INTEGER NOT NULL DEFAULT 0,
+			errorMessage TEXT,
+			dateAttempted TEXT
+		);
+	`
+
+	_, err = db.Exec(sql)
+	if err != nil {
+		return err
+	}
+
+	sql = `
+		CREATE TABLE mailevent (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			eventType TEXT,
+			mailItemId INTEGER,
+			data TEXT,
+			dateCreated TEXT
+		);
+	`
+
+	_, err = db.Exec(sql)
+	if err != nil {
+		return err
+	}
+
+	sql = `
+		CREATE TABLE mailrelay (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			mailItemId INTEGER,
+			relayName TEXT,
+			ruleName TEXT,
+			recipients TEXT,
+			success INTEGER NOT NULL DEFAULT 0,
+			errorMessage TEXT,
+			dateRelayed TEXT
+		);
+	`
+
+	_, err = db.Exec(sql)
+	if err != nil {
+		return err
+	}
+
+	sql = `
+		CREATE TABLE smtpsession (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			mailItemId INTEGER NOT NULL DEFAULT 0,
+			clientAddress TEXT,
+			heloName TEXT,
+			tls INTEGER NOT NULL DEFAULT 0,
+			tlsVersion TEXT,
+			tlsCipherSuite TEXT,
+			outcome TEXT,
+			dateStarted TEXT,
+			dateEnded TEXT,
+			transcript TEXT
+		);
+	`
+
+	_, err = db.Exec(sql)
+	if err != nil {
+		return err
+	}
+
 	log.Println("Created tables successfully.")
 	return nil
 }
@@ -8,7 +8,9 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/adampresley/mailslurper/profiling"
 	"github.com/adampresley/mailslurper/admin/model"
@@ -18,8 +20,20 @@ const (
 	ENGINE_SQLITE int = 1
 	ENGINE_MYSQL  int = 2
 	ENGINE_MSSQL  int = 3
+
+	ENGINE_SQLITE_MEMORY int = 4
 )
 
+/*
+A column added to a table after the table was first created, so
+tables from earlier versions need it added.
+*/
+type addedColumn struct {
+	table      string
+	name       string
+	definition string
+}
+
 /*
 Structure for holding a persistent database connection.
 */
@@ -32,15 +46,21 @@ type MailStorage struct {
 	Password string
 
 	Db *sql.DB
-}
 
-// Global variable for our server's database connection
-var Storage MailStorage
+	// Websocket hub to notify of new and changed mail items. May be nil.
+	Websockets *WebsocketHub
+
+	listeners      map[chan MailItemStruct]bool
+	eventListeners map[chan model.JSONMailEvent]bool
+	listenersLock  sync.Mutex
+	eventsLock     sync.Mutex
+}
 
 /*
-Open a connection to a SQLite database. This will attempt to delete any
-existing database file and create a new one with a blank table for holding
-mail data.
+Open a connection to the configured database engine and create the tables
+for holding mail data. For SQLite this will attempt to delete any existing
+database file and create a new one. ENGINE_SQLITE_MEMORY uses a private
+in-memory SQLite database, which is handy for tests.
 */
 func (ms *MailStorage) Connect() error {
 	var db *sql.DB
@@ -51,6 +71,10 @@ func (ms *MailStorage) Connect() error {
 		db, err = ConnectSqlite()
 		err = CreateSqlliteDatabase(db)
 
+	case ENGINE_SQLITE_MEMORY:
+		db, err = ConnectSqliteMemory()
+		err = CreateSqlliteDatabase(db)
+
 	case ENGINE_MYSQL:
 		db, err = ConnectMySQL(ms.Host, ms.Port, ms.Database, ms.UserName, ms.Password)
 		err = CreateMySQLDatabase(db)
@@ -77,11 +101,11 @@ func (ms *MailStorage) Disconnect() {
 
 /*
 Listens for messages on a channel for mail messages to be written
-to disk. This channel takes in MailItemStruct mail items.
+to disk. This channel takes in MailItemStruct mail items. This
+returns once the channel is closed and every item has been written.
 */
 func (ms *MailStorage) StartWriteListener(dbWriteChannel chan MailItemStruct) {
-	for {
-		mailItem := <-dbWriteChannel
+	for mailItem := range dbWriteChannel {
 
 		profiling.Timer.Step("Writing mail item to database")
 
@@ -96,7 +120,7 @@ func (ms *MailStorage) StartWriteListener(dbWriteChannel chan MailItemStruct) {
 		/*
 		 * Insert the mail item
 		 */
-		statement, err := transaction.Prepare("INSERT INTO mailitem (dateSent, fromAddress, toAddressList, subject, xmailer, body, contentType, boundary) VALUES (?, ?, ?, ?, ?, ?, ?, ?)")
+		statement, err := transaction.Prepare("INSERT INTO mailitem (dateSent, fromAddress, toAddressList, subject, xmailer, body, contentType, boundary, dateReceived, rawSource, bodyType, smtpUtf8, clientIP, clientPort, heloName, authUser, tls, tlsVersion, tlsCipherSuite) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
 		if err != nil {
 			panic(fmt.Sprintf("Error preparing insert statement: %s", err))
 		}
@@ -110,6 +134,17 @@ func (ms *MailStorage) StartWriteListener(dbWriteChannel chan MailItemStruct) {
 			mailItem.Body,
 			mailItem.ContentType,
 			mailItem.Boundary,
+			mailItem.DateReceived,
+			mailItem.RawSource,
+			mailItem.BodyType,
+			mailItem.SMTPUTF8,
+			mailItem.ClientIP,
+			mailItem.ClientPort,
+			mailItem.HeloName,
+			mailItem.AuthUser,
+			mailItem.TLS,
+			mailItem.TLSVersion,
+			mailItem.TLSCipherSuite,
 		)
 
 		if err != nil {
@@ -143,20 +178,57 @@ func (ms *MailStorage) StartWriteListener(dbWriteChannel chan MailItemStruct) {
 			statement.Close()
 		}
 
+		/*
+		 * Record what the relay rules did with it
+		 */
+		for _, mailRelay := range mailItem.Relays {
+			_, err = transaction.Exec(
+				"INSERT INTO mailrelay (mailItemId, relayName, ruleName, recipients, success, errorMessage, dateRelayed) VALUES (?, ?, ?, ?, ?, ?, ?)",
+				mailItemId,
+				mailRelay.RelayName,
+				mailRelay.RuleName,
+				strings.Join(mailRelay.Recipients, "; "),
+				mailRelay.Success,
+				mailRelay.Error,
+				mailRelay.DateRelayed,
+			)
+
+			if err != nil {
+				panic(fmt.Sprintf("Error executing insert mail relay statement: %s", err))
+			}
+		}
+
+		/*
+		 * Record the SMTP session it was received in
+		 */
+		if mailItem.Session != nil {
+			mailItem.Session.MailItemId = mailItem.Id
+
+			_, err = insertSmtpSession(transaction, *mailItem.Session)
+			if err != nil {
+				panic(fmt.Sprintf("Error executing insert SMTP session statement: %s", err))
+			}
+		}
+
 		transaction.Commit()
 		log.Printf("New mail item written to database.\n\n")
 
-		BroadcastMessageToWebsockets(mailItem)
+		ms.publishEvent(EVENT_MAIL_RECEIVED, mailItem.Id, mailItemSummary(mailItem), mailItem.ToAddresses, mailItem.FromAddress)
+		ms.notifyMailReceived(mailItem)
 	}
 }
 
 /*
-Retrieves all stored mail items as an array of MailItemStruct items.
+Retrieves stored mail items as an array of JSONMailItem items. The
+search criteria can be used to narrow down which mail items are
+returned. Pass an empty MailSearch to get everything.
 */
-func (ms *MailStorage) GetMails() []model.JSONMailItem {
+func (ms *MailStorage) GetMails(search MailSearch) []model.JSONMailItem {
 	profiling.Timer.Step("Getting mail collection")
 
 	result := make([]model.JSONMailItem, 0)
+	whereClause, parameters := search.whereClause()
+	tags := ms.getTags()
 
 	rows, err := ms.Db.Query(`
 		SELECT
@@ -166,12 +238,16 @@ func (ms *MailStorage) GetMails() []model.JSONMailItem {
 			, mailitem.toAddressList
 			, mailitem.subject
 			, mailitem.xmailer
+			, mailitem.isRead
+			, mailitem.isStarred
+			, mailitem.dateReceived
 			, attachment.id AS attachmentId
 			, attachment.fileName
 		FROM mailitem
 			LEFT OUTER JOIN attachment ON mailitem.id=attachment.mailItemId
+		`+whereClause+`
 		ORDER BY mailitem.dateSent DESC
-	`)
+	`, parameters...)
 
 	if err != nil {
 		log.Panic("Error running query to get mail items: ", err)
@@ -188,10 +264,13 @@ func (ms *MailStorage) GetMails() []model.JSONMailItem {
 		var toAddressList string
 		var subject string
 		var xmailer string
+		var isRead bool
+		var isStarred bool
+		var dateReceived string
 		var attachmentId int
 		var fileName string
 
-		rows.Scan(&mailItemId, &dateSent, &fromAddress, &toAddressList, &subject, &xmailer, &attachmentId, &fileName)
+		rows.Scan(&mailItemId, &dateSent, &fromAddress, &toAddressList, &subject, &xmailer, &isRead, &isStarred, &dateReceived, &attachmentId, &fileName)
 
 		/*
 		 * If this is our first iteration then we haven't looked at a
@@ -222,6 +301,10 @@ func (ms *MailStorage) GetMails() []model.JSONMailItem {
 				ContentType:     "",
 				AttachmentCount: 0,
 				Attachments:     nil,
+				IsRead:          isRead,
+				IsStarred:       isStarred,
+				DateReceived:    dateReceived,
+				Tags:            tagsForMailItem(tags, mailItemId),
 			}
 		} else {
 			newItem.Attachments = attachments
@@ -247,6 +330,10 @@ func (ms *MailStorage) GetMails() []model.JSONMailItem {
 				ContentType:     "",
 				AttachmentCount: 0,
 				Attachments:     nil,
+				IsRead:          isRead,
+				IsStarred:       isStarred,
+				DateReceived:    dateReceived,
+				Tags:            tagsForMailItem(tags, mailItemId),
 			}
 
 			if currentMailItemId != mailItemId {
@@ -256,11 +343,89 @@ func (ms *MailStorage) GetMails() []model.JSONMailItem {
 		}
 	}
 
-	newItem.Attachments = attachments
-	newItem.AttachmentCount = len(attachments)
-	result = append(result, newItem)
+	/*
+	 * Only add the last item if we actually read one. Otherwise
+	 * an empty result set would return a single blank mail item.
+	 */
+	if newItem.Id > 0 {
+		newItem.Attachments = attachments
+		newItem.AttachmentCount = len(attachments)
+		result = append(result, newItem)
+	}
 
 	rows.Close()
+	return search.filterByMailbox(result)
+}
+
+/*
+Retrieves the list of virtual mailboxes, with total and unread counts,
+found by grouping the recipients of all stored mail items by kind
+(one of the MAILBOX_BY_ constants). Mailboxes are sorted by name.
+*/
+func (ms *MailStorage) GetMailboxes(kind string) []model.JSONMailbox {
+	profiling.Timer.Step("Getting mailboxes")
+
+	rows, err := ms.Db.Query("SELECT toAddressList, isRead FROM mailitem")
+	if err != nil {
+		log.Panic("Error running query to get mailboxes: ", err)
+	}
+
+	defer rows.Close()
+
+	mailboxes := make(map[string]*model.JSONMailbox)
+	names := make([]string, 0)
+
+	for rows.Next() {
+		var toAddressList string
+		var isRead bool
+
+		rows.Scan(&toAddressList, &isRead)
+
+		for _, name := range mailboxNames(strings.Split(toAddressList, "; "), kind) {
+			mailbox, ok := mailboxes[name]
+			if !ok {
+				mailbox = &model.JSONMailbox{Name: name}
+				mailboxes[name] = mailbox
+				names = append(names, name)
+			}
+
+			mailbox.TotalCount++
+			if !isRead {
+				mailbox.UnreadCount++
+			}
+		}
+	}
+
+	sort.Strings(names)
+	result := make([]model.JSONMailbox, 0, len(names))
+
+	for _, name := range names {
+		result = append(result, *mailboxes[name])
+	}
+
+	return result
+}
+
+/*
+Returns the number of stored mail items and how many are unread,
+for serverStatus websocket events.
+*/
+func (ms *MailStorage) GetServerStatus() ServerStatus {
+	profiling.Timer.Step("Counting mail items")
+
+	result := ServerStatus{}
+
+	rows, err := ms.Db.Query("SELECT COUNT(*), COALESCE(SUM(CASE WHEN isRead=0 THEN 1 ELSE 0 END), 0) FROM mailitem")
+	if err != nil {
+		log.Panic("Error running query to count mail items: ", err)
+	}
+
+	defer rows.Close()
+
+	if rows.Next() {
+		rows.Scan(&result.MailItemCount, &result.UnreadCount)
+	}
+
 	return result
 }
 
@@ -316,6 +481,18 @@ func (ms *MailStorage) GetMail(id int) model.JSONMailItem {
 			, mailitem.xmailer
 			, mailitem.body
 			, mailitem.contentType
+			, mailitem.bodyType
+			, mailitem.smtpUtf8
+			, mailitem.clientIP
+			, mailitem.clientPort
+			, mailitem.heloName
+			, mailitem.authUser
+			, mailitem.tls
+			, mailitem.tlsVersion
+			, mailitem.tlsCipherSuite
+			, mailitem.isRead
+			, mailitem.isStarred
+			, mailitem.dateReceived
 			, attachment.id AS attachmentId
 			, attachment.fileName
 		FROM mailitem
@@ -327,8 +504,6 @@ func (ms *MailStorage) GetMail(id int) model.JSONMailItem {
 		log.Panic("Error running query to get mail item: ", err)
 	}
 
-	defer rows.Close()
-
 	result := model.JSONMailItem{}
 	attachments := make([]model.JSONAttachment, 0)
 
@@ -341,10 +516,22 @@ func (ms *MailStorage) GetMail(id int) model.JSONMailItem {
 		var xmailer string
 		var body string
 		var contentType string
+		var bodyType string
+		var smtpUtf8 bool
+		var clientIP string
+		var clientPort int
+		var heloName string
+		var authUser string
+		var tls bool
+		var tlsVersion string
+		var tlsCipherSuite string
+		var isRead bool
+		var isStarred bool
+		var dateReceived string
 		var attachmentId int
 		var fileName string
 
-		rows.Scan(&mailItemId, &dateSent, &fromAddress, &toAddressList, &subject, &xmailer, &body, &contentType, &attachmentId, &fileName)
+		rows.Scan(&mailItemId, &dateSent, &fromAddress, &toAddressList, &subject, &xmailer, &body, &contentType, &bodyType, &smtpUtf8, &clientIP, &clientPort, &heloName, &authUser, &tls, &tlsVersion, &tlsCipherSuite, &isRead, &isStarred, &dateReceived, &attachmentId, &fileName)
 
 		if attachmentId > 0 {
 			attachments = append(attachments, model.JSONAttachment{Id: attachmentId, FileName: fileName})
@@ -359,10 +546,305 @@ func (ms *MailStorage) GetMail(id int) model.JSONMailItem {
 			XMailer:         xmailer,
 			Body:            body,
 			ContentType:     contentType,
+			BodyType:        bodyType,
+			SMTPUTF8:        smtpUtf8,
+			ClientIP:        clientIP,
+			ClientPort:      clientPort,
+			HeloName:        heloName,
+			AuthUser:        authUser,
+			TLS:             tls,
+			TLSVersion:      tlsVersion,
+			TLSCipherSuite:  tlsCipherSuite,
 			AttachmentCount: len(attachments),
 			Attachments:     attachments,
+			IsRead:          isRead,
+			IsStarred:       isStarred,
+			DateReceived:    dateReceived,
+		}
+	}
+
+	rows.Close()
+
+	result.Tags = make([]string, 0)
+	if result.Id > 0 {
+		result.Tags = ms.getMailTags(result.Id)
+		result.Relays = ms.GetMailRelays(result.Id)
+	}
+
+	return result
+}
+
+/*
+Retrieves the raw source of a mail item, exactly as it was sent in the
+DATA command, after the Received header added by the server. The second
+return value is false if the mail item does not exist.
+*/
+func (ms *MailStorage) GetMailRawSource(id int) (string, bool) {
+	profiling.Timer.Step("Get mail item raw source")
+
+	rows, err := ms.Db.Query("SELECT rawSource FROM mailitem WHERE id=?", id)
+	if err != nil {
+		log.Panic("Error running query to get mail item raw source: ", err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var rawSource string
+
+		rows.Scan(&rawSource)
+		return rawSource, true
+	}
+
+	return "", false
+}
+
+/*
+Deletes a mail item along with its attachments, tags, relay log,
+webhook deliveries and SMTP session. Returns false if there is no
+such mail item.
+*/
+func (ms *MailStorage) DeleteMail(id int) (bool, error) {
+	profiling.Timer.Step("Deleting mail item")
+
+	mailItem := ms.GetMail(id)
+
+	transaction, err := ms.Db.Begin()
+	if err != nil {
+		return false, err
+	}
+
+	for _, query := range []string{
+		"DELETE FROM attachment WHERE mailItemId=?",
+		"DELETE FROM mailitemtag WHERE mailItemId=?",
+		"DELETE FROM mailrelay WHERE mailItemId=?",
+		"DELETE FROM webhookdelivery WHERE mailItemId=?",
+		"DELETE FROM smtpsession WHERE mailItemId=?",
+	} {
+		_, err = transaction.Exec(query, id)
+		if err != nil {
+			transaction.Rollback()
+			return false, err
+		}
+	}
+
+	result, err := transaction.Exec("DELETE FROM mailitem WHERE id=?", id)
+	if err != nil {
+		transaction.Rollback()
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil || rowsAffected <= 0 {
+		transaction.Rollback()
+		return false, err
+	}
+
+	err = transaction.Commit()
+	if err != nil {
+		return false, err
+	}
+
+	ms.publishEvent(EVENT_MAIL_DELETED, id, map[string]int{"id": id}, mailItem.ToAddresses, mailItem.FromAddress)
+	return true, nil
+}
+
+/*
+Deletes every mail item along with all attachments, tags, relay logs,
+webhook deliveries and the SMTP sessions they were received in.
+Sessions that did not produce a mail item are kept.
+*/
+func (ms *MailStorage) PurgeMails() error {
+	profiling.Timer.Step("Purging mail items")
+
+	transaction, err := ms.Db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, query := range []string{
+		"DELETE FROM attachment",
+		"DELETE FROM mailitemtag",
+		"DELETE FROM mailrelay",
+		"DELETE FROM webhookdelivery",
+		"DELETE FROM smtpsession WHERE mailItemId > 0",
+		"DELETE FROM mailitem",
+	} {
+		_, err = transaction.Exec(query)
+		if err != nil {
+			transaction.Rollback()
+			return err
 		}
 	}
 
+	err = transaction.Commit()
+	if err != nil {
+		return err
+	}
+
+	ms.publishEvent(EVENT_MAILS_PURGED, 0, map[string]interface{}{}, nil, "")
+	return nil
+}
+
+/*
+Marks a mail item as read or unread. Connected websockets are
+notified of the change. Returns false if there is no such mail item.
+*/
+func (ms *MailStorage) SetMailRead(id int, isRead bool) (bool, error) {
+	profiling.Timer.Step("Setting mail item read flag")
+
+	return ms.updateMailItem(id, "UPDATE mailitem SET isRead=? WHERE id=?", isRead, id)
+}
+
+/*
+Stars or un-stars a mail item. Connected websockets are notified
+of the change. Returns false if there is no such mail item.
+*/
+func (ms *MailStorage) SetMailStarred(id int, isStarred bool) (bool, error) {
+	profiling.Timer.Step("Setting mail item starred flag")
+
+	return ms.updateMailItem(id, "UPDATE mailitem SET isStarred=? WHERE id=?", isStarred, id)
+}
+
+/*
+Runs an update against a single mail item and notifies connected
+websockets. Returns false if no mail item was updated.
+*/
+func (ms *MailStorage) updateMailItem(id int, query string, args ...interface{}) (bool, error) {
+	result, err := ms.Db.Exec(query, args...)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	if rowsAffected <= 0 {
+		return false, nil
+	}
+
+	ms.broadcastMailItemUpdate(id)
+	return true, nil
+}
+
+/*
+Replaces the set of tags attached to a mail item. Tags are free-form
+strings. Blank and duplicate tags are ignored. Connected websockets
+are notified of the change. Returns false if there is no such mail
+item.
+*/
+func (ms *MailStorage) SetMailTags(id int, tags []string) (bool, error) {
+	profiling.Timer.Step("Setting mail item tags")
+
+	transaction, err := ms.Db.Begin()
+	if err != nil {
+		return false, err
+	}
+
+	var count int
+
+	err = transaction.QueryRow("SELECT COUNT(*) FROM mailitem WHERE id=?", id).Scan(&count)
+	if err != nil || count <= 0 {
+		transaction.Rollback()
+		return false, err
+	}
+
+	_, err = transaction.Exec("DELETE FROM mailitemtag WHERE mailItemId=?", id)
+	if err != nil {
+		transaction.Rollback()
+		return false, err
+	}
+
+	for _, tag := range normalizeTags(tags) {
+		_, err = transaction.Exec("INSERT INTO mailitemtag (mailItemId, tag) VALUES (?, ?)", id, tag)
+		if err != nil {
+			transaction.Rollback()
+			return false, err
+		}
+	}
+
+	err = transaction.Commit()
+	if err != nil {
+		return false, err
+	}
+
+	ms.broadcastMailItemUpdate(id)
+	return true, nil
+}
+
+/*
+Retrieves the tags attached to a single mail item.
+*/
+func (ms *MailStorage) getMailTags(id int) []string {
+	rows, err := ms.Db.Query("SELECT tag FROM mailitemtag WHERE mailItemId=? ORDER BY id", id)
+	if err != nil {
+		log.Panic("Error running query to get mail item tags: ", err)
+	}
+
+	defer rows.Close()
+
+	result := make([]string, 0)
+
+	for rows.Next() {
+		var tag string
+
+		rows.Scan(&tag)
+		result = append(result, tag)
+	}
+
+	return result
+}
+
+/*
+Retrieves all tags for all mail items, keyed by mail item ID.
+*/
+func (ms *MailStorage) getTags() map[int][]string {
+	rows, err := ms.Db.Query("SELECT mailItemId, tag FROM mailitemtag ORDER BY id")
+	if err != nil {
+		log.Panic("Error running query to get mail item tags: ", err)
+	}
+
+	defer rows.Close()
+
+	result := make(map[int][]string)
+
+	for rows.Next() {
+		var mailItemId int
+		var tag string
+
+		rows.Scan(&mailItemId, &tag)
+		result[mailItemId] = append(result[mailItemId], tag)
+	}
+
 	return result
 }
+
+/*
+Publishes the current read, starred and tag state of a mail item
+to websockets and the event log.
+*/
+func (ms *MailStorage) broadcastMailItemUpdate(id int) {
+	mailItem := ms.GetMail(id)
+	if mailItem.Id <= 0 {
+		return
+	}
+
+	update := MailItemUpdate{
+		Id:        mailItem.Id,
+		IsRead:    mailItem.IsRead,
+		IsStarred: mailItem.IsStarred,
+		Tags:      mailItem.Tags,
+	}
+
+	ms.publishEvent(EVENT_MAIL_UPDATED, id, update, mailItem.ToAddresses, mailItem.FromAddress)
+}
+
+func tagsForMailItem(tags map[int][]string, mailItemId int) []string {
+	if result, ok := tags[mailItemId]; ok {
+		return result
+	}
+
+	return make([]string, 0)
+}
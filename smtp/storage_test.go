@@ -0,0 +1,288 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package smtp
+
+import (
+	"database/sql"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/adampresley/mailslurper/admin/model"
+)
+
+func newTestStorage(t *testing.T) *MailStorage {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Unable to open in-memory database: %s", err)
+	}
+
+	/*
+	 * Every connection to ":memory:" gets its own database
+	 */
+	db.SetMaxOpenConns(1)
+
+	if err = CreateSqlliteDatabase(db); err != nil {
+		t.Fatalf("Unable to create tables: %s", err)
+	}
+
+	return &MailStorage{Engine: ENGINE_SQLITE, Db: db}
+}
+
+/*
+Writes mail items through the storage write listener and waits
+until they can be read back.
+*/
+func writeTestMail(t *testing.T, storage *MailStorage, mailItems ...MailItemStruct) {
+	before := len(storage.GetMails(MailSearch{}))
+
+	dbWriteChannel := make(chan MailItemStruct, len(mailItems))
+	for _, mailItem := range mailItems {
+		dbWriteChannel <- mailItem
+	}
+
+	go storage.StartWriteListener(dbWriteChannel)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(storage.GetMails(MailSearch{})) < before+len(mailItems) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %d mail items to be written", len(mailItems))
+		}
+
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func testMailItem(to string, subject string) MailItemStruct {
+	return MailItemStruct{
+		DateSent:    "2014-01-02 03:04:05",
+		FromAddress: "<sender@example.com>",
+		ToAddresses: []string{to},
+		Subject:     subject,
+		Body:        "Hello",
+	}
+}
+
+func TestGetMailboxes(t *testing.T) {
+	storage := newTestStorage(t)
+	defer storage.Disconnect()
+
+	writeTestMail(t, storage,
+		MailItemStruct{ToAddresses: []string{"<bob+a@example.com>", "<alice@other.com>"}, Subject: "One"},
+		MailItemStruct{ToAddresses: []string{"<bob+b@example.com>"}, Subject: "Two"},
+	)
+
+	for _, mailItem := range storage.GetMails(MailSearch{}) {
+		if mailItem.Subject == "One" {
+			storage.SetMailRead(mailItem.Id, true)
+		}
+	}
+
+	expected := []model.JSONMailbox{
+		{Name: "example.com", TotalCount: 2, UnreadCount: 1},
+		{Name: "other.com", TotalCount: 1, UnreadCount: 0},
+	}
+
+	if mailboxes := storage.GetMailboxes(MAILBOX_BY_DOMAIN); !reflect.DeepEqual(mailboxes, expected) {
+		t.Errorf("Expected mailboxes %+v, got %+v", expected, mailboxes)
+	}
+
+	if mailItems := storage.GetMails(MailSearch{Mailbox: "a", MailboxKind: MAILBOX_BY_TAG}); len(mailItems) != 1 || mailItems[0].Subject != "One" {
+		t.Errorf("Expected only mail item One in the tag mailbox a, got %+v", mailItems)
+	}
+}
+
+func TestSetMailReadAndStarred(t *testing.T) {
+	storage := newTestStorage(t)
+	defer storage.Disconnect()
+
+	writeTestMail(t, storage, testMailItem("<user@example.com>", "First"))
+	id := storage.GetMails(MailSearch{})[0].Id
+
+	if mailItem := storage.GetMail(id); mailItem.IsRead || mailItem.IsStarred {
+		t.Fatalf("Expected a new mail item to be unread and not starred, got %+v", mailItem)
+	}
+
+	if _, err := storage.SetMailRead(id, true); err != nil {
+		t.Fatalf("SetMailRead failed: %s", err)
+	}
+
+	if _, err := storage.SetMailStarred(id, true); err != nil {
+		t.Fatalf("SetMailStarred failed: %s", err)
+	}
+
+	if mailItem := storage.GetMail(id); !mailItem.IsRead || !mailItem.IsStarred {
+		t.Errorf("Expected the mail item to be read and starred, got %+v", mailItem)
+	}
+
+	if _, err := storage.SetMailRead(id, false); err != nil {
+		t.Fatalf("SetMailRead failed: %s", err)
+	}
+
+	if mailItem := storage.GetMail(id); mailItem.IsRead || !mailItem.IsStarred {
+		t.Errorf("Expected the mail item to be unread and still starred, got %+v", mailItem)
+	}
+}
+
+func TestSetMailStateOnMissingMailItem(t *testing.T) {
+	storage := newTestStorage(t)
+	defer storage.Disconnect()
+
+	if found, err := storage.SetMailRead(42, true); found || err != nil {
+		t.Errorf("SetMailRead on a missing mail item = %v, %v, expected false, nil", found, err)
+	}
+
+	if found, err := storage.SetMailStarred(42, true); found || err != nil {
+		t.Errorf("SetMailStarred on a missing mail item = %v, %v, expected false, nil", found, err)
+	}
+
+	if found, err := storage.SetMailTags(42, []string{"invoice"}); found || err != nil {
+		t.Errorf("SetMailTags on a missing mail item = %v, %v, expected false, nil", found, err)
+	}
+
+	if tags := storage.getMailTags(42); len(tags) != 0 {
+		t.Errorf("Expected no tags to be stored for a missing mail item, got %v", tags)
+	}
+}
+
+func TestSetMailTags(t *testing.T) {
+	storage := newTestStorage(t)
+	defer storage.Disconnect()
+
+	writeTestMail(t, storage, testMailItem("<user@example.com>", "Tagged"))
+	id := storage.GetMails(MailSearch{})[0].Id
+
+	if _, err := storage.SetMailTags(id, []string{" invoice ", "", "urgent", "invoice"}); err != nil {
+		t.Fatalf("SetMailTags failed: %s", err)
+	}
+
+	if tags := storage.GetMail(id).Tags; !reflect.DeepEqual(tags, []string{"invoice", "urgent"}) {
+		t.Errorf("Expected tags [invoice urgent], got %v", tags)
+	}
+
+	if _, err := storage.SetMailTags(id, []string{}); err != nil {
+		t.Fatalf("SetMailTags failed: %s", err)
+	}
+
+	if tags := storage.GetMail(id).Tags; len(tags) != 0 {
+		t.Errorf("Expected an empty tag list to remove all tags, got %v", tags)
+	}
+}
+
+func TestGetMailRawSourceAndDeleteMail(t *testing.T) {
+	storage := newTestStorage(t)
+	defer storage.Disconnect()
+
+	mailItem := testMailItem("<user@example.com>", "Raw")
+	mailItem.RawSource = "Subject: Raw\r\n\r\nHello"
+
+	writeTestMail(t, storage, mailItem)
+	id := storage.GetMails(MailSearch{})[0].Id
+	storage.SetMailTags(id, []string{"invoice"})
+
+	if rawSource, ok := storage.GetMailRawSource(id); !ok || rawSource != mailItem.RawSource {
+		t.Errorf("Expected the raw source %q, got %q", mailItem.RawSource, rawSource)
+	}
+
+	if _, err := storage.DeleteMail(id); err != nil {
+		t.Fatalf("DeleteMail failed: %s", err)
+	}
+
+	if _, ok := storage.GetMailRawSource(id); ok {
+		t.Error("Expected no raw source for a deleted mail item")
+	}
+
+	if tags := storage.getMailTags(id); len(tags) != 0 {
+		t.Errorf("Expected the tags to be deleted with the mail item, got %v", tags)
+	}
+}
+
+func TestDeleteMailDeletesWebhookDeliveries(t *testing.T) {
+	storage := newTestStorage(t)
+	defer storage.Disconnect()
+
+	writeTestMail(t, storage, testMailItem("<user@example.com>", "First"), testMailItem("<user@example.com>", "Second"))
+
+	mails := storage.GetMails(MailSearch{})
+	for _, mail := range mails {
+		delivery := model.JSONWebhookDelivery{MailItemId: mail.Id, WebhookName: "ci", URL: "http://127.0.0.1/hook", Attempt: 1, StatusCode: 200, Success: true}
+		if err := storage.AddWebhookDelivery(delivery); err != nil {
+			t.Fatalf("AddWebhookDelivery failed: %s", err)
+		}
+	}
+
+	if _, err := storage.DeleteMail(mails[0].Id); err != nil {
+		t.Fatalf("DeleteMail failed: %s", err)
+	}
+
+	if deliveries := storage.GetWebhookDeliveries(mails[0].Id, ""); len(deliveries) != 0 {
+		t.Errorf("Expected the webhook deliveries to be deleted with the mail item, got %v", deliveries)
+	}
+
+	if deliveries := storage.GetWebhookDeliveries(mails[1].Id, ""); len(deliveries) != 1 {
+		t.Errorf("Expected the other mail item to keep its webhook delivery, got %v", deliveries)
+	}
+
+	if err := storage.PurgeMails(); err != nil {
+		t.Fatalf("PurgeMails failed: %s", err)
+	}
+
+	if deliveries := storage.GetWebhookDeliveries(0, ""); len(deliveries) != 0 {
+		t.Errorf("Expected PurgeMails to delete every webhook delivery, got %v", deliveries)
+	}
+}
+
+func TestGetMailsFiltersByState(t *testing.T) {
+	storage := newTestStorage(t)
+	defer storage.Disconnect()
+
+	writeTestMail(t, storage,
+		testMailItem("<one@example.com>", "One"),
+		testMailItem("<two@example.com>", "Two"),
+		testMailItem("<three@example.com>", "Three"),
+	)
+
+	ids := make(map[string]int)
+	for _, mailItem := range storage.GetMails(MailSearch{}) {
+		ids[mailItem.Subject] = mailItem.Id
+	}
+
+	storage.SetMailRead(ids["One"], true)
+	storage.SetMailStarred(ids["Two"], true)
+	storage.SetMailTags(ids["Two"], []string{"invoice"})
+	storage.SetMailTags(ids["Three"], []string{"receipt"})
+
+	yes, no := true, false
+
+	tests := []struct {
+		name     string
+		search   MailSearch
+		expected []string
+	}{
+		{"everything", MailSearch{}, []string{"One", "Three", "Two"}},
+		{"read", MailSearch{IsRead: &yes}, []string{"One"}},
+		{"unread", MailSearch{IsRead: &no}, []string{"Three", "Two"}},
+		{"starred", MailSearch{IsStarred: &yes}, []string{"Two"}},
+		{"tag", MailSearch{Tag: "invoice"}, []string{"Two"}},
+		{"unread with tag", MailSearch{IsRead: &no, Tag: "receipt"}, []string{"Three"}},
+		{"no match", MailSearch{IsRead: &yes, IsStarred: &yes}, []string{}},
+		{"text in subject", MailSearch{Text: "hre"}, []string{"Three"}},
+		{"text in recipient", MailSearch{Text: "two@example"}, []string{"Two"}},
+	}
+
+	for _, test := range tests {
+		subjects := make([]string, 0)
+		for _, mailItem := range storage.GetMails(test.search) {
+			subjects = append(subjects, mailItem.Subject)
+		}
+
+		sort.Strings(subjects)
+
+		if !reflect.DeepEqual(subjects, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, subjects)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package smtp
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/adampresley/mailslurper/admin/model"
+)
+
+// Who a transcript line came from. Notes are added by the server
+// for things that are not part of the conversation, such as a
+// connection being dropped.
+const (
+	TRANSCRIPT_CLIENT = "client"
+	TRANSCRIPT_SERVER = "server"
+	TRANSCRIPT_NOTE   = "note"
+)
+
+// How an SMTP session ended. "accepted" sessions have a mail item,
+// "noMessage" sessions quit without one being accepted, and "error"
+// sessions were cut off by an error, timeout or dropped connection.
+const (
+	SESSION_OUTCOME_ACCEPTED   = "accepted"
+	SESSION_OUTCOME_NO_MESSAGE = "noMessage"
+	SESSION_OUTCOME_ERROR      = "error"
+)
+
+// Number of sessions without a mail item kept. Sessions that
+// produced a mail item are kept as long as the mail item.
+const SESSION_LOG_MAX_LEN = 1000
+
+/*
+Transcript records every command and response in an SMTP session.
+Message content is not recorded, only its size, and neither are AUTH
+credentials. A transcript belongs to one session and is not safe to
+share between goroutines.
+*/
+type Transcript struct {
+	ClientAddress string
+	HeloName      string
+	DateStarted   string
+
+	lines []model.JSONTranscriptLine
+}
+
+/*
+Starts a transcript for a client connection.
+*/
+func NewTranscript(connection net.Conn) *Transcript {
+	return &Transcript{
+		ClientAddress: connection.RemoteAddr().String(),
+		DateStarted:   time.Now().UTC().Format(DATE_RECEIVED_FORMAT),
+		lines:         make([]model.JSONTranscriptLine, 0, 20),
+	}
+}
+
+/*
+Adds a line to the transcript. Direction is one of the
+TRANSCRIPT_* constants.
+*/
+func (transcript *Transcript) Add(direction string, line string) {
+	transcript.lines = append(transcript.lines, model.JSONTranscriptLine{
+		Direction: direction,
+		Line:      line,
+		Date:      time.Now().UTC().Format(DATE_RECEIVED_FORMAT),
+	})
+}
+
+/*
+Returns a command line as it should appear in a transcript. The initial
+response given with AUTH holds credentials, so it is left out.
+*/
+func hideCredentials(command int, line string) string {
+	fields := strings.Fields(line)
+	if command != AUTH || len(fields) < 3 {
+		return line
+	}
+
+	return fields[0] + " " + fields[1] + " [credentials]"
+}
+
+/*
+Ends the transcript and returns it as a session ready to be stored.
+The TLS state is read from the connection as it is when the session
+ends.
+*/
+func (transcript *Transcript) Session(connection net.Conn, outcome string) model.JSONSmtpSession {
+	result := model.JSONSmtpSession{
+		ClientAddress: transcript.ClientAddress,
+		HeloName:      transcript.HeloName,
+		Outcome:       outcome,
+		DateStarted:   transcript.DateStarted,
+		DateEnded:     time.Now().UTC().Format(DATE_RECEIVED_FORMAT),
+		Transcript:    transcript.lines,
+	}
+
+	result.TLS, result.TLSVersion, result.TLSCipherSuite = connectionTLSState(connection)
+	return result
+}
+
+/*
+Returns whether a connection is using TLS, and if so its protocol
+version and cipher suite.
+*/
+func connectionTLSState(connection net.Conn) (bool, string, string) {
+	tlsConnection, ok := connection.(*tls.Conn)
+	if !ok {
+		return false, "", ""
+	}
+
+	state := tlsConnection.ConnectionState()
+	if !state.HandshakeComplete {
+		return false, "", ""
+	}
+
+	return true, tlsVersionName(state.Version), tls.CipherSuiteName(state.CipherSuite)
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+
+	default:
+		return ""
+	}
+}
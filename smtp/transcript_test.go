@@ -0,0 +1,143 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package smtp
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParserRunRecordsTranscript(t *testing.T) {
+	server, client := net.Pipe()
+	client.Close()
+
+	transcript := NewTranscript(server)
+	parser := &Parser{Transcript: transcript}
+	session := startTestSession(t, parser)
+
+	session.run([]sessionStep{
+		{"", "220"},
+		{"HELO client.example.com", "250"},
+		{"MAIL FROM:<sender@example.com>", "250"},
+		{"RCPT TO:<bob@example.com>", "250"},
+		{"DATA", "354"},
+		{"Subject: Secret\r\n\r\nDo not record me\r\n.", "250"},
+		{"QUIT", "221"},
+	})
+
+	session.close()
+
+	result := transcript.Session(parser.Connection, SESSION_OUTCOME_ACCEPTED)
+
+	if result.HeloName != "client.example.com" || result.Outcome != SESSION_OUTCOME_ACCEPTED || result.TLS {
+		t.Errorf("Expected an accepted session without TLS from client.example.com, got %+v", result)
+	}
+
+	if len(result.DateStarted) == 0 || len(result.DateEnded) == 0 {
+		t.Errorf("Expected the session dates to be recorded, got %q and %q", result.DateStarted, result.DateEnded)
+	}
+
+	lines := make([]string, 0, len(result.Transcript))
+	for _, line := range result.Transcript {
+		lines = append(lines, fmt.Sprintf("%s %s", line.Direction, strings.SplitN(line.Line, " ", 2)[0]))
+
+		if strings.Contains(line.Line, "Do not record me") {
+			t.Errorf("Expected message content not to be recorded, got %q", line.Line)
+		}
+	}
+
+	expected := []string{
+		"server 220", "client HELO", "server 250", "client MAIL", "server 250", "client RCPT", "server 250",
+		"client DATA", "server 354", "client [35", "client .", "server 250", "client QUIT", "server 221",
+	}
+
+	if strings.Join(lines, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected transcript %v, got %v", expected, lines)
+	}
+}
+
+func TestParserRunRecordsRefusedMessage(t *testing.T) {
+	server, client := net.Pipe()
+	client.Close()
+
+	transcript := NewTranscript(server)
+	parser := &Parser{MaxMessageSize: 10, Transcript: transcript}
+	session := startTestSession(t, parser)
+
+	session.run([]sessionStep{
+		{"", "220"},
+		{"EHLO localhost", "250"},
+		{"MAIL FROM:<sender@example.com>", "250"},
+		{"RCPT TO:<bob@example.com>", "250"},
+		{"DATA", "354"},
+		{"Subject: Too large\r\n\r\nHello\r\n.", "552"},
+		{"QUIT", "221"},
+	})
+
+	session.close()
+
+	result := transcript.Session(parser.Connection, SESSION_OUTCOME_NO_MESSAGE)
+	notes := 0
+
+	for _, line := range result.Transcript {
+		if line.Direction == TRANSCRIPT_NOTE {
+			notes++
+		}
+	}
+
+	if notes != 1 {
+		t.Errorf("Expected a note that the content was discarded, got %+v", result.Transcript)
+	}
+
+	/*
+	 * Every line of a multi-line reply is recorded on its own
+	 */
+	ehloLines := 0
+	for _, line := range result.Transcript {
+		if line.Direction == TRANSCRIPT_SERVER && strings.HasPrefix(line.Line, "250") && strings.Contains(line.Line, "SIZE") {
+			ehloLines++
+		}
+	}
+
+	if ehloLines != 1 {
+		t.Errorf("Expected the SIZE line of the EHLO reply to be recorded on its own, got %+v", result.Transcript)
+	}
+}
+
+func TestTLSVersionName(t *testing.T) {
+	tests := map[uint16]string{
+		tls.VersionTLS10: "TLS 1.0",
+		tls.VersionTLS12: "TLS 1.2",
+		tls.VersionTLS13: "TLS 1.3",
+		0:                "",
+	}
+
+	for version, expected := range tests {
+		if result := tlsVersionName(version); result != expected {
+			t.Errorf("tlsVersionName(%x) = %q, expected %q", version, result, expected)
+		}
+	}
+}
+
+func TestHideCredentials(t *testing.T) {
+	tests := []struct {
+		command  int
+		line     string
+		expected string
+	}{
+		{AUTH, "AUTH PLAIN AHVzZXIAc2VjcmV0", "AUTH PLAIN [credentials]"},
+		{AUTH, "AUTH LOGIN", "AUTH LOGIN"},
+		{MAIL, "MAIL FROM:<bob@example.com> SIZE=10", "MAIL FROM:<bob@example.com> SIZE=10"},
+	}
+
+	for _, test := range tests {
+		if result := hideCredentials(test.command, test.line); result != test.expected {
+			t.Errorf("hideCredentials(%q) = %q, expected %q", test.line, result, test.expected)
+		}
+	}
+}
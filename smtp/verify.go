@@ -0,0 +1,119 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package smtp
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Ways the server can answer VRFY and EXPN. "always" gives 252, the
+// reply of a server that will not say whether an address exists.
+// "known" checks addresses against a list of known recipients, and
+// "disabled" refuses the commands with 502.
+const (
+	VRFY_MODE_ALWAYS   = "always"
+	VRFY_MODE_KNOWN    = "known"
+	VRFY_MODE_DISABLED = "disabled"
+)
+
+/*
+AddressVerifier answers the VRFY and EXPN commands. KnownRecipients
+are address wildcard patterns, such as "*@ourcompany.com", and are only
+used in "known" mode. Create one with NewAddressVerifier.
+*/
+type AddressVerifier struct {
+	Mode            string
+	KnownRecipients []string
+}
+
+/*
+Creates an address verifier. An empty mode means "always". An error
+is returned if the mode is not recognized.
+*/
+func NewAddressVerifier(mode string, knownRecipients []string) (*AddressVerifier, error) {
+	if len(mode) <= 0 {
+		mode = VRFY_MODE_ALWAYS
+	}
+
+	switch mode {
+	case VRFY_MODE_ALWAYS, VRFY_MODE_KNOWN, VRFY_MODE_DISABLED:
+	default:
+		return nil, fmt.Errorf("VRFY mode %q is not one of always, known or disabled", mode)
+	}
+
+	return &AddressVerifier{Mode: mode, KnownRecipients: knownRecipients}, nil
+}
+
+/*
+Returns the reply to a VRFY command. The argument may be an address or
+just a user name, which is checked against the local part of each known
+recipient.
+*/
+func (verifier *AddressVerifier) Verify(argument string) string {
+	switch verifier.Mode {
+	case VRFY_MODE_DISABLED:
+		return "502 5.5.1 VRFY is disabled"
+
+	case VRFY_MODE_KNOWN:
+		if address, ok := verifier.find(argument); ok {
+			return fmt.Sprintf("250 2.1.5 <%s>", address)
+		}
+
+		return "550 5.1.1 User unknown"
+
+	default:
+		return "252 2.1.5 Cannot VRFY user, but will accept message and attempt delivery"
+	}
+}
+
+/*
+Returns the reply to an EXPN command. There are no mailing lists, so in
+"known" mode a known address expands to itself.
+*/
+func (verifier *AddressVerifier) Expand(argument string) string {
+	switch verifier.Mode {
+	case VRFY_MODE_DISABLED:
+		return "502 5.5.1 EXPN is disabled"
+
+	case VRFY_MODE_KNOWN:
+		if address, ok := verifier.find(argument); ok {
+			return fmt.Sprintf("250 2.1.5 <%s>", address)
+		}
+
+		return "550 5.1.1 Mailing list not found"
+
+	default:
+		return "252 2.1.5 Cannot EXPN list, but will accept message and attempt delivery"
+	}
+}
+
+func (verifier *AddressVerifier) find(argument string) (string, bool) {
+	address := NormalizeAddress(argument)
+
+	for _, pattern := range verifier.KnownRecipients {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+
+		if strings.Contains(address, "@") {
+			if MatchAddressPattern(pattern, address) {
+				return address, true
+			}
+
+			continue
+		}
+
+		localPattern := pattern
+		if index := strings.LastIndex(pattern, "@"); index > -1 {
+			localPattern = pattern[:index]
+		}
+
+		if matched, err := path.Match(localPattern, address); err == nil && matched {
+			return strings.Replace(pattern, localPattern, address, 1), true
+		}
+	}
+
+	return "", false
+}
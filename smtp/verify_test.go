@@ -0,0 +1,96 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package smtp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAddressVerifier(t *testing.T) {
+	known, _ := NewAddressVerifier(VRFY_MODE_KNOWN, []string{"bob@example.com", "*@tenant-a.test"})
+	always, _ := NewAddressVerifier("", nil)
+	disabled, _ := NewAddressVerifier(VRFY_MODE_DISABLED, nil)
+
+	tests := []struct {
+		verifier *AddressVerifier
+		argument string
+		verify   string
+		expand   string
+	}{
+		{always, "<anyone@example.com>", "252", "252"},
+		{disabled, "<bob@example.com>", "502", "502"},
+		{known, "<Bob@Example.com>", "250 2.1.5 <bob@example.com>", "250 2.1.5 <bob@example.com>"},
+		{known, "alice@tenant-a.test", "250 2.1.5 <alice@tenant-a.test>", "250"},
+		{known, "bob", "250 2.1.5 <bob@example.com>", "250"},
+		{known, "<alice@example.com>", "550", "550"},
+	}
+
+	for _, test := range tests {
+		if reply := test.verifier.Verify(test.argument); !strings.HasPrefix(reply, test.verify) {
+			t.Errorf("%s Verify(%q) = %q, expected %q", test.verifier.Mode, test.argument, reply, test.verify)
+		}
+
+		if reply := test.verifier.Expand(test.argument); !strings.HasPrefix(reply, test.expand) {
+			t.Errorf("%s Expand(%q) = %q, expected %q", test.verifier.Mode, test.argument, reply, test.expand)
+		}
+	}
+
+	if _, err := NewAddressVerifier("sometimes", nil); err == nil {
+		t.Error("Expected an error for an unknown mode")
+	}
+}
+
+func TestParserRunNoopVrfyExpnHelp(t *testing.T) {
+	for _, strict := range []bool{true, false} {
+		verifier, _ := NewAddressVerifier(VRFY_MODE_KNOWN, []string{"bob@example.com"})
+		parser := &Parser{Strict: strict, Verifier: verifier}
+		session := startTestSession(t, parser)
+
+		session.run([]sessionStep{
+			{"", "220"},
+			{"NOOP", "250"},
+			{"EHLO localhost", "250"},
+			{"MAIL FROM:<sender@example.com>", "250"},
+			{"NOOP", "250"},
+			{"VRFY <bob@example.com>", "250 2.1.5 <bob@example.com>"},
+			{"VRFY <alice@example.com>", "550"},
+			{"EXPN staff", "550"},
+			{"RCPT TO:<bob@example.com>", "250"},
+		})
+
+		session.send("HELP")
+		if reply := session.expect("214"); !strings.Contains(reply, "VRFY") || !strings.HasSuffix(reply, "214 2.0.0 End of HELP info\r\n") {
+			t.Errorf("Expected a multi-line HELP reply listing the commands, got %q", reply)
+		}
+
+		session.run([]sessionStep{
+			{"VRFY", "501"},
+			{"DATA", "354"},
+			{"Subject: Hello\r\n\r\nHello\r\n.", "250"},
+			{"QUIT", "221"},
+		})
+
+		session.close()
+
+		if len(parser.Messages) != 1 || strings.Join(parser.Messages[0].ToAddresses, ",") != "<bob@example.com>" {
+			t.Errorf("Expected the commands not to change the transaction, got %+v", parser.Messages)
+		}
+	}
+}
+
+func TestParserRunVrfyWithoutVerifier(t *testing.T) {
+	parser := &Parser{}
+	session := startTestSession(t, parser)
+
+	session.run([]sessionStep{
+		{"", "220"},
+		{"VRFY bob", "252"},
+		{"EXPN staff", "252"},
+		{"QUIT", "221"},
+	})
+
+	session.close()
+}
@@ -0,0 +1,104 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package smtp
+
+import (
+	"log"
+	"strings"
+
+	"github.com/adampresley/mailslurper/admin/model"
+	"github.com/adampresley/mailslurper/profiling"
+)
+
+/*
+Records one attempt to deliver a mail item to a webhook.
+*/
+func (ms *MailStorage) AddWebhookDelivery(delivery model.JSONWebhookDelivery) error {
+	profiling.Timer.Step("Writing webhook delivery")
+
+	_, err := ms.Db.Exec(
+		"INSERT INTO webhookdelivery (mailItemId, webhookName, url, attempt, statusCode, success, errorMessage, dateAttempted) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		delivery.MailItemId,
+		delivery.WebhookName,
+		delivery.URL,
+		delivery.Attempt,
+		delivery.StatusCode,
+		delivery.Success,
+		delivery.Error,
+		delivery.DateAttempted,
+	)
+
+	return err
+}
+
+/*
+Retrieves the webhook delivery log, newest first. Pass a mail item ID
+greater than zero, or a webhook name, to only see those deliveries.
+*/
+func (ms *MailStorage) GetWebhookDeliveries(mailItemId int, webhookName string) []model.JSONWebhookDelivery {
+	profiling.Timer.Step("Getting webhook deliveries")
+
+	conditions := make([]string, 0)
+	parameters := make([]interface{}, 0)
+	whereClause := ""
+
+	if mailItemId > 0 {
+		conditions = append(conditions, "mailItemId=?")
+		parameters = append(parameters, mailItemId)
+	}
+
+	if len(webhookName) > 0 {
+		conditions = append(conditions, "webhookName=?")
+		parameters = append(parameters, webhookName)
+	}
+
+	if len(conditions) > 0 {
+		whereClause = "WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	rows, err := ms.Db.Query(`
+		SELECT
+			  id
+			, mailItemId
+			, webhookName
+			, url
+			, attempt
+			, statusCode
+			, success
+			, errorMessage
+			, dateAttempted
+		FROM webhookdelivery
+		`+whereClause+`
+		ORDER BY id DESC
+	`, parameters...)
+
+	if err != nil {
+		log.Panic("Error running query to get webhook deliveries: ", err)
+	}
+
+	defer rows.Close()
+
+	result := make([]model.JSONWebhookDelivery, 0)
+
+	for rows.Next() {
+		delivery := model.JSONWebhookDelivery{}
+
+		rows.Scan(
+			&delivery.Id,
+			&delivery.MailItemId,
+			&delivery.WebhookName,
+			&delivery.URL,
+			&delivery.Attempt,
+			&delivery.StatusCode,
+			&delivery.Success,
+			&delivery.Error,
+			&delivery.DateAttempted,
+		)
+
+		result = append(result, delivery)
+	}
+
+	return result
+}
@@ -5,38 +5,208 @@
 package smtp
 
 import (
+	"encoding/json"
+	"log"
 	"net/http"
+	"time"
 
 	"github.com/adampresley/mailslurper/admin/model"
 	"github.com/gorilla/websocket"
 )
 
+const (
+	// Time allowed to write a message to a websocket
+	WEBSOCKET_WRITE_WAIT = 10 * time.Second
+
+	// Time allowed to read the next pong from a websocket
+	WEBSOCKET_PONG_WAIT = 60 * time.Second
+
+	// How often pings are sent. This must be less than WEBSOCKET_PONG_WAIT.
+	WEBSOCKET_PING_PERIOD = (WEBSOCKET_PONG_WAIT * 9) / 10
+
+	// Largest message a websocket client may send
+	WEBSOCKET_MAX_MESSAGE_SIZE = 4096
+
+	// Number of outbound messages queued per websocket. Clients
+	// that fall this far behind are disconnected.
+	WEBSOCKET_SEND_BUFFER_LEN = 256
+
+	// How often every websocket is sent a server status event
+	WEBSOCKET_STATUS_PERIOD = 30 * time.Second
+)
+
+// Version of the websocket event envelope. This is increased
+// whenever a change would break existing clients.
+const WEBSOCKET_PROTOCOL_VERSION = 1
+
+// Type of the event sent to websockets when they connect and
+// every WEBSOCKET_STATUS_PERIOD after that
+const EVENT_SERVER_STATUS = "serverStatus"
+
 // Structure for tracking and working with websockets
 type WebsocketConnection struct {
 	// Websocket connection handle
 	WS *websocket.Conn
 
 	// Buffered channel for outbound messages
-	SendChannel chan MailItemStruct
+	SendChannel chan WebsocketEvent
+
+	// Only mail matching this subscription is sent to the connection
+	subscription WebsocketSubscription
+}
+
+/*
+WebsocketSubscription narrows down which mail a websocket receives
+events for. To and From are address wildcard patterns such as
+"*@tenant-a.test". Empty patterns match everything.
+
+Clients change their subscription by sending a JSON message:
+
+	{"action": "subscribe", "to": "*@tenant-a.test", "from": ""}
+
+Sending {"action": "unsubscribe"} goes back to receiving everything.
+*/
+type WebsocketSubscription struct {
+	To   string `json:"to"`
+	From string `json:"from"`
+}
+
+/*
+WebsocketEvent is the envelope for every message sent to websockets.
+Type is one of the EVENT_* constants and decides the shape of Data:
+
+	mailReceived     JSONMailItem without the body
+	mailItemUpdated  MailItemUpdate
+	mailItemDeleted  {"id": 12}
+	mailsPurged      {}
+	serverStatus     ServerStatus
+
+Id is the event's ID in the event log, the same ID used by the "/events"
+stream. It is left out of serverStatus events, which are not logged.
+*/
+type WebsocketEvent struct {
+	Version int         `json:"version"`
+	Type    string      `json:"type"`
+	Id      int         `json:"id,omitempty"`
+	Data    interface{} `json:"data"`
+}
+
+// Data of a serverStatus event
+type ServerStatus struct {
+	MailItemCount    int    `json:"mailItemCount"`
+	UnreadCount      int    `json:"unreadCount"`
+	WebsocketClients int    `json:"websocketClients"`
+	StartedAt        string `json:"startedAt"`
+}
+
+// Data of a mailItemUpdated event, sent when the read, starred
+// or tag state of an existing mail item changes
+type MailItemUpdate struct {
+	Id        int      `json:"id"`
+	IsRead    bool     `json:"isRead"`
+	IsStarred bool     `json:"isStarred"`
+	Tags      []string `json:"tags"`
 }
 
-var WebsocketConnections map[*WebsocketConnection]bool = make(map[*WebsocketConnection]bool)
+// Structure for tracking the open websockets of one MailSlurper
+// administrator. Create one with NewWebsocketHub. All connection
+// state is owned by the hub's own goroutine. Mail counts for
+// serverStatus events are fetched by a second goroutine so a slow
+// database never holds up the hub.
+type WebsocketHub struct {
+	connections  map[*WebsocketConnection]bool
+	status       func() ServerStatus
+	serverStatus ServerStatus
+	startedAt    time.Time
+
+	register      chan *WebsocketConnection
+	unregister    chan *WebsocketConnection
+	subscribe     chan subscriptionChange
+	broadcast     chan hubMessage
+	statusUpdates chan ServerStatus
+	stop          chan bool
+	stopped       chan bool
+	pollerStopped chan bool
+}
+
+type hubMessage struct {
+	event       WebsocketEvent
+	everyone    bool
+	toAddresses []string
+	fromAddress string
+}
+
+type subscriptionChange struct {
+	connection   *WebsocketConnection
+	subscription WebsocketSubscription
+}
+
+type websocketClientMessage struct {
+	Action string `json:"action"`
+	WebsocketSubscription
+}
 
 /*
-This function takes a MailItemStruct and sends it to all open websockets.
+Creates a new websocket hub with no open connections and starts its
+goroutines. The status function supplies the mail counts for serverStatus
+events and may be nil. It is called once here and then every
+WEBSOCKET_STATUS_PERIOD. Call Close to stop the hub.
 */
-func BroadcastMessageToWebsockets(message MailItemStruct) {
-	for connection := range WebsocketConnections {
-		connection.SendChannel <- message
+func NewWebsocketHub(status func() ServerStatus) *WebsocketHub {
+	hub := &WebsocketHub{
+		connections:   make(map[*WebsocketConnection]bool),
+		status:        status,
+		startedAt:     time.Now().UTC(),
+		register:      make(chan *WebsocketConnection),
+		unregister:    make(chan *WebsocketConnection),
+		subscribe:     make(chan subscriptionChange),
+		broadcast:     make(chan hubMessage, WEBSOCKET_SEND_BUFFER_LEN),
+		statusUpdates: make(chan ServerStatus),
+		stop:          make(chan bool),
+		stopped:       make(chan bool),
+		pollerStopped: make(chan bool),
 	}
+
+	if status != nil {
+		hub.serverStatus = status()
+	}
+
+	go hub.run()
+	go hub.pollStatus()
+	return hub
+}
+
+/*
+Disconnects every websocket and stops the hub's goroutines.
+*/
+func (hub *WebsocketHub) Close() {
+	close(hub.stop)
+	<-hub.stopped
+	<-hub.pollerStopped
+}
+
+/*
+Sends an event to every open websocket, whatever its subscription.
+It never blocks on a slow client.
+*/
+func (hub *WebsocketHub) BroadcastEvent(event WebsocketEvent) {
+	hub.send(hubMessage{event: event, everyone: true})
+}
+
+/*
+Sends an event about a mail item to the open websockets subscribed
+to the mail item's addresses. It never blocks on a slow client.
+*/
+func (hub *WebsocketHub) BroadcastMailEvent(event WebsocketEvent, toAddresses []string, fromAddress string) {
+	hub.send(hubMessage{event: event, toAddresses: toAddresses, fromAddress: fromAddress})
 }
 
 /*
 This function handles the handshake for our websocket connection.
-It sets up a goroutine to handle sending MailItemStructs to the
-other side.
+Outgoing messages are written from their own goroutine while this
+one reads subscription changes and pongs from the client.
 */
-func WebsocketHandler(writer http.ResponseWriter, request *http.Request) {
+func (hub *WebsocketHub) Handler(writer http.ResponseWriter, request *http.Request) {
 	ws, err := websocket.Upgrade(writer, request, nil, 1024, 1024)
 	if _, ok := err.(websocket.HandshakeError); ok {
 		http.Error(writer, "Invalid handshake", 400)
@@ -45,40 +215,252 @@ func WebsocketHandler(writer http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	/*
-	 * Create a new websocket connection struct and add it's pointer
-	 * address to our web socket tracking map.
-	 */
-	connection := &WebsocketConnection{WS: ws, SendChannel: make(chan MailItemStruct, 256)}
-	WebsocketConnections[connection] = true
-	defer destroyConnection(connection)
+	connection := &WebsocketConnection{WS: ws, SendChannel: make(chan WebsocketEvent, WEBSOCKET_SEND_BUFFER_LEN)}
+
+	select {
+	case hub.register <- connection:
+	case <-hub.stop:
+		ws.Close()
+		return
+	}
+
+	go hub.writePump(connection)
+	hub.readPump(connection)
+}
+
+/*
+Owns the connection map. Registers, unregisters, subscription changes
+and broadcasts are all handled here so no locking is needed.
+*/
+func (hub *WebsocketHub) run() {
+	defer close(hub.stopped)
 
 	for {
-		for message := range connection.SendChannel {
-			transformedMessage := model.JSONMailItem{
-				Id:              message.Id,
-				DateSent:        message.DateSent,
-				FromAddress:     message.FromAddress,
-				ToAddresses:     message.ToAddresses,
-				Subject:         message.Subject,
-				XMailer:         message.XMailer,
-				Body:            "",
-				ContentType:     "",
-				AttachmentCount: len(message.Attachments),
+		select {
+		case connection := <-hub.register:
+			hub.connections[connection] = true
+			connection.SendChannel <- hub.statusEvent()
+
+		case connection := <-hub.unregister:
+			hub.destroyConnection(connection)
+
+		case change := <-hub.subscribe:
+			if _, ok := hub.connections[change.connection]; ok {
+				change.connection.subscription = change.subscription
 			}
 
-			err := connection.WS.WriteJSON(transformedMessage)
-			if err != nil {
-				break
+		case message := <-hub.broadcast:
+			for connection := range hub.connections {
+				if message.everyone || connection.subscription.matches(message.toAddresses, message.fromAddress) {
+					hub.sendToConnection(connection, message.event)
+				}
 			}
+
+		case status := <-hub.statusUpdates:
+			hub.serverStatus = status
+
+			if len(hub.connections) > 0 {
+				event := hub.statusEvent()
+
+				for connection := range hub.connections {
+					hub.sendToConnection(connection, event)
+				}
+			}
+
+		case <-hub.stop:
+			for connection := range hub.connections {
+				hub.destroyConnection(connection)
+			}
+
+			return
 		}
 	}
+}
 
-	connection.WS.Close()
+/*
+Queues an event for one connection, disconnecting it if its queue
+is full. Only called from run.
+*/
+func (hub *WebsocketHub) sendToConnection(connection *WebsocketConnection, event WebsocketEvent) {
+	select {
+	case connection.SendChannel <- event:
+	default:
+		log.Println("Disconnecting websocket that is not keeping up")
+		hub.destroyConnection(connection)
+	}
 }
 
-func destroyConnection(connection *WebsocketConnection) {
-	// Remove the connection from our map, and close its channel
-	delete(WebsocketConnections, connection)
+/*
+Fetches the mail counts every WEBSOCKET_STATUS_PERIOD and hands them
+to run, which sends them to every websocket.
+*/
+func (hub *WebsocketHub) pollStatus() {
+	defer close(hub.pollerStopped)
+
+	if hub.status == nil {
+		<-hub.stop
+		return
+	}
+
+	statusTicker := time.NewTicker(WEBSOCKET_STATUS_PERIOD)
+	defer statusTicker.Stop()
+
+	for {
+		select {
+		case <-statusTicker.C:
+			select {
+			case hub.statusUpdates <- hub.status():
+			case <-hub.stop:
+				return
+			}
+
+		case <-hub.stop:
+			return
+		}
+	}
+}
+
+/*
+Builds a serverStatus event from the most recently fetched mail
+counts. Only called from run.
+*/
+func (hub *WebsocketHub) statusEvent() WebsocketEvent {
+	status := hub.serverStatus
+	status.WebsocketClients = len(hub.connections)
+	status.StartedAt = hub.startedAt.Format(DATE_RECEIVED_FORMAT)
+
+	return WebsocketEvent{Version: WEBSOCKET_PROTOCOL_VERSION, Type: EVENT_SERVER_STATUS, Data: status}
+}
+
+func (hub *WebsocketHub) send(message hubMessage) {
+	select {
+	case hub.broadcast <- message:
+	case <-hub.stop:
+	}
+}
+
+/*
+Reads messages from the client until the socket is closed or stops
+answering pings. Clients may only send subscription changes.
+*/
+func (hub *WebsocketHub) readPump(connection *WebsocketConnection) {
+	defer func() {
+		select {
+		case hub.unregister <- connection:
+		case <-hub.stop:
+		}
+
+		connection.WS.Close()
+	}()
+
+	connection.WS.SetReadLimit(WEBSOCKET_MAX_MESSAGE_SIZE)
+	connection.WS.SetReadDeadline(time.Now().Add(WEBSOCKET_PONG_WAIT))
+	connection.WS.SetPongHandler(func(string) error {
+		connection.WS.SetReadDeadline(time.Now().Add(WEBSOCKET_PONG_WAIT))
+		return nil
+	})
+
+	for {
+		_, data, err := connection.WS.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		message := websocketClientMessage{}
+		if err = json.Unmarshal(data, &message); err != nil {
+			continue
+		}
+
+		change := subscriptionChange{connection: connection}
+
+		switch message.Action {
+		case "subscribe":
+			change.subscription = message.WebsocketSubscription
+
+		case "unsubscribe":
+
+		default:
+			continue
+		}
+
+		select {
+		case hub.subscribe <- change:
+		case <-hub.stop:
+			return
+		}
+	}
+}
+
+/*
+Writes queued messages and periodic pings to the client. Returns
+when the hub closes the connection's send channel or a write fails.
+*/
+func (hub *WebsocketHub) writePump(connection *WebsocketConnection) {
+	ticker := time.NewTicker(WEBSOCKET_PING_PERIOD)
+
+	defer func() {
+		ticker.Stop()
+		connection.WS.Close()
+	}()
+
+	for {
+		select {
+		case event, ok := <-connection.SendChannel:
+			connection.WS.SetWriteDeadline(time.Now().Add(WEBSOCKET_WRITE_WAIT))
+
+			if !ok {
+				connection.WS.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+
+			if err := connection.WS.WriteJSON(event); err != nil {
+				return
+			}
+
+		case <-ticker.C:
+			connection.WS.SetWriteDeadline(time.Now().Add(WEBSOCKET_WRITE_WAIT))
+
+			if err := connection.WS.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+/*
+Converts a newly received mail item into the JSON structure sent to
+websockets and event streams. The body is left out; clients fetch it
+when the mail item is opened.
+*/
+func mailItemSummary(mailItem MailItemStruct) model.JSONMailItem {
+	return model.JSONMailItem{
+		Id:              mailItem.Id,
+		DateSent:        mailItem.DateSent,
+		FromAddress:     mailItem.FromAddress,
+		ToAddresses:     mailItem.ToAddresses,
+		Subject:         mailItem.Subject,
+		XMailer:         mailItem.XMailer,
+		Body:            "",
+		ContentType:     "",
+		AttachmentCount: len(mailItem.Attachments),
+		Tags:            make([]string, 0),
+		DateReceived:    mailItem.DateReceived,
+	}
+}
+
+func (subscription WebsocketSubscription) matches(toAddresses []string, fromAddress string) bool {
+	return MatchAnyAddressPattern(subscription.To, toAddresses) && MatchAddressPattern(subscription.From, fromAddress)
+}
+
+/*
+Removes a connection from the hub and closes its send channel, which
+makes its write goroutine close the socket. Only called from run.
+*/
+func (hub *WebsocketHub) destroyConnection(connection *WebsocketConnection) {
+	if _, ok := hub.connections[connection]; !ok {
+		return
+	}
+
+	delete(hub.connections, connection)
 	close(connection.SendChannel)
 }
@@ -0,0 +1,302 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package smtp
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adampresley/mailslurper/admin/model"
+	"github.com/gorilla/websocket"
+)
+
+func TestWebsocketSubscriptionMatches(t *testing.T) {
+	tests := []struct {
+		subscription WebsocketSubscription
+		toAddresses  []string
+		fromAddress  string
+		expected     bool
+	}{
+		{WebsocketSubscription{}, []string{"<bob@tenant-a.test>"}, "<app@example.com>", true},
+		{WebsocketSubscription{}, nil, "", true},
+		{WebsocketSubscription{To: "*@tenant-a.test"}, []string{"<bob@tenant-a.test>"}, "<app@example.com>", true},
+		{WebsocketSubscription{To: "*@tenant-a.test"}, []string{"<bob@tenant-b.test>", "<alice@tenant-a.test>"}, "<app@example.com>", true},
+		{WebsocketSubscription{To: "*@tenant-a.test"}, []string{"<bob@tenant-b.test>"}, "<app@example.com>", false},
+		{WebsocketSubscription{From: "app@example.com"}, []string{"<bob@tenant-b.test>"}, "<App@Example.com>", true},
+		{WebsocketSubscription{From: "app@example.com"}, []string{"<bob@tenant-b.test>"}, "<other@example.com>", false},
+		{WebsocketSubscription{To: "*@tenant-a.test", From: "app@example.com"}, []string{"<bob@tenant-a.test>"}, "<other@example.com>", false},
+	}
+
+	for _, test := range tests {
+		if result := test.subscription.matches(test.toAddresses, test.fromAddress); result != test.expected {
+			t.Errorf("%+v matches(%v, %q) = %v, expected %v", test.subscription, test.toAddresses, test.fromAddress, result, test.expected)
+		}
+	}
+}
+
+/*
+Registers a connection without a socket. Messages the hub sends
+it can be read from its SendChannel.
+*/
+func registerTestConnection(hub *WebsocketHub, subscription WebsocketSubscription) *WebsocketConnection {
+	connection := &WebsocketConnection{SendChannel: make(chan WebsocketEvent, WEBSOCKET_SEND_BUFFER_LEN)}
+
+	hub.register <- connection
+	hub.subscribe <- subscriptionChange{connection: connection, subscription: subscription}
+
+	return connection
+}
+
+/*
+Sends a mailReceived event for a mail item with the provided
+subject and recipients.
+*/
+func broadcastTestMail(hub *WebsocketHub, subject string, toAddresses ...string) {
+	mailItem := MailItemStruct{Subject: subject, ToAddresses: toAddresses}
+	hub.BroadcastMailEvent(WebsocketEvent{Version: WEBSOCKET_PROTOCOL_VERSION, Type: EVENT_MAIL_RECEIVED, Data: mailItemSummary(mailItem)}, toAddresses, "")
+}
+
+/*
+Returns the subjects of the mail items queued for a connection. A
+last mail item that every test subscription matches is broadcast so
+we know when the hub has handled everything sent before it. Such
+mail items left over from earlier calls are skipped.
+*/
+func queuedSubjects(t *testing.T, hub *WebsocketHub, connection *WebsocketConnection) []string {
+	last := fmt.Sprintf("Last %d", time.Now().UnixNano())
+	broadcastTestMail(hub, last, "<last@tenant-a.test>")
+
+	result := make([]string, 0)
+
+	for {
+		select {
+		case event, ok := <-connection.SendChannel:
+			if !ok {
+				return result
+			}
+
+			if event.Type != EVENT_MAIL_RECEIVED {
+				continue
+			}
+
+			subject := event.Data.(model.JSONMailItem).Subject
+			if subject == last {
+				return result
+			}
+
+			if strings.HasPrefix(subject, "Last ") {
+				continue
+			}
+
+			result = append(result, subject)
+
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for the hub")
+		}
+	}
+}
+
+func TestWebsocketHubBroadcastsToSubscribers(t *testing.T) {
+	hub := NewWebsocketHub(nil)
+	defer hub.Close()
+
+	everything := registerTestConnection(hub, WebsocketSubscription{})
+	tenantA := registerTestConnection(hub, WebsocketSubscription{To: "*@tenant-a.test"})
+
+	broadcastTestMail(hub, "For A", "<bob@tenant-a.test>")
+	broadcastTestMail(hub, "For B", "<bob@tenant-b.test>")
+
+	if subjects := queuedSubjects(t, hub, everything); strings.Join(subjects, ",") != "For A,For B" {
+		t.Errorf("Expected the unsubscribed connection to get both mail items, got %v", subjects)
+	}
+
+	if subjects := queuedSubjects(t, hub, tenantA); strings.Join(subjects, ",") != "For A" {
+		t.Errorf("Expected the tenant A connection to get only its mail item, got %v", subjects)
+	}
+
+	hub.subscribe <- subscriptionChange{connection: tenantA}
+	broadcastTestMail(hub, "For B", "<bob@tenant-b.test>")
+
+	if subjects := queuedSubjects(t, hub, tenantA); strings.Join(subjects, ",") != "For B" {
+		t.Errorf("Expected an unsubscribed connection to get everything, got %v", subjects)
+	}
+}
+
+func TestWebsocketHubDisconnectsSlowConnections(t *testing.T) {
+	hub := NewWebsocketHub(nil)
+	defer hub.Close()
+
+	connection := registerTestConnection(hub, WebsocketSubscription{})
+
+	/*
+	 * The serverStatus event sent on connecting takes one place in the queue
+	 */
+	for index := 0; index < WEBSOCKET_SEND_BUFFER_LEN; index++ {
+		broadcastTestMail(hub, "Hello")
+	}
+
+	if subjects := queuedSubjects(t, hub, connection); len(subjects) != WEBSOCKET_SEND_BUFFER_LEN-1 {
+		t.Errorf("Expected %d queued mail items, got %d", WEBSOCKET_SEND_BUFFER_LEN-1, len(subjects))
+	}
+
+	if _, ok := <-connection.SendChannel; ok {
+		t.Error("Expected the send channel of a slow connection to be closed")
+	}
+}
+
+func TestWebsocketHubCloseDisconnectsEveryone(t *testing.T) {
+	hub := NewWebsocketHub(nil)
+	connection := registerTestConnection(hub, WebsocketSubscription{})
+
+	hub.Close()
+
+	if event := <-connection.SendChannel; event.Type != EVENT_SERVER_STATUS {
+		t.Errorf("Expected the serverStatus event sent on connecting, got %+v", event)
+	}
+
+	if _, ok := <-connection.SendChannel; ok {
+		t.Error("Expected the send channel to be closed")
+	}
+
+	broadcastTestMail(hub, "After close")
+}
+
+func TestWebsocketHubSendsFetchedStatus(t *testing.T) {
+	calls := 0
+
+	hub := NewWebsocketHub(func() ServerStatus {
+		calls++
+		return ServerStatus{MailItemCount: 3}
+	})
+
+	defer hub.Close()
+
+	first := registerTestConnection(hub, WebsocketSubscription{})
+	second := registerTestConnection(hub, WebsocketSubscription{})
+
+	for _, connection := range []*WebsocketConnection{first, second} {
+		if event := <-connection.SendChannel; event.Data.(ServerStatus).MailItemCount != 3 {
+			t.Errorf("Expected the status fetched when the hub started, got %+v", event)
+		}
+	}
+
+	/*
+	 * Stands in for the status goroutine's next fetch
+	 */
+	hub.statusUpdates <- ServerStatus{MailItemCount: 5}
+
+	for _, connection := range []*WebsocketConnection{first, second} {
+		if event := <-connection.SendChannel; event.Type != EVENT_SERVER_STATUS || event.Data.(ServerStatus).MailItemCount != 5 || event.Data.(ServerStatus).WebsocketClients != 2 {
+			t.Errorf("Expected the new status for two clients, got %+v", event)
+		}
+	}
+
+	if calls != 1 {
+		t.Errorf("Expected the status to be fetched once, when the hub started, got %d", calls)
+	}
+}
+
+func TestWebsocketHubHandler(t *testing.T) {
+	hub := NewWebsocketHub(func() ServerStatus {
+		return ServerStatus{MailItemCount: 3, UnreadCount: 2}
+	})
+
+	defer hub.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(hub.Handler))
+	defer server.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Unable to open websocket: %s", err)
+	}
+
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	status := struct {
+		Version int          `json:"version"`
+		Type    string       `json:"type"`
+		Id      *int         `json:"id"`
+		Data    ServerStatus `json:"data"`
+	}{}
+
+	if err = ws.ReadJSON(&status); err != nil {
+		t.Fatalf("Unable to read the serverStatus event: %s", err)
+	}
+
+	if status.Version != WEBSOCKET_PROTOCOL_VERSION || status.Type != EVENT_SERVER_STATUS || status.Id != nil {
+		t.Errorf("Expected a serverStatus envelope without an id, got %+v", status)
+	}
+
+	if status.Data.MailItemCount != 3 || status.Data.UnreadCount != 2 || status.Data.WebsocketClients != 1 || len(status.Data.StartedAt) == 0 {
+		t.Errorf("Expected the server status for one client, got %+v", status.Data)
+	}
+
+	hub.BroadcastMailEvent(WebsocketEvent{
+		Version: WEBSOCKET_PROTOCOL_VERSION,
+		Type:    EVENT_MAIL_RECEIVED,
+		Id:      7,
+		Data:    mailItemSummary(MailItemStruct{Id: 12, Subject: "Hello", Body: "Secret"}),
+	}, []string{"<bob@example.com>"}, "")
+
+	received := struct {
+		Version int                `json:"version"`
+		Type    string             `json:"type"`
+		Id      int                `json:"id"`
+		Data    model.JSONMailItem `json:"data"`
+	}{}
+
+	if err = ws.ReadJSON(&received); err != nil {
+		t.Fatalf("Unable to read the mailReceived event: %s", err)
+	}
+
+	if received.Type != EVENT_MAIL_RECEIVED || received.Id != 7 || received.Data.Id != 12 || received.Data.Body != "" {
+		t.Errorf("Expected event 7 with a summary of mail item 12, got %+v", received)
+	}
+}
+
+func TestPublishEventSendsEnvelopes(t *testing.T) {
+	storage := newTestStorage(t)
+	defer storage.Disconnect()
+
+	storage.Websockets = NewWebsocketHub(storage.GetServerStatus)
+	defer storage.Websockets.Close()
+
+	tenantA := registerTestConnection(storage.Websockets, WebsocketSubscription{To: "*@tenant-a.test"})
+
+	if event := <-tenantA.SendChannel; event.Type != EVENT_SERVER_STATUS {
+		t.Fatalf("Expected a serverStatus event on connecting, got %s", event.Type)
+	}
+
+	writeTestMail(t, storage, testMailItem("<bob@tenant-b.test>", "For B"), testMailItem("<bob@tenant-a.test>", "For A"))
+
+	received := <-tenantA.SendChannel
+	if received.Version != WEBSOCKET_PROTOCOL_VERSION || received.Type != EVENT_MAIL_RECEIVED || received.Id != 2 {
+		t.Fatalf("Expected mailReceived event 2, got %+v", received)
+	}
+
+	mailItem := received.Data.(model.JSONMailItem)
+	if mailItem.Subject != "For A" {
+		t.Errorf("Expected only the tenant A mail item, got %q", mailItem.Subject)
+	}
+
+	storage.SetMailStarred(mailItem.Id, true)
+
+	updated := <-tenantA.SendChannel
+	if update, ok := updated.Data.(MailItemUpdate); updated.Type != EVENT_MAIL_UPDATED || !ok || !update.IsStarred {
+		t.Errorf("Expected a mailItemUpdated event, got %+v", updated)
+	}
+
+	storage.PurgeMails()
+
+	if purged := <-tenantA.SendChannel; purged.Type != EVENT_MAILS_PURGED {
+		t.Errorf("Expected every websocket to get mailsPurged, got %+v", purged)
+	}
+}
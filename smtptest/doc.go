@@ -0,0 +1,9 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+/*
+Package smtptest provides an in-process MailSlurper SMTP server for
+use in tests, in the spirit of net/http/httptest.
+*/
+package smtptest
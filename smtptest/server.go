@@ -0,0 +1,145 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package smtptest
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/adampresley/mailslurper/smtp"
+)
+
+// Number of received mail items the MailItems channel holds
+// before further mail items are no longer sent to it
+const MAIL_ITEMS_BUFFER_LEN = 1000
+
+/*
+Server is a MailSlurper SMTP server listening on a random port on the
+loopback interface, storing mail in a private in-memory database.
+Several can run at once.
+*/
+type Server struct {
+	// Address of the SMTP listener in host:port form
+	Address string
+
+	// Storage the server writes received mail items to
+	Storage *smtp.MailStorage
+
+	// Receives each mail item once it has been written to storage.
+	// It is closed by Close. If nobody reads from it, mail items past
+	// MAIL_ITEMS_BUFFER_LEN are only available from Received.
+	MailItems chan smtp.MailItemStruct
+
+	server   *smtp.Server
+	listener chan smtp.MailItemStruct
+	received []smtp.MailItemStruct
+	lock     sync.Mutex
+	done     chan bool
+}
+
+/*
+Starts and returns a new Server. The caller should call Close when
+finished, to shut it down. This panics if the server cannot start.
+
+Example:
+
+	server := smtptest.NewServer()
+	defer server.Close()
+
+	sendWelcomeMail(server.Address, "user@example.com")
+
+	mailItem, ok := server.WaitForMail(5 * time.Second)
+*/
+func NewServer() *Server {
+	storage := &smtp.MailStorage{Engine: smtp.ENGINE_SQLITE_MEMORY}
+
+	err := storage.Connect()
+	if err != nil {
+		panic(fmt.Sprintf("smtptest: failed to set up in-memory storage: %s", err))
+	}
+
+	server := &smtp.Server{Address: "127.0.0.1:0", Storage: storage}
+	err = server.Connect()
+	if err != nil {
+		panic(fmt.Sprintf("smtptest: failed to start SMTP server: %s", err))
+	}
+
+	result := &Server{
+		Address:   server.Listeners[0].Addr().String(),
+		Storage:   storage,
+		MailItems: make(chan smtp.MailItemStruct, MAIL_ITEMS_BUFFER_LEN),
+		server:    server,
+		listener:  storage.AddMailReceivedListener(),
+		received:  make([]smtp.MailItemStruct, 0),
+		done:      make(chan bool),
+	}
+
+	go result.collect()
+	go server.ProcessRequests()
+
+	return result
+}
+
+/*
+Returns a copy of every mail item received so far, oldest first.
+*/
+func (s *Server) Received() []smtp.MailItemStruct {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	result := make([]smtp.MailItemStruct, len(s.received))
+	copy(result, s.received)
+	return result
+}
+
+/*
+Waits for the next mail item on the MailItems channel. The second return
+value is false if no mail item arrives within the timeout.
+*/
+func (s *Server) WaitForMail(timeout time.Duration) (smtp.MailItemStruct, bool) {
+	select {
+	case mailItem, ok := <-s.MailItems:
+		return mailItem, ok
+
+	case <-time.After(timeout):
+		return smtp.MailItemStruct{}, false
+	}
+}
+
+/*
+Shuts down the server. Sessions in progress are allowed to finish and
+their mail items are written before the MailItems channel is closed and
+the in-memory storage is discarded.
+*/
+func (s *Server) Close() {
+	s.server.Close()
+
+	s.Storage.RemoveMailReceivedListener(s.listener)
+	close(s.listener)
+	<-s.done
+
+	close(s.MailItems)
+	s.Storage.Disconnect()
+}
+
+/*
+Records mail items as they are written to storage and hands
+them out on the MailItems channel.
+*/
+func (s *Server) collect() {
+	for mailItem := range s.listener {
+		s.lock.Lock()
+		s.received = append(s.received, mailItem)
+		s.lock.Unlock()
+
+		select {
+		case s.MailItems <- mailItem:
+		default:
+		}
+	}
+
+	close(s.done)
+}
@@ -0,0 +1,106 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package smtptest
+
+import (
+	"net/smtp"
+	"testing"
+	"time"
+)
+
+func sendMail(t *testing.T, address string, to string, subject string) {
+	message := "From: sender@example.com\r\nTo: " + to + "\r\nSubject: " + subject + "\r\n\r\nHello\r\n"
+
+	err := smtp.SendMail(address, nil, "sender@example.com", []string{to}, []byte(message))
+	if err != nil {
+		t.Fatalf("Sending mail to %s failed: %s", address, err)
+	}
+}
+
+func TestServerReceivesMail(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+
+	sendMail(t, server.Address, "user@example.com", "Welcome")
+
+	mailItem, ok := server.WaitForMail(5 * time.Second)
+	if !ok {
+		t.Fatal("No mail item was received")
+	}
+
+	if mailItem.Subject != "Welcome" {
+		t.Errorf("Expected subject Welcome, got %q", mailItem.Subject)
+	}
+
+	if len(mailItem.ToAddresses) != 1 || mailItem.ToAddresses[0] != "<user@example.com>" {
+		t.Errorf("Expected recipient <user@example.com>, got %v", mailItem.ToAddresses)
+	}
+
+	if mailItem.Id <= 0 {
+		t.Errorf("Expected the mail item to have been stored, got id %d", mailItem.Id)
+	}
+
+	stored := server.Storage.GetMail(mailItem.Id)
+	if stored.Subject != "Welcome" {
+		t.Errorf("Expected the stored subject to be Welcome, got %q", stored.Subject)
+	}
+}
+
+func TestServerWaitForMailTimesOut(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+
+	if _, ok := server.WaitForMail(50 * time.Millisecond); ok {
+		t.Error("Expected no mail item before any was sent")
+	}
+}
+
+func TestServerCloseWritesMailInProgress(t *testing.T) {
+	server := NewServer()
+
+	sendMail(t, server.Address, "first@example.com", "First")
+	sendMail(t, server.Address, "second@example.com", "Second")
+	server.Close()
+
+	received := server.Received()
+	if len(received) != 2 {
+		t.Fatalf("Expected 2 mail items, got %d", len(received))
+	}
+
+	if received[0].Subject != "First" || received[1].Subject != "Second" {
+		t.Errorf("Expected mail items in the order sent, got %q and %q", received[0].Subject, received[1].Subject)
+	}
+
+	count := 0
+	for range server.MailItems {
+		count++
+	}
+
+	if count != 2 {
+		t.Errorf("Expected 2 mail items on the closed MailItems channel, got %d", count)
+	}
+}
+
+func TestServersRunInParallel(t *testing.T) {
+	first := NewServer()
+	defer first.Close()
+
+	second := NewServer()
+	defer second.Close()
+
+	if first.Address == second.Address {
+		t.Fatalf("Expected different addresses, both are %s", first.Address)
+	}
+
+	sendMail(t, first.Address, "user@example.com", "For first")
+
+	if _, ok := first.WaitForMail(5 * time.Second); !ok {
+		t.Fatal("The first server did not receive its mail item")
+	}
+
+	if received := second.Received(); len(received) != 0 {
+		t.Errorf("Expected the second server to receive nothing, got %d mail items", len(received))
+	}
+}
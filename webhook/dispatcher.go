@@ -0,0 +1,381 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adampresley/mailslurper/admin/model"
+	"github.com/adampresley/mailslurper/settings"
+	"github.com/adampresley/mailslurper/smtp"
+)
+
+// Defaults for webhooks that do not specify their own retry
+// settings, and the longest we will ever wait between retries.
+const (
+	DEFAULT_MAX_ATTEMPTS        = 5
+	DEFAULT_RETRY_DELAY_SECONDS = 1
+	MAX_RETRY_DELAY_SECONDS     = 300
+	REQUEST_TIMEOUT_SECONDS     = 10
+)
+
+// Names of the HTTP headers sent with each webhook request
+const (
+	HEADER_EVENT     = "X-MailSlurper-Event"
+	HEADER_DELIVERY  = "X-MailSlurper-Delivery"
+	HEADER_SIGNATURE = "X-MailSlurper-Signature"
+)
+
+type webhook struct {
+	settings.WebhookConfiguration
+	subject *regexp.Regexp
+}
+
+/*
+Dispatcher sends a JSON POST to each configured webhook after a new mail
+item has been written to storage. Every attempt is recorded in the
+storage's webhook delivery log.
+*/
+type Dispatcher struct {
+	Storage    *smtp.MailStorage
+	HTTPClient *http.Client
+
+	webhooks []webhook
+	listener chan smtp.MailItemStruct
+	stop     chan bool
+	running  sync.WaitGroup
+
+	// New mail items waiting to be dispatched. The queue has no limit
+	// so the storage listener, which never drops mail items, is always
+	// read from straight away and does not hold up storage.
+	queue     []smtp.MailItemStruct
+	queueLock sync.Mutex
+	queued    chan bool
+	received  chan bool
+}
+
+/*
+Creates a dispatcher for a set of webhook configurations. An error is
+returned if a webhook is missing its URL or has an invalid subject pattern.
+*/
+func NewDispatcher(storage *smtp.MailStorage, configurations []settings.WebhookConfiguration) (*Dispatcher, error) {
+	result := &Dispatcher{
+		Storage:    storage,
+		HTTPClient: &http.Client{Timeout: REQUEST_TIMEOUT_SECONDS * time.Second},
+		webhooks:   make([]webhook, 0, len(configurations)),
+		stop:       make(chan bool),
+		queued:     make(chan bool, 1),
+		received:   make(chan bool),
+	}
+
+	for index, configuration := range configurations {
+		hook := webhook{WebhookConfiguration: configuration}
+
+		if len(strings.TrimSpace(hook.URL)) <= 0 {
+			return nil, fmt.Errorf("Webhook %d (%s) does not have a URL", index+1, hook.Name)
+		}
+
+		if len(hook.Name) <= 0 {
+			hook.Name = hook.URL
+		}
+
+		if hook.MaxAttempts <= 0 {
+			hook.MaxAttempts = DEFAULT_MAX_ATTEMPTS
+		}
+
+		if hook.RetryDelaySeconds <= 0 {
+			hook.RetryDelaySeconds = DEFAULT_RETRY_DELAY_SECONDS
+		}
+
+		if len(hook.Subject) > 0 {
+			subject, err := regexp.Compile(hook.Subject)
+			if err != nil {
+				return nil, fmt.Errorf("Webhook %s has an invalid subject pattern: %s", hook.Name, err)
+			}
+
+			hook.subject = subject
+		}
+
+		result.webhooks = append(result.webhooks, hook)
+	}
+
+	return result, nil
+}
+
+/*
+Starts listening for new mail items in a goroutine. Does nothing
+if there are no webhooks configured.
+*/
+func (d *Dispatcher) Start() {
+	if len(d.webhooks) <= 0 {
+		return
+	}
+
+	d.listener = d.Storage.AddBlockingMailReceivedListener()
+	d.running.Add(2)
+
+	go d.receive()
+	go d.work()
+
+	log.Printf("Sending new mail items to %d webhook(s)\n", len(d.webhooks))
+}
+
+/*
+Stops listening for new mail items and abandons any pending retries.
+Mail items already written to storage are still sent to their webhooks
+once, and this waits for those requests and any others in flight to
+finish.
+*/
+func (d *Dispatcher) Stop() {
+	if d.listener == nil {
+		return
+	}
+
+	d.Storage.RemoveMailReceivedListener(d.listener)
+	close(d.stop)
+	d.running.Wait()
+}
+
+/*
+Moves new mail items from the storage listener onto the queue. Once
+stopped, whatever is left on the listener is queued before returning.
+*/
+func (d *Dispatcher) receive() {
+	defer d.running.Done()
+	defer close(d.received)
+
+	for {
+		select {
+		case mailItem := <-d.listener:
+			d.enqueue(mailItem)
+
+		case <-d.stop:
+			for {
+				select {
+				case mailItem := <-d.listener:
+					d.enqueue(mailItem)
+
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (d *Dispatcher) enqueue(mailItem smtp.MailItemStruct) {
+	d.queueLock.Lock()
+	d.queue = append(d.queue, mailItem)
+	d.queueLock.Unlock()
+
+	select {
+	case d.queued <- true:
+	default:
+	}
+}
+
+/*
+Dispatches queued mail items until receive has finished and
+the queue is empty.
+*/
+func (d *Dispatcher) work() {
+	defer d.running.Done()
+
+	for {
+		mailItems := d.takeQueue()
+		for _, mailItem := range mailItems {
+			d.dispatch(mailItem)
+		}
+
+		if len(mailItems) > 0 {
+			continue
+		}
+
+		select {
+		case <-d.queued:
+
+		case <-d.received:
+			for _, mailItem := range d.takeQueue() {
+				d.dispatch(mailItem)
+			}
+
+			return
+		}
+	}
+}
+
+func (d *Dispatcher) takeQueue() []smtp.MailItemStruct {
+	d.queueLock.Lock()
+	defer d.queueLock.Unlock()
+
+	result := d.queue
+	d.queue = nil
+	return result
+}
+
+/*
+Starts a delivery for each webhook whose filters match the mail item.
+*/
+func (d *Dispatcher) dispatch(mailItem smtp.MailItemStruct) {
+	var payload []byte
+
+	for _, hook := range d.webhooks {
+		if !hook.matches(mailItem) {
+			continue
+		}
+
+		if payload == nil {
+			payload = d.buildPayload(mailItem)
+		}
+
+		d.running.Add(1)
+		go d.deliver(hook, mailItem.Id, payload)
+	}
+}
+
+/*
+Posts the payload to a webhook, retrying with an increasing delay
+until it succeeds, runs out of attempts, or the dispatcher is stopped.
+*/
+func (d *Dispatcher) deliver(hook webhook, mailItemId int, payload []byte) {
+	defer d.running.Done()
+
+	deliveryId := fmt.Sprintf("%d-%d", mailItemId, time.Now().UnixNano())
+	delay := time.Duration(hook.RetryDelaySeconds * float64(time.Second))
+
+	for attempt := 1; attempt <= hook.MaxAttempts; attempt++ {
+		statusCode, err := d.post(hook, deliveryId, payload)
+
+		delivery := model.JSONWebhookDelivery{
+			MailItemId:    mailItemId,
+			WebhookName:   hook.Name,
+			URL:           hook.URL,
+			Attempt:       attempt,
+			StatusCode:    statusCode,
+			Success:       err == nil,
+			DateAttempted: time.Now().UTC().Format(smtp.DATE_RECEIVED_FORMAT),
+		}
+
+		if err != nil {
+			delivery.Error = err.Error()
+			log.Printf("Webhook %s attempt %d for mail item %d failed: %s\n", hook.Name, attempt, mailItemId, err)
+		}
+
+		if logErr := d.Storage.AddWebhookDelivery(delivery); logErr != nil {
+			log.Println("Error recording webhook delivery: ", logErr)
+		}
+
+		if err == nil || attempt >= hook.MaxAttempts {
+			return
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-d.stop:
+			return
+		}
+
+		delay *= 2
+		if delay > MAX_RETRY_DELAY_SECONDS*time.Second {
+			delay = MAX_RETRY_DELAY_SECONDS * time.Second
+		}
+	}
+}
+
+/*
+Sends a single webhook request. Any response other than a 2xx
+is treated as a failure.
+*/
+func (d *Dispatcher) post(hook webhook, deliveryId string, payload []byte) (int, error) {
+	request, err := http.NewRequest("POST", hook.URL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(HEADER_EVENT, "mailReceived")
+	request.Header.Set(HEADER_DELIVERY, deliveryId)
+
+	if len(hook.Secret) > 0 {
+		request.Header.Set(HEADER_SIGNATURE, "sha256="+Sign(hook.Secret, payload))
+	}
+
+	response, err := d.HTTPClient.Do(request)
+	if err != nil {
+		return 0, err
+	}
+
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, response.Body)
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, fmt.Errorf("Webhook responded with %s", response.Status)
+	}
+
+	return response.StatusCode, nil
+}
+
+/*
+Builds the JSON body sent to webhooks: the stored mail item
+plus the headers parsed from its raw source.
+*/
+func (d *Dispatcher) buildPayload(mailItem smtp.MailItemStruct) []byte {
+	payload := model.JSONWebhookPayload{
+		JSONMailItem: d.Storage.GetMail(mailItem.Id),
+		Headers:      make(map[string][]string),
+	}
+
+	message, err := mail.ReadMessage(strings.NewReader(mailItem.RawSource + "\r\n"))
+	if err == nil {
+		payload.Headers = message.Header
+	}
+
+	result, _ := json.Marshal(payload)
+	return result
+}
+
+/*
+Returns true if a mail item passes this webhook's filters.
+*/
+func (hook webhook) matches(mailItem smtp.MailItemStruct) bool {
+	if !smtp.MatchAnyAddressPattern(hook.To, mailItem.ToAddresses) {
+		return false
+	}
+
+	if !smtp.MatchAddressPattern(hook.From, mailItem.FromAddress) {
+		return false
+	}
+
+	if hook.subject != nil && !hook.subject.MatchString(mailItem.Subject) {
+		return false
+	}
+
+	return true
+}
+
+/*
+Returns the hex encoded HMAC-SHA256 of a request body, as sent in the
+X-MailSlurper-Signature header. Receivers can compute the same value
+with their copy of the secret to verify a request came from us.
+*/
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,263 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package webhook
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adampresley/mailslurper/admin/model"
+	"github.com/adampresley/mailslurper/settings"
+	"github.com/adampresley/mailslurper/smtp"
+)
+
+type receivedRequest struct {
+	body      []byte
+	signature string
+	event     string
+	delivery  string
+}
+
+/*
+Records the requests made to it, answering each with the
+next status code in turn and 200 once they run out.
+*/
+type recorder struct {
+	lock        sync.Mutex
+	statusCodes []int
+	requests    []receivedRequest
+	received    chan bool
+}
+
+func (r *recorder) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	body, _ := ioutil.ReadAll(request.Body)
+
+	r.lock.Lock()
+	r.requests = append(r.requests, receivedRequest{
+		body:      body,
+		signature: request.Header.Get(HEADER_SIGNATURE),
+		event:     request.Header.Get(HEADER_EVENT),
+		delivery:  request.Header.Get(HEADER_DELIVERY),
+	})
+
+	statusCode := http.StatusOK
+	if len(r.statusCodes) > 0 {
+		statusCode, r.statusCodes = r.statusCodes[0], r.statusCodes[1:]
+	}
+	r.lock.Unlock()
+
+	writer.WriteHeader(statusCode)
+	r.received <- true
+}
+
+func (r *recorder) waitForRequests(t *testing.T, count int) {
+	for index := 0; index < count; index++ {
+		select {
+		case <-r.received:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected %d webhook requests, got %d", count, index)
+		}
+	}
+}
+
+func newStorage(t *testing.T) *smtp.MailStorage {
+	storage := &smtp.MailStorage{Engine: smtp.ENGINE_SQLITE_MEMORY}
+
+	err := storage.Connect()
+	if err != nil {
+		t.Fatalf("Unable to connect to in-memory storage: %s", err)
+	}
+
+	return storage
+}
+
+func storeMail(storage *smtp.MailStorage, to string, subject string) {
+	dbWriteChannel := make(chan smtp.MailItemStruct, 1)
+	dbWriteChannel <- smtp.MailItemStruct{
+		FromAddress: "<sender@example.com>",
+		ToAddresses: []string{to},
+		Subject:     subject,
+		Body:        "Hello",
+		RawSource:   "Subject: " + subject + "\r\nX-Test: yes\r\n\r\nHello",
+	}
+
+	close(dbWriteChannel)
+	storage.StartWriteListener(dbWriteChannel)
+}
+
+func TestSign(t *testing.T) {
+	expected := "f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8"
+
+	if signature := Sign("key", []byte("The quick brown fox jumps over the lazy dog")); signature != expected {
+		t.Errorf("Expected signature %s, got %s", expected, signature)
+	}
+}
+
+func TestDispatcherSignsAndRetries(t *testing.T) {
+	storage := newStorage(t)
+	defer storage.Disconnect()
+
+	target := &recorder{statusCodes: []int{http.StatusInternalServerError}, received: make(chan bool, 10)}
+	server := httptest.NewServer(target)
+	defer server.Close()
+
+	dispatcher, err := NewDispatcher(storage, []settings.WebhookConfiguration{
+		{Name: "test", URL: server.URL, Secret: "secret", RetryDelaySeconds: 0.01},
+	})
+
+	if err != nil {
+		t.Fatalf("Unable to create dispatcher: %s", err)
+	}
+
+	dispatcher.Start()
+	storeMail(storage, "<user@example.com>", "Signed")
+
+	target.waitForRequests(t, 2)
+	dispatcher.Stop()
+
+	for index, request := range target.requests {
+		if request.signature != "sha256="+Sign("secret", request.body) {
+			t.Errorf("Request %d has signature %q, which does not match its body", index+1, request.signature)
+		}
+
+		if request.event != "mailReceived" {
+			t.Errorf("Request %d has event %q", index+1, request.event)
+		}
+	}
+
+	if target.requests[0].delivery != target.requests[1].delivery {
+		t.Errorf("Expected a retry to keep the delivery ID, got %q and %q", target.requests[0].delivery, target.requests[1].delivery)
+	}
+
+	payload := model.JSONWebhookPayload{}
+	if err := json.Unmarshal(target.requests[1].body, &payload); err != nil {
+		t.Fatalf("Unable to decode payload: %s", err)
+	}
+
+	if payload.Subject != "Signed" || len(payload.Headers["X-Test"]) != 1 {
+		t.Errorf("Expected the payload to have the mail item and its headers, got %+v", payload)
+	}
+
+	deliveries := storage.GetWebhookDeliveries(payload.Id, "test")
+	if len(deliveries) != 2 {
+		t.Fatalf("Expected 2 recorded deliveries, got %d", len(deliveries))
+	}
+
+	for _, delivery := range deliveries {
+		switch delivery.Attempt {
+		case 1:
+			if delivery.Success || delivery.StatusCode != http.StatusInternalServerError {
+				t.Errorf("Expected the first attempt to fail with 500, got %+v", delivery)
+			}
+
+		case 2:
+			if !delivery.Success || delivery.StatusCode != http.StatusOK {
+				t.Errorf("Expected the second attempt to succeed, got %+v", delivery)
+			}
+
+		default:
+			t.Errorf("Unexpected attempt %d", delivery.Attempt)
+		}
+	}
+}
+
+func TestDispatcherGivesUpAfterMaxAttempts(t *testing.T) {
+	storage := newStorage(t)
+	defer storage.Disconnect()
+
+	target := &recorder{statusCodes: []int{500, 500, 500, 500}, received: make(chan bool, 10)}
+	server := httptest.NewServer(target)
+	defer server.Close()
+
+	dispatcher, _ := NewDispatcher(storage, []settings.WebhookConfiguration{
+		{Name: "test", URL: server.URL, MaxAttempts: 3, RetryDelaySeconds: 0.01},
+	})
+
+	dispatcher.Start()
+	storeMail(storage, "<user@example.com>", "Failing")
+
+	target.waitForRequests(t, 3)
+	dispatcher.Stop()
+
+	if len(target.requests) != 3 {
+		t.Errorf("Expected 3 attempts, got %d", len(target.requests))
+	}
+
+	if target.requests[0].signature != "" {
+		t.Errorf("Expected no signature without a secret, got %q", target.requests[0].signature)
+	}
+}
+
+func TestDispatcherFilters(t *testing.T) {
+	storage := newStorage(t)
+	defer storage.Disconnect()
+
+	target := &recorder{received: make(chan bool, 10)}
+	server := httptest.NewServer(target)
+	defer server.Close()
+
+	dispatcher, err := NewDispatcher(storage, []settings.WebhookConfiguration{
+		{Name: "company", URL: server.URL, To: "*@ourcompany.com"},
+		{Name: "invoices", URL: server.URL, Subject: "^Invoice"},
+	})
+
+	if err != nil {
+		t.Fatalf("Unable to create dispatcher: %s", err)
+	}
+
+	dispatcher.Start()
+	storeMail(storage, "<user@example.com>", "Invoice 12")
+
+	target.waitForRequests(t, 1)
+	dispatcher.Stop()
+
+	if len(target.requests) != 1 {
+		t.Fatalf("Expected only the invoices webhook to be called, got %d requests", len(target.requests))
+	}
+
+	if deliveries := storage.GetWebhookDeliveries(0, "company"); len(deliveries) != 0 {
+		t.Errorf("Expected no deliveries for the company webhook, got %d", len(deliveries))
+	}
+}
+
+func TestDispatcherStopSendsMailAlreadyStored(t *testing.T) {
+	storage := newStorage(t)
+	defer storage.Disconnect()
+
+	target := &recorder{received: make(chan bool, 200)}
+	server := httptest.NewServer(target)
+	defer server.Close()
+
+	dispatcher, _ := NewDispatcher(storage, []settings.WebhookConfiguration{{Name: "test", URL: server.URL}})
+	dispatcher.Start()
+
+	for index := 0; index < 150; index++ {
+		storeMail(storage, "<user@example.com>", "Queued")
+	}
+
+	dispatcher.Stop()
+
+	if deliveries := storage.GetWebhookDeliveries(0, "test"); len(deliveries) != 150 {
+		t.Errorf("Expected 150 deliveries, got %d", len(deliveries))
+	}
+}
+
+func TestNewDispatcherRejectsInvalidWebhooks(t *testing.T) {
+	storage := newStorage(t)
+	defer storage.Disconnect()
+
+	if _, err := NewDispatcher(storage, []settings.WebhookConfiguration{{Name: "no url"}}); err == nil {
+		t.Error("Expected an error for a webhook without a URL")
+	}
+
+	if _, err := NewDispatcher(storage, []settings.WebhookConfiguration{{URL: "http://localhost", Subject: "("}}); err == nil {
+		t.Error("Expected an error for an invalid subject pattern")
+	}
+}
@@ -0,0 +1,23 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+/*
+Package webhook notifies external services when MailSlurper receives mail.
+Each configured webhook is sent an HTTP POST with a JSON body containing
+the mail item and its headers. Requests carry the headers X-MailSlurper-Event
+and X-MailSlurper-Delivery, and, when a secret is configured,
+X-MailSlurper-Signature in the form "sha256=<hex HMAC of the body>".
+
+Example:
+
+	dispatcher, err := webhook.NewDispatcher(storage, settings.Config.Webhooks)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	dispatcher.Start()
+	defer dispatcher.Stop()
+*/
+package webhook
@@ -125,10 +125,12 @@ require(
 					mailView: MailViewPartial
 				},
 				data: {
+					id: 0,
 					mailView: "",
 					subject: "",
 					dateSent: "",
 					fromAddress: "",
+					client: "",
 					attachments: []
 				}
 			}),
@@ -145,6 +147,45 @@ require(
 				mailsBackup = mails;
 			},
 
+			/**
+			 * Applies a read, starred, or tag change sent from the server
+			 * to the matching mail item, if we have it.
+			 */
+			applyMailItemUpdate = function(update) {
+				FuncTools.each(mailsBackup, function(item) {
+					if (item.id === update.id) {
+						item.isRead = update.isRead;
+						item.isStarred = update.isStarred;
+						item.tags = update.tags || [];
+					}
+				});
+
+				mailListRactive.update("mails");
+			},
+
+			/**
+			 * Removes a deleted mail item from the table.
+			 */
+			removeMailItemFromTable = function(id) {
+				var keep = function(item) { return item.id !== id; };
+
+				mailsBackup = FuncTools.filter(mailsBackup, keep);
+				mails = FuncTools.filter(mails, keep);
+
+				mailListRactive.set("mails", mails);
+			},
+
+			/**
+			 * Empties the table after all mail items have been purged.
+			 */
+			clearMailTable = function() {
+				mails = [];
+				mailsBackup = mails;
+
+				mailListRactive.set("mails", mails);
+				clearMailView();
+			},
+
 			/**
 			 * Fired off when the clear button is clicked in the search box
 			 */
@@ -161,7 +202,7 @@ require(
 			 */
 			clearMailView = function() {
 				$("#mailItemsTable tr").removeClass("highlight-row");
-				setMailView("", "", "", "", []);
+				setMailView(0, "", "", "", "", [], "");
 			},
 
 			/**
@@ -184,25 +225,51 @@ require(
 			/**
 			 * Updates Ractive with mail data to update the mail view DOM
 			 */
-			setMailView = function(subject, dateSent, fromAddress, body, attachments) {
+			setMailView = function(id, subject, dateSent, fromAddress, body, attachments, client) {
+				mailViewRactive.set("id", id);
 				mailViewRactive.set("subject", subject);
 				mailViewRactive.set("dateSent", ((dateSent.length > 0) ? MailService.formatMailDate(dateSent) : ""));
 				mailViewRactive.set("fromAddress", fromAddress);
 				mailViewRactive.set("mailView", body);
 				mailViewRactive.set("attachments", attachments)
+				mailViewRactive.set("client", client);
 			},
 
 			/**
 			 * Sets up a websocket connection to the web server. Hooks up the
-			 * close, message, and error events. The *onmessage* event adds
-			 * the passed in mail item to our table.
+			 * close, message, and error events. The *onmessage* event reads
+			 * the event envelope and updates our table to match.
 			 */
 			setupWebsocket = function() {
 				if (window.hasOwnProperty("WebSocket")) {
 					websocketConnection = new WebSocket("ws://" + location.host + "/ws");
 
 					websocketConnection.onclose = function(e) { logger("Websocket closed"); websocketConnection = null; }
-					websocketConnection.onmessage = function(e) { addMailItemToTable($.parseJSON(e.data)); }
+					websocketConnection.onmessage = function(e) {
+						var event = $.parseJSON(e.data);
+
+						switch (event.type) {
+							case "mailReceived":
+								addMailItemToTable(event.data);
+								break;
+
+							case "mailItemUpdated":
+								applyMailItemUpdate(event.data);
+								break;
+
+							case "mailItemDeleted":
+								removeMailItemFromTable(event.data.id);
+								break;
+
+							case "mailsPurged":
+								clearMailTable();
+								break;
+
+							case "serverStatus":
+								logger("Server has %d mail item(s), %d unread", event.data.mailItemCount, event.data.unreadCount);
+								break;
+						}
+					}
 					websocketConnection.onerror = function(e) { logger("An error occurred on the websocket. Closing."); websocketConnection.close(); websocketConnection = null; }
 				}
 			};
@@ -212,13 +279,22 @@ require(
 				Blocker.block("Loading...", "#mailView");
 
 				MailService.getMailItem(e.context.id).done(function(data) {
-					setMailView(data.subject, data.dateSent, data.fromAddress, data.body, data.attachments);
+					setMailView(data.id, data.subject, data.dateSent, data.fromAddress, data.body, data.attachments, MailService.formatClient(data));
 
 					$(".mailrow").removeClass("highlight-row");
 					$(e.node).addClass("highlight-row");
 
 					Blocker.unblock("#mailView");
 				});
+
+				if (!e.context.isRead) {
+					MailService.setRead(e.context.id, true);
+				}
+			},
+
+			toggleStarred: function(e) {
+				e.original.stopPropagation();
+				MailService.setStarred(e.context.id, !e.context.isStarred);
 			},
 
 			sort: function(e, column) {
@@ -0,0 +1,131 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+require(
+	[
+		/* Injected dependencies */
+		"jquery", "modules/util/Logger", "modules/util/Blocker",
+		"Ractive", "modules/util/FuncTools", "widgets/dialog/Modal",
+
+		"services/session/SessionService",
+
+		/* Templates */
+		"text!/resources/templates/session-list.html",
+		"text!/resources/templates/transcript-view.html",
+
+		/* Other non-injected dependencies */
+		"layout"
+	],
+	function($, logger, Blocker, Ractive, FuncTools, Modal, SessionService, SessionListPartial, TranscriptViewPartial) {
+		"use strict";
+
+		Blocker.block("Loading sessions...");
+
+		var
+			/*
+			 * Ractive instance to handle the list of SMTP sessions
+			 */
+			sessionListRactive = new Ractive({
+				el: "sessionList",
+				template: "{{>sessionList}}",
+				partials: {
+					sessionList: SessionListPartial
+				},
+				data: {
+					sessions: [],
+					outcome: ""
+				},
+
+				complete: function() {
+					$("body").layout({
+						north__resizable: false,
+						north__closable: false,
+						south__resizable: false,
+						south__closable: false,
+						east__size: "50%"
+					});
+
+					$("#transcriptsNav").addClass("active");
+				}
+			}),
+
+			/*
+			 * Ractive to handle viewing a single session's transcript
+			 */
+			transcriptViewRactive = new Ractive({
+				el: "transcriptView",
+				template: "{{>transcriptView}}",
+				partials: {
+					transcriptView: TranscriptViewPartial
+				},
+				data: {
+					session: { id: 0 }
+				}
+			}),
+
+			/**
+			 * Retrieves the sessions that ended with an outcome, or
+			 * all sessions if the outcome is empty.
+			 */
+			loadSessions = function(outcome) {
+				SessionService.getSessions(outcome)
+					.done(function(data) {
+						sessionListRactive.set("outcome", outcome);
+						sessionListRactive.set("sessions", FuncTools.map(data, SessionService.parseSession));
+						Blocker.unblock();
+					})
+					.fail(function() {
+						Blocker.unblock();
+						Modal.error({
+							message: "There was an error trying to retrieve SMTP sessions!"
+						});
+					});
+			},
+
+			/**
+			 * Shows the transcript of a session once it has been retrieved.
+			 */
+			showSession = function(request) {
+				Blocker.block("Loading...", "#transcriptView");
+
+				request
+					.done(function(data) {
+						transcriptViewRactive.set("session", SessionService.parseSession(data));
+						Blocker.unblock("#transcriptView");
+					})
+					.fail(function() {
+						Blocker.unblock("#transcriptView");
+						Modal.error({
+							message: "There was an error trying to retrieve the SMTP transcript!"
+						});
+					});
+			},
+
+			mailItemMatch = window.location.hash.match(/^#mail=(\d+)$/);
+
+		sessionListRactive.on({
+			filter: function(e, outcome) {
+				Blocker.block("Loading sessions...");
+				transcriptViewRactive.set("session", { id: 0 });
+				loadSessions(outcome || "");
+			},
+
+			viewSession: function(e) {
+				$(".sessionrow").removeClass("highlight-row");
+				$(e.node).addClass("highlight-row");
+
+				showSession(SessionService.getSession(e.context.id));
+			}
+		});
+
+		loadSessions("");
+
+		/*
+		 * Linked from a mail item, so show the session it was received in
+		 */
+		if (mailItemMatch) {
+			showSession(SessionService.getMailItemSession(mailItemMatch[1]));
+		}
+	}
+);
@@ -18,13 +18,40 @@ define(
 					return moment(dateString).format("MMMM Do YYYY, h:mm:ss a");
 				},
 
+				formatClient: function(mailItem) {
+					var result = (mailItem.heloName || "unknown") + (mailItem.clientIP ? " [" + mailItem.clientIP + "]:" + mailItem.clientPort : " (local socket)");
+
+					if (mailItem.tls) {
+						result += " with " + mailItem.tlsVersion;
+					}
+
+					if (mailItem.authUser) {
+						result += " as " + mailItem.authUser;
+					}
+
+					return result;
+				},
+
 				getMailItem: function(id) {
 					return Http.get("/mail?id=" + id);
 				},
 
 				parseMailItem: function(mailItem) {
 					mailItem.attachmentIcon = (mailItem.attachmentCount > 0) ? "<span class=\"glyphicon glyphicon-paperclip\"></span>" : "&nbsp;";
+					mailItem.tags = mailItem.tags || [];
 					return mailItem;
+				},
+
+				setRead: function(id, isRead) {
+					return Http.put("/mail/read", { id: id, read: isRead });
+				},
+
+				setStarred: function(id, isStarred) {
+					return Http.put("/mail/starred", { id: id, starred: isStarred });
+				},
+
+				setTags: function(id, tags) {
+					return Http.put("/mail/tags", { id: id, tags: tags.join(",") });
 				}
 			};
 
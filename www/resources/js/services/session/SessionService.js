@@ -0,0 +1,41 @@
+// Copyright 2013-2014 Adam Presley. All rights reserved
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+define(
+	[
+		"jquery",
+		"modules/util/Http",
+		"moment"
+	],
+	function($, Http, moment) {
+		"use strict";
+
+		var
+			service = {
+				formatSessionDate: function(dateString) {
+					return (dateString.length > 0) ? moment(dateString).format("MMMM Do YYYY, h:mm:ss a") : "";
+				},
+
+				getSessions: function(outcome) {
+					return Http.get("/sessions?outcome=" + encodeURIComponent(outcome || ""));
+				},
+
+				getSession: function(id) {
+					return Http.get("/session?id=" + id);
+				},
+
+				getMailItemSession: function(mailItemId) {
+					return Http.get("/mail/transcript?id=" + mailItemId);
+				},
+
+				parseSession: function(session) {
+					session.dateStartedFormatted = service.formatSessionDate(session.dateStarted);
+					session.transcript = session.transcript || [];
+					return session;
+				}
+			};
+
+		return service;
+	}
+);